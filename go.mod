@@ -6,3 +6,5 @@ require (
 	golang.org/x/net v0.8.0
 	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/text v0.8.0 // indirect
@@ -0,0 +1,144 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay/traffic"
+)
+
+var HealthPath = "/healthz"
+
+// HealthCheckDialTimeout is how long the health service waits when checking
+// whether a relay target is reachable.
+var HealthCheckDialTimeout = 2 * time.Second
+
+// HealthService reports the health of the relay at HealthPath, for use as a
+// liveness and readiness check by container orchestrators. It responds with a
+// 503 until the relay has been marked ready. If target checks are enabled, it
+// also responds with a 503 if none of the targets to which requests may be
+// routed accept connections.
+//
+// The health service runs on its own address, separately from the relay
+// service, so that it isn't exposed to relayed traffic.
+type HealthService struct {
+	checkTargets bool
+	listener     net.Listener
+	ready        atomic.Bool
+	targets      atomic.Pointer[[]healthTarget]
+}
+
+// healthTarget is a relay target, along with the network and address which
+// are dialed to check whether it's reachable.
+type healthTarget struct {
+	address string
+	network string
+	target  *traffic.Target
+}
+
+func NewHealthService(options *Options) *HealthService {
+	service := &HealthService{
+		checkTargets: options.Service.HealthCheckTargets,
+	}
+	service.SetTargets(options.Relay)
+	return service
+}
+
+// SetTargets replaces the targets which are checked with those of the provided
+// relay options. It should be called when the relay's configuration is
+// reloaded.
+func (service *HealthService) SetTargets(relayOptions *traffic.RelayOptions) {
+	targets := healthTargets(relayOptions)
+	service.targets.Store(&targets)
+}
+
+// healthTargets returns the targets which should be checked, each with the
+// address the relay actually dials to reach it. Targets which share an address
+// are only checked once.
+func healthTargets(relayOptions *traffic.RelayOptions) []healthTarget {
+	defaultTargets := map[*traffic.Target]bool{}
+	for _, target := range relayOptions.Targets {
+		defaultTargets[target] = true
+	}
+
+	var targets []healthTarget
+	seen := map[string]bool{}
+	for _, target := range routedTargets(relayOptions) {
+		network, address := target.DialAddress()
+		if network == "tcp" && relayOptions.ConnectAddress != "" && defaultTargets[target] {
+			// Default targets are dialed via the connect address, if one is
+			// configured.
+			address = relayOptions.ConnectAddress
+		}
+		if !seen[network+" "+address] {
+			seen[network+" "+address] = true
+			targets = append(targets, healthTarget{address: address, network: network, target: target})
+		}
+	}
+	return targets
+}
+
+func (service *HealthService) Address() string {
+	if service.listener == nil {
+		return ""
+	}
+	return service.listener.Addr().String()
+}
+
+func (service *HealthService) Close() error {
+	if service.listener == nil {
+		return nil
+	}
+	return service.listener.Close()
+}
+
+// SetReady marks the relay as ready, or not ready, to handle traffic.
+func (service *HealthService) SetReady(ready bool) {
+	service.ready.Store(ready)
+}
+
+func (service *HealthService) Start(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("Could not start health service: %v", err)
+	}
+	service.listener = listener
+
+	mux := http.NewServeMux()
+	mux.Handle(HealthPath, service)
+	go http.Serve(listener, mux)
+
+	return nil
+}
+
+func (service *HealthService) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if !service.ready.Load() {
+		http.Error(response, "The relay is not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	if service.checkTargets && !service.anyTargetReachable() {
+		http.Error(response, "No relay target is reachable", http.StatusServiceUnavailable)
+		return
+	}
+
+	response.Write([]byte("OK"))
+}
+
+// anyTargetReachable reports whether at least one relay target accepts
+// connections.
+func (service *HealthService) anyTargetReachable() bool {
+	for _, target := range *service.targets.Load() {
+		conn, err := net.DialTimeout(target.network, target.address, HealthCheckDialTimeout)
+		if err != nil {
+			logger.Warnf("Health check could not reach target %v: %v", target.target, err)
+			continue
+		}
+		conn.Close()
+		return true
+	}
+	return false
+}
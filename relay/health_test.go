@@ -0,0 +1,218 @@
+package relay_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+)
+
+func TestHealthService(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("OK"))
+	}))
+	defer target.Close()
+
+	// Reserve a port and then release it, so that nothing is listening there.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error reserving port: %v", err)
+	}
+	unreachableURL := fmt.Sprintf("http://%v", listener.Addr())
+	listener.Close()
+
+	testCases := []struct {
+		desc           string
+		target         string
+		extraConfig    string
+		checkTarget    bool
+		ready          bool
+		expectedStatus int
+	}{
+		{
+			desc:           "The relay is unhealthy until it's ready",
+			target:         target.URL,
+			ready:          false,
+			expectedStatus: 503,
+		},
+		{
+			desc:           "The relay is healthy once it's ready",
+			target:         target.URL,
+			ready:          true,
+			expectedStatus: 200,
+		},
+		{
+			desc:           "The relay is healthy if a checked target is reachable",
+			target:         target.URL,
+			checkTarget:    true,
+			ready:          true,
+			expectedStatus: 200,
+		},
+		{
+			desc:           "The relay is unhealthy if a checked target is unreachable",
+			target:         unreachableURL,
+			checkTarget:    true,
+			ready:          true,
+			expectedStatus: 503,
+		},
+		{
+			desc:           "The relay is healthy if one of several checked targets is reachable",
+			target:         unreachableURL + "," + target.URL,
+			checkTarget:    true,
+			ready:          true,
+			expectedStatus: 200,
+		},
+		{
+			desc:           "The relay is healthy if a checked host route target is reachable",
+			target:         unreachableURL,
+			extraConfig:    "host-map: api.example=" + target.URL,
+			checkTarget:    true,
+			ready:          true,
+			expectedStatus: 200,
+		},
+		{
+			desc:           "The relay is healthy if a checked path route target is reachable",
+			target:         unreachableURL,
+			extraConfig:    "path-map: /api=" + target.URL,
+			checkTarget:    true,
+			ready:          true,
+			expectedStatus: 200,
+		},
+		{
+			desc:           "The relay is unhealthy if no checked route target is reachable",
+			target:         unreachableURL,
+			extraConfig:    "path-map: /api=" + unreachableURL,
+			checkTarget:    true,
+			ready:          true,
+			expectedStatus: 503,
+		},
+		{
+			desc:           "Checked targets are dialed via the connect address",
+			target:         "http://relay-target.invalid",
+			extraConfig:    "connect-addr: " + target.Listener.Addr().String(),
+			checkTarget:    true,
+			ready:          true,
+			expectedStatus: 200,
+		},
+		{
+			desc:           "Targets aren't checked by default",
+			target:         unreachableURL,
+			ready:          true,
+			expectedStatus: 200,
+		},
+	}
+
+	for _, testCase := range testCases {
+		options, err := readOptions(fmt.Sprintf(`relay:
+                                                    port: 8990
+                                                    target: %v
+                                                    health-addr: localhost:0
+                                                    health-check-target: %v
+                                                    %v
+        `, testCase.target, testCase.checkTarget, testCase.extraConfig))
+		if err != nil {
+			t.Errorf("Test '%v': Error reading options: %v", testCase.desc, err)
+			continue
+		}
+
+		healthService := relay.NewHealthService(options)
+		if err := healthService.Start(options.Service.HealthAddr); err != nil {
+			t.Errorf("Test '%v': Error starting health service: %v", testCase.desc, err)
+			continue
+		}
+		healthService.SetReady(testCase.ready)
+
+		response, err := http.Get(fmt.Sprintf("http://%v%v", healthService.Address(), relay.HealthPath))
+		healthService.Close()
+		if err != nil {
+			t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+			continue
+		}
+		response.Body.Close()
+
+		if response.StatusCode != testCase.expectedStatus {
+			t.Errorf(
+				"Test '%v': Expected status %v but got %v",
+				testCase.desc,
+				testCase.expectedStatus,
+				response.StatusCode,
+			)
+		}
+	}
+}
+
+func TestHealthServiceReload(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("OK"))
+	}))
+	defer target.Close()
+
+	// Reserve a port and then release it, so that nothing is listening there.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error reserving port: %v", err)
+	}
+	unreachableURL := fmt.Sprintf("http://%v", listener.Addr())
+	listener.Close()
+
+	readTargetOptions := func(targetURL string) *relay.Options {
+		options, err := readOptions(fmt.Sprintf(`relay:
+                                                    port: 8990
+                                                    target: %v
+                                                    health-addr: localhost:0
+                                                    health-check-target: true
+        `, targetURL))
+		if err != nil {
+			t.Fatalf("Error reading options: %v", err)
+		}
+		return options
+	}
+
+	options := readTargetOptions(target.URL)
+	healthService := relay.NewHealthService(options)
+	if err := healthService.Start(options.Service.HealthAddr); err != nil {
+		t.Fatalf("Error starting health service: %v", err)
+	}
+	defer healthService.Close()
+	healthService.SetReady(true)
+
+	testCases := []struct {
+		desc           string
+		target         string
+		expectedStatus int
+	}{
+		{
+			desc:           "The relay is unhealthy after reloading to an unreachable target",
+			target:         unreachableURL,
+			expectedStatus: 503,
+		},
+		{
+			desc:           "The relay is healthy after reloading to a reachable target",
+			target:         target.URL,
+			expectedStatus: 200,
+		},
+	}
+
+	for _, testCase := range testCases {
+		healthService.SetTargets(readTargetOptions(testCase.target).Relay)
+
+		response, err := http.Get(fmt.Sprintf("http://%v%v", healthService.Address(), relay.HealthPath))
+		if err != nil {
+			t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+			continue
+		}
+		response.Body.Close()
+
+		if response.StatusCode != testCase.expectedStatus {
+			t.Errorf(
+				"Test '%v': Expected status %v but got %v",
+				testCase.desc,
+				testCase.expectedStatus,
+				response.StatusCode,
+			)
+		}
+	}
+}
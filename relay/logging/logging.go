@@ -0,0 +1,264 @@
+// Package logging provides the loggers used throughout the relay. By default,
+// log lines are written as human-readable text, but they can instead be written
+// as JSON objects for ingestion into a log pipeline. Loggers can carry
+// structured fields, which are included in JSON output. Each log line has a
+// level, and lines less severe than the configured level are discarded.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Format determines how log lines are written.
+type Format int
+
+const (
+	// TextFormat writes each log line as plain text, prefixed with the name of
+	// the logger. Structured fields are omitted.
+	TextFormat Format = iota
+
+	// JSONFormat writes each log line as a JSON object containing the message,
+	// the name of the logger, and any structured fields.
+	JSONFormat
+)
+
+// ParseFormat returns the Format with the provided name, which may be "text"
+// or "json".
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "text":
+		return TextFormat, nil
+	case "json":
+		return JSONFormat, nil
+	default:
+		return TextFormat, fmt.Errorf(`Unknown log format "%v"; expected "text" or "json"`, name)
+	}
+}
+
+func (format Format) String() string {
+	switch format {
+	case TextFormat:
+		return "text"
+	case JSONFormat:
+		return "json"
+	default:
+		return "(unknown format)"
+	}
+}
+
+// Level indicates the severity of a log line. Levels are ordered from most to
+// least severe.
+type Level int
+
+const (
+	// ErrorLevel is used for failures, like being unable to reach a target.
+	ErrorLevel Level = iota
+
+	// WarnLevel is used for unusual situations which the relay can handle,
+	// like rejecting a request which exceeds a configured limit.
+	WarnLevel
+
+	// InfoLevel is used for routine information, like the relay's
+	// configuration. It's the default level.
+	InfoLevel
+
+	// DebugLevel is used for detailed information about each request.
+	DebugLevel
+)
+
+// ParseLevel returns the Level with the provided name, which may be "error",
+// "warn", "info", or "debug".
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "error":
+		return ErrorLevel, nil
+	case "warn":
+		return WarnLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "debug":
+		return DebugLevel, nil
+	default:
+		return InfoLevel, fmt.Errorf(`Unknown log level "%v"; expected "error", "warn", "info", or "debug"`, name)
+	}
+}
+
+func (level Level) String() string {
+	switch level {
+	case ErrorLevel:
+		return "error"
+	case WarnLevel:
+		return "warn"
+	case InfoLevel:
+		return "info"
+	case DebugLevel:
+		return "debug"
+	default:
+		return "(unknown level)"
+	}
+}
+
+var (
+	mutex        sync.Mutex
+	output       io.Writer = os.Stdout
+	outputFormat           = TextFormat
+	outputLevel            = InfoLevel
+)
+
+// SetFormat sets the format used by all loggers.
+func SetFormat(format Format) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	outputFormat = format
+}
+
+// Enabled reports whether log lines at the provided level are written. It can
+// be used to avoid preparing log lines which would be discarded.
+func Enabled(level Level) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return level <= outputLevel
+}
+
+// SetLevel sets the least severe level which is logged by all loggers. Log
+// lines which are less severe are discarded.
+func SetLevel(level Level) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	outputLevel = level
+}
+
+// SetOutput sets the destination to which all loggers write. The default is
+// stdout.
+func SetOutput(writer io.Writer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	output = writer
+}
+
+// Fields contains structured data associated with a log line, like the method
+// and URL of the request being handled. Values must be serializable as JSON;
+// error values are serialized as their message.
+type Fields map[string]interface{}
+
+// Logger writes log lines on behalf of a component of the relay.
+type Logger struct {
+	name   string
+	fields Fields
+}
+
+// New returns a Logger with the provided name, which identifies the component
+// that is logging (e.g. "relay-traffic").
+func New(name string) *Logger {
+	return &Logger{
+		name: name,
+	}
+}
+
+// With returns a Logger that includes the provided fields, in addition to any
+// fields that this Logger already includes, in each log line.
+func (logger *Logger) With(fields Fields) *Logger {
+	mergedFields := Fields{}
+	for key, value := range logger.fields {
+		mergedFields[key] = value
+	}
+	for key, value := range fields {
+		mergedFields[key] = value
+	}
+	return &Logger{
+		name:   logger.name,
+		fields: mergedFields,
+	}
+}
+
+// Printf writes a log line at InfoLevel. Arguments are handled in the manner
+// of fmt.Printf.
+func (logger *Logger) Printf(format string, args ...interface{}) {
+	logger.logf(InfoLevel, format, args...)
+}
+
+// Println writes a log line at InfoLevel. Arguments are handled in the manner
+// of fmt.Println.
+func (logger *Logger) Println(args ...interface{}) {
+	logger.logln(InfoLevel, args...)
+}
+
+// Debugf is like Printf, but writes the log line at DebugLevel.
+func (logger *Logger) Debugf(format string, args ...interface{}) {
+	logger.logf(DebugLevel, format, args...)
+}
+
+// Debugln is like Println, but writes the log line at DebugLevel.
+func (logger *Logger) Debugln(args ...interface{}) {
+	logger.logln(DebugLevel, args...)
+}
+
+// Warnf is like Printf, but writes the log line at WarnLevel.
+func (logger *Logger) Warnf(format string, args ...interface{}) {
+	logger.logf(WarnLevel, format, args...)
+}
+
+// Warnln is like Println, but writes the log line at WarnLevel.
+func (logger *Logger) Warnln(args ...interface{}) {
+	logger.logln(WarnLevel, args...)
+}
+
+// Errorf is like Printf, but writes the log line at ErrorLevel.
+func (logger *Logger) Errorf(format string, args ...interface{}) {
+	logger.logf(ErrorLevel, format, args...)
+}
+
+// Errorln is like Println, but writes the log line at ErrorLevel.
+func (logger *Logger) Errorln(args ...interface{}) {
+	logger.logln(ErrorLevel, args...)
+}
+
+// The message is only formatted if the level is enabled, since formatting can
+// be expensive for the debug lines logged for each request.
+func (logger *Logger) logf(level Level, format string, args ...interface{}) {
+	if Enabled(level) {
+		logger.write(level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (logger *Logger) logln(level Level, args ...interface{}) {
+	if Enabled(level) {
+		logger.write(level, fmt.Sprintln(args...))
+	}
+}
+
+func (logger *Logger) write(level Level, message string) {
+	message = strings.TrimSuffix(message, "\n")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	switch outputFormat {
+	case JSONFormat:
+		entry := map[string]interface{}{}
+		for key, value := range logger.fields {
+			if err, ok := value.(error); ok {
+				value = err.Error()
+			}
+			entry[key] = value
+		}
+		entry["level"] = level.String()
+		entry["logger"] = logger.name
+		entry["msg"] = message
+
+		entryBytes, err := json.Marshal(entry)
+		if err != nil {
+			fmt.Fprintf(output, "[%s] %s (could not encode log fields: %v)\n", logger.name, message, err)
+			return
+		}
+		output.Write(append(entryBytes, '\n'))
+
+	default:
+		fmt.Fprintf(output, "[%s] %s\n", logger.name, message)
+	}
+}
@@ -0,0 +1,145 @@
+package logging_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay/logging"
+)
+
+func TestTextFormat(t *testing.T) {
+	output := captureOutput(logging.TextFormat)
+
+	logger := logging.New("test").With(logging.Fields{"method": "GET"})
+	logger.Printf("Hello, %v", "world")
+	logger.Println("Goodbye,", "world")
+
+	expected := "[test] Hello, world\n[test] Goodbye, world\n"
+	if output.String() != expected {
+		t.Errorf("Expected '%v' but got '%v'", expected, output.String())
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	output := captureOutput(logging.JSONFormat)
+
+	logger := logging.New("test").With(logging.Fields{
+		"method": "GET",
+		"url":    "http://example.com/",
+	})
+	logger.With(logging.Fields{
+		"error":  errors.New("Something broke"),
+		"status": 502,
+	}).Printf("Hello, %v", "world")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(output.Bytes(), &entry); err != nil {
+		t.Errorf("Error parsing JSON log line '%v': %v", output.String(), err)
+		return
+	}
+
+	expected := map[string]interface{}{
+		"error":  "Something broke",
+		"level":  "info",
+		"logger": "test",
+		"method": "GET",
+		"msg":    "Hello, world",
+		"status": float64(502),
+		"url":    "http://example.com/",
+	}
+	if !reflect.DeepEqual(expected, entry) {
+		t.Errorf("Expected '%v' but got '%v'", expected, entry)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	if format, err := logging.ParseFormat("JSON"); err != nil || format != logging.JSONFormat {
+		t.Errorf("Expected JSON format but got '%v': %v", format, err)
+	}
+	if format, err := logging.ParseFormat("text"); err != nil || format != logging.TextFormat {
+		t.Errorf("Expected text format but got '%v': %v", format, err)
+	}
+	if _, err := logging.ParseFormat("xml"); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
+
+func TestLevels(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		level    logging.Level
+		expected string
+	}{
+		{
+			desc:     "Debug lines are suppressed at info level",
+			level:    logging.InfoLevel,
+			expected: "[test] Error\n[test] Warning\n[test] Info\n",
+		},
+		{
+			desc:     "All lines are written at debug level",
+			level:    logging.DebugLevel,
+			expected: "[test] Error\n[test] Warning\n[test] Info\n[test] Debug\n",
+		},
+		{
+			desc:     "Only errors are written at error level",
+			level:    logging.ErrorLevel,
+			expected: "[test] Error\n",
+		},
+	}
+
+	for _, testCase := range testCases {
+		output := captureOutput(logging.TextFormat)
+		logging.SetLevel(testCase.level)
+
+		logger := logging.New("test")
+		logger.Errorf("Error")
+		logger.Warnln("Warning")
+		logger.Printf("Info")
+		logger.Debugf("Debug")
+
+		if output.String() != testCase.expected {
+			t.Errorf("Test '%v': Expected '%v' but got '%v'", testCase.desc, testCase.expected, output.String())
+		}
+	}
+}
+
+func TestJSONLevel(t *testing.T) {
+	output := captureOutput(logging.JSONFormat)
+	logging.SetLevel(logging.DebugLevel)
+
+	logging.New("test").Debugln("Hello")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(output.Bytes(), &entry); err != nil {
+		t.Errorf("Error parsing JSON log line '%v': %v", output.String(), err)
+		return
+	}
+	if entry["level"] != "debug" {
+		t.Errorf("Expected level 'debug' but got '%v'", entry["level"])
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if level, err := logging.ParseLevel("DEBUG"); err != nil || level != logging.DebugLevel {
+		t.Errorf("Expected debug level but got '%v': %v", level, err)
+	}
+	if level, err := logging.ParseLevel("warn"); err != nil || level != logging.WarnLevel {
+		t.Errorf("Expected warn level but got '%v': %v", level, err)
+	}
+	if _, err := logging.ParseLevel("verbose"); err == nil {
+		t.Errorf("Expected an error for an unknown level")
+	}
+}
+
+// captureOutput configures logging to use the provided format and the default
+// level, and to write to a buffer, which is returned.
+func captureOutput(format logging.Format) *bytes.Buffer {
+	output := &bytes.Buffer{}
+	logging.SetFormat(format)
+	logging.SetLevel(logging.InfoLevel)
+	logging.SetOutput(output)
+	return output
+}
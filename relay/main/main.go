@@ -1,19 +1,22 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
 	"github.com/fullstorydev/relay-core/relay"
 	"github.com/fullstorydev/relay-core/relay/config"
 	"github.com/fullstorydev/relay-core/relay/environment"
+	"github.com/fullstorydev/relay-core/relay/logging"
 	"github.com/fullstorydev/relay-core/relay/traffic/plugin-loader"
 )
 
-var logger = log.New(os.Stdout, "[relay] ", 0)
+var logger = logging.New("relay")
 
 func readConfigFile(path string) (rawConfigFileBytes []byte, err error) {
 	if path == "-" {
@@ -25,19 +28,12 @@ func readConfigFile(path string) (rawConfigFileBytes []byte, err error) {
 	return
 }
 
-func main() {
-	// The --config option determines the path to the configuration file. A
-	// default configuration file, 'relay.yaml', is distributed with the relay,
-	// so it's not necessary to specify one if you just want to configure the
-	// relay with environment variables. Use '-' to read the configuration file
-	// from stdin.
-	configFilePath := flag.String("config", "relay.yaml", "Configuration file path")
-	flag.Parse()
-
-	rawConfigFileBytes, err := readConfigFile(*configFilePath)
+// loadConfig reads the configuration file at the provided path, substituting
+// the values of environment variables into it.
+func loadConfig(path string) (*config.File, error) {
+	rawConfigFileBytes, err := readConfigFile(path)
 	if err != nil {
-		logger.Printf(`Couldn't read configuration file "%s": %v\n`, *configFilePath, err)
-		os.Exit(1)
+		return nil, fmt.Errorf(`Couldn't read configuration file "%s": %v`, path, err)
 	}
 
 	// Substitute the values of environment variables into the configuration
@@ -51,21 +47,93 @@ func main() {
 	configFileString := env.SubstituteVarsIntoYaml(string(rawConfigFileBytes))
 
 	// Parse the configuration file.
-	configFile, err := config.NewFileFromYamlString(configFileString)
+	return config.NewFileFromYamlString(configFileString)
+}
+
+// reloadConfig reads the configuration file at the provided path again and
+// replaces the relay's configuration with it, updating the targets checked by
+// the health service, if there is one. If the new configuration can't be
+// loaded, nothing changes: anything opened for it is closed again, and its log
+// format and level are only applied once it has replaced the old one.
+func reloadConfig(relayService *relay.Service, healthService *relay.HealthService, path string) error {
+	configFile, err := loadConfig(path)
 	if err != nil {
-		logger.Println(err)
+		return err
+	}
+	options, err := relay.ReadOptions(configFile)
+	if err != nil {
+		return err
+	}
+
+	trafficPlugins, err := plugin_loader.Load(plugin_loader.DefaultPlugins, configFile)
+	if err == nil {
+		err = relay.StartTracing(options)
+	}
+	if err != nil {
+		if options.Relay.AccessLog != nil {
+			options.Relay.AccessLog.Close()
+		}
+		return err
+	}
+
+	relayService.Reload(options, trafficPlugins)
+	if healthService != nil {
+		healthService.SetTargets(options.Relay)
+	}
+	relay.ApplyLogOptions(options.Service)
+	return nil
+}
+
+func main() {
+	// The --config option determines the path to the configuration file. A
+	// default configuration file, 'relay.yaml', is distributed with the relay,
+	// so it's not necessary to specify one if you just want to configure the
+	// relay with environment variables. Use '-' to read the configuration file
+	// from stdin.
+	configFilePath := flag.String("config", "relay.yaml", "Configuration file path")
+	flag.Parse()
+
+	configFile, err := loadConfig(*configFilePath)
+	if err != nil {
+		logger.Errorln(err)
 		os.Exit(1)
 	}
 
+	// The log format and level are applied first, so that they apply to the
+	// log lines generated while the rest of the options are read.
+	logOptions := relay.NewDefaultServiceOptions()
+	if err := relay.ReadLogOptions(configFile, logOptions); err != nil {
+		logger.Errorln(err)
+		os.Exit(1)
+	}
+	relay.ApplyLogOptions(logOptions)
+
 	config, err := relay.ReadOptions(configFile)
 	if err != nil {
-		logger.Println(err)
+		logger.Errorln(err)
 		os.Exit(1)
 	}
 
+	// The health service starts as early as possible, so that it can report
+	// that the relay isn't ready while it's starting up.
+	var healthService *relay.HealthService
+	if config.Service.HealthAddr != "" {
+		healthService = relay.NewHealthService(config)
+		if err := healthService.Start(config.Service.HealthAddr); err != nil {
+			logger.Errorln(err)
+			os.Exit(1)
+		}
+		logger.Println("Health checks available at", healthService.Address())
+	}
+
 	trafficPlugins, err := plugin_loader.Load(plugin_loader.DefaultPlugins, configFile)
 	if err != nil {
-		logger.Println(err)
+		logger.Errorln(err)
+		os.Exit(1)
+	}
+
+	if err := relay.StartTracing(config); err != nil {
+		logger.Errorln(err)
 		os.Exit(1)
 	}
 
@@ -74,13 +142,52 @@ func main() {
 		logger.Println("\tTraffic:", tp.Name())
 	}
 
-	relayService := relay.NewService(config.Relay, trafficPlugins)
+	relayService := relay.NewService(config, trafficPlugins)
 	if err := relayService.Start("0.0.0.0", config.Service.Port); err != nil {
 		panic("Could not start catcher service: " + err.Error())
 	}
 	logger.Println("Relay listening on port", relayService.Port())
-	for {
-		time.Sleep(100 * time.Minute)
+	if metricsAddress := relayService.MetricsAddress(); metricsAddress != "" {
+		logger.Println("Metrics available at", metricsAddress)
+	}
+	if healthService != nil {
+		healthService.SetReady(true)
+	}
+
+	// Reload the configuration on SIGHUP. Traffic which is already in flight
+	// finishes using the old configuration. Reloading also reopens the access
+	// log, so that it can be rotated; if the new configuration can't be
+	// loaded, the old one is kept, but the access log is still reopened.
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	go func() {
+		for range reloadSignals {
+			logger.Println("Reloading configuration from", *configFilePath)
+			if err := reloadConfig(relayService, healthService, *configFilePath); err != nil {
+				logger.Errorln("Could not reload configuration; keeping the current configuration:", err)
+				if err := relayService.ReopenAccessLog(); err != nil {
+					logger.Errorln("Could not reopen access log:", err)
+				}
+			}
+		}
+	}()
+
+	// Run until we're asked to stop, then drain in-flight traffic before
+	// exiting.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	logger.Printf("Received %v; shutting down", <-signals)
+
+	if healthService != nil {
+		healthService.SetReady(false)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.Service.ShutdownTimeout)
+	defer cancel()
+	if err := relayService.Shutdown(ctx); err != nil {
+		logger.Errorln("Relay did not shut down cleanly:", err)
+	}
+	if healthService != nil {
+		healthService.Close()
 	}
 }
 
@@ -0,0 +1,250 @@
+// Package metrics collects statistics about the traffic handled by the relay
+// and exposes them in the Prometheus text exposition format. Metrics are
+// optional; all Collector methods are no-ops when invoked on a nil Collector,
+// so that instrumented code doesn't need to check whether metrics are enabled.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DurationBuckets contains the upper bounds, in seconds, of the buckets used
+// for the request duration histogram. These match the Prometheus defaults.
+var DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ResponseSizeBuckets contains the upper bounds, in bytes, of the buckets used
+// for the response size histogram, from 1KiB to 64MiB.
+var ResponseSizeBuckets = []float64{1 << 10, 1 << 12, 1 << 14, 1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26}
+
+// Collector records metrics about relayed traffic. It implements
+// http.Handler, serving the current values of the metrics.
+type Collector struct {
+	activeWebSockets          atomic.Int64
+	newUpstreamConnections    atomic.Uint64
+	reusedUpstreamConnections atomic.Uint64
+	upstreamErrors            atomic.Uint64
+
+	mutex         sync.Mutex
+	requests      map[requestKey]uint64
+	durations     *histogram
+	responseSizes *histogram
+}
+
+type requestKey struct {
+	method      string
+	statusClass string
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		requests:      map[requestKey]uint64{},
+		durations:     newHistogram(DurationBuckets),
+		responseSizes: newHistogram(ResponseSizeBuckets),
+	}
+}
+
+// ObserveRequest records a request that was handled by the relay, along with
+// the status of the response and how long it took to handle.
+func (collector *Collector) ObserveRequest(method string, status int, duration time.Duration) {
+	if collector == nil {
+		return
+	}
+
+	key := requestKey{
+		method:      normalizeMethod(method),
+		statusClass: statusClass(status),
+	}
+
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	collector.requests[key]++
+	collector.durations.observe(duration.Seconds())
+}
+
+// ObserveResponseSize records the length in bytes of a response body relayed
+// from the target.
+func (collector *Collector) ObserveResponseSize(bytes int64) {
+	if collector == nil {
+		return
+	}
+
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	collector.responseSizes.observe(float64(bytes))
+}
+
+// UpstreamError records a failure to communicate with the relay target.
+func (collector *Collector) UpstreamError() {
+	if collector == nil {
+		return
+	}
+	collector.upstreamErrors.Add(1)
+}
+
+// UpstreamConnection records that a connection to the relay target was used
+// to send a request, and whether it was reused rather than newly dialed.
+func (collector *Collector) UpstreamConnection(reused bool) {
+	if collector == nil {
+		return
+	}
+	if reused {
+		collector.reusedUpstreamConnections.Add(1)
+	} else {
+		collector.newUpstreamConnections.Add(1)
+	}
+}
+
+// WebSocketOpened records that a websocket connection is being relayed. It
+// should be paired with a call to WebSocketClosed.
+func (collector *Collector) WebSocketOpened() {
+	if collector == nil {
+		return
+	}
+	collector.activeWebSockets.Add(1)
+}
+
+// WebSocketClosed records that a websocket connection is no longer being
+// relayed.
+func (collector *Collector) WebSocketClosed() {
+	if collector == nil {
+		return
+	}
+	collector.activeWebSockets.Add(-1)
+}
+
+func (collector *Collector) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	collector.WriteTo(response)
+}
+
+// WriteTo writes the current values of the metrics to the provided writer in
+// the Prometheus text exposition format.
+func (collector *Collector) WriteTo(writer io.Writer) (int64, error) {
+	output := &countingWriter{writer: writer}
+
+	collector.mutex.Lock()
+	keys := make([]requestKey, 0, len(collector.requests))
+	for key := range collector.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].statusClass < keys[j].statusClass
+	})
+
+	output.printf("# HELP relay_requests_total Requests handled by the relay, by method and response status class.\n")
+	output.printf("# TYPE relay_requests_total counter\n")
+	for _, key := range keys {
+		output.printf("relay_requests_total{method=%q,status=%q} %v\n", key.method, key.statusClass, collector.requests[key])
+	}
+
+	output.printf("# HELP relay_request_duration_seconds Time taken to handle requests.\n")
+	output.printf("# TYPE relay_request_duration_seconds histogram\n")
+	collector.durations.writeTo(output, "relay_request_duration_seconds")
+
+	output.printf("# HELP relay_response_size_bytes Length of response bodies relayed from the target.\n")
+	output.printf("# TYPE relay_response_size_bytes histogram\n")
+	collector.responseSizes.writeTo(output, "relay_response_size_bytes")
+	collector.mutex.Unlock()
+
+	output.printf("# HELP relay_upstream_errors_total Failures to communicate with the relay target.\n")
+	output.printf("# TYPE relay_upstream_errors_total counter\n")
+	output.printf("relay_upstream_errors_total %v\n", collector.upstreamErrors.Load())
+
+	output.printf("# HELP relay_upstream_connections_total Connections used to send requests to the relay target, by whether they were reused.\n")
+	output.printf("# TYPE relay_upstream_connections_total counter\n")
+	output.printf("relay_upstream_connections_total{reused=\"false\"} %v\n", collector.newUpstreamConnections.Load())
+	output.printf("relay_upstream_connections_total{reused=\"true\"} %v\n", collector.reusedUpstreamConnections.Load())
+
+	output.printf("# HELP relay_active_websocket_connections Websocket connections currently being relayed.\n")
+	output.printf("# TYPE relay_active_websocket_connections gauge\n")
+	output.printf("relay_active_websocket_connections %v\n", collector.activeWebSockets.Load())
+
+	return output.written, output.err
+}
+
+// histogram counts observed values in buckets with the provided upper bounds.
+// It isn't safe for concurrent use; the Collector's mutex protects it.
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // Per bucket; the final entry is the +Inf bucket.
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+func (hist *histogram) observe(value float64) {
+	hist.counts[sort.SearchFloat64s(hist.buckets, value)]++
+	hist.sum += value
+	hist.count++
+}
+
+// writeTo writes the histogram's cumulative bucket counts, sum, and count,
+// using the provided metric name.
+func (hist *histogram) writeTo(output *countingWriter, name string) {
+	cumulativeCount := uint64(0)
+	for bucket, count := range hist.counts {
+		cumulativeCount += count
+		upperBound := "+Inf"
+		if bucket < len(hist.buckets) {
+			upperBound = strconv.FormatFloat(hist.buckets[bucket], 'g', -1, 64)
+		}
+		output.printf("%v_bucket{le=%q} %v\n", name, upperBound, cumulativeCount)
+	}
+	output.printf("%v_sum %v\n", name, strconv.FormatFloat(hist.sum, 'g', -1, 64))
+	output.printf("%v_count %v\n", name, hist.count)
+}
+
+// normalizeMethod limits the methods used as label values to the standard
+// ones, so that clients can't create an unbounded number of time series.
+func normalizeMethod(method string) string {
+	switch method {
+	case http.MethodConnect, http.MethodDelete, http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodPatch, http.MethodPost, http.MethodPut, http.MethodTrace:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+// statusClass returns the class of the provided status code - e.g. "2xx".
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+// countingWriter is a writer that tracks the number of bytes written and the
+// first error encountered, which simplifies writing many lines in sequence.
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+	err     error
+}
+
+func (output *countingWriter) printf(format string, args ...interface{}) {
+	if output.err != nil {
+		return
+	}
+	written, err := fmt.Fprintf(output.writer, format, args...)
+	output.written += int64(written)
+	output.err = err
+}
@@ -0,0 +1,79 @@
+package metrics_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay/metrics"
+)
+
+func TestCollector(t *testing.T) {
+	collector := metrics.NewCollector()
+	collector.ObserveRequest("GET", 200, 20*time.Millisecond)
+	collector.ObserveRequest("GET", 204, 2*time.Second)
+	collector.ObserveRequest("POST", 502, 20*time.Millisecond)
+	collector.ObserveRequest("BREW", 418, 20*time.Millisecond)
+	collector.ObserveResponseSize(100)
+	collector.ObserveResponseSize(5000)
+	collector.ObserveResponseSize(100 << 20)
+	collector.UpstreamError()
+	collector.UpstreamConnection(false)
+	collector.UpstreamConnection(true)
+	collector.UpstreamConnection(true)
+	collector.WebSocketOpened()
+	collector.WebSocketOpened()
+	collector.WebSocketClosed()
+
+	output := &bytes.Buffer{}
+	if _, err := collector.WriteTo(output); err != nil {
+		t.Errorf("Error writing metrics: %v", err)
+		return
+	}
+
+	expectedLines := []string{
+		`relay_requests_total{method="GET",status="2xx"} 2`,
+		`relay_requests_total{method="OTHER",status="4xx"} 1`,
+		`relay_requests_total{method="POST",status="5xx"} 1`,
+		`relay_request_duration_seconds_bucket{le="0.01"} 0`,
+		`relay_request_duration_seconds_bucket{le="0.025"} 3`,
+		`relay_request_duration_seconds_bucket{le="2.5"} 4`,
+		`relay_request_duration_seconds_bucket{le="+Inf"} 4`,
+		`relay_request_duration_seconds_count 4`,
+		`relay_response_size_bytes_bucket{le="1024"} 1`,
+		`relay_response_size_bytes_bucket{le="16384"} 2`,
+		`relay_response_size_bytes_bucket{le="6.7108864e+07"} 2`,
+		`relay_response_size_bytes_bucket{le="+Inf"} 3`,
+		`relay_response_size_bytes_count 3`,
+		`relay_upstream_errors_total 1`,
+		`relay_upstream_connections_total{reused="false"} 1`,
+		`relay_upstream_connections_total{reused="true"} 2`,
+		`relay_active_websocket_connections 1`,
+	}
+	assertMetricLines(t, output.String(), expectedLines)
+}
+
+func TestNilCollector(t *testing.T) {
+	// A nil collector is used when metrics are disabled; it should silently
+	// ignore all observations.
+	var collector *metrics.Collector
+	collector.ObserveRequest("GET", 200, time.Second)
+	collector.ObserveResponseSize(1024)
+	collector.UpstreamError()
+	collector.UpstreamConnection(true)
+	collector.WebSocketOpened()
+	collector.WebSocketClosed()
+}
+
+func assertMetricLines(t *testing.T, output string, expectedLines []string) {
+	lines := map[string]bool{}
+	for _, line := range strings.Split(output, "\n") {
+		lines[line] = true
+	}
+	for _, expectedLine := range expectedLines {
+		if !lines[expectedLine] {
+			t.Errorf("Expected metrics line '%v' in output:\n%v", expectedLine, output)
+		}
+	}
+}
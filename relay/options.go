@@ -1,23 +1,55 @@
 package relay
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"math"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/fullstorydev/relay-core/relay/config"
+	"github.com/fullstorydev/relay-core/relay/environment"
+	"github.com/fullstorydev/relay-core/relay/logging"
+	"github.com/fullstorydev/relay-core/relay/tracing"
 	"github.com/fullstorydev/relay-core/relay/traffic"
+	"golang.org/x/net/http/httpguts"
 )
 
+// Options contains all of the relay's configuration. It's usually read from a
+// configuration file by ReadOptions, but when the relay is embedded in another
+// program, it may instead be built directly, starting from NewDefaultOptions,
+// and passed to NewService.
 type Options struct {
 	Service *ServiceOptions
 	Relay   *traffic.RelayOptions
 }
 
-func ReadOptions(configFile *config.File) (*Options, error) {
-	options := &Options{
+// NewDefaultOptions returns Options with the default value for every option.
+// At least one target must be added to Relay.Targets before it's used.
+func NewDefaultOptions() *Options {
+	return &Options{
 		Service: NewDefaultServiceOptions(),
 		Relay:   traffic.NewDefaultRelayOptions(),
 	}
+}
+
+// ReadOptions reads Options from the "relay" section of the provided
+// configuration file. Options which aren't present keep their default values.
+// Reading options doesn't change the relay's behavior: the log format and level
+// only take effect once they're passed to ApplyLogOptions. The access log is
+// opened, though; if the options are discarded, it should be closed.
+func ReadOptions(configFile *config.File) (*Options, error) {
+	options := NewDefaultOptions()
+
+	if err := ReadLogOptions(configFile, options.Service); err != nil {
+		return nil, err
+	}
 
 	configSection, err := configFile.LookupRequiredSection("relay")
 	if err != nil {
@@ -31,21 +63,284 @@ func ReadOptions(configFile *config.File) (*Options, error) {
 		options.Service.Port = port
 	}
 
+	if healthAddr, err := config.LookupOptional[string](configSection, "health-addr"); err != nil {
+		return nil, err
+	} else if healthAddr != nil && *healthAddr != "" {
+		logger.Printf("Health address: %v\n", *healthAddr)
+		options.Service.HealthAddr = *healthAddr
+	}
+
+	if healthCheckTargets, err := config.LookupOptional[bool](configSection, "health-check-target"); err != nil {
+		return nil, err
+	} else if healthCheckTargets != nil {
+		options.Service.HealthCheckTargets = *healthCheckTargets
+	}
+
+	if metricsAddr, err := config.LookupOptional[string](configSection, "metrics-addr"); err != nil {
+		return nil, err
+	} else if metricsAddr != nil && *metricsAddr != "" {
+		logger.Printf("Metrics address: %v\n", *metricsAddr)
+		options.Service.MetricsAddr = *metricsAddr
+	}
+
+	if serverReadTimeout, err := lookupDuration(configSection, "server-read-timeout"); err != nil {
+		return nil, err
+	} else if serverReadTimeout != nil {
+		logger.Printf("Server read timeout: %v\n", *serverReadTimeout)
+		options.Service.ServerReadTimeout = *serverReadTimeout
+	}
+
+	if serverWriteTimeout, err := lookupDuration(configSection, "server-write-timeout"); err != nil {
+		return nil, err
+	} else if serverWriteTimeout != nil {
+		logger.Printf("Server write timeout: %v\n", *serverWriteTimeout)
+		options.Service.ServerWriteTimeout = *serverWriteTimeout
+	}
+
+	if serverIdleTimeout, err := lookupDuration(configSection, "server-idle-timeout"); err != nil {
+		return nil, err
+	} else if serverIdleTimeout != nil {
+		logger.Printf("Server idle timeout: %v\n", *serverIdleTimeout)
+		options.Service.ServerIdleTimeout = *serverIdleTimeout
+	}
+
+	if shutdownTimeout, err := lookupDuration(configSection, "shutdown-timeout"); err != nil {
+		return nil, err
+	} else if shutdownTimeout != nil {
+		logger.Printf("Shutdown timeout: %v\n", *shutdownTimeout)
+		options.Service.ShutdownTimeout = *shutdownTimeout
+	}
+
 	if err := config.ParseRequired(configSection, "target", func(key, value string) error {
-		logger.Printf("Target: %v\n", value)
-		if targetURL, err := url.Parse(value); err != nil {
+		targets, err := parseTargetList(value)
+		if err != nil {
+			return err
+		}
+		for _, target := range targets {
+			logger.Printf("Target: %v\n", target)
+		}
+		options.Relay.Targets = targets
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "connect-addr", func(key, value string) error {
+		if value == "" {
+			return nil
+		}
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			return fmt.Errorf(`Option "%v" must have the form "host:port": %v`, key, err)
+		}
+		logger.Printf("Connect address: %v\n", value)
+		options.Relay.ConnectAddress = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if preserveHost, err := config.LookupOptional[bool](configSection, "preserve-host"); err != nil {
+		return nil, err
+	} else if preserveHost != nil && *preserveHost {
+		logger.Printf("Preserving the client's Host header\n")
+		options.Relay.PreserveHost = true
+	}
+
+	if err := config.ParseOptional(configSection, "shadow-target", func(key, value string) error {
+		if value == "" {
+			return nil
+		}
+		target, err := parseTarget(value)
+		if err != nil {
 			return err
-		} else if targetURL.Scheme == "" || targetURL.Host == "" {
-			return fmt.Errorf("Invalid or relative target URL")
+		}
+		logger.Printf("Shadow target: %v\n", target)
+		options.Relay.ShadowTarget = target
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if cookieDomain, err := config.LookupOptional[string](configSection, "cookie-domain"); err != nil {
+		return nil, err
+	} else if cookieDomain != nil && *cookieDomain != "" {
+		logger.Printf("Cookie domain: %v\n", *cookieDomain)
+		options.Relay.CookieDomain = *cookieDomain
+	}
+
+	if cookiePath, err := config.LookupOptional[string](configSection, "cookie-path"); err != nil {
+		return nil, err
+	} else if cookiePath != nil && *cookiePath != "" {
+		if !strings.HasPrefix(*cookiePath, "/") {
+			return nil, fmt.Errorf(`Option "cookie-path" must start with "/": %v`, *cookiePath)
+		}
+		logger.Printf("Cookie path: %v\n", *cookiePath)
+		options.Relay.CookiePath = *cookiePath
+	}
+
+	if err := config.ParseOptional(configSection, "sticky-cookie", func(key, value string) error {
+		if value == "" {
+			return nil
+		}
+		if err := (&http.Cookie{Name: value}).Valid(); err != nil {
+			return fmt.Errorf(`Option "%v" must be a valid cookie name: %v`, key, err)
+		}
+		logger.Printf("Sticky session cookie: %v\n", value)
+		options.Relay.StickyCookie = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "split-header", func(key, value string) error {
+		if value == "" {
+			return nil
+		}
+		if !httpguts.ValidHeaderFieldName(value) {
+			return fmt.Errorf(`Option "%v" must be a valid header name: %v`, key, value)
+		}
+		logger.Printf("Split header: %v\n", value)
+		options.Relay.SplitHeader = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if splitBuckets, err := lookupList(configSection, "split-buckets"); err != nil {
+		return nil, err
+	} else if len(splitBuckets) > 0 {
+		for _, value := range splitBuckets {
+			bucket, err := parseSplitBucket(value)
+			if err != nil {
+				return nil, err
+			}
+			for _, other := range options.Relay.SplitBuckets {
+				if bucket.First <= other.Last && other.First <= bucket.Last {
+					return nil, fmt.Errorf(`Option "split-buckets" has overlapping bucket ranges: %v`, value)
+				}
+			}
+			logger.Printf("Split buckets %v-%v: %v\n", bucket.First, bucket.Last, bucket.Target)
+			options.Relay.SplitBuckets = append(options.Relay.SplitBuckets, bucket)
+		}
+	}
+
+	if (options.Relay.SplitHeader == "") != (len(options.Relay.SplitBuckets) == 0) {
+		return nil, fmt.Errorf(`Options "split-header" and "split-buckets" must be set together`)
+	}
+
+	if corsAllowOrigins, err := lookupList(configSection, "cors-allow-origin"); err != nil {
+		return nil, err
+	} else if len(corsAllowOrigins) > 0 {
+		for _, origin := range corsAllowOrigins {
+			if origin == "*" {
+				continue
+			}
+			if originURL, err := url.Parse(origin); err != nil || originURL.Scheme == "" || originURL.Host == "" || originURL.Path != "" || originURL.RawQuery != "" {
+				return nil, fmt.Errorf(`Option "cors-allow-origin" must contain "*" or origins like "https://app.example.com": %v`, origin)
+			}
+		}
+		logger.Printf("CORS allowed origins: %v\n", corsAllowOrigins)
+		options.Relay.CORSAllowOrigins = corsAllowOrigins
+	}
+
+	if hostRoutes, err := readHostMap(configSection); err != nil {
+		return nil, err
+	} else {
+		for _, route := range hostRoutes {
+			var details []string
+			if route.OriginMode != "" {
+				details = append(details, fmt.Sprintf("origin mode: %v", route.OriginMode))
+			}
+			if route.DialTimeout > 0 {
+				details = append(details, fmt.Sprintf("dial timeout: %v", route.DialTimeout))
+			}
+			if route.RequestTimeout > 0 {
+				details = append(details, fmt.Sprintf("request timeout: %v", route.RequestTimeout))
+			}
+			if route.ResponseHeaderTimeout > 0 {
+				details = append(details, fmt.Sprintf("response header timeout: %v", route.ResponseHeaderTimeout))
+			}
+			if len(details) > 0 {
+				logger.Printf("Host route: %v -> %v (%v)\n", route.Pattern, route.Target, strings.Join(details, ", "))
+			} else {
+				logger.Printf("Host route: %v -> %v\n", route.Pattern, route.Target)
+			}
+		}
+		options.Relay.HostRoutes = hostRoutes
+	}
+
+	if pathRoutes, err := readPathMap(configSection); err != nil {
+		return nil, err
+	} else {
+		for _, route := range pathRoutes {
+			if route.StripPrefix {
+				logger.Printf("Path route: %v -> %v (prefix stripped)\n", route.Prefix, route.Target)
+			} else {
+				logger.Printf("Path route: %v -> %v\n", route.Prefix, route.Target)
+			}
+		}
+		options.Relay.PathRoutes = pathRoutes
+	}
+
+	if err := config.ParseOptional(configSection, "public-host", func(key, value string) error {
+		// The public host may include a scheme, like "https://relay.example".
+		if value == "" {
+			return nil
+		} else if strings.Contains(value, "://") {
+			publicURL, err := url.Parse(value)
+			if err != nil {
+				return err
+			} else if publicURL.Host == "" {
+				return fmt.Errorf(`Public host URL "%v" has no host`, value)
+			}
+			options.Relay.PublicScheme = publicURL.Scheme
+			options.Relay.PublicHost = publicURL.Host
 		} else {
-			options.Relay.TargetScheme = targetURL.Scheme
-			options.Relay.TargetHost = targetURL.Host
+			options.Relay.PublicHost = value
+		}
+		logger.Printf("Public host: %v\n", value)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "force-client-scheme", func(key, value string) error {
+		if value == "" {
 			return nil
 		}
+		if value = strings.ToLower(value); value != "http" && value != "https" {
+			return fmt.Errorf(`Option "%v" must be "http" or "https": %v`, key, value)
+		}
+		logger.Printf("Client scheme: %v\n", value)
+		options.Relay.ForceClientScheme = value
+		return nil
 	}); err != nil {
 		return nil, err
 	}
 
+	if responseReplace, err := config.LookupOptional[bool](configSection, "response-replace"); err != nil {
+		return nil, err
+	} else if responseReplace != nil && *responseReplace {
+		logger.Printf("Rewriting target URLs in response bodies\n")
+		options.Relay.ResponseReplace = true
+	}
+
+	if compressResponse, err := config.LookupOptional[bool](configSection, "compress-response"); err != nil {
+		return nil, err
+	} else if compressResponse != nil && *compressResponse {
+		logger.Printf("Compressing text responses for clients which accept gzip\n")
+		options.Relay.CompressResponse = true
+	}
+
+	if compressMinSize, err := config.LookupOptional[int64](configSection, "compress-min-size"); err != nil {
+		return nil, err
+	} else if compressMinSize != nil {
+		if *compressMinSize < 0 {
+			return nil, fmt.Errorf(`Option "compress-min-size" must not be negative: %v`, *compressMinSize)
+		}
+		options.Relay.CompressMinSize = *compressMinSize
+	}
+
 	if maxBodySize, err := config.LookupOptional[int64](configSection, "max-body-size"); err != nil {
 		return nil, err
 	} else if maxBodySize != nil {
@@ -53,5 +348,1129 @@ func ReadOptions(configFile *config.File) (*Options, error) {
 		options.Relay.MaxBodySize = *maxBodySize
 	}
 
-	return options, nil
+	if largeResponseThreshold, err := config.LookupOptional[int64](configSection, "large-response-threshold"); err != nil {
+		return nil, err
+	} else if largeResponseThreshold != nil {
+		if *largeResponseThreshold < 0 {
+			return nil, fmt.Errorf(`Option "large-response-threshold" must not be negative: %v`, *largeResponseThreshold)
+		}
+		if *largeResponseThreshold > 0 {
+			logger.Printf("Large response threshold: %v\n", *largeResponseThreshold)
+			options.Relay.LargeResponseThreshold = *largeResponseThreshold
+		}
+	}
+
+	if replacements, err := lookupList(configSection, "body-replace"); err != nil {
+		return nil, err
+	} else if len(replacements) > 0 {
+		for _, value := range replacements {
+			replacement, err := parseBodyReplacement(value)
+			if err != nil {
+				return nil, err
+			}
+			logger.Printf("Replacing %q with %q in request bodies\n", replacement.From, replacement.To)
+			options.Relay.BodyReplacements = append(options.Relay.BodyReplacements, replacement)
+		}
+	}
+
+	if maxRequestBodySize, err := config.LookupOptional[int64](configSection, "max-request-body-size"); err != nil {
+		return nil, err
+	} else if maxRequestBodySize != nil {
+		if *maxRequestBodySize < 0 {
+			return nil, fmt.Errorf(`Option "max-request-body-size" must not be negative: %v`, *maxRequestBodySize)
+		}
+		logger.Printf("Maximum request body size: %v\n", *maxRequestBodySize)
+		options.Relay.MaxRequestBodySize = *maxRequestBodySize
+	}
+
+	if maxHeaderBytes, err := config.LookupOptional[int](configSection, "max-header-bytes"); err != nil {
+		return nil, err
+	} else if maxHeaderBytes != nil {
+		if *maxHeaderBytes < 0 {
+			return nil, fmt.Errorf(`Option "max-header-bytes" must not be negative: %v`, *maxHeaderBytes)
+		}
+		logger.Printf("Maximum header size: %v\n", *maxHeaderBytes)
+		options.Relay.MaxHeaderBytes = *maxHeaderBytes
+	}
+
+	if cacheSize, err := config.LookupOptional[int](configSection, "cache-size"); err != nil {
+		return nil, err
+	} else if cacheSize != nil {
+		if *cacheSize < 0 {
+			return nil, fmt.Errorf(`Option "cache-size" must not be negative: %v`, *cacheSize)
+		}
+		logger.Printf("Response cache size: %v\n", *cacheSize)
+		options.Relay.CacheSize = *cacheSize
+	}
+
+	if maxIdleConns, err := config.LookupOptional[int](configSection, "max-idle-conns"); err != nil {
+		return nil, err
+	} else if maxIdleConns != nil {
+		if *maxIdleConns < 0 {
+			return nil, fmt.Errorf(`Option "max-idle-conns" must not be negative: %v`, *maxIdleConns)
+		}
+		logger.Printf("Maximum idle connections: %v\n", *maxIdleConns)
+		options.Relay.MaxIdleConns = *maxIdleConns
+	}
+
+	if maxIdleConnsPerHost, err := config.LookupOptional[int](configSection, "max-idle-conns-per-host"); err != nil {
+		return nil, err
+	} else if maxIdleConnsPerHost != nil {
+		if *maxIdleConnsPerHost < 0 {
+			return nil, fmt.Errorf(`Option "max-idle-conns-per-host" must not be negative: %v`, *maxIdleConnsPerHost)
+		}
+		logger.Printf("Maximum idle connections per host: %v\n", *maxIdleConnsPerHost)
+		options.Relay.MaxIdleConnsPerHost = *maxIdleConnsPerHost
+	}
+
+	if maxConnsPerHost, err := config.LookupOptional[int](configSection, "max-conns-per-host"); err != nil {
+		return nil, err
+	} else if maxConnsPerHost != nil {
+		if *maxConnsPerHost < 0 {
+			return nil, fmt.Errorf(`Option "max-conns-per-host" must not be negative: %v`, *maxConnsPerHost)
+		}
+		logger.Printf("Maximum connections per host: %v\n", *maxConnsPerHost)
+		options.Relay.MaxConnsPerHost = *maxConnsPerHost
+	}
+
+	if idleConnTimeout, err := lookupDuration(configSection, "idle-conn-timeout"); err != nil {
+		return nil, err
+	} else if idleConnTimeout != nil {
+		logger.Printf("Idle connection timeout: %v\n", *idleConnTimeout)
+		options.Relay.IdleConnTimeout = *idleConnTimeout
+	}
+
+	if dialTimeout, err := lookupDuration(configSection, "dial-timeout"); err != nil {
+		return nil, err
+	} else if dialTimeout != nil {
+		logger.Printf("Dial timeout: %v\n", *dialTimeout)
+		options.Relay.DialTimeout = *dialTimeout
+	}
+
+	if requestTimeout, err := lookupDuration(configSection, "request-timeout"); err != nil {
+		return nil, err
+	} else if requestTimeout != nil {
+		logger.Printf("Request timeout: %v\n", *requestTimeout)
+		options.Relay.RequestTimeout = *requestTimeout
+	}
+
+	if slowRequestThreshold, err := lookupDuration(configSection, "slow-request-threshold"); err != nil {
+		return nil, err
+	} else if slowRequestThreshold != nil && *slowRequestThreshold > 0 {
+		logger.Printf("Slow request threshold: %v", *slowRequestThreshold)
+		options.Relay.SlowRequestThreshold = *slowRequestThreshold
+	}
+
+	if clientWriteTimeout, err := lookupDuration(configSection, "client-write-timeout"); err != nil {
+		return nil, err
+	} else if clientWriteTimeout != nil && *clientWriteTimeout > 0 {
+		logger.Printf("Client write timeout: %v\n", *clientWriteTimeout)
+		options.Relay.ClientWriteTimeout = *clientWriteTimeout
+	}
+
+	if clientKeepAlive, err := config.LookupOptional[bool](configSection, "client-keepalive"); err != nil {
+		return nil, err
+	} else if clientKeepAlive != nil && !*clientKeepAlive {
+		logger.Printf("Closing client connections after each response\n")
+		options.Relay.DisableClientKeepAlive = true
+	}
+
+	if expectContinueTimeout, err := lookupDuration(configSection, "expect-continue-timeout"); err != nil {
+		return nil, err
+	} else if expectContinueTimeout != nil {
+		logger.Printf("Expect continue timeout: %v\n", *expectContinueTimeout)
+		options.Relay.ExpectContinueTimeout = *expectContinueTimeout
+	}
+
+	if responseHeaderTimeout, err := lookupDuration(configSection, "response-header-timeout"); err != nil {
+		return nil, err
+	} else if responseHeaderTimeout != nil {
+		logger.Printf("Response header timeout: %v\n", *responseHeaderTimeout)
+		options.Relay.ResponseHeaderTimeout = *responseHeaderTimeout
+	}
+
+	if maxRetries, err := config.LookupOptional[int](configSection, "max-retries"); err != nil {
+		return nil, err
+	} else if maxRetries != nil {
+		if *maxRetries < 0 {
+			return nil, fmt.Errorf(`Option "max-retries" must not be negative: %v`, *maxRetries)
+		}
+		logger.Printf("Maximum retries: %v\n", *maxRetries)
+		options.Relay.MaxRetries = *maxRetries
+	}
+
+	if threshold, err := config.LookupOptional[int](configSection, "circuit-breaker-threshold"); err != nil {
+		return nil, err
+	} else if threshold != nil {
+		if *threshold < 0 {
+			return nil, fmt.Errorf(`Option "circuit-breaker-threshold" must not be negative: %v`, *threshold)
+		}
+		logger.Printf("Circuit breaker threshold: %v\n", *threshold)
+		options.Relay.CircuitBreakerThreshold = *threshold
+	}
+
+	if cooldown, err := lookupDuration(configSection, "circuit-breaker-cooldown"); err != nil {
+		return nil, err
+	} else if cooldown != nil {
+		logger.Printf("Circuit breaker cooldown: %v\n", *cooldown)
+		options.Relay.CircuitBreakerCooldown = *cooldown
+	}
+
+	if threshold, err := config.LookupOptional[int](configSection, "target-fail-threshold"); err != nil {
+		return nil, err
+	} else if threshold != nil {
+		if *threshold < 0 {
+			return nil, fmt.Errorf(`Option "target-fail-threshold" must not be negative: %v`, *threshold)
+		}
+		logger.Printf("Target failure threshold: %v\n", *threshold)
+		options.Relay.TargetFailThreshold = *threshold
+	}
+
+	if recovery, err := lookupDuration(configSection, "target-recovery"); err != nil {
+		return nil, err
+	} else if recovery != nil {
+		logger.Printf("Target recovery: %v\n", *recovery)
+		options.Relay.TargetRecovery = *recovery
+	}
+
+	if interval, err := lookupDuration(configSection, "target-health-interval"); err != nil {
+		return nil, err
+	} else if interval != nil && *interval > 0 {
+		logger.Printf("Target health check interval: %v\n", *interval)
+		options.Relay.TargetHealthInterval = *interval
+	}
+
+	if err := config.ParseOptional(configSection, "target-health-path", func(key, value string) error {
+		if value == "" {
+			return nil
+		}
+		if !strings.HasPrefix(value, "/") {
+			return fmt.Errorf(`Option "%v" must be a path starting with "/": %v`, key, value)
+		}
+		logger.Printf("Target health check path: %v\n", value)
+		options.Relay.TargetHealthPath = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if status, err := config.LookupOptional[int](configSection, "target-health-status"); err != nil {
+		return nil, err
+	} else if status != nil {
+		if *status < 100 || *status > 599 {
+			return nil, fmt.Errorf(`Option "target-health-status" must be an HTTP status code: %v`, *status)
+		}
+		logger.Printf("Target health check status: %v\n", *status)
+		options.Relay.TargetHealthStatus = *status
+	}
+
+	if allowCIDRs, err := lookupCIDRs(configSection, "allow-cidrs"); err != nil {
+		return nil, err
+	} else if len(allowCIDRs) > 0 {
+		logger.Printf("Allowed client addresses: %v\n", allowCIDRs)
+		options.Relay.AllowCIDRs = allowCIDRs
+	}
+
+	if denyCIDRs, err := lookupCIDRs(configSection, "deny-cidrs"); err != nil {
+		return nil, err
+	} else if len(denyCIDRs) > 0 {
+		logger.Printf("Denied client addresses: %v\n", denyCIDRs)
+		options.Relay.DenyCIDRs = denyCIDRs
+	}
+
+	if rateLimit, err := config.LookupOptional[float64](configSection, "rate-limit"); err != nil {
+		return nil, err
+	} else if rateLimit != nil {
+		if *rateLimit < 0 {
+			return nil, fmt.Errorf(`Option "rate-limit" must not be negative: %v`, *rateLimit)
+		}
+		logger.Printf("Rate limit: %v requests per second\n", *rateLimit)
+		options.Relay.RateLimit = *rateLimit
+	}
+
+	if rateBurst, err := config.LookupOptional[int](configSection, "rate-burst"); err != nil {
+		return nil, err
+	} else if rateBurst != nil {
+		if *rateBurst < 0 {
+			return nil, fmt.Errorf(`Option "rate-burst" must not be negative: %v`, *rateBurst)
+		}
+		options.Relay.RateBurst = *rateBurst
+	}
+
+	// Without a burst, no request could ever be allowed, so it defaults to a
+	// second's worth of requests.
+	if options.Relay.RateLimit > 0 {
+		if options.Relay.RateBurst == 0 {
+			options.Relay.RateBurst = int(math.Ceil(options.Relay.RateLimit))
+		}
+		logger.Printf("Rate burst: %v requests\n", options.Relay.RateBurst)
+	}
+
+	if maxConcurrent, err := config.LookupOptional[int](configSection, "max-concurrent"); err != nil {
+		return nil, err
+	} else if maxConcurrent != nil && *maxConcurrent != 0 {
+		if *maxConcurrent < 0 {
+			return nil, fmt.Errorf(`Option "max-concurrent" must not be negative: %v`, *maxConcurrent)
+		}
+		logger.Printf("Maximum concurrent requests: %v\n", *maxConcurrent)
+		options.Relay.MaxConcurrent = *maxConcurrent
+	}
+
+	if queueTimeout, err := lookupDuration(configSection, "queue-timeout"); err != nil {
+		return nil, err
+	} else if queueTimeout != nil && *queueTimeout > 0 {
+		logger.Printf("Queue timeout: %v\n", *queueTimeout)
+		options.Relay.QueueTimeout = *queueTimeout
+	}
+
+	if basicAuthUser, err := config.LookupOptional[string](configSection, "basic-auth-user"); err != nil {
+		return nil, err
+	} else if basicAuthUser != nil && *basicAuthUser != "" {
+		logger.Printf("Basic Auth user: %v\n", *basicAuthUser)
+		options.Relay.BasicAuthUser = *basicAuthUser
+	}
+
+	// The password itself is never logged.
+	if basicAuthPassword, err := config.LookupOptional[string](configSection, "basic-auth-pass"); err != nil {
+		return nil, err
+	} else if basicAuthPassword != nil && *basicAuthPassword != "" {
+		options.Relay.BasicAuthPassword = *basicAuthPassword
+	}
+
+	if (options.Relay.BasicAuthUser == "") != (options.Relay.BasicAuthPassword == "") {
+		return nil, fmt.Errorf(`Options "basic-auth-user" and "basic-auth-pass" must be set together`)
+	}
+
+	if hmacHeader, err := config.LookupOptional[string](configSection, "hmac-header"); err != nil {
+		return nil, err
+	} else if hmacHeader != nil && *hmacHeader != "" {
+		if !httpguts.ValidHeaderFieldName(*hmacHeader) {
+			return nil, fmt.Errorf(`Option "hmac-header" must be a valid header name: %v`, *hmacHeader)
+		}
+		logger.Printf("Signing requests with HMAC in header: %v\n", *hmacHeader)
+		options.Relay.HMACHeader = *hmacHeader
+	}
+
+	// Like the Basic Auth password, the secret is never logged.
+	if hmacSecret, err := config.LookupOptional[string](configSection, "hmac-secret"); err != nil {
+		return nil, err
+	} else if hmacSecret != nil && *hmacSecret != "" {
+		options.Relay.HMACSecret = *hmacSecret
+	}
+
+	if (options.Relay.HMACHeader == "") != (options.Relay.HMACSecret == "") {
+		return nil, fmt.Errorf(`Options "hmac-header" and "hmac-secret" must be set together`)
+	}
+
+	if basicAuthForward, err := config.LookupOptional[bool](configSection, "basic-auth-forward"); err != nil {
+		return nil, err
+	} else if basicAuthForward != nil && *basicAuthForward {
+		logger.Printf("Forwarding Basic Auth credentials to the target\n")
+		options.Relay.BasicAuthForward = true
+	}
+
+	if trustForwarded, err := config.LookupOptional[bool](configSection, "trust-forwarded"); err != nil {
+		return nil, err
+	} else if trustForwarded != nil && *trustForwarded {
+		logger.Printf("Trusting X-Forwarded-For headers\n")
+		options.Relay.TrustForwarded = true
+	}
+
+	if err := config.ParseOptional(configSection, "relay-id", func(key, value string) error {
+		if value == "" {
+			return nil
+		}
+		if strings.ContainsAny(value, ", \t") || !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf(`Option "%v" must not contain commas, whitespace, or control characters: %q`, key, value)
+		}
+		logger.Printf("Relay ID: %v\n", value)
+		options.Relay.RelayID = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "request-id-header", func(key, value string) error {
+		if value == "" {
+			return nil
+		}
+		if !httpguts.ValidHeaderFieldName(value) {
+			return fmt.Errorf(`Option "%v" must be a valid header name: %v`, key, value)
+		}
+		logger.Printf("Request ID header: %v\n", value)
+		options.Relay.RequestIDHeader = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "user-agent", func(key, value string) error {
+		if value == "" {
+			return nil
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf(`Option "%v" must be a valid header value: %v`, key, value)
+		}
+		logger.Printf("User agent: %v\n", value)
+		options.Relay.UserAgent = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := config.ParseOptional(configSection, "error-format", func(key, value string) error {
+		if value == "" {
+			return nil
+		}
+		format, err := traffic.ParseErrorFormat(value)
+		if err != nil {
+			return fmt.Errorf(`Option "%v" must be "text" or "json": %v`, key, value)
+		}
+		logger.Printf("Error format: %v\n", format)
+		options.Relay.ErrorFormat = format
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if timingHeader, err := config.LookupOptional[bool](configSection, "timing-header"); err != nil {
+		return nil, err
+	} else if timingHeader != nil && *timingHeader {
+		logger.Printf("Reporting upstream response times in the %v header\n", traffic.UpstreamTimeHeaderName)
+		options.Relay.TimingHeader = true
+	}
+
+	if traceConnections, err := config.LookupOptional[bool](configSection, "trace-connections"); err != nil {
+		return nil, err
+	} else if traceConnections != nil && *traceConnections {
+		logger.Printf("Tracing connections to the target\n")
+		options.Relay.TraceConnections = true
+	}
+
+	if maintenance, err := config.LookupOptional[bool](configSection, "maintenance"); err != nil {
+		return nil, err
+	} else if maintenance != nil && *maintenance {
+		logger.Printf("Maintenance mode is enabled; requests won't be relayed\n")
+		options.Relay.Maintenance = true
+	}
+
+	if status, err := config.LookupOptional[int](configSection, "maintenance-status"); err != nil {
+		return nil, err
+	} else if status != nil {
+		if *status < 200 || *status > 599 {
+			return nil, fmt.Errorf(`Option "maintenance-status" must be a final HTTP status code: %v`, *status)
+		}
+		logger.Printf("Maintenance status: %v\n", *status)
+		options.Relay.MaintenanceStatus = *status
+	}
+
+	if body, err := config.LookupOptional[string](configSection, "maintenance-body"); err != nil {
+		return nil, err
+	} else if body != nil && *body != "" {
+		options.Relay.MaintenanceBody = *body
+	}
+
+	if retryAfter, err := lookupDuration(configSection, "maintenance-retry-after"); err != nil {
+		return nil, err
+	} else if retryAfter != nil && *retryAfter > 0 {
+		logger.Printf("Maintenance Retry-After: %v\n", *retryAfter)
+		options.Relay.MaintenanceRetryAfter = *retryAfter
+	}
+
+	if maxWebSocketConnections, err := config.LookupOptional[int](configSection, "max-ws-connections"); err != nil {
+		return nil, err
+	} else if maxWebSocketConnections != nil {
+		if *maxWebSocketConnections < 0 {
+			return nil, fmt.Errorf(`Option "max-ws-connections" must not be negative: %v`, *maxWebSocketConnections)
+		}
+		logger.Printf("Maximum websocket connections: %v\n", *maxWebSocketConnections)
+		options.Relay.MaxWebSocketConnections = *maxWebSocketConnections
+	}
+
+	if webSocketBufferSize, err := config.LookupOptional[int](configSection, "ws-buffer-size"); err != nil {
+		return nil, err
+	} else if webSocketBufferSize != nil {
+		if *webSocketBufferSize < traffic.MinWebSocketBufferSize || *webSocketBufferSize > traffic.MaxWebSocketBufferSize {
+			return nil, fmt.Errorf(
+				`Option "ws-buffer-size" must be between %v and %v bytes: %v`,
+				traffic.MinWebSocketBufferSize,
+				traffic.MaxWebSocketBufferSize,
+				*webSocketBufferSize,
+			)
+		}
+		logger.Printf("Websocket buffer size: %v bytes\n", *webSocketBufferSize)
+		options.Relay.WebSocketBufferSize = *webSocketBufferSize
+	}
+
+	if retryBackoff, err := lookupDuration(configSection, "retry-backoff"); err != nil {
+		return nil, err
+	} else if retryBackoff != nil {
+		logger.Printf("Retry backoff: %v\n", *retryBackoff)
+		options.Relay.RetryBackoff = *retryBackoff
+	}
+
+	if retryOnStatus, err := lookupList(configSection, "retry-on-status"); err != nil {
+		return nil, err
+	} else if len(retryOnStatus) > 0 {
+		for _, value := range retryOnStatus {
+			status, err := strconv.Atoi(value)
+			if err != nil || status < 100 || status > 599 {
+				return nil, fmt.Errorf(`Option "retry-on-status" must list HTTP status codes: %v`, value)
+			}
+			options.Relay.RetryOnStatus = append(options.Relay.RetryOnStatus, status)
+		}
+		logger.Printf("Retrying on status: %v\n", options.Relay.RetryOnStatus)
+	}
+
+	if retryBufferLimit, err := config.LookupOptional[int64](configSection, "retry-buffer-limit"); err != nil {
+		return nil, err
+	} else if retryBufferLimit != nil {
+		if *retryBufferLimit < 0 {
+			return nil, fmt.Errorf(`Option "retry-buffer-limit" must not be negative: %v`, *retryBufferLimit)
+		}
+		logger.Printf("Retry buffer limit: %v\n", *retryBufferLimit)
+		options.Relay.RetryBufferLimit = *retryBufferLimit
+	}
+
+	if webSocketIdleTimeout, err := lookupDuration(configSection, "ws-idle-timeout"); err != nil {
+		return nil, err
+	} else if webSocketIdleTimeout != nil {
+		logger.Printf("Websocket idle timeout: %v\n", *webSocketIdleTimeout)
+		options.Relay.WebSocketIdleTimeout = *webSocketIdleTimeout
+	}
+
+	if allowConnect, err := config.LookupOptional[bool](configSection, "allow-connect"); err != nil {
+		return nil, err
+	} else if allowConnect != nil && *allowConnect {
+		logger.Printf("Allowing CONNECT tunnels\n")
+		options.Relay.AllowConnect = true
+	}
+
+	if allowedMethods, err := lookupList(configSection, "allowed-methods"); err != nil {
+		return nil, err
+	} else if len(allowedMethods) > 0 {
+		for i, method := range allowedMethods {
+			if !httpguts.ValidHeaderFieldName(method) {
+				return nil, fmt.Errorf(`Option "allowed-methods" must list valid HTTP methods: %q`, method)
+			}
+			allowedMethods[i] = strings.ToUpper(method)
+		}
+		logger.Printf("Allowed methods: %v\n", allowedMethods)
+		options.Relay.AllowedMethods = allowedMethods
+	}
+
+	if stripResponseHeaders, err := lookupList(configSection, "strip-response-headers"); err != nil {
+		return nil, err
+	} else if len(stripResponseHeaders) > 0 {
+		logger.Printf("Stripped response headers: %v\n", stripResponseHeaders)
+		options.Relay.StripResponseHeaders = stripResponseHeaders
+	}
+
+	if whitelist, err := lookupList(configSection, "request-header-whitelist"); err != nil {
+		return nil, err
+	} else if len(whitelist) > 0 {
+		for _, name := range whitelist {
+			if !httpguts.ValidHeaderFieldName(name) {
+				return nil, fmt.Errorf(`Option "request-header-whitelist" must list valid header names: %q`, name)
+			}
+		}
+		logger.Printf("Request header whitelist: %v\n", whitelist)
+		options.Relay.RequestHeaderWhitelist = whitelist
+	}
+
+	if bufferStreamedResponses, err := config.LookupOptional[bool](configSection, "buffer-streamed-responses"); err != nil {
+		return nil, err
+	} else if bufferStreamedResponses != nil && *bufferStreamedResponses {
+		logger.Printf("Buffering streamed responses\n")
+		options.Relay.BufferStreamedResponses = true
+	}
+
+	if enableHTTP2, err := config.LookupOptional[bool](configSection, "enable-http2"); err != nil {
+		return nil, err
+	} else if enableHTTP2 != nil && *enableHTTP2 {
+		logger.Printf("HTTP/2 enabled\n")
+		options.Relay.EnableHTTP2 = true
+	}
+
+	if err := config.ParseOptional(configSection, "upstream-proxy", func(key, value string) error {
+		if value == "" {
+			return nil
+		}
+		// Like HTTP_PROXY, the proxy may be given without a scheme.
+		if !strings.Contains(value, "://") {
+			value = "http://" + value
+		}
+		proxyURL, err := url.Parse(value)
+		if err != nil {
+			return err
+		} else if proxyURL.Host == "" {
+			return fmt.Errorf(`Option "%v" must include a host: %v`, key, value)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf(`Option "%v" must use the http, https, or socks5 scheme: %v`, key, value)
+		}
+		logger.Printf("Upstream proxy: %v\n", proxyURL.Redacted())
+		options.Relay.UpstreamProxy = proxyURL
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if noProxy, err := lookupList(configSection, "no-proxy"); err != nil {
+		return nil, err
+	} else if len(noProxy) > 0 {
+		logger.Printf("No proxy: %v\n", noProxy)
+		options.Relay.NoProxy = strings.Join(noProxy, ",")
+	}
+
+	if otelEnabled, err := config.LookupOptional[bool](configSection, "otel-enabled"); err != nil {
+		return nil, err
+	} else if otelEnabled != nil && *otelEnabled {
+		logger.Printf("OpenTelemetry tracing enabled\n")
+		options.Service.OTelEnabled = true
+	}
+
+	if err := readTLSOptions(configSection, options.Relay); err != nil {
+		return nil, err
+	}
+
+	// The access log is opened last, once all of the other options are known
+	// to be valid, so that it isn't left open if they're not.
+	if err := config.ParseOptional(configSection, "access-log", func(key, path string) error {
+		accessLog, err := traffic.OpenAccessLog(path)
+		if err != nil {
+			return fmt.Errorf(`Could not open access log "%v": %v`, path, err)
+		}
+		logger.Printf("Access log: %v\n", path)
+		options.Relay.AccessLog = accessLog
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return options, nil
+}
+
+// ReadLogOptions reads the log format and level from the "relay" section of
+// the provided configuration file into the provided ServiceOptions. ReadOptions
+// reads them too, but when the relay starts, it reads and applies them first,
+// so that they apply to the log lines generated while the rest of the options
+// are read.
+func ReadLogOptions(configFile *config.File, options *ServiceOptions) error {
+	configSection, err := configFile.LookupRequiredSection("relay")
+	if err != nil {
+		return err
+	}
+
+	if err := config.ParseOptional(configSection, "log-format", func(key, value string) error {
+		format, err := logging.ParseFormat(value)
+		if err != nil {
+			return err
+		}
+		options.LogFormat = &format
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return config.ParseOptional(configSection, "log-level", func(key, value string) error {
+		level, err := logging.ParseLevel(value)
+		if err != nil {
+			return err
+		}
+		options.LogLevel = &level
+		return nil
+	})
+}
+
+// ApplyLogOptions sets the format and level used by all loggers to those in
+// the provided ServiceOptions. Those which aren't set are left unchanged.
+func ApplyLogOptions(options *ServiceOptions) {
+	if options.LogFormat != nil {
+		logging.SetFormat(*options.LogFormat)
+		logger.Printf("Log format: %v\n", *options.LogFormat)
+	}
+	if options.LogLevel != nil {
+		logging.SetLevel(*options.LogLevel)
+		logger.Printf("Log level: %v\n", *options.LogLevel)
+	}
+}
+
+// StartTracing starts exporting spans over OTLP if OTelEnabled is set, so that
+// the relay records a span for each request it sends to a target. The exporter
+// is configured by the standard OpenTelemetry environment variables. It runs in
+// the background until the relay shuts down, so it should only be started once
+// the options have been accepted.
+func StartTracing(options *Options) error {
+	if !options.Service.OTelEnabled {
+		return nil
+	}
+	exporter, err := tracing.NewOTLPExporter(environment.NewDefaultProvider())
+	if err != nil {
+		return err
+	}
+	logger.Printf("Exporting OpenTelemetry traces to %v\n", exporter)
+	options.Relay.Tracer = tracing.NewTracer(exporter)
+	return nil
+}
+
+// readTLSOptions reads the options that control how the relay communicates
+// with targets over TLS.
+func readTLSOptions(configSection *config.Section, relayOptions *traffic.RelayOptions) error {
+	if err := config.ParseOptional(configSection, "tls-ca-file", func(key, path string) error {
+		pemBytes, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(pemBytes) {
+			return fmt.Errorf(`No certificates found in CA file "%v"`, path)
+		}
+		logger.Printf("TLS CA file: %v\n", path)
+		relayOptions.TLSRootCAs = rootCAs
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := config.ParseOptional(configSection, "tls-server-name", func(key, value string) error {
+		if value == "" {
+			return nil
+		}
+		logger.Printf("TLS server name: %v\n", value)
+		relayOptions.TLSServerName = value
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// A client certificate requires both the certificate and its private key.
+	var certFile, keyFile string
+	if value, err := config.LookupOptional[string](configSection, "tls-client-cert-file"); err != nil {
+		return err
+	} else if value != nil {
+		certFile = *value
+	}
+	if value, err := config.LookupOptional[string](configSection, "tls-client-key-file"); err != nil {
+		return err
+	} else if value != nil {
+		keyFile = *value
+	}
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf(`Options "tls-client-cert-file" and "tls-client-key-file" must be set together`)
+	}
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("Could not load TLS client certificate: %v", err)
+		}
+		logger.Printf("TLS client certificate: %v\n", certFile)
+		relayOptions.TLSClientCertificate = &certificate
+	}
+
+	if tlsVerify, err := config.LookupOptional[bool](configSection, "tls-verify"); err != nil {
+		return err
+	} else if tlsVerify != nil && !*tlsVerify {
+		relayOptions.TLSInsecureSkipVerify = true
+	}
+
+	if !relayOptions.TLSInsecureSkipVerify {
+		return nil
+	}
+
+	// Disabling verification is easy to overlook, so the affected targets are
+	// named explicitly. Operators who want to rule it out entirely can refuse
+	// to start instead.
+	insecureHosts := httpsTargetHosts(relayOptions)
+	if len(insecureHosts) == 0 {
+		logger.Warnf("TLS certificate verification is disabled; the relay will trust any certificate presented by the target")
+		return nil
+	}
+	if refuseInsecure, err := config.LookupOptional[bool](configSection, "refuse-insecure"); err != nil {
+		return err
+	} else if refuseInsecure != nil && *refuseInsecure {
+		return fmt.Errorf(`TLS certificate verification is disabled for https targets %v, but "refuse-insecure" is set`, strings.Join(insecureHosts, ", "))
+	}
+	logger.Warnf("TLS certificate verification is disabled; the relay will trust any certificate presented by https targets %v", strings.Join(insecureHosts, ", "))
+
+	return nil
+}
+
+// httpsTargetHosts returns the hosts of all of the https targets the relay is
+// configured to use, without duplicates.
+func httpsTargetHosts(relayOptions *traffic.RelayOptions) []string {
+	targets := append([]*traffic.Target{relayOptions.ShadowTarget}, routedTargets(relayOptions)...)
+
+	var hosts []string
+	seen := map[string]bool{}
+	for _, target := range targets {
+		if target != nil && target.Scheme == "https" && !seen[target.Host] {
+			seen[target.Host] = true
+			hosts = append(hosts, target.Host)
+		}
+	}
+	return hosts
+}
+
+// routedTargets returns every target to which client requests may be routed:
+// the default targets, and the targets of host routes, path routes, and split
+// buckets. The shadow target isn't included.
+func routedTargets(relayOptions *traffic.RelayOptions) []*traffic.Target {
+	targets := append([]*traffic.Target{}, relayOptions.Targets...)
+	for _, route := range relayOptions.HostRoutes {
+		targets = append(targets, route.Target)
+	}
+	for _, route := range relayOptions.PathRoutes {
+		targets = append(targets, route.Target)
+	}
+	for _, bucket := range relayOptions.SplitBuckets {
+		targets = append(targets, bucket.Target)
+	}
+	return targets
+}
+
+// hostMapEntry is the configuration file representation of a host route.
+type hostMapEntry struct {
+	Host                  string
+	Target                string
+	OriginMode            string `yaml:"origin-mode"`
+	DialTimeout           string `yaml:"dial-timeout"`
+	RequestTimeout        string `yaml:"request-timeout"`
+	ResponseHeaderTimeout string `yaml:"response-header-timeout"`
+}
+
+// readHostMap reads the 'host-map' option, which routes requests for particular
+// hosts to specific targets. It may be provided as a YAML list of objects with
+// 'host' and 'target' properties, and optionally 'origin-mode' and timeout
+// properties, or as a comma-separated string of "host=target" pairs, which is
+// convenient when the value comes from an environment variable.
+func readHostMap(configSection *config.Section) ([]*traffic.HostRoute, error) {
+	var entries []hostMapEntry
+	if values, err := config.LookupOptional[[]hostMapEntry](configSection, "host-map"); err == nil {
+		if values != nil {
+			entries = *values
+		}
+	} else if value, err := config.LookupOptional[string](configSection, "host-map"); err != nil {
+		return nil, err
+	} else if value != nil {
+		pairs, err := parsePairList(*value, "Host map entry", "host=target")
+		if err != nil {
+			return nil, err
+		}
+		for _, pair := range pairs {
+			entries = append(entries, hostMapEntry{Host: pair[0], Target: pair[1]})
+		}
+	}
+
+	var routes []*traffic.HostRoute
+	for _, entry := range entries {
+		if entry.Host == "" {
+			return nil, fmt.Errorf(`Host map entry for target "%v" has no host`, entry.Target)
+		}
+		if strings.Contains(strings.TrimPrefix(entry.Host, "*"), "*") ||
+			(strings.HasPrefix(entry.Host, "*") && !strings.HasPrefix(entry.Host, "*.")) {
+			return nil, fmt.Errorf(`Invalid host pattern "%v"; wildcards must have the form "*.example.com"`, entry.Host)
+		}
+		target, err := parseTarget(entry.Target)
+		if err != nil {
+			return nil, err
+		}
+		var originMode traffic.OriginMode
+		if entry.OriginMode != "" {
+			if originMode, err = traffic.ParseOriginMode(entry.OriginMode); err != nil {
+				return nil, fmt.Errorf(`Invalid host map entry for "%v": %v`, entry.Host, err)
+			}
+		}
+		route := &traffic.HostRoute{
+			OriginMode: originMode,
+			Pattern:    entry.Host,
+			Target:     target,
+		}
+		for _, timeout := range []struct {
+			key   string
+			value string
+			field *time.Duration
+		}{
+			{"dial-timeout", entry.DialTimeout, &route.DialTimeout},
+			{"request-timeout", entry.RequestTimeout, &route.RequestTimeout},
+			{"response-header-timeout", entry.ResponseHeaderTimeout, &route.ResponseHeaderTimeout},
+		} {
+			if timeout.value == "" {
+				continue
+			}
+			duration, err := time.ParseDuration(timeout.value)
+			if err != nil || duration < 0 {
+				return nil, fmt.Errorf(`Invalid host map entry for "%v": "%v" must be a non-negative duration: %v`, entry.Host, timeout.key, timeout.value)
+			}
+			*timeout.field = duration
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// pathMapEntry is the configuration file representation of a path route.
+type pathMapEntry struct {
+	Path        string
+	Target      string
+	StripPrefix bool `yaml:"strip-prefix"`
+}
+
+// readPathMap reads the 'path-map' option, which routes requests for particular
+// path prefixes to specific targets. Like the host map, it may be provided as a
+// YAML list of objects with 'path' and 'target' properties, and optionally a
+// 'strip-prefix' property, or as a comma-separated string of "path=target"
+// pairs.
+func readPathMap(configSection *config.Section) ([]*traffic.PathRoute, error) {
+	var entries []pathMapEntry
+	if values, err := config.LookupOptional[[]pathMapEntry](configSection, "path-map"); err == nil {
+		if values != nil {
+			entries = *values
+		}
+	} else if value, err := config.LookupOptional[string](configSection, "path-map"); err != nil {
+		return nil, err
+	} else if value != nil {
+		pairs, err := parsePairList(*value, "Path map entry", "path=target")
+		if err != nil {
+			return nil, err
+		}
+		for _, pair := range pairs {
+			entries = append(entries, pathMapEntry{Path: pair[0], Target: pair[1]})
+		}
+	}
+
+	var routes []*traffic.PathRoute
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Path, "/") {
+			return nil, fmt.Errorf(`Path map entry for target "%v" must have a path starting with "/": %v`, entry.Target, entry.Path)
+		}
+		target, err := parseTarget(entry.Target)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, &traffic.PathRoute{
+			Prefix:      entry.Path,
+			StripPrefix: entry.StripPrefix,
+			Target:      target,
+		})
+	}
+	return routes, nil
+}
+
+// parsePairList parses a comma-separated list of "key=value" pairs, as used by
+// options like 'host-map' when they're provided as a string. Whitespace around
+// keys and values is ignored, and empty items are skipped. Errors describe the
+// offending item using the provided noun and expected form.
+func parsePairList(value string, noun string, form string) ([][2]string, error) {
+	var pairs [][2]string
+	for _, item := range splitList(value) {
+		key, pairValue, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf(`%v "%v" must have the form "%v"`, noun, item, form)
+		}
+		pairs = append(pairs, [2]string{strings.TrimSpace(key), strings.TrimSpace(pairValue)})
+	}
+	return pairs, nil
+}
+
+// parseBodyReplacement parses a literal body replacement of the form
+// "from=>to". The text to replace must not be empty, but the replacement may
+// be.
+func parseBodyReplacement(value string) (traffic.BodyReplacement, error) {
+	from, to, found := strings.Cut(value, "=>")
+	if !found || from == "" {
+		return traffic.BodyReplacement{}, fmt.Errorf(`Option "body-replace" must contain "from=>to" pairs: %v`, value)
+	}
+	return traffic.BodyReplacement{From: []byte(from), To: []byte(to)}, nil
+}
+
+// parseTargetList parses the 'target' option: a comma-separated list of
+// targets, each of which may be followed by "|" and its weight, as accepted by
+// parseWeightedTarget.
+func parseTargetList(value string) ([]*traffic.Target, error) {
+	var targets []*traffic.Target
+	for _, targetValue := range strings.Split(value, ",") {
+		target, err := parseWeightedTarget(strings.TrimSpace(targetValue))
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// parseWeightedTarget parses a target URL which may be followed by "|" and a
+// positive integer weight, as in "https://relay-target.example|80". Targets
+// without a weight are left with a zero Weight, which is treated as 1.
+func parseWeightedTarget(value string) (*traffic.Target, error) {
+	weight := 0
+	if separator := strings.LastIndex(value, "|"); separator >= 0 {
+		var err error
+		weight, err = strconv.Atoi(strings.TrimSpace(value[separator+1:]))
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf(`Target "%v" must have a positive integer weight`, value)
+		}
+		value = strings.TrimSpace(value[:separator])
+	}
+
+	target, err := parseTarget(value)
+	if err != nil {
+		return nil, err
+	}
+	target.Weight = weight
+	return target, nil
+}
+
+// parseSplitBucket parses a range of split header buckets and the target they're
+// relayed to, as in "0-49=https://a.relay-target.example". A single bucket may
+// be given without a range, as in "7=https://b.relay-target.example".
+func parseSplitBucket(value string) (*traffic.SplitBucket, error) {
+	buckets, targetValue, found := strings.Cut(value, "=")
+	if !found {
+		return nil, fmt.Errorf(`Split bucket "%v" must have the form "first-last=target"`, value)
+	}
+	firstValue, lastValue, isRange := strings.Cut(strings.TrimSpace(buckets), "-")
+	if !isRange {
+		lastValue = firstValue
+	}
+	first, err := strconv.Atoi(firstValue)
+	if err != nil {
+		return nil, fmt.Errorf(`Split bucket "%v" must start with a bucket number or range`, value)
+	}
+	last, err := strconv.Atoi(lastValue)
+	if err != nil {
+		return nil, fmt.Errorf(`Split bucket "%v" must start with a bucket number or range`, value)
+	}
+	if first < 0 || last >= traffic.SplitBucketCount || first > last {
+		return nil, fmt.Errorf(`Split bucket "%v" must name buckets from 0 to %v in ascending order`, value, traffic.SplitBucketCount-1)
+	}
+
+	target, err := parseTarget(strings.TrimSpace(targetValue))
+	if err != nil {
+		return nil, err
+	}
+	return &traffic.SplitBucket{First: first, Last: last, Target: target}, nil
+}
+
+// parseTarget parses a target URL, which must include a scheme and a host. If
+// it includes a path, other than "/", the path is prepended to the path of each
+// request relayed to the target.
+//
+// A target may also be a Unix socket, written as "unix:///path/to/socket". HTTP
+// requests are sent over the socket with the Host header set to "localhost",
+// or to the value of the URL's "host" query parameter if it's provided, as in
+// "unix:///path/to/socket?host=backend.example".
+func parseTarget(value string) (*traffic.Target, error) {
+	if targetURL, err := url.Parse(value); err != nil {
+		return nil, err
+	} else if targetURL.Scheme == "unix" {
+		if targetURL.Host != "" || targetURL.Path == "" {
+			return nil, fmt.Errorf(`Unix socket target "%v" must have the form "unix:///path/to/socket"`, value)
+		}
+		host := targetURL.Query().Get("host")
+		if host == "" {
+			host = "localhost"
+		}
+		return &traffic.Target{
+			Host:       host,
+			Scheme:     "http",
+			SocketPath: targetURL.Path,
+		}, nil
+	} else if targetURL.Scheme == "" {
+		return nil, fmt.Errorf(`Target URL "%v" has no scheme; expected a URL like "https://relay-target.example"`, value)
+	} else if targetURL.Host == "" {
+		return nil, fmt.Errorf(`Target URL "%v" has no host; expected a URL like "https://relay-target.example"`, value)
+	} else {
+		return &traffic.Target{
+			Host:   targetURL.Host,
+			Path:   strings.TrimSuffix(targetURL.Path, "/"),
+			Scheme: targetURL.Scheme,
+		}, nil
+	}
+}
+
+// lookupCIDRs reads a list of CIDR ranges, as accepted by parseCIDR, from the
+// provided configuration section.
+func lookupCIDRs(section *config.Section, key string) ([]*net.IPNet, error) {
+	values, err := lookupList(section, key)
+	if err != nil {
+		return nil, err
+	}
+	var networks []*net.IPNet
+	for _, value := range values {
+		network, err := parseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf(`Option "%v" must list IP addresses or CIDR ranges: %v`, key, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// parseCIDR parses a CIDR range like "10.0.0.0/8" or "2001:db8::/32". A single
+// IP address is also accepted, and is treated as a range containing only that
+// address.
+func parseCIDR(value string) (*net.IPNet, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
+
+// lookupList reads a list of strings from the provided configuration section.
+// The list may be provided either as a YAML list or as a comma-separated
+// string, which is convenient when the value comes from an environment
+// variable. Empty items are ignored. If the option is not present, nil is
+// returned.
+func lookupList(section *config.Section, key string) ([]string, error) {
+	if values, err := config.LookupOptional[[]string](section, key); err == nil {
+		if values == nil {
+			return nil, nil
+		}
+		return splitList(strings.Join(*values, ",")), nil
+	}
+
+	value, err := config.LookupOptional[string](section, key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return splitList(*value), nil
+}
+
+// splitList splits a comma-separated string into its non-empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// lookupDuration reads a duration, expressed as a Go duration string like
+// "30s" or "1m30s", from the provided configuration section. If the option is
+// not present, nil is returned. If the option is present but can't be parsed
+// as a duration, a warning is logged and nil is returned, so that the default
+// value will be used.
+func lookupDuration(section *config.Section, key string) (*time.Duration, error) {
+	value, err := config.LookupOptional[string](section, key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+
+	duration, err := time.ParseDuration(*value)
+	if err != nil {
+		logger.Warnf("Ignoring invalid duration %q for configuration option %q: %v", *value, key, err)
+		return nil, nil
+	}
+
+	return &duration, nil
 }
@@ -0,0 +1,929 @@
+package relay_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/config"
+	"github.com/fullstorydev/relay-core/relay/logging"
+	"github.com/fullstorydev/relay-core/relay/traffic"
+)
+
+func TestIdleConnTimeout(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		config   string
+		expected time.Duration
+	}{
+		{
+			desc: "The default is used if no value is provided",
+			config: `relay:
+                        port: 8990
+                        target: http://example.com
+            `,
+			expected: traffic.DefaultIdleConnTimeout,
+		},
+		{
+			desc: "Valid durations are parsed",
+			config: `relay:
+                        port: 8990
+                        target: http://example.com
+                        idle-conn-timeout: 1m30s
+            `,
+			expected: 90 * time.Second,
+		},
+		{
+			desc: "The default is used if the value can't be parsed",
+			config: `relay:
+                        port: 8990
+                        target: http://example.com
+                        idle-conn-timeout: forever
+            `,
+			expected: traffic.DefaultIdleConnTimeout,
+		},
+	}
+
+	for _, testCase := range testCases {
+		options, err := readOptions(testCase.config)
+		if err != nil {
+			t.Errorf("Test '%v': Error reading options: %v", testCase.desc, err)
+			continue
+		}
+
+		if options.Relay.IdleConnTimeout != testCase.expected {
+			t.Errorf(
+				"Test '%v': Expected idle connection timeout '%v' but got '%v'",
+				testCase.desc,
+				testCase.expected,
+				options.Relay.IdleConnTimeout,
+			)
+		}
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		config   string
+		expected time.Duration
+	}{
+		{
+			desc: "There's no timeout by default",
+			config: `relay:
+                        port: 8990
+                        target: http://example.com
+            `,
+			expected: 0,
+		},
+		{
+			desc: "Valid durations are parsed",
+			config: `relay:
+                        port: 8990
+                        target: http://example.com
+                        response-header-timeout: 1m30s
+            `,
+			expected: 90 * time.Second,
+		},
+	}
+
+	for _, testCase := range testCases {
+		options, err := readOptions(testCase.config)
+		if err != nil {
+			t.Errorf("Test '%v': Error reading options: %v", testCase.desc, err)
+			continue
+		}
+
+		if options.Relay.ResponseHeaderTimeout != testCase.expected {
+			t.Errorf(
+				"Test '%v': Expected response header timeout '%v' but got '%v'",
+				testCase.desc,
+				testCase.expected,
+				options.Relay.ResponseHeaderTimeout,
+			)
+		}
+	}
+}
+
+func TestConnectionPoolOptions(t *testing.T) {
+	options, err := readOptions(`relay:
+                                    port: 8990
+                                    target: http://example.com
+    `)
+	if err != nil {
+		t.Errorf("Error reading options: %v", err)
+		return
+	}
+	if options.Relay.MaxIdleConns != traffic.DefaultMaxIdleConns ||
+		options.Relay.MaxIdleConnsPerHost != traffic.DefaultMaxIdleConnsPerHost ||
+		options.Relay.MaxConnsPerHost != 0 {
+		t.Errorf("Expected default connection pool options but got %+v", options.Relay)
+	}
+
+	options, err = readOptions(`relay:
+                                   port: 8990
+                                   target: http://example.com
+                                   max-idle-conns: 1000
+                                   max-idle-conns-per-host: 500
+                                   max-conns-per-host: 750
+    `)
+	if err != nil {
+		t.Errorf("Error reading options: %v", err)
+		return
+	}
+	if options.Relay.MaxIdleConns != 1000 ||
+		options.Relay.MaxIdleConnsPerHost != 500 ||
+		options.Relay.MaxConnsPerHost != 750 {
+		t.Errorf("Expected configured connection pool options but got %+v", options.Relay)
+	}
+}
+
+func TestInvalidTarget(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		target string
+	}{
+		{
+			desc:   "A missing target is rejected",
+			target: ``,
+		},
+		{
+			desc:   "An empty target is rejected",
+			target: `''`,
+		},
+		{
+			desc:   "A target with only a scheme is rejected",
+			target: `'https://'`,
+		},
+		{
+			desc:   "A target with only a host is rejected",
+			target: `relay-target.example`,
+		},
+		{
+			desc:   "A target with a non-numeric weight is rejected",
+			target: `'http://relay-target.example|heavy'`,
+		},
+		{
+			desc:   "A target with a zero weight is rejected",
+			target: `'http://relay-target.example|0'`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		_, err := readOptions(`relay:
+                                  port: 8990
+                                  target: ` + testCase.target)
+		if err == nil {
+			t.Errorf("Test '%v': Expected an error for target '%v'", testCase.desc, testCase.target)
+		}
+	}
+}
+
+func TestNegativeMaxRetries(t *testing.T) {
+	_, err := readOptions(`relay:
+                              port: 8990
+                              target: http://example.com
+                              max-retries: -1
+    `)
+	if err == nil {
+		t.Errorf("Expected an error for a negative max-retries value")
+	}
+}
+
+func TestNegativeRetryBufferLimit(t *testing.T) {
+	_, err := readOptions(`relay:
+                              port: 8990
+                              target: http://example.com
+                              retry-buffer-limit: -1
+    `)
+	if err == nil {
+		t.Errorf("Expected an error for a negative retry-buffer-limit value")
+	}
+}
+
+func TestNegativeMaxConcurrent(t *testing.T) {
+	_, err := readOptions(`relay:
+                              port: 8990
+                              target: http://example.com
+                              max-concurrent: -1
+    `)
+	if err == nil {
+		t.Errorf("Expected an error for a negative max-concurrent value")
+	}
+}
+
+func TestInvalidRequestHeaderWhitelist(t *testing.T) {
+	_, err := readOptions(`relay:
+                              port: 8990
+                              target: http://example.com
+                              request-header-whitelist: Accept,Not A Header
+    `)
+	if err == nil {
+		t.Errorf("Expected an error for an invalid request-header-whitelist value")
+	}
+}
+
+func TestHMACOptionsSetTogether(t *testing.T) {
+	_, err := readOptions(`relay:
+                              port: 8990
+                              target: http://example.com
+                              hmac-secret: s3cret
+    `)
+	if err == nil {
+		t.Errorf("Expected an error for hmac-secret without hmac-header")
+	}
+}
+
+func TestInvalidForceClientScheme(t *testing.T) {
+	_, err := readOptions(`relay:
+                              port: 8990
+                              target: http://example.com
+                              force-client-scheme: ftp
+    `)
+	if err == nil {
+		t.Errorf("Expected an error for an invalid force-client-scheme value")
+	}
+}
+
+func TestInvalidRetryOnStatus(t *testing.T) {
+	for _, value := range []string{"503,abc", "99", "600"} {
+		_, err := readOptions(fmt.Sprintf(`relay:
+                                  port: 8990
+                                  target: http://example.com
+                                  retry-on-status: '%v'
+        `, value))
+		if err == nil {
+			t.Errorf("Expected an error for retry-on-status value '%v'", value)
+		}
+	}
+}
+
+func TestInvalidHostMap(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		hostMap string
+	}{
+		{
+			desc:    "Entries must include a target",
+			hostMap: `a.example.com`,
+		},
+		{
+			desc:    "Targets must be valid",
+			hostMap: `a.example.com=backend-a.example`,
+		},
+		{
+			desc:    "Wildcards must be a prefix of the form '*.'",
+			hostMap: `'*example.com=http://backend-a.example'`,
+		},
+		{
+			desc:    "Wildcards may only appear at the start",
+			hostMap: `'a.*.example.com=http://backend-a.example'`,
+		},
+		{
+			desc:    "Origin modes must be valid",
+			hostMap: `[{host: a.example.com, target: 'http://backend-a.example', origin-mode: sideways}]`,
+		},
+		{
+			desc:    "Timeouts must be durations",
+			hostMap: `[{host: a.example.com, target: 'http://backend-a.example', dial-timeout: soon}]`,
+		},
+		{
+			desc:    "Timeouts must not be negative",
+			hostMap: `[{host: a.example.com, target: 'http://backend-a.example', request-timeout: -1s}]`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		_, err := readOptions(`relay:
+                                  port: 8990
+                                  target: http://example.com
+                                  host-map: ` + testCase.hostMap)
+		if err == nil {
+			t.Errorf("Test '%v': Expected an error for host map '%v'", testCase.desc, testCase.hostMap)
+		}
+	}
+}
+
+func TestInvalidPathMap(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		pathMap string
+	}{
+		{
+			desc:    "Entries must include a target",
+			pathMap: `/api`,
+		},
+		{
+			desc:    "Targets must be valid",
+			pathMap: `/api=backend-a.example`,
+		},
+		{
+			desc:    "Paths must start with a slash",
+			pathMap: `api=http://backend-a.example`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		_, err := readOptions(`relay:
+                                  port: 8990
+                                  target: http://example.com
+                                  path-map: ` + testCase.pathMap)
+		if err == nil {
+			t.Errorf("Test '%v': Expected an error for path map '%v'", testCase.desc, testCase.pathMap)
+		}
+	}
+}
+
+func TestUnixSocketTargets(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		target   string
+		expected *traffic.Target
+	}{
+		{
+			desc:     "Unix socket targets use localhost as the host by default",
+			target:   "unix:///var/run/backend.sock",
+			expected: &traffic.Target{Host: "localhost", Scheme: "http", SocketPath: "/var/run/backend.sock"},
+		},
+		{
+			desc:     "Unix socket targets may specify a host",
+			target:   "unix:///var/run/backend.sock?host=backend.example",
+			expected: &traffic.Target{Host: "backend.example", Scheme: "http", SocketPath: "/var/run/backend.sock"},
+		},
+		{
+			desc:     "Unix socket targets must have an absolute path",
+			target:   "unix://var/run/backend.sock",
+			expected: nil,
+		},
+		{
+			desc:     "Unix socket targets must have a path",
+			target:   "unix://",
+			expected: nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		options, err := readOptions(fmt.Sprintf(`relay:
+                                                    port: 8990
+                                                    target: '%v'
+        `, testCase.target))
+
+		if testCase.expected == nil {
+			if err == nil {
+				t.Errorf("Test '%v': Expected an error for target '%v'", testCase.desc, testCase.target)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test '%v': Error reading options: %v", testCase.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(options.Relay.Targets, []*traffic.Target{testCase.expected}) {
+			t.Errorf("Test '%v': Expected target %+v but got %+v", testCase.desc, testCase.expected, options.Relay.Targets[0])
+		}
+	}
+}
+
+func TestInvalidRateLimit(t *testing.T) {
+	for _, option := range []string{"rate-limit", "rate-burst"} {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: http://localhost
+                                      port: 8990
+                                      %v: -1
+        `, option)
+		if _, err := readOptions(configYaml); err == nil {
+			t.Errorf("Expected an error for a negative %v", option)
+		}
+	}
+}
+
+func TestInvalidWebSocketBufferSize(t *testing.T) {
+	for _, size := range []int{0, traffic.MinWebSocketBufferSize - 1, traffic.MaxWebSocketBufferSize + 1} {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: http://localhost
+                                      port: 8990
+                                      ws-buffer-size: %v
+        `, size)
+		if _, err := readOptions(configYaml); err == nil {
+			t.Errorf("Expected an error for a websocket buffer size of %v", size)
+		}
+	}
+}
+
+func TestInvalidUpstreamProxy(t *testing.T) {
+	for _, proxy := range []string{"ftp://proxy.example", "http://"} {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: http://localhost
+                                      port: 8990
+                                      upstream-proxy: '%v'
+        `, proxy)
+		if _, err := readOptions(configYaml); err == nil {
+			t.Errorf("Expected an error for upstream proxy '%v'", proxy)
+		}
+	}
+}
+
+func TestIncompleteBasicAuth(t *testing.T) {
+	for _, option := range []string{"basic-auth-user", "basic-auth-pass"} {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: http://localhost
+                                      port: 8990
+                                      %v: secret
+        `, option)
+		if _, err := readOptions(configYaml); err == nil {
+			t.Errorf("Expected an error if only %v is set", option)
+		}
+	}
+}
+
+func TestInvalidCIDRs(t *testing.T) {
+	for _, option := range []string{"allow-cidrs", "deny-cidrs"} {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: http://localhost
+                                      port: 8990
+                                      %v: 10.0.0.0/8,10.0.0.0/33
+        `, option)
+		if _, err := readOptions(configYaml); err == nil {
+			t.Errorf("Expected an error for an invalid range in %v", option)
+		}
+	}
+}
+
+func TestInvalidRelayID(t *testing.T) {
+	for _, relayID := range []string{"relay one", "relay,one"} {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: http://localhost
+                                      port: 8990
+                                      relay-id: '%v'
+        `, relayID)
+		if _, err := readOptions(configYaml); err == nil {
+			t.Errorf("Expected an error for relay ID '%v'", relayID)
+		}
+	}
+}
+
+func TestInvalidConnectAddress(t *testing.T) {
+	for _, connectAddress := range []string{"10.0.0.12", "http://10.0.0.12:443"} {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: https://relay-target.example
+                                      port: 8990
+                                      connect-addr: '%v'
+        `, connectAddress)
+		if _, err := readOptions(configYaml); err == nil {
+			t.Errorf("Expected an error for connect address '%v'", connectAddress)
+		}
+	}
+}
+
+func TestInvalidErrorFormat(t *testing.T) {
+	configYaml := `relay:
+                       target: https://relay-target.example
+                       port: 8990
+                       error-format: xml
+    `
+	if _, err := readOptions(configYaml); err == nil {
+		t.Errorf("Expected an error for error format 'xml'")
+	}
+}
+
+func TestInvalidMaintenanceStatus(t *testing.T) {
+	for _, status := range []int{101, 600} {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: https://relay-target.example
+                                      port: 8990
+                                      maintenance-status: %v
+        `, status)
+		if _, err := readOptions(configYaml); err == nil {
+			t.Errorf("Expected an error for maintenance status %v", status)
+		}
+	}
+}
+
+func TestInvalidSplitBuckets(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		options string
+	}{
+		{
+			desc:    "Buckets without a header",
+			options: "split-buckets: 0-49=https://a.relay-target.example",
+		},
+		{
+			desc:    "A header without buckets",
+			options: "split-header: X-User-ID",
+		},
+		{
+			desc:    "A bucket out of range",
+			options: "split-header: X-User-ID\nsplit-buckets: 50-100=https://a.relay-target.example",
+		},
+		{
+			desc:    "A descending range",
+			options: "split-header: X-User-ID\nsplit-buckets: 49-0=https://a.relay-target.example",
+		},
+		{
+			desc:    "Overlapping ranges",
+			options: "split-header: X-User-ID\nsplit-buckets: 0-49=https://a.relay-target.example,40-59=https://b.relay-target.example",
+		},
+		{
+			desc:    "A bucket without a target",
+			options: "split-header: X-User-ID\nsplit-buckets: 0-49",
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := "relay:\n  target: https://relay-target.example\n  port: 8990\n" +
+			"  " + strings.ReplaceAll(testCase.options, "\n", "\n  ") + "\n"
+		if _, err := readOptions(configYaml); err == nil {
+			t.Errorf("Test '%v': Expected an error", testCase.desc)
+		}
+	}
+}
+
+func TestIncompleteTLSClientCertificate(t *testing.T) {
+	for _, option := range []string{"tls-client-cert-file", "tls-client-key-file"} {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: https://localhost
+                                      port: 8990
+                                      %v: client.pem
+        `, option)
+		if _, err := readOptions(configYaml); err == nil {
+			t.Errorf("Expected an error if only %v is set", option)
+		}
+	}
+}
+
+func TestInsecureTLS(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		config         string
+		expectError    bool
+		expectedOutput string
+	}{
+		{
+			desc: "A warning names the https targets which aren't verified",
+			config: `relay:
+                        port: 8990
+                        target: https://secure.example
+                        tls-verify: false
+            `,
+			expectedOutput: "https targets secure.example",
+		},
+		{
+			desc: "The relay refuses to start if insecure TLS is refused",
+			config: `relay:
+                        port: 8990
+                        target: https://secure.example
+                        tls-verify: false
+                        refuse-insecure: true
+            `,
+			expectError: true,
+		},
+		{
+			desc: "The warning names https split bucket targets",
+			config: `relay:
+                        port: 8990
+                        target: http://plain.example
+                        split-header: X-User-ID
+                        split-buckets: 0-9=https://variant.example
+                        tls-verify: false
+            `,
+			expectedOutput: "https targets variant.example",
+		},
+		{
+			desc: "The relay refuses to start if a split bucket target is insecure",
+			config: `relay:
+                        port: 8990
+                        target: http://plain.example
+                        split-header: X-User-ID
+                        split-buckets: 0-9=https://variant.example
+                        tls-verify: false
+                        refuse-insecure: true
+            `,
+			expectError: true,
+		},
+		{
+			desc: "Refusing insecure TLS has no effect without https targets",
+			config: `relay:
+                        port: 8990
+                        target: http://plain.example
+                        tls-verify: false
+                        refuse-insecure: true
+            `,
+			expectedOutput: "TLS certificate verification is disabled",
+		},
+		{
+			desc: "Refusing insecure TLS has no effect if verification is enabled",
+			config: `relay:
+                        port: 8990
+                        target: https://secure.example
+                        refuse-insecure: true
+            `,
+		},
+	}
+
+	defer logging.SetOutput(os.Stdout)
+
+	for _, testCase := range testCases {
+		output := &bytes.Buffer{}
+		logging.SetOutput(output)
+
+		_, err := readOptions(testCase.config)
+		if testCase.expectError {
+			if err == nil {
+				t.Errorf("Test '%v': Expected an error", testCase.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test '%v': Error reading options: %v", testCase.desc, err)
+			continue
+		}
+
+		warned := strings.Contains(output.String(), "TLS certificate verification is disabled")
+		if testCase.expectedOutput == "" && warned {
+			t.Errorf("Test '%v': Expected no warning but got log output:\n%v", testCase.desc, output.String())
+		} else if !strings.Contains(output.String(), testCase.expectedOutput) {
+			t.Errorf("Test '%v': Expected a warning containing '%v' but got log output:\n%v", testCase.desc, testCase.expectedOutput, output.String())
+		}
+	}
+}
+
+// The fuzz tests below pass arbitrary strings to options which are commonly
+// provided as structured environment variables. Reading the options must never
+// panic, and must either fail or produce values which satisfy the invariants
+// the rest of the relay relies on. Run one with e.g.:
+//
+//	go test ./relay -run '^$' -fuzz FuzzHostMapOption
+
+func TestLogOptions(t *testing.T) {
+	defer logging.SetFormat(logging.TextFormat)
+	defer logging.SetLevel(logging.InfoLevel)
+
+	options, err := readOptions(`relay:
+                                    port: 8990
+                                    target: http://example.com
+                                    log-format: json
+                                    log-level: debug
+    `)
+	if err != nil {
+		t.Fatalf("Error reading options: %v", err)
+	}
+	if logging.Enabled(logging.DebugLevel) {
+		t.Errorf("Expected the log level not to change while reading options")
+	}
+	if options.Service.LogFormat == nil || *options.Service.LogFormat != logging.JSONFormat {
+		t.Errorf("Expected log format %v but got %v", logging.JSONFormat, options.Service.LogFormat)
+	}
+
+	relay.ApplyLogOptions(options.Service)
+	if !logging.Enabled(logging.DebugLevel) {
+		t.Errorf("Expected the log level to change once the log options are applied")
+	}
+}
+
+func TestInvalidOptionsDontOpenAccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	_, err := readOptions(fmt.Sprintf(`relay:
+                                          port: 8990
+                                          target: http://example.com
+                                          access-log: %v
+                                          max-retries: -1
+    `, path))
+	if err == nil {
+		t.Fatalf("Expected an error for a negative max-retries value")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the access log not to be opened, but got: %v", err)
+	}
+}
+
+func TestStartTracing(t *testing.T) {
+	options, err := readOptions(`relay:
+                                    port: 8990
+                                    target: http://example.com
+                                    otel-enabled: true
+    `)
+	if err != nil {
+		t.Fatalf("Error reading options: %v", err)
+	}
+	if !options.Service.OTelEnabled {
+		t.Errorf("Expected OpenTelemetry tracing to be enabled")
+	}
+	if options.Relay.Tracer != nil {
+		t.Errorf("Expected no tracer to be started while reading options")
+	}
+
+	// The exporter's configuration is only checked once it's started.
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc")
+	if err := relay.StartTracing(options); err == nil {
+		t.Errorf("Expected an error for an unsupported OTLP protocol")
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "http/json")
+	if err := relay.StartTracing(options); err != nil {
+		t.Fatalf("Error starting tracing: %v", err)
+	}
+	if options.Relay.Tracer == nil {
+		t.Fatalf("Expected a tracer to be started")
+	}
+	if err := options.Relay.Tracer.Shutdown(context.Background()); err != nil {
+		t.Errorf("Error shutting down tracer: %v", err)
+	}
+}
+
+func FuzzTargetOption(f *testing.F) {
+	for _, seed := range []string{
+		"http://example.com",
+		"https://a.example|80, https://b.example|20",
+		"unix:///tmp/relay.sock?host=backend.example",
+		"http://example.com|0",
+		"http://example.com|",
+		"|",
+		",",
+		"example.com",
+		"http://[::1",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		options, err := readOptionsWithValues(map[string]string{"target": value})
+		if err != nil {
+			return
+		}
+		if len(options.Relay.Targets) == 0 {
+			t.Errorf("Expected at least one target for %q", value)
+		}
+		for _, target := range options.Relay.Targets {
+			if target.Host == "" || target.Scheme == "" || target.Weight < 0 {
+				t.Errorf("Invalid target %#v for %q", target, value)
+			}
+		}
+	})
+}
+
+func FuzzHostMapOption(f *testing.F) {
+	for _, seed := range []string{
+		"api.example.com=http://api.internal",
+		"*.example.com=http://wildcard.internal, other.example=unix:///tmp/s.sock",
+		"api.example.com",
+		"=http://api.internal",
+		"**.example.com=http://api.internal",
+		"*example.com=http://api.internal",
+		"api.example.com==",
+		",,",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		options, err := readOptionsWithValues(map[string]string{"host-map": value})
+		if err != nil {
+			return
+		}
+		for _, route := range options.Relay.HostRoutes {
+			if route.Pattern == "" || route.Target == nil || route.Target.Host == "" {
+				t.Errorf("Invalid host route %#v for %q", route, value)
+			}
+		}
+	})
+}
+
+func FuzzPathMapOption(f *testing.F) {
+	for _, seed := range []string{
+		"/api=http://api.internal",
+		"/api/v1=http://v1.internal, /=http://default.internal",
+		"api=http://api.internal",
+		"/api",
+		"/api=",
+		"=",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		options, err := readOptionsWithValues(map[string]string{"path-map": value})
+		if err != nil {
+			return
+		}
+		for _, route := range options.Relay.PathRoutes {
+			if !strings.HasPrefix(route.Prefix, "/") || route.Target == nil || route.Target.Host == "" {
+				t.Errorf("Invalid path route %#v for %q", route, value)
+			}
+		}
+	})
+}
+
+func FuzzSplitBucketsOption(f *testing.F) {
+	for _, seed := range []string{
+		"0-49=http://a.example, 50-99=http://b.example",
+		"7=http://b.example",
+		"0-49=http://a.example, 40-60=http://b.example",
+		"50-10=http://a.example",
+		"0-100=http://a.example",
+		"-1=http://a.example",
+		"x-y=http://a.example",
+		"0-49",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		options, err := readOptionsWithValues(map[string]string{
+			"split-header":  "X-Split",
+			"split-buckets": value,
+		})
+		if err != nil {
+			return
+		}
+		if len(options.Relay.SplitBuckets) == 0 {
+			t.Errorf("Expected at least one split bucket for %q", value)
+		}
+		for _, bucket := range options.Relay.SplitBuckets {
+			if bucket.First < 0 || bucket.Last >= traffic.SplitBucketCount || bucket.First > bucket.Last || bucket.Target == nil {
+				t.Errorf("Invalid split bucket %#v for %q", bucket, value)
+			}
+		}
+	})
+}
+
+func FuzzBodyReplaceOption(f *testing.F) {
+	for _, seed := range []string{
+		"internal.example=>public.example",
+		"secret=>, token=>***",
+		"=>empty",
+		"no arrow",
+		"a=>b=>c",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		options, err := readOptionsWithValues(map[string]string{"body-replace": value})
+		if err != nil {
+			return
+		}
+		for _, replacement := range options.Relay.BodyReplacements {
+			if len(replacement.From) == 0 {
+				t.Errorf("Invalid body replacement %#v for %q", replacement, value)
+			}
+		}
+	})
+}
+
+func FuzzAllowCIDRsOption(f *testing.F) {
+	for _, seed := range []string{
+		"10.0.0.0/8, 192.168.1.1",
+		"2001:db8::/32, ::1",
+		"10.0.0.0/33",
+		"not-an-ip",
+		"/",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		options, err := readOptionsWithValues(map[string]string{"allow-cidrs": value})
+		if err != nil {
+			return
+		}
+		for _, network := range options.Relay.AllowCIDRs {
+			if network == nil || network.IP == nil || network.Mask == nil {
+				t.Errorf("Invalid network %#v for %q", network, value)
+			}
+		}
+	})
+}
+
+// readOptionsWithValues reads options from a "relay" section containing the
+// provided values, which are set as strings, just as they would be if they
+// came from environment variables. A target is provided if none is given.
+// Log output is discarded, since fuzzing generates a great deal of it.
+func readOptionsWithValues(values map[string]string) (*relay.Options, error) {
+	logging.SetOutput(io.Discard)
+	defer logging.SetOutput(os.Stdout)
+
+	configFile := config.NewFile()
+	section := configFile.GetOrAddSection("relay")
+	section.Set("target", "http://example.com")
+	for key, value := range values {
+		section.Set(key, value)
+	}
+	return relay.ReadOptions(configFile)
+}
+
+func readOptions(configYaml string) (*relay.Options, error) {
+	configFile, err := config.NewFileFromYamlString(configYaml)
+	if err != nil {
+		return nil, err
+	}
+	return relay.ReadOptions(configFile)
+}
@@ -26,13 +26,12 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"os"
 	"regexp"
 	"strconv"
 
 	"github.com/fullstorydev/relay-core/relay/config"
+	"github.com/fullstorydev/relay-core/relay/logging"
 	"github.com/fullstorydev/relay-core/relay/traffic"
 	"github.com/fullstorydev/relay-core/relay/version"
 )
@@ -40,7 +39,7 @@ import (
 var (
 	Factory    contentBlockerPluginFactory
 	pluginName = "block-content"
-	logger     = log.New(os.Stdout, fmt.Sprintf("[traffic-%s] ", pluginName), 0)
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
 
 	PluginVersionHeaderName = "X-Relay-Content-Blocker-Version"
 )
@@ -213,7 +212,7 @@ func (plug contentBlockerPlugin) blockBodyContent(response http.ResponseWriter,
 	// because we don't actually need to support websockets, but if that changes
 	// we'll need to revisit this.
 	if len(plug.bodyBlockers) > 0 && request.Header.Get("Upgrade") == "websocket" {
-		logger.Println("Rejecting websocket connection (content blocking is not supported with websockets):", request.URL)
+		logger.Warnln("Rejecting websocket connection (content blocking is not supported with websockets):", request.URL)
 		http.Error(response, fmt.Sprintf("Blocking unsupported websocket connection: %v", request.URL), 500)
 		return true
 	}
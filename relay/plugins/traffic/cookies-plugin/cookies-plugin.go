@@ -8,19 +8,18 @@ package cookies_plugin
 
 import (
 	"fmt"
-	"log"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/fullstorydev/relay-core/relay/config"
+	"github.com/fullstorydev/relay-core/relay/logging"
 	"github.com/fullstorydev/relay-core/relay/traffic"
 )
 
 var (
 	Factory    cookiesPluginFactory
 	pluginName = "cookies"
-	logger     = log.New(os.Stdout, fmt.Sprintf("[traffic-%s] ", pluginName), 0)
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
 )
 
 type cookiesPluginFactory struct{}
@@ -39,8 +38,7 @@ func (f cookiesPluginFactory) New(configSection *config.Section) (traffic.Plugin
 		"allowlist",
 		func(key string, allowlist []string) error {
 			for _, cookieName := range allowlist {
-				logger.Printf(`Added rule: allowlist cookie "%s"`, cookieName)
-				plugin.allowlist[cookieName] = true
+				plugin.addToAllowlist(cookieName)
 			}
 
 			return nil
@@ -53,9 +51,12 @@ func (f cookiesPluginFactory) New(configSection *config.Section) (traffic.Plugin
 		configSection,
 		"TRAFFIC_RELAY_COOKIES",
 		func(key string, allowlist string) error {
-			for _, cookieName := range strings.Split(allowlist, " ") {
-				logger.Printf(`Added rule: allowlist cookie "%s"`, cookieName)
-				plugin.allowlist[cookieName] = true
+			// Cookie names may be separated by commas, spaces, or both.
+			cookieNames := strings.FieldsFunc(allowlist, func(r rune) bool {
+				return r == ',' || r == ' '
+			})
+			for _, cookieName := range cookieNames {
+				plugin.addToAllowlist(cookieName)
 			}
 
 			return nil
@@ -72,7 +73,14 @@ func (f cookiesPluginFactory) New(configSection *config.Section) (traffic.Plugin
 }
 
 type cookiesPlugin struct {
-	allowlist map[string]bool // The name of cookies that should be relayed.
+	allowlist map[string]bool // The lowercased names of cookies that should be relayed.
+}
+
+// addToAllowlist adds a cookie name to the allowlist. Cookie names are matched
+// case-insensitively, so they're normalized to lowercase.
+func (plug *cookiesPlugin) addToAllowlist(cookieName string) {
+	logger.Printf(`Added rule: allowlist cookie "%s"`, cookieName)
+	plug.allowlist[strings.ToLower(cookieName)] = true
 }
 
 func (plug cookiesPlugin) Name() string {
@@ -98,7 +106,7 @@ func (plug cookiesPlugin) HandleRequest(
 	// the allowlist.
 	var cookies []string
 	for _, cookie := range request.Cookies() {
-		if !plug.allowlist[cookie.Name] {
+		if !plug.allowlist[strings.ToLower(cookie.Name)] {
 			continue
 		}
 		cookies = append(cookies, cookie.String())
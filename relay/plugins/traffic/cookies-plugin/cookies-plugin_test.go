@@ -73,6 +73,32 @@ func TestRelayedCookies(t *testing.T) {
 			originalCookieHeaders: []string{"SPECIAL_ID=298zf09hf012fh2; token=u32t4o3tb3gg43; _gat=1; safe_cookie=xyz"},
 			expectedCookieHeaders: []string{"SPECIAL_ID=298zf09hf012fh2; _gat=1; safe_cookie=xyz"},
 		},
+		{
+			desc: "TRAFFIC_RELAY_COOKIES may be comma-separated",
+			config: `cookies:
+                        TRAFFIC_RELAY_COOKIES: SPECIAL_ID,_gat, safe_cookie
+            `,
+			originalCookieHeaders: []string{"SPECIAL_ID=298zf09hf012fh2; token=u32t4o3tb3gg43", "_gat=1; safe_cookie=xyz"},
+			expectedCookieHeaders: []string{"SPECIAL_ID=298zf09hf012fh2; _gat=1; safe_cookie=xyz"},
+		},
+		{
+			desc: "Cookie names are matched case-insensitively",
+			config: `cookies:
+                        allowlist:
+                          - special_id
+                        TRAFFIC_RELAY_COOKIES: _GAT
+            `,
+			originalCookieHeaders: []string{"SPECIAL_ID=298zf09hf012fh2; token=u32t4o3tb3gg43", "_gat=1"},
+			expectedCookieHeaders: []string{"SPECIAL_ID=298zf09hf012fh2; _gat=1"},
+		},
+		{
+			desc: "An empty TRAFFIC_RELAY_COOKIES relays no cookies",
+			config: `cookies:
+                        TRAFFIC_RELAY_COOKIES: ''
+            `,
+			originalCookieHeaders: []string{"SPECIAL_ID=298zf09hf012fh2; token=u32t4o3tb3gg43", "_gat=1"},
+			expectedCookieHeaders: nil,
+		},
 	}
 
 	plugins := []traffic.PluginFactory{
@@ -4,18 +4,20 @@ package headers_plugin
 
 import (
 	"fmt"
-	"log"
 	"net/http"
-	"os"
+	"sort"
+	"strings"
 
 	"github.com/fullstorydev/relay-core/relay/config"
+	"github.com/fullstorydev/relay-core/relay/logging"
 	"github.com/fullstorydev/relay-core/relay/traffic"
+	"golang.org/x/net/http/httpguts"
 )
 
 var (
 	Factory    headersPluginFactory
 	pluginName = "headers"
-	logger     = log.New(os.Stdout, fmt.Sprintf("[traffic-%s] ", pluginName), 0)
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
 )
 
 type headersPluginFactory struct{}
@@ -29,19 +31,99 @@ func (f headersPluginFactory) New(configSection *config.Section) (traffic.Plugin
 
 	if value, err := config.LookupOptional[string](configSection, "override-origin"); err != nil {
 		return nil, err
-	} else if value == nil {
-		return nil, nil
-	} else {
-		plugin.originOverride = *value
+	} else if value != nil {
+		plugin.originOverride = value
+		logger.Printf(`Added rule: override "Origin" header to "%s"`, *plugin.originOverride)
+	}
+
+	if err := config.ParseOptional(configSection, "origin-mode", func(key, value string) error {
+		if value == "" {
+			return nil
+		}
+		mode, err := traffic.ParseOriginMode(value)
+		if err != nil {
+			return fmt.Errorf(`Option "%v" must be "passthrough", "target", or "none": %v`, key, value)
+		}
+		if mode != traffic.OriginModePassthrough {
+			plugin.originMode = mode
+			logger.Printf(`Added rule: "Origin" header mode is "%s"`, mode)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if plugin.originOverride != nil && plugin.originMode != "" {
+		return nil, fmt.Errorf(`The "override-origin" and "origin-mode" options can't be used together`)
+	}
+
+	if err := config.ParseOptional(configSection, "add-request-headers", func(key, value string) error {
+		headers, err := ParseHeaderList(value)
+		if err != nil {
+			return err
+		}
+		plugin.addedHeaders = headers
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	addedHeaderNames := make([]string, 0, len(plugin.addedHeaders))
+	for headerName := range plugin.addedHeaders {
+		addedHeaderNames = append(addedHeaderNames, headerName)
+	}
+	sort.Strings(addedHeaderNames)
+	for _, headerName := range addedHeaderNames {
+		// Only the name is logged, since values are often credentials.
+		logger.Printf(`Added rule: set "%s" header on requests`, headerName)
 	}
 
-	logger.Printf(`Added rule: override "Origin" header to "%s"`, plugin.originOverride)
+	if plugin.originOverride == nil && plugin.originMode == "" && len(plugin.addedHeaders) == 0 {
+		return nil, nil
+	}
 
 	return plugin, nil
 }
 
+// ParseHeaderList parses a semicolon-separated list of "Name: Value" pairs
+// into a map from canonical header name to value. Whitespace around names and
+// values is ignored, and empty list items are skipped. A value may be empty,
+// but a pair without a colon, with an invalid header name, or with a value
+// containing control characters is an error.
+func ParseHeaderList(value string) (map[string]string, error) {
+	headers := map[string]string{}
+
+	for _, pair := range strings.Split(value, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		name, headerValue, found := strings.Cut(pair, ":")
+		if !found {
+			return nil, fmt.Errorf(`Header "%v" must have the form "Name: Value"`, pair)
+		}
+
+		name = strings.TrimSpace(name)
+		if !httpguts.ValidHeaderFieldName(name) {
+			return nil, fmt.Errorf(`Invalid header name "%v"`, name)
+		}
+
+		headerValue = strings.TrimSpace(headerValue)
+		if !httpguts.ValidHeaderFieldValue(headerValue) {
+			return nil, fmt.Errorf(`Invalid value for header "%v"`, name)
+		}
+
+		headers[http.CanonicalHeaderKey(name)] = headerValue
+	}
+
+	return headers, nil
+}
+
 type headersPlugin struct {
-	originOverride string
+	addedHeaders   map[string]string
+	originMode     traffic.OriginMode
+	originOverride *string
 }
 
 func (plug headersPlugin) Name() string {
@@ -57,10 +139,21 @@ func (plug headersPlugin) HandleRequest(
 		return false
 	}
 
-	request.Header.Set(
-		"Origin",
-		fmt.Sprintf("%v://%v", request.URL.Scheme, plug.originOverride),
-	)
+	if plug.originOverride != nil {
+		request.Header.Set(
+			"Origin",
+			fmt.Sprintf("%v://%v", request.URL.Scheme, *plug.originOverride),
+		)
+	}
+
+	// Plugins run before both HTTP requests and websocket upgrades are
+	// relayed, so the Origin mode applies to both. Host routes may override it.
+	plug.originMode.Apply(request, request.Header.Get("Origin"))
+
+	// Added headers replace any values supplied by the client.
+	for headerName, headerValue := range plug.addedHeaders {
+		request.Header.Set(headerName, headerValue)
+	}
 
 	return false
 }
@@ -1,15 +1,21 @@
 package headers_plugin_test
 
 import (
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/fullstorydev/relay-core/catcher"
 	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/config"
 	"github.com/fullstorydev/relay-core/relay/plugins/traffic/headers-plugin"
 	"github.com/fullstorydev/relay-core/relay/test"
 	"github.com/fullstorydev/relay-core/relay/traffic"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/websocket"
 )
 
 func TestHeadersPlugin(t *testing.T) {
@@ -52,6 +58,35 @@ func TestHeadersPlugin(t *testing.T) {
 				"Viewport-Width":  "100",
 			},
 		},
+		{
+			desc: "Static headers are added to requests",
+			config: `headers:
+                        add-request-headers: "Authorization: Bearer secret; X-Api-Key: 12345"
+            `,
+			originalHeaders: map[string]string{
+				"Origin": "https://test.com",
+			},
+			expectedHeaders: map[string]string{
+				"Authorization": "Bearer secret",
+				"Origin":        "https://test.com",
+				"X-Api-Key":     "12345",
+			},
+		},
+		{
+			desc: "Static headers replace headers supplied by the client",
+			config: `headers:
+                        add-request-headers: "authorization: Bearer secret"
+                        override-origin: example.com
+            `,
+			originalHeaders: map[string]string{
+				"Authorization": "Bearer client",
+				"Origin":        "https://test.com",
+			},
+			expectedHeaders: map[string]string{
+				"Authorization": "Bearer secret",
+				"Origin":        "http://example.com",
+			},
+		},
 	}
 
 	plugins := []traffic.PluginFactory{
@@ -105,6 +140,229 @@ func TestHeadersPlugin(t *testing.T) {
 	}
 }
 
+func TestOriginMode(t *testing.T) {
+	// The target records the Origin header of each request, including
+	// websocket upgrades. A custom handshake is used because the default one
+	// rejects upgrades without an Origin header.
+	origins := make(chan []string, 1)
+	recordOrigin := func(request *http.Request) {
+		origins <- request.Header.Values("Origin")
+	}
+	webSocketServer := websocket.Server{
+		Handshake: func(config *websocket.Config, request *http.Request) error {
+			recordOrigin(request)
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {},
+	}
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/ws" {
+			webSocketServer.ServeHTTP(response, request)
+			return
+		}
+		recordOrigin(request)
+		response.Write([]byte("OK"))
+	}))
+	defer target.Close()
+
+	clientOrigin := "https://client.example"
+
+	testCases := []struct {
+		desc           string
+		originMode     string
+		expectedOrigin []string
+	}{
+		{
+			desc:           "The client's Origin is relayed by default",
+			originMode:     "",
+			expectedOrigin: []string{clientOrigin},
+		},
+		{
+			desc:           "The client's Origin is relayed in passthrough mode",
+			originMode:     "passthrough",
+			expectedOrigin: []string{clientOrigin},
+		},
+		{
+			desc:           "The Origin is replaced with the target's in target mode",
+			originMode:     "target",
+			expectedOrigin: []string{target.URL},
+		},
+		{
+			desc:           "The Origin is removed in none mode",
+			originMode:     "none",
+			expectedOrigin: nil,
+		},
+	}
+
+	plugins := []traffic.PluginFactory{
+		headers_plugin.Factory,
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(
+			"relay:\n  target: %v\nheaders:\n  origin-mode: '%v'\n",
+			target.URL,
+			testCase.originMode,
+		)
+
+		test.WithRelay(t, configYaml, plugins, func(relayService *relay.Service) {
+			request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			request.Header.Set("Origin", clientOrigin)
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			if origin := <-origins; !reflect.DeepEqual(origin, testCase.expectedOrigin) {
+				t.Errorf("Test '%v': Expected HTTP Origin '%v' but got '%v'", testCase.desc, testCase.expectedOrigin, origin)
+			}
+
+			ws, err := websocket.Dial(relayService.WsUrl()+"/ws", "", clientOrigin)
+			if err != nil {
+				t.Errorf("Test '%v': Error dialing websocket: %v", testCase.desc, err)
+				return
+			}
+			ws.Close()
+
+			if origin := <-origins; !reflect.DeepEqual(origin, testCase.expectedOrigin) {
+				t.Errorf("Test '%v': Expected websocket Origin '%v' but got '%v'", testCase.desc, testCase.expectedOrigin, origin)
+			}
+		})
+	}
+}
+
+func TestOriginModeConflict(t *testing.T) {
+	configYaml := `headers:
+                      override-origin: example.com
+                      origin-mode: none
+    `
+	configFile, err := config.NewFileFromYamlString(configYaml)
+	if err != nil {
+		t.Fatalf("Error parsing configuration YAML: %v", err)
+	}
+	if _, err := headers_plugin.Factory.New(configFile.GetOrAddSection("headers")); err == nil {
+		t.Errorf("Expected an error when both override-origin and origin-mode are set")
+	}
+}
+
+func TestParseHeaderList(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		value       string
+		expected    map[string]string
+		expectError bool
+	}{
+		{
+			desc:     "An empty list contains no headers",
+			value:    "",
+			expected: map[string]string{},
+		},
+		{
+			desc:  "Whitespace around names and values is ignored",
+			value: "  x-api-key :  12345 ;Authorization:Bearer secret  ",
+			expected: map[string]string{
+				"Authorization": "Bearer secret",
+				"X-Api-Key":     "12345",
+			},
+		},
+		{
+			desc:  "Empty list items are skipped",
+			value: ";X-Api-Key: 12345;; ;",
+			expected: map[string]string{
+				"X-Api-Key": "12345",
+			},
+		},
+		{
+			desc:  "Values may be empty",
+			value: "X-Empty:",
+			expected: map[string]string{
+				"X-Empty": "",
+			},
+		},
+		{
+			desc:  "Values may contain colons",
+			value: "X-Forwarded-Host: example.com:8080",
+			expected: map[string]string{
+				"X-Forwarded-Host": "example.com:8080",
+			},
+		},
+		{
+			desc:        "A pair without a colon is rejected",
+			value:       "X-Api-Key 12345",
+			expectError: true,
+		},
+		{
+			desc:        "A pair without a name is rejected",
+			value:       ": 12345",
+			expectError: true,
+		},
+		{
+			desc:        "A name containing whitespace is rejected",
+			value:       "X Api Key: 12345",
+			expectError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		headers, err := headers_plugin.ParseHeaderList(testCase.value)
+		if testCase.expectError {
+			if err == nil {
+				t.Errorf("Test '%v': Expected an error but got '%v'", testCase.desc, headers)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Test '%v': Unexpected error: %v", testCase.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(testCase.expected, headers) {
+			t.Errorf("Test '%v': Expected '%v' but got '%v'", testCase.desc, testCase.expected, headers)
+		}
+	}
+}
+
+func FuzzParseHeaderList(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"X-Api-Key: 12345; Authorization: Bearer secret",
+		";X-Api-Key: 12345;; ;",
+		"X-Empty:",
+		"X-Forwarded-Host: example.com:8080",
+		"X-Api-Key 12345",
+		": 12345",
+		"X Api Key: 12345",
+		"X-Injected: a\r\nX-Other: b",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		headers, err := headers_plugin.ParseHeaderList(value)
+		if err != nil {
+			if headers != nil {
+				t.Errorf("Expected no headers alongside error '%v' for %q", err, value)
+			}
+			return
+		}
+		for name, headerValue := range headers {
+			if !httpguts.ValidHeaderFieldName(name) || http.CanonicalHeaderKey(name) != name {
+				t.Errorf("Invalid header name %q for %q", name, value)
+			}
+			if !httpguts.ValidHeaderFieldValue(headerValue) || strings.TrimSpace(headerValue) != headerValue {
+				t.Errorf("Invalid value %q for header %q for %q", headerValue, name, value)
+			}
+		}
+	})
+}
+
 /*
 Copyright 2022 FullStory, Inc.
 
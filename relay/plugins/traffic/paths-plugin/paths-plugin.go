@@ -5,21 +5,20 @@ package paths_plugin
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"regexp"
 	"strings"
 
 	"github.com/fullstorydev/relay-core/relay/config"
+	"github.com/fullstorydev/relay-core/relay/logging"
 	"github.com/fullstorydev/relay-core/relay/traffic"
 )
 
 var (
 	Factory    pathsPluginFactory
 	pluginName = "paths"
-	logger     = log.New(os.Stdout, fmt.Sprintf("[traffic-%s] ", pluginName), 0)
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
 )
 
 type ConfigRouteRule struct {
@@ -78,7 +77,30 @@ func (f pathsPluginFactory) New(configSection *config.Section) (traffic.Plugin,
 		return nil, err
 	}
 
-	if len(plugin.rules) == 0 {
+	if err := config.ParseOptional(configSection, "strip-prefix", func(key, value string) error {
+		prefix, err := escapedPrefix(value)
+		if err != nil {
+			return err
+		}
+		logger.Printf(`Added rule: strip path prefix "%s"`, value)
+		plugin.stripPrefix = prefix
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := config.ParseOptional(configSection, "add-prefix", func(key, value string) error {
+		prefix, err := escapedPrefix(value)
+		if err != nil {
+			return err
+		}
+		logger.Printf(`Added rule: add path prefix "%s"`, value)
+		plugin.addPrefix = prefix
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if len(plugin.rules) == 0 && plugin.stripPrefix == "" && plugin.addPrefix == "" {
 		return nil, nil
 	}
 
@@ -149,8 +171,20 @@ func (f pathsPluginFactory) addSpecialsRule(
 	)
 }
 
+// escapedPrefix validates a path prefix and returns it in escaped form, without
+// a trailing slash, so that it can be compared against escaped request paths.
+func escapedPrefix(prefix string) (string, error) {
+	if !strings.HasPrefix(prefix, "/") {
+		return "", fmt.Errorf(`Path prefix "%v" must start with "/"`, prefix)
+	}
+	escaped := (&url.URL{Path: prefix}).EscapedPath()
+	return strings.TrimSuffix(escaped, "/"), nil
+}
+
 type pathsPlugin struct {
-	rules []*pathRule
+	addPrefix   string // Escaped, with no trailing slash.
+	rules       []*pathRule
+	stripPrefix string // Escaped, with no trailing slash.
 }
 
 type pathRule struct {
@@ -190,6 +224,8 @@ func (plug pathsPlugin) HandleRequest(
 		return false
 	}
 
+	plug.rewritePrefix(request.URL)
+
 	for _, rule := range plug.rules {
 		switch rule.target {
 		case pathTarget:
@@ -208,7 +244,7 @@ func (plug pathsPlugin) HandleRequest(
 			urlVal := rule.match.ReplaceAllString(request.URL.Path, rule.replacement)
 			newURL, err := url.Parse(urlVal)
 			if err != nil {
-				logger.Printf("Failed to create URL for path rule %v: %v", rule.match, err)
+				logger.Errorf("Failed to create URL for path rule %v: %v", rule.match, err)
 			} else {
 				request.URL.Scheme = newURL.Scheme
 				request.URL.Host = newURL.Host
@@ -221,6 +257,38 @@ func (plug pathsPlugin) HandleRequest(
 	return false
 }
 
+// rewritePrefix strips and then adds the configured path prefixes. This is done
+// using the escaped form of the path, so that encoded characters in the rest of
+// the path are preserved exactly. The query string is unaffected.
+func (plug pathsPlugin) rewritePrefix(requestURL *url.URL) {
+	if plug.stripPrefix == "" && plug.addPrefix == "" {
+		return
+	}
+
+	path := requestURL.EscapedPath()
+	if plug.stripPrefix != "" {
+		// The prefix must match whole path segments, so "/api" is stripped
+		// from "/api/users" but not from "/apiary".
+		if rest := strings.TrimPrefix(path, plug.stripPrefix); rest != path && (rest == "" || strings.HasPrefix(rest, "/")) {
+			path = rest
+		}
+	}
+	if plug.addPrefix != "" {
+		path = plug.addPrefix + path
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	unescapedPath, err := url.PathUnescape(path)
+	if err != nil {
+		logger.Errorf("Failed to rewrite path prefix for %v: %v", requestURL, err)
+		return
+	}
+	requestURL.Path = unescapedPath
+	requestURL.RawPath = path
+}
+
 /*
 Copyright 2020 FullStory, Inc.
 
@@ -223,6 +223,85 @@ func TestPathRewritingToFullUrl(t *testing.T) {
 	}
 }
 
+func TestPathPrefixRewriting(t *testing.T) {
+	testCases := []pathsPluginTestCase{
+		{
+			desc: "Prefixes can be stripped",
+			config: `paths:
+                        strip-prefix: /api
+            `,
+			originalUrl: `${RELAY_HTTP_URL}/api/users`,
+			expectedUrl: `${TARGET_HTTP_URL}/users`,
+		},
+		{
+			desc: "Prefixes can be added",
+			config: `paths:
+                        add-prefix: /v2
+            `,
+			originalUrl: `${RELAY_HTTP_URL}/users`,
+			expectedUrl: `${TARGET_HTTP_URL}/v2/users`,
+		},
+		{
+			desc: "Prefixes can be stripped and added together",
+			config: `paths:
+                        strip-prefix: /api/
+                        add-prefix: /v2/
+            `,
+			originalUrl: `${RELAY_HTTP_URL}/api/users?id=123`,
+			expectedUrl: `${TARGET_HTTP_URL}/v2/users?id=123`,
+		},
+		{
+			desc: "Paths that do not match the stripped prefix are unchanged",
+			config: `paths:
+                        strip-prefix: /api
+                        add-prefix: /v2
+            `,
+			originalUrl: `${RELAY_HTTP_URL}/static/app.js`,
+			expectedUrl: `${TARGET_HTTP_URL}/v2/static/app.js`,
+		},
+		{
+			desc: "Stripped prefixes match whole path segments",
+			config: `paths:
+                        strip-prefix: /api
+            `,
+			originalUrl: `${RELAY_HTTP_URL}/apiary/bees`,
+			expectedUrl: `${TARGET_HTTP_URL}/apiary/bees`,
+		},
+		{
+			desc: "Stripping the entire path leaves the root path",
+			config: `paths:
+                        strip-prefix: /api
+            `,
+			originalUrl: `${RELAY_HTTP_URL}/api`,
+			expectedUrl: `${TARGET_HTTP_URL}/`,
+		},
+		{
+			desc: "Encoded characters are preserved",
+			config: `paths:
+                        strip-prefix: /api
+                        add-prefix: /v2
+            `,
+			originalUrl: `${RELAY_HTTP_URL}/api/files/a%2Fb%20c?q=a%2Fb`,
+			expectedUrl: `${TARGET_HTTP_URL}/v2/files/a%2Fb%20c?q=a%2Fb`,
+		},
+		{
+			desc: "Prefixes are applied before routes",
+			config: `paths:
+                        strip-prefix: /api
+                        routes:
+                          - path: '^/users'
+                            target-path: '/people'
+            `,
+			originalUrl: `${RELAY_HTTP_URL}/api/users/1`,
+			expectedUrl: `${TARGET_HTTP_URL}/people/1`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		runPathsPluginTest(t, testCase)
+	}
+}
+
 type pathsPluginTestCase struct {
 	desc        string
 	config      string
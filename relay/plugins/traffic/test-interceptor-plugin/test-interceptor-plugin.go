@@ -5,18 +5,17 @@ package test_interceptor_plugin
 
 import (
 	"fmt"
-	"log"
 	"net/http"
-	"os"
 
 	"github.com/fullstorydev/relay-core/relay/config"
+	"github.com/fullstorydev/relay-core/relay/logging"
 	"github.com/fullstorydev/relay-core/relay/traffic"
 )
 
 var (
 	Factory    testInterceptorPluginFactory
 	pluginName = "test-interceptor"
-	logger     = log.New(os.Stdout, fmt.Sprintf("[traffic-%s] ", pluginName), 0)
+	logger     = logging.New(fmt.Sprintf("traffic-%s", pluginName))
 )
 
 type HandleRequestListener func(request *http.Request)
@@ -1,8 +1,5 @@
 package relay
 
-import (
-	"log"
-	"os"
-)
+import "github.com/fullstorydev/relay-core/relay/logging"
 
-var logger = log.New(os.Stdout, "[relay] ", 0)
+var logger = logging.New("relay")
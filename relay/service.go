@@ -1,37 +1,73 @@
 package relay
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/fullstorydev/relay-core/relay/logging"
+	"github.com/fullstorydev/relay-core/relay/metrics"
 	"github.com/fullstorydev/relay-core/relay/traffic"
 )
 
 var MonitorPath = "/__relay__up__/"
 
+// DefaultShutdownTimeout is how long the relay waits for in-flight requests and
+// websockets to finish when it shuts down.
+var DefaultShutdownTimeout = 30 * time.Second
+
 // ServiceOptions contains configuration options for the relay network service.
 //
 // See also traffic.RelayOptions, which provides options for the actual relay
 // functionality.
 type ServiceOptions struct {
-	Port int // The port that the relay service should listen on.
+	HealthAddr         string          // The address the health service should listen on. If empty, it's disabled.
+	HealthCheckTargets bool            // If true, the health service reports failure when no target is reachable.
+	LogFormat          *logging.Format // The format of log lines; see ApplyLogOptions. If nil, the format is left unchanged.
+	LogLevel           *logging.Level  // The least severe level which is logged; see ApplyLogOptions. If nil, the level is left unchanged.
+	MetricsAddr        string          // The address the metrics service should listen on. If empty, metrics are disabled.
+	OTelEnabled        bool            // If true, StartTracing exports spans over OTLP.
+	Port               int             // The port that the relay service should listen on.
+	ServerIdleTimeout  time.Duration   // How long an idle keep-alive connection from a client is kept open. Zero means the read timeout is used.
+	ServerReadTimeout  time.Duration   // How long a client may take to send a request, including its body. Zero means no timeout.
+	ServerWriteTimeout time.Duration   // How long the relay may take to respond to a request after reading its headers. Zero means no timeout.
+	ShutdownTimeout    time.Duration   // How long to wait for in-flight traffic when shutting down.
 }
 
 func NewDefaultServiceOptions() *ServiceOptions {
-	return &ServiceOptions{}
+	return &ServiceOptions{
+		ShutdownTimeout: DefaultShutdownTimeout,
+	}
 }
 
 // Service implements the relay service, exposing both the traffic handler and
-// the monitoring page.
+// the monitoring page. If metrics are enabled, they're served separately, on
+// their own address.
 type Service struct {
-	listener net.Listener
-	mux      *http.ServeMux
+	idleTimeout     time.Duration
+	listener        net.Listener
+	metrics         *metrics.Collector
+	metricsAddr     string
+	metricsListener net.Listener
+	handler         http.Handler
+	readTimeout     time.Duration
+	server          *http.Server
+	trafficHandler  atomic.Pointer[traffic.Handler] // Replaced by Reload.
+	writeTimeout    time.Duration
 }
 
-func NewService(relayConfig *traffic.RelayOptions, trafficPlugins []traffic.Plugin) *Service {
+func NewService(options *Options, trafficPlugins []traffic.Plugin) *Service {
 	mux := http.NewServeMux()
 
+	var metricsCollector *metrics.Collector
+	if options.Service.MetricsAddr != "" {
+		metricsCollector = metrics.NewCollector()
+	}
+
 	// Write a simple page for monitoring.
 	// TODO add a control/monitoring service
 	mux.HandleFunc(MonitorPath, func(response http.ResponseWriter, request *http.Request) {
@@ -39,12 +75,26 @@ func NewService(relayConfig *traffic.RelayOptions, trafficPlugins []traffic.Plug
 		response.Write([]byte("<html><body>Up</body></html>"))
 	})
 
-	// Set up the traffic handler.
-	mux.Handle("/", traffic.NewHandler(relayConfig, trafficPlugins))
-
-	return &Service{
-		mux: mux,
+	// Set up the traffic handler. Relayed requests bypass the ServeMux, since
+	// it would otherwise clean their paths (e.g. by collapsing "//" or
+	// resolving "..") and redirect the client, rather than relaying the path
+	// to the target unchanged.
+	service := &Service{
+		idleTimeout:  options.Service.ServerIdleTimeout,
+		metrics:      metricsCollector,
+		metricsAddr:  options.Service.MetricsAddr,
+		readTimeout:  options.Service.ServerReadTimeout,
+		writeTimeout: options.Service.ServerWriteTimeout,
 	}
+	service.trafficHandler.Store(traffic.NewHandler(options.Relay, trafficPlugins, metricsCollector))
+	service.handler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if strings.HasPrefix(request.URL.Path, MonitorPath) {
+			mux.ServeHTTP(response, request)
+		} else {
+			service.trafficHandler.Load().ServeHTTP(response, request)
+		}
+	})
+	return service
 }
 
 func (service *Service) Address() string {
@@ -55,6 +105,10 @@ func (service *Service) Address() string {
 }
 
 func (service *Service) Close() error {
+	service.trafficHandler.Load().StopHealthChecks()
+	if service.metricsListener != nil {
+		service.metricsListener.Close()
+	}
 	if service.listener == nil {
 		return nil
 	}
@@ -65,6 +119,15 @@ func (service *Service) HttpUrl() string {
 	return fmt.Sprintf("http://%v", service.Address())
 }
 
+// MetricsAddress returns the address the metrics service is listening on, or
+// the empty string if metrics are disabled.
+func (service *Service) MetricsAddress() string {
+	if service.metricsListener == nil {
+		return ""
+	}
+	return service.metricsListener.Addr().String()
+}
+
 func (service *Service) Port() int {
 	if service.listener == nil {
 		return 0
@@ -72,17 +135,85 @@ func (service *Service) Port() int {
 	return service.listener.Addr().(*net.TCPAddr).Port
 }
 
+// ReopenAccessLog reopens the access log file, if one is configured. It should
+// be called after the log has been rotated.
+func (service *Service) ReopenAccessLog() error {
+	return service.trafficHandler.Load().ReopenAccessLog()
+}
+
+// Reload replaces the relay's configuration and plugins without interrupting
+// traffic. New requests are handled using the new configuration, while those
+// already in flight, including websockets and CONNECT tunnels, finish using the
+// old one. The old configuration's resources are released once they finish, or
+// once the new configuration's shutdown timeout has passed, whichever comes
+// first. Only the relay options are reloaded; service options, like the port,
+// only change when the relay restarts.
+func (service *Service) Reload(options *Options, trafficPlugins []traffic.Plugin) {
+	newHandler := traffic.NewHandler(options.Relay, trafficPlugins, service.metrics)
+	if service.listener != nil {
+		newHandler.StartHealthChecks()
+	}
+	oldHandler := service.trafficHandler.Swap(newHandler)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), options.Service.ShutdownTimeout)
+		defer cancel()
+		if err := oldHandler.Retire(ctx); err != nil {
+			logger.Warnf("Closed connections using the previous configuration which didn't finish in time: %v", err)
+		}
+	}()
+}
+
+// Shutdown gracefully shuts down the service. It stops accepting new
+// connections, then waits for in-flight requests, websockets, and CONNECT
+// tunnels to finish. If the context expires first, any remaining websockets and
+// tunnels are closed and the context's error is returned.
+func (service *Service) Shutdown(ctx context.Context) error {
+	service.trafficHandler.Load().StopHealthChecks()
+	if service.metricsListener != nil {
+		service.metricsListener.Close()
+	}
+	if service.server == nil {
+		return nil
+	}
+
+	// The server doesn't track hijacked connections, so websockets and
+	// tunnels are drained separately by the traffic handler.
+	serverErr := service.server.Shutdown(ctx)
+	if err := service.trafficHandler.Load().Shutdown(ctx); err != nil {
+		return err
+	}
+	return serverErr
+}
+
 func (service *Service) Start(host string, port int) error {
 	address := fmt.Sprintf("%v:%v", host, port)
+	// The timeouts protect the relay from clients which hold connections open
+	// by sending requests very slowly. Hijacking a connection clears its
+	// deadlines, so they don't apply to websockets or tunnels once they've been
+	// established.
 	server := &http.Server{
-		Addr:    address,
-		Handler: service.mux,
+		Addr:         address,
+		Handler:      service.handler,
+		IdleTimeout:  service.idleTimeout,
+		ReadTimeout:  service.readTimeout,
+		WriteTimeout: service.writeTimeout,
 	}
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		return err
 	}
 	service.listener = listener
+	service.server = server
+
+	if service.metrics != nil {
+		if err := service.startMetrics(); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	service.trafficHandler.Load().StartHealthChecks()
 
 	go func() {
 		server.Serve(
@@ -98,3 +229,17 @@ func (service *Service) Start(host string, port int) error {
 func (service *Service) WsUrl() string {
 	return fmt.Sprintf("ws://%v", service.Address())
 }
+
+func (service *Service) startMetrics() error {
+	listener, err := net.Listen("tcp", service.metricsAddr)
+	if err != nil {
+		return fmt.Errorf("Could not start metrics service: %v", err)
+	}
+	service.metricsListener = listener
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", service.metrics)
+	go http.Serve(listener, mux)
+
+	return nil
+}
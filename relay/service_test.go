@@ -0,0 +1,275 @@
+package relay_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"github.com/fullstorydev/relay-core/relay/traffic"
+	"golang.org/x/net/websocket"
+)
+
+func TestServiceFromOptions(t *testing.T) {
+	catcherService := catcher.NewService()
+	if err := catcherService.Start("localhost", 0); err != nil {
+		t.Fatalf("Error starting catcher: %v", err)
+	}
+	defer catcherService.Close()
+
+	catcherURL, err := url.Parse(catcherService.HttpUrl())
+	if err != nil {
+		t.Fatalf("Error parsing catcher URL: %v", err)
+	}
+
+	testCases := []struct {
+		desc           string
+		configure      func(options *relay.Options)
+		expectedStatus int
+		expectedHeader string
+	}{
+		{
+			desc:           "A relay built from default options relays traffic",
+			configure:      func(options *relay.Options) {},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc: "Relay options set programmatically take effect",
+			configure: func(options *relay.Options) {
+				options.Relay.RequestIDHeader = "X-Trace-Id"
+			},
+			expectedStatus: http.StatusOK,
+			expectedHeader: "X-Trace-Id",
+		},
+		{
+			desc: "Basic Auth set programmatically is enforced",
+			configure: func(options *relay.Options) {
+				options.Relay.BasicAuthUser = "user"
+				options.Relay.BasicAuthPassword = "secret"
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := relay.NewDefaultOptions()
+		options.Relay.Targets = []*traffic.Target{{Scheme: catcherURL.Scheme, Host: catcherURL.Host}}
+		testCase.configure(options)
+
+		relayService := relay.NewService(options, nil)
+		if err := relayService.Start("localhost", 0); err != nil {
+			t.Errorf("Test '%v': Error starting relay: %v", testCase.desc, err)
+			continue
+		}
+
+		response, err := http.Get(relayService.HttpUrl())
+		if err != nil {
+			t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+			relayService.Close()
+			continue
+		}
+		response.Body.Close()
+		relayService.Close()
+
+		if response.StatusCode != testCase.expectedStatus {
+			t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+		}
+		if testCase.expectedHeader != "" && response.Header.Get(testCase.expectedHeader) == "" {
+			t.Errorf("Test '%v': Expected the response to have header %v", testCase.desc, testCase.expectedHeader)
+		}
+	}
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		config       string
+		expectClosed bool
+	}{
+		{
+			desc: "Clients which send headers too slowly are disconnected",
+			config: `relay:
+                        server-read-timeout: 100ms
+            `,
+			expectClosed: true,
+		},
+		{
+			desc:         "Slow clients aren't disconnected by default",
+			config:       "",
+			expectClosed: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, testCase.config, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+			conn, err := net.Dial("tcp", relayService.Address())
+			if err != nil {
+				t.Errorf("Test '%v': Error connecting to relay: %v", testCase.desc, err)
+				return
+			}
+			defer conn.Close()
+
+			// Start a request, but never finish its headers.
+			if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: relay\r\n"); err != nil {
+				t.Errorf("Test '%v': Error writing request: %v", testCase.desc, err)
+				return
+			}
+
+			// If the relay disconnects the client, reading fails with EOF;
+			// otherwise, the read times out on the client side.
+			conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			_, err = io.ReadAll(conn)
+			var netErr net.Error
+			timedOut := errors.As(err, &netErr) && netErr.Timeout()
+			if closed := !timedOut; closed != testCase.expectClosed {
+				t.Errorf("Test '%v': Expected the connection to be closed: %v but got %v (error: %v)", testCase.desc, testCase.expectClosed, closed, err)
+			}
+		})
+	}
+}
+
+func TestServerWriteTimeoutWebSocket(t *testing.T) {
+	configYaml := `relay:
+                      server-read-timeout: 100ms
+                      server-write-timeout: 100ms
+    `
+
+	test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		ws, err := websocket.Dial(fmt.Sprintf("%v/echo", relayService.WsUrl()), "", relayService.HttpUrl())
+		if err != nil {
+			t.Errorf("Error dialing websocket: %v", err)
+			return
+		}
+		defer ws.Close()
+
+		// The websocket outlives the server's timeouts.
+		time.Sleep(300 * time.Millisecond)
+
+		const message = "Still here"
+		if _, err := ws.Write([]byte(message)); err != nil {
+			t.Errorf("Error writing to websocket: %v", err)
+			return
+		}
+		reply := make([]byte, len(message))
+		if _, err := io.ReadFull(ws, reply); err != nil {
+			t.Errorf("Error reading from websocket: %v", err)
+			return
+		}
+		if string(reply) != message {
+			t.Errorf("Expected echo '%v' but got '%v'", message, string(reply))
+		}
+	})
+}
+
+func TestReload(t *testing.T) {
+	release := make(chan struct{})
+	newTarget := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				<-release
+			}
+			io.WriteString(w, name)
+		}))
+	}
+	targetA := newTarget("A")
+	defer targetA.Close()
+	targetB := newTarget("B")
+	defer targetB.Close()
+
+	optionsFor := func(target *httptest.Server) *relay.Options {
+		targetURL, err := url.Parse(target.URL)
+		if err != nil {
+			t.Fatalf("Error parsing target URL: %v", err)
+		}
+		options := relay.NewDefaultOptions()
+		options.Relay.Targets = []*traffic.Target{{Scheme: targetURL.Scheme, Host: targetURL.Host}}
+		return options
+	}
+
+	relayService := relay.NewService(optionsFor(targetA), nil)
+	if err := relayService.Start("localhost", 0); err != nil {
+		t.Fatalf("Error starting relay: %v", err)
+	}
+	defer relayService.Close()
+
+	get := func(path string) (string, error) {
+		response, err := http.Get(relayService.HttpUrl() + path)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			return "", err
+		}
+		if response.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("unexpected status %v", response.StatusCode)
+		}
+		return string(body), nil
+	}
+
+	if body, err := get("/"); err != nil || body != "A" {
+		t.Fatalf("Expected a response from target A but got %q, %v", body, err)
+	}
+
+	// Start a request which is in flight while the configuration is reloaded.
+	slowResult := make(chan error, 1)
+	go func() {
+		body, err := get("/slow")
+		if err == nil && body != "A" {
+			err = fmt.Errorf("expected a response from target A but got %q", body)
+		}
+		slowResult <- err
+	}()
+
+	// Keep sending traffic while the configuration is reloaded; none of it
+	// should fail.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := get("/"); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	relayService.Reload(optionsFor(targetB), nil)
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Error relaying traffic during reload: %v", err)
+	}
+
+	if body, err := get("/"); err != nil || body != "B" {
+		t.Errorf("Expected a response from target B after reloading but got %q, %v", body, err)
+	}
+
+	close(release)
+	if err := <-slowResult; err != nil {
+		t.Errorf("In-flight request failed during reload: %v", err)
+	}
+}
@@ -36,9 +36,40 @@ func WithCatcherAndRelay(
 	}
 
 	relaySection := configFile.GetOrAddSection("relay")
-	relaySection.Set("port", 0)
 	relaySection.Set("target", catcherService.HttpUrl())
 
+	withRelayForConfigFile(t, configFile, pluginFactories, func(relayService *relay.Service) {
+		action(catcherService, relayService)
+	})
+}
+
+// WithRelay is like WithCatcherAndRelay, but it doesn't start a catcher. It's
+// useful for tests which need to relay traffic to their own target services;
+// the relay target must be specified in the provided configuration.
+func WithRelay(
+	t *testing.T,
+	configYaml string,
+	pluginFactories []traffic.PluginFactory,
+	action func(relayService *relay.Service),
+) {
+	configFile, err := config.NewFileFromYamlString(configYaml)
+	if err != nil {
+		t.Errorf("Error parsing configuration YAML: %v", err)
+		return
+	}
+
+	withRelayForConfigFile(t, configFile, pluginFactories, action)
+}
+
+func withRelayForConfigFile(
+	t *testing.T,
+	configFile *config.File,
+	pluginFactories []traffic.PluginFactory,
+	action func(relayService *relay.Service),
+) {
+	relaySection := configFile.GetOrAddSection("relay")
+	relaySection.Set("port", 0)
+
 	relayService, err := setupRelay(configFile, pluginFactories)
 	if err != nil {
 		t.Errorf("Error setting up relay: %v", err)
@@ -51,7 +82,7 @@ func WithCatcherAndRelay(
 	}
 	defer relayService.Close()
 
-	action(catcherService, relayService)
+	action(relayService)
 }
 
 func setupRelay(
@@ -62,11 +93,12 @@ func setupRelay(
 	if err != nil {
 		return nil, err
 	}
+	relay.ApplyLogOptions(options.Service)
 
 	trafficPlugins, err := plugin_loader.Load(pluginFactories, configFile)
 	if err != nil {
 		return nil, err
 	}
 
-	return relay.NewService(options.Relay, trafficPlugins), nil
+	return relay.NewService(options, trafficPlugins), nil
 }
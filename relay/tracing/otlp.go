@@ -0,0 +1,356 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay/environment"
+	"github.com/fullstorydev/relay-core/relay/logging"
+	"github.com/fullstorydev/relay-core/relay/version"
+)
+
+var logger = logging.New("relay-tracing")
+
+const (
+	otlpBatchSize     = 512
+	otlpBatchInterval = 5 * time.Second
+	otlpQueueSize     = 2048
+)
+
+// OTLPExporter exports spans to an OpenTelemetry collector using OTLP over
+// HTTP, with JSON encoding. Spans are queued and sent in batches in the
+// background; if the queue fills up, additional spans are dropped.
+type OTLPExporter struct {
+	client   *http.Client
+	endpoint string
+	headers  map[string]string
+	resource otlpResource
+
+	queue    chan *Span
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+// NewOTLPExporter creates an OTLPExporter configured by the standard
+// OpenTelemetry environment variables:
+//   - OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT sets
+//     where spans are sent. The default is http://localhost:4318/v1/traces.
+//   - OTEL_EXPORTER_OTLP_HEADERS or OTEL_EXPORTER_OTLP_TRACES_HEADERS adds
+//     headers to each export request.
+//   - OTEL_EXPORTER_OTLP_TIMEOUT or OTEL_EXPORTER_OTLP_TRACES_TIMEOUT sets the
+//     timeout for each export request, in milliseconds.
+//   - OTEL_EXPORTER_OTLP_PROTOCOL or OTEL_EXPORTER_OTLP_TRACES_PROTOCOL must be
+//     "http/json" if it's set, since that's the only protocol supported.
+//   - OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES describe the relay.
+//
+// The exporter starts sending spans immediately; call Shutdown to flush any
+// queued spans and stop it.
+func NewOTLPExporter(env environment.Provider) (*OTLPExporter, error) {
+	lookup := func(key string) (string, bool) {
+		if value, ok := env.Lookup("OTEL_EXPORTER_OTLP_TRACES_" + key); ok {
+			return value, true
+		}
+		if value, ok := env.Lookup("OTEL_EXPORTER_OTLP_" + key); ok {
+			return value, true
+		}
+		return "", false
+	}
+
+	if protocol, ok := lookup("PROTOCOL"); ok && protocol != "http/json" {
+		return nil, fmt.Errorf(`Unsupported OTLP protocol "%v"; only "http/json" is supported`, protocol)
+	}
+
+	endpoint := "http://localhost:4318/v1/traces"
+	if value, ok := env.Lookup("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); ok {
+		endpoint = value
+	} else if value, ok := env.Lookup("OTEL_EXPORTER_OTLP_ENDPOINT"); ok {
+		endpoint = strings.TrimSuffix(value, "/") + "/v1/traces"
+	}
+	if endpointURL, err := url.Parse(endpoint); err != nil || endpointURL.Host == "" {
+		return nil, fmt.Errorf(`Invalid OTLP endpoint "%v"`, endpoint)
+	}
+
+	headers := map[string]string{}
+	if value, ok := lookup("HEADERS"); ok {
+		pairs, err := parseKeyValueList(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid OTLP headers: %v", err)
+		}
+		for _, pair := range pairs {
+			headers[pair[0]] = pair[1]
+		}
+	}
+
+	timeout := 10 * time.Second
+	if value, ok := lookup("TIMEOUT"); ok {
+		milliseconds, err := strconv.Atoi(value)
+		if err != nil || milliseconds < 0 {
+			return nil, fmt.Errorf(`Invalid OTLP timeout "%v"`, value)
+		}
+		timeout = time.Duration(milliseconds) * time.Millisecond
+	}
+
+	serviceName := "relay"
+	var resourceAttributes []otlpAttribute
+	if value, ok := env.Lookup("OTEL_RESOURCE_ATTRIBUTES"); ok {
+		pairs, err := parseKeyValueList(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid OpenTelemetry resource attributes: %v", err)
+		}
+		for _, pair := range pairs {
+			if pair[0] == "service.name" {
+				serviceName = pair[1]
+				continue
+			}
+			resourceAttributes = append(resourceAttributes, newOTLPAttribute(pair[0], pair[1]))
+		}
+	}
+	if value, ok := env.Lookup("OTEL_SERVICE_NAME"); ok {
+		serviceName = value
+	}
+	resourceAttributes = append(resourceAttributes, newOTLPAttribute("service.name", serviceName))
+
+	exporter := &OTLPExporter{
+		client:   &http.Client{Timeout: timeout},
+		endpoint: endpoint,
+		headers:  headers,
+		resource: otlpResource{Attributes: resourceAttributes},
+		queue:    make(chan *Span, otlpQueueSize),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go exporter.run()
+	return exporter, nil
+}
+
+func (exporter *OTLPExporter) ExportSpan(span *Span) {
+	select {
+	case exporter.queue <- span:
+	default:
+		logger.Warnf("Dropping span: the OTLP export queue is full")
+	}
+}
+
+// Shutdown sends any queued spans and stops the exporter. If the context
+// expires first, the context's error is returned.
+func (exporter *OTLPExporter) Shutdown(ctx context.Context) error {
+	exporter.stopOnce.Do(func() { close(exporter.stop) })
+	select {
+	case <-exporter.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (exporter *OTLPExporter) String() string {
+	return exporter.endpoint
+}
+
+// run sends queued spans in batches, either once a full batch is available or
+// after otlpBatchInterval, whichever comes first.
+func (exporter *OTLPExporter) run() {
+	defer close(exporter.stopped)
+
+	ticker := time.NewTicker(otlpBatchInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case span := <-exporter.queue:
+			batch = append(batch, span)
+			if len(batch) >= otlpBatchSize {
+				exporter.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			exporter.send(batch)
+			batch = nil
+		case <-exporter.stop:
+			for {
+				select {
+				case span := <-exporter.queue:
+					batch = append(batch, span)
+				default:
+					exporter.send(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (exporter *OTLPExporter) send(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, span := range batch {
+		spans = append(spans, newOTLPSpan(span))
+	}
+	body, err := json.Marshal(otlpTracesRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: exporter.resource,
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "relay", Version: version.RelayRelease},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		logger.Errorf("Could not encode spans: %v", err)
+		return
+	}
+
+	request, err := http.NewRequest("POST", exporter.endpoint, bytes.NewReader(body))
+	if err != nil {
+		logger.Errorf("Could not create OTLP export request: %v", err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range exporter.headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := exporter.client.Do(request)
+	if err != nil {
+		logger.Warnf("Could not export %v spans to %v: %v", len(batch), exporter.endpoint, err)
+		return
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		logger.Warnf("Could not export %v spans to %v: status %v", len(batch), exporter.endpoint, response.StatusCode)
+	}
+}
+
+// parseKeyValueList parses a comma-separated list of URL-encoded key=value
+// pairs, the format used by OpenTelemetry environment variables.
+func parseKeyValueList(value string) ([][2]string, error) {
+	var pairs [][2]string
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf(`Expected key=value but got "%v"`, entry)
+		}
+		decodedKey, err := url.QueryUnescape(strings.TrimSpace(key))
+		if err != nil {
+			return nil, err
+		}
+		decodedValue, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, [2]string{decodedKey, decodedValue})
+	}
+	return pairs, nil
+}
+
+// The types below mirror the JSON encoding of the OTLP ExportTraceServiceRequest
+// message. IDs are hex-encoded, and 64-bit integers are encoded as strings.
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    StatusCode `json:"code,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	IntValue    *string `json:"intValue,omitempty"`
+	StringValue *string `json:"stringValue,omitempty"`
+}
+
+func newOTLPSpan(span *Span) otlpSpan {
+	encoded := otlpSpan{
+		TraceID:           hex.EncodeToString(span.SpanContext.TraceID[:]),
+		SpanID:            hex.EncodeToString(span.SpanContext.SpanID[:]),
+		TraceState:        span.TraceState,
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Status:            otlpStatus{Code: span.StatusCode, Message: span.StatusMessage},
+	}
+	if span.Parent != [8]byte{} {
+		encoded.ParentSpanID = hex.EncodeToString(span.Parent[:])
+	}
+	keys := make([]string, 0, len(span.Attributes))
+	for key := range span.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		encoded.Attributes = append(encoded.Attributes, newOTLPAttribute(key, span.Attributes[key]))
+	}
+	return encoded
+}
+
+func newOTLPAttribute(key string, value interface{}) otlpAttribute {
+	var encoded otlpValue
+	switch typed := value.(type) {
+	case int64:
+		intValue := strconv.FormatInt(typed, 10)
+		encoded.IntValue = &intValue
+	default:
+		stringValue := fmt.Sprint(typed)
+		encoded.StringValue = &stringValue
+	}
+	return otlpAttribute{Key: key, Value: encoded}
+}
@@ -0,0 +1,241 @@
+// Package tracing records spans for the requests the relay sends to its
+// targets, and propagates W3C Trace Context (the traceparent and tracestate
+// headers) so that the relay appears in distributed traces. Spans can be
+// exported to an OpenTelemetry collector using OTLP. Tracing is optional; all
+// Tracer and Span methods are no-ops when invoked on a nil receiver, so that
+// instrumented code doesn't need to check whether tracing is enabled.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TraceparentHeader = "Traceparent"
+	TracestateHeader  = "Tracestate"
+)
+
+// SpanContext identifies a span within a trace, as carried by the traceparent
+// header.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// ParseTraceparent parses the value of a traceparent header. It returns false
+// if the value isn't a valid traceparent.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	// The format is "version-traceid-spanid-flags". Versions after 00 may
+	// append additional fields, which are ignored.
+	value = strings.TrimSpace(value)
+	if len(value) < 55 || (len(value) > 55 && value[55] != '-') {
+		return SpanContext{}, false
+	}
+	if value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return SpanContext{}, false
+	}
+
+	var version, flags [1]byte
+	var spanContext SpanContext
+	for _, field := range []struct {
+		destination []byte
+		hex         string
+	}{
+		{version[:], value[0:2]},
+		{spanContext.TraceID[:], value[3:35]},
+		{spanContext.SpanID[:], value[36:52]},
+		{flags[:], value[53:55]},
+	} {
+		// Only lowercase hex digits are allowed.
+		if strings.ToLower(field.hex) != field.hex {
+			return SpanContext{}, false
+		}
+		if _, err := hex.Decode(field.destination, []byte(field.hex)); err != nil {
+			return SpanContext{}, false
+		}
+	}
+
+	if version[0] == 0xff || (version[0] == 0 && len(value) != 55) {
+		return SpanContext{}, false
+	}
+	if spanContext.TraceID == [16]byte{} || spanContext.SpanID == [8]byte{} {
+		return SpanContext{}, false
+	}
+	spanContext.Sampled = flags[0]&0x01 != 0
+	return spanContext, true
+}
+
+// Traceparent returns the value of the traceparent header which identifies
+// this span context.
+func (spanContext SpanContext) Traceparent() string {
+	flags := "00"
+	if spanContext.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%v", spanContext.TraceID, spanContext.SpanID, flags)
+}
+
+// SpanKind describes the relationship between a span and the remote side of
+// the operation it represents. The values match those used by OTLP.
+type SpanKind int
+
+const SpanKindClient SpanKind = 3
+
+// StatusCode indicates whether the operation a span represents succeeded. The
+// values match those used by OTLP.
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Span records a single operation within a trace.
+type Span struct {
+	Attributes    map[string]interface{} // Values are strings or int64s.
+	End           time.Time
+	Kind          SpanKind
+	Name          string
+	Parent        [8]byte // The ID of the parent span, or all zeros if this is a root span.
+	SpanContext   SpanContext
+	Start         time.Time
+	StatusCode    StatusCode
+	StatusMessage string
+	TraceState    string
+
+	tracer *Tracer
+}
+
+// Exporter delivers finished spans to a tracing backend. ExportSpan must not
+// block for long, since it's invoked while requests are being handled.
+type Exporter interface {
+	ExportSpan(span *Span)
+	Shutdown(ctx context.Context) error
+}
+
+// Tracer creates spans and delivers them to an Exporter once they end.
+type Tracer struct {
+	exporter Exporter
+}
+
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// StartClientSpan starts a span representing the provided outbound request.
+// If the request carries a valid traceparent header, the span joins that
+// trace; otherwise, it starts a new one. The request's traceparent header is
+// replaced so that it identifies the new span, and the tracestate header is
+// relayed unchanged if the inbound traceparent was valid. Spans are only
+// exported if they're sampled; following the W3C recommendation, the sampling
+// decision of the inbound trace is respected, and new traces are sampled.
+func (tracer *Tracer) StartClientSpan(request *http.Request) *Span {
+	if tracer == nil {
+		return nil
+	}
+
+	span := &Span{
+		Attributes: map[string]interface{}{
+			"http.request.method": request.Method,
+			"server.address":      request.URL.Hostname(),
+			"url.full":            request.URL.String(),
+		},
+		Kind:   SpanKindClient,
+		Name:   request.Method,
+		Start:  time.Now(),
+		tracer: tracer,
+	}
+
+	if parent, ok := ParseTraceparent(request.Header.Get(TraceparentHeader)); ok {
+		span.SpanContext.TraceID = parent.TraceID
+		span.SpanContext.Sampled = parent.Sampled
+		span.Parent = parent.SpanID
+		span.TraceState = request.Header.Get(TracestateHeader)
+	} else {
+		// Without a valid traceparent, the tracestate is meaningless.
+		request.Header.Del(TracestateHeader)
+		randomBytes(span.SpanContext.TraceID[:])
+		span.SpanContext.Sampled = true
+	}
+	randomBytes(span.SpanContext.SpanID[:])
+
+	request.Header.Set(TraceparentHeader, span.SpanContext.Traceparent())
+	return span
+}
+
+// EndHTTP ends a span started by StartClientSpan, recording the status of the
+// response or the error which prevented the request from completing. A status
+// of 400 or greater is treated as an error, as OpenTelemetry recommends for
+// client spans.
+func (span *Span) EndHTTP(status int, err error) {
+	if span == nil {
+		return
+	}
+
+	if err != nil {
+		span.StatusCode = StatusError
+		span.StatusMessage = err.Error()
+	} else {
+		span.Attributes["http.response.status_code"] = int64(status)
+		if status >= 400 {
+			span.StatusCode = StatusError
+		}
+	}
+	span.end()
+}
+
+func (span *Span) end() {
+	span.End = time.Now()
+	if span.SpanContext.Sampled {
+		span.tracer.exporter.ExportSpan(span)
+	}
+}
+
+// Shutdown flushes any spans which haven't been exported yet and stops the
+// exporter.
+func (tracer *Tracer) Shutdown(ctx context.Context) error {
+	if tracer == nil {
+		return nil
+	}
+	return tracer.exporter.Shutdown(ctx)
+}
+
+// InMemoryExporter is an Exporter which keeps finished spans in memory. It's
+// intended for tests.
+type InMemoryExporter struct {
+	mutex sync.Mutex
+	spans []*Span
+}
+
+func (exporter *InMemoryExporter) ExportSpan(span *Span) {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	exporter.spans = append(exporter.spans, span)
+}
+
+func (exporter *InMemoryExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// Spans returns the spans which have been exported so far.
+func (exporter *InMemoryExporter) Spans() []*Span {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	return append([]*Span{}, exporter.spans...)
+}
+
+func randomBytes(destination []byte) {
+	if _, err := rand.Read(destination); err != nil {
+		// crypto/rand only fails if the system's entropy source is broken.
+		panic(fmt.Sprintf("Could not generate a trace ID: %v", err))
+	}
+}
@@ -0,0 +1,181 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay/tracing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		traceparent     string
+		expectValid     bool
+		expectedSampled bool
+	}{
+		{
+			desc:            "Sampled traceparents are parsed",
+			traceparent:     "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			expectValid:     true,
+			expectedSampled: true,
+		},
+		{
+			desc:            "Unsampled traceparents are parsed",
+			traceparent:     "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			expectValid:     true,
+			expectedSampled: false,
+		},
+		{
+			desc:            "Future versions may have additional fields",
+			traceparent:     "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			expectValid:     true,
+			expectedSampled: true,
+		},
+		{
+			desc:        "Version 00 may not have additional fields",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		},
+		{
+			desc:        "Version ff is invalid",
+			traceparent: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
+		{
+			desc:        "All-zero trace IDs are invalid",
+			traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		},
+		{
+			desc:        "All-zero span IDs are invalid",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		},
+		{
+			desc:        "Uppercase hex digits are invalid",
+			traceparent: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		},
+		{
+			desc:        "Truncated traceparents are invalid",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		},
+		{
+			desc:        "Empty traceparents are invalid",
+			traceparent: "",
+		},
+	}
+
+	for _, testCase := range testCases {
+		spanContext, valid := tracing.ParseTraceparent(testCase.traceparent)
+		if valid != testCase.expectValid {
+			t.Errorf("Test '%v': Expected valid: %v but got %v", testCase.desc, testCase.expectValid, valid)
+			continue
+		}
+		if !valid {
+			continue
+		}
+		if spanContext.Sampled != testCase.expectedSampled {
+			t.Errorf("Test '%v': Expected sampled: %v but got %v", testCase.desc, testCase.expectedSampled, spanContext.Sampled)
+		}
+		if testCase.traceparent[:2] == "00" && spanContext.Traceparent() != testCase.traceparent {
+			t.Errorf("Test '%v': Expected traceparent to round-trip but got '%v'", testCase.desc, spanContext.Traceparent())
+		}
+	}
+}
+
+type testProvider map[string]string
+
+func (provider testProvider) Lookup(key string) (string, bool) {
+	value, ok := provider[key]
+	return value, ok
+}
+
+func TestOTLPExporter(t *testing.T) {
+	type exportRequest struct {
+		authorization string
+		contentType   string
+		body          map[string]interface{}
+	}
+	requests := make(chan exportRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		exported := exportRequest{
+			authorization: request.Header.Get("Authorization"),
+			contentType:   request.Header.Get("Content-Type"),
+		}
+		if request.URL.Path != "/v1/traces" {
+			t.Errorf("Expected spans to be sent to /v1/traces but got %v", request.URL.Path)
+		}
+		if err := json.NewDecoder(request.Body).Decode(&exported.body); err != nil {
+			t.Errorf("Error decoding export request: %v", err)
+		}
+		requests <- exported
+	}))
+	defer collector.Close()
+
+	exporter, err := tracing.NewOTLPExporter(testProvider{
+		"OTEL_EXPORTER_OTLP_ENDPOINT": collector.URL,
+		"OTEL_EXPORTER_OTLP_HEADERS":  "Authorization=Bearer%20token",
+		"OTEL_SERVICE_NAME":           "test-relay",
+	})
+	if err != nil {
+		t.Fatalf("Error creating exporter: %v", err)
+	}
+	tracer := tracing.NewTracer(exporter)
+
+	request := httptest.NewRequest("GET", "http://target.example/path", nil)
+	request.Header.Set(tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	span := tracer.StartClientSpan(request)
+	span.EndHTTP(0, errors.New("connection refused"))
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Error shutting down tracer: %v", err)
+	}
+
+	var exported exportRequest
+	select {
+	case exported = <-requests:
+	default:
+		t.Fatalf("Expected spans to be exported on shutdown")
+	}
+
+	if exported.authorization != "Bearer token" {
+		t.Errorf("Expected Authorization header 'Bearer token' but got '%v'", exported.authorization)
+	}
+	if exported.contentType != "application/json" {
+		t.Errorf("Expected Content-Type 'application/json' but got '%v'", exported.contentType)
+	}
+
+	resourceSpans := exported.body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	resourceAttributes := resourceSpans["resource"].(map[string]interface{})["attributes"].([]interface{})
+	serviceName := resourceAttributes[0].(map[string]interface{})
+	if serviceName["key"] != "service.name" || serviceName["value"].(map[string]interface{})["stringValue"] != "test-relay" {
+		t.Errorf("Expected service.name 'test-relay' but got %v", serviceName)
+	}
+
+	exportedSpan := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})[0].(map[string]interface{})
+	expectedFields := map[string]interface{}{
+		"traceId":      "4bf92f3577b34da6a3ce929d0e0e4736",
+		"parentSpanId": "00f067aa0ba902b7",
+		"name":         "GET",
+		"kind":         float64(tracing.SpanKindClient),
+	}
+	for field, expected := range expectedFields {
+		if exportedSpan[field] != expected {
+			t.Errorf("Expected span %v '%v' but got '%v'", field, expected, exportedSpan[field])
+		}
+	}
+	status := exportedSpan["status"].(map[string]interface{})
+	if status["code"] != float64(tracing.StatusError) || status["message"] != "connection refused" {
+		t.Errorf("Expected an error status but got %v", status)
+	}
+}
+
+func TestOTLPExporterProtocol(t *testing.T) {
+	_, err := tracing.NewOTLPExporter(testProvider{
+		"OTEL_EXPORTER_OTLP_PROTOCOL": "grpc",
+	})
+	if err == nil {
+		t.Errorf("Expected an error for an unsupported protocol")
+	}
+}
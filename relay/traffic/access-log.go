@@ -0,0 +1,156 @@
+package traffic
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLog writes a line in the NCSA Combined Log Format for each request the
+// relay handles. It's separate from the diagnostic logs, and is meant for
+// offline analysis with standard web server tooling.
+type AccessLog struct {
+	file   *os.File // The open log file, or nil if the log is written to stdout.
+	mutex  sync.Mutex
+	path   string
+	writer io.Writer
+}
+
+// OpenAccessLog opens the access log at the provided path, creating it if
+// necessary. Lines are appended to any existing content. If the path is
+// "stdout", lines are written to standard output instead.
+func OpenAccessLog(path string) (*AccessLog, error) {
+	accessLog := &AccessLog{path: path}
+	if path == "stdout" {
+		accessLog.writer = os.Stdout
+		return accessLog, nil
+	}
+
+	file, err := openAccessLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	accessLog.file = file
+	accessLog.writer = file
+	return accessLog, nil
+}
+
+// Reopen closes and reopens the access log file. This allows the log to be
+// rotated: once the old file has been moved aside, reopening the log creates a
+// new file at the original path. It has no effect when logging to stdout.
+func (accessLog *AccessLog) Reopen() error {
+	if accessLog.file == nil {
+		return nil
+	}
+
+	file, err := openAccessLogFile(accessLog.path)
+	if err != nil {
+		return err
+	}
+
+	accessLog.mutex.Lock()
+	defer accessLog.mutex.Unlock()
+	accessLog.file.Close()
+	accessLog.file = file
+	accessLog.writer = file
+	return nil
+}
+
+// Close closes the access log file. It has no effect when logging to stdout.
+func (accessLog *AccessLog) Close() error {
+	if accessLog.file == nil {
+		return nil
+	}
+
+	accessLog.mutex.Lock()
+	defer accessLog.mutex.Unlock()
+	return accessLog.file.Close()
+}
+
+func (accessLog *AccessLog) String() string {
+	return accessLog.path
+}
+
+func (accessLog *AccessLog) write(entry *accessLogEntry, status int, bytesSent int64) {
+	size := "-"
+	if bytesSent > 0 {
+		size = fmt.Sprint(bytesSent)
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] \"%s\" %d %s \"%s\" \"%s\"\n",
+		entry.clientAddress,
+		entry.user,
+		entry.start.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.requestLine,
+		status,
+		size,
+		entry.referer,
+		entry.userAgent,
+	)
+
+	accessLog.mutex.Lock()
+	defer accessLog.mutex.Unlock()
+	if _, err := io.WriteString(accessLog.writer, line); err != nil {
+		logger.Errorf("Error writing to access log %v: %v", accessLog.path, err)
+	}
+}
+
+func openAccessLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// accessLogEntry holds the parts of an access log line which describe the
+// request. They're captured when the request arrives, before plugins or the
+// relay itself have a chance to modify it.
+type accessLogEntry struct {
+	clientAddress string
+	referer       string
+	requestLine   string
+	start         time.Time
+	user          string
+	userAgent     string
+}
+
+func newAccessLogEntry(request *http.Request, clientAddress string, start time.Time) *accessLogEntry {
+	user := "-"
+	if username, _, ok := request.BasicAuth(); ok && username != "" {
+		user = escapeAccessLogField(username)
+	}
+
+	return &accessLogEntry{
+		clientAddress: clientAddress,
+		referer:       escapeAccessLogField(request.Header.Get("Referer")),
+		requestLine:   escapeAccessLogField(fmt.Sprintf("%s %s %s", request.Method, request.RequestURI, request.Proto)),
+		start:         start,
+		user:          user,
+		userAgent:     escapeAccessLogField(request.Header.Get("User-Agent")),
+	}
+}
+
+// escapeAccessLogField escapes a value from the request so that it can't break
+// the format of the access log line. Quotes and backslashes are escaped with a
+// backslash, and control and non-ASCII bytes are written as \xhh, matching the
+// behavior of Apache. Empty values are written as "-".
+func escapeAccessLogField(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	var builder strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch b := value[i]; {
+		case b == '"' || b == '\\':
+			builder.WriteByte('\\')
+			builder.WriteByte(b)
+		case b < 0x20 || b >= 0x7f:
+			fmt.Fprintf(&builder, "\\x%02x", b)
+		default:
+			builder.WriteByte(b)
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,229 @@
+package traffic_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+// combinedLogFormat matches a line in the NCSA Combined Log Format and captures
+// each of its fields.
+var combinedLogFormat = regexp.MustCompile(`^(\S+) (\S+) (\S+) \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}) (\S+) "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)"$`)
+
+func TestAccessLog(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/empty" {
+			response.WriteHeader(http.StatusNoContent)
+			return
+		}
+		response.Write([]byte("Hello, world!"))
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc                string
+		path                string
+		headers             map[string]string
+		username            string
+		expectedUser        string
+		expectedRequestLine string
+		expectedStatus      string
+		expectedSize        string
+		expectedReferer     string
+		expectedUserAgent   string
+	}{
+		{
+			desc: "Requests are logged",
+			path: "/page?query=1",
+			headers: map[string]string{
+				"Referer":    "http://example.com/",
+				"User-Agent": "test-agent/1.0",
+			},
+			expectedUser:        "-",
+			expectedRequestLine: "GET /page?query=1 HTTP/1.1",
+			expectedStatus:      "200",
+			expectedSize:        "13",
+			expectedReferer:     "http://example.com/",
+			expectedUserAgent:   "test-agent/1.0",
+		},
+		{
+			desc: "Missing fields are logged as '-'",
+			path: "/empty",
+			headers: map[string]string{
+				"User-Agent": "",
+			},
+			expectedUser:        "-",
+			expectedRequestLine: "GET /empty HTTP/1.1",
+			expectedStatus:      "204",
+			expectedSize:        "-",
+			expectedReferer:     "-",
+			expectedUserAgent:   "-",
+		},
+		{
+			desc: "Quotes and unusual bytes are escaped",
+			path: "/",
+			headers: map[string]string{
+				"User-Agent": `agent "quoted" \ caf` + "\xc3\xa9",
+			},
+			username:            "alice",
+			expectedUser:        "alice",
+			expectedRequestLine: "GET / HTTP/1.1",
+			expectedStatus:      "200",
+			expectedSize:        "13",
+			expectedReferer:     "-",
+			expectedUserAgent:   `agent \"quoted\" \\ caf\xc3\xa9`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		accessLogPath := filepath.Join(t.TempDir(), "access.log")
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      access-log: %v
+        `, target.URL, accessLogPath)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			request, err := http.NewRequest("GET", relayService.HttpUrl()+testCase.path, nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			for name, value := range testCase.headers {
+				request.Header.Set(name, value)
+			}
+			if testCase.username != "" {
+				request.SetBasicAuth(testCase.username, "secret")
+			}
+
+			before := time.Now().Truncate(time.Second)
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+
+			lines := waitForAccessLogLines(accessLogPath, 1)
+			if len(lines) != 1 {
+				t.Errorf("Test '%v': Expected 1 access log line but got %v", testCase.desc, len(lines))
+				return
+			}
+
+			fields := combinedLogFormat.FindStringSubmatch(lines[0])
+			if fields == nil {
+				t.Errorf("Test '%v': Access log line isn't in the Combined Log Format: %v", testCase.desc, lines[0])
+				return
+			}
+
+			expectedFields := []struct {
+				name     string
+				index    int
+				expected string
+			}{
+				{"client address", 1, "127.0.0.1"},
+				{"identity", 2, "-"},
+				{"user", 3, testCase.expectedUser},
+				{"request line", 5, testCase.expectedRequestLine},
+				{"status", 6, testCase.expectedStatus},
+				{"size", 7, testCase.expectedSize},
+				{"referer", 8, testCase.expectedReferer},
+				{"user agent", 9, testCase.expectedUserAgent},
+			}
+			for _, field := range expectedFields {
+				if fields[field.index] != field.expected {
+					t.Errorf("Test '%v': Expected %v '%v' but got '%v'", testCase.desc, field.name, field.expected, fields[field.index])
+				}
+			}
+
+			timestamp, err := time.Parse("02/Jan/2006:15:04:05 -0700", fields[4])
+			if err != nil {
+				t.Errorf("Test '%v': Error parsing timestamp: %v", testCase.desc, err)
+			} else if timestamp.Before(before) || timestamp.After(time.Now()) {
+				t.Errorf("Test '%v': Timestamp %v isn't the time of the request", testCase.desc, timestamp)
+			}
+		})
+	}
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("OK"))
+	}))
+	defer target.Close()
+
+	directory := t.TempDir()
+	accessLogPath := filepath.Join(directory, "access.log")
+	rotatedPath := filepath.Join(directory, "access.log.1")
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+                                  access-log: %v
+    `, target.URL, accessLogPath)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		get := func(path string) {
+			response, err := http.Get(relayService.HttpUrl() + path)
+			if err != nil {
+				t.Errorf("Error GETing: %v", err)
+				return
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+
+		get("/before")
+		waitForAccessLogLines(accessLogPath, 1)
+
+		// Rotate the log, as a tool like logrotate would.
+		if err := os.Rename(accessLogPath, rotatedPath); err != nil {
+			t.Fatalf("Error rotating access log: %v", err)
+		}
+		if err := relayService.ReopenAccessLog(); err != nil {
+			t.Fatalf("Error reopening access log: %v", err)
+		}
+
+		get("/after")
+
+		for _, expected := range []struct {
+			path    string
+			request string
+		}{
+			{rotatedPath, "GET /before "},
+			{accessLogPath, "GET /after "},
+		} {
+			lines := waitForAccessLogLines(expected.path, 1)
+			if len(lines) != 1 || !strings.Contains(lines[0], expected.request) {
+				t.Errorf("Expected %v to contain only '%v' but got %v", expected.path, expected.request, lines)
+			}
+		}
+	})
+}
+
+// waitForAccessLogLines returns the lines of the access log at the provided
+// path once it contains at least the expected number of lines. Requests are
+// logged after the response is complete, so the client may see the response
+// before the line is written. If the lines don't appear within a second,
+// whatever lines are present are returned.
+func waitForAccessLogLines(path string, expected int) []string {
+	deadline := time.Now().Add(time.Second)
+	for {
+		var lines []string
+		if contents, _ := os.ReadFile(path); len(contents) > 0 {
+			lines = strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+		}
+		if len(lines) >= expected || time.Now().After(deadline) {
+			return lines
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,34 @@
+package traffic
+
+import (
+	"net/http"
+	"strings"
+)
+
+// allowMethod checks the request's method against AllowedMethods, and responds
+// with a 405 listing the allowed methods if it isn't one of them. It returns
+// true if the request may proceed. If AllowedMethods is empty, every method is
+// allowed.
+func (handler *Handler) allowMethod(clientResponse http.ResponseWriter, clientRequest *http.Request, requestInfo RequestInfo) bool {
+	allowedMethods := handler.config.AllowedMethods
+	if len(allowedMethods) == 0 {
+		return true
+	}
+
+	// If the relay is handling CORS, it answers preflight requests itself
+	// without involving the target, so they're always allowed.
+	if handler.cors != nil && isPreflight(clientRequest, requestInfo.OriginalOrigin) {
+		return true
+	}
+
+	for _, method := range allowedMethods {
+		if clientRequest.Method == method {
+			return true
+		}
+	}
+
+	loggerForRequest(clientRequest).Debugf("Rejecting request: method %v is not allowed", clientRequest.Method)
+	clientResponse.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+	handler.writeError(clientResponse, "Method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
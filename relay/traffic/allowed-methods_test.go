@@ -0,0 +1,81 @@
+package traffic_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestAllowedMethods(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		config         string
+		method         string
+		expectedStatus int
+		expectedAllow  string
+	}{
+		{
+			desc: "Allowed methods are relayed",
+			config: `relay:
+                        allowed-methods: get,HEAD
+            `,
+			method:         "GET",
+			expectedStatus: 200,
+		},
+		{
+			desc: "Other methods are rejected",
+			config: `relay:
+                        allowed-methods: get,HEAD
+            `,
+			method:         "POST",
+			expectedStatus: 405,
+			expectedAllow:  "GET, HEAD",
+		},
+		{
+			desc: "Methods are matched case-sensitively",
+			config: `relay:
+                        allowed-methods: GET
+            `,
+			method:         "get",
+			expectedStatus: 405,
+			expectedAllow:  "GET",
+		},
+		{
+			desc:           "All methods are allowed by default",
+			config:         "",
+			method:         "DELETE",
+			expectedStatus: 200,
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, testCase.config, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+			request, err := http.NewRequest(testCase.method, relayService.HttpUrl(), nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+			if allow := response.Header.Get("Allow"); allow != testCase.expectedAllow {
+				t.Errorf("Test '%v': Expected Allow header '%v' but got '%v'", testCase.desc, testCase.expectedAllow, allow)
+			}
+			if testCase.expectedStatus != 200 {
+				if _, err := catcherService.LastRequest(); err == nil {
+					t.Errorf("Test '%v': Expected the request not to reach the target", testCase.desc)
+				}
+			}
+		})
+	}
+}
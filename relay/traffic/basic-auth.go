@@ -0,0 +1,47 @@
+package traffic
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// authorize checks the request's Basic Auth credentials against those the
+// relay is configured to require, and responds with a 401 challenge if they
+// don't match. It returns true if the request may proceed. Unless
+// BasicAuthForward is set, the credentials are removed from the request once
+// they're validated, since they're intended for the relay and not the target.
+func (handler *Handler) authorize(clientResponse http.ResponseWriter, clientRequest *http.Request, requestInfo RequestInfo) bool {
+	if handler.config.BasicAuthUser == "" {
+		return true
+	}
+
+	// Browsers don't send credentials with CORS preflight requests. If the
+	// relay is handling CORS, it answers those itself without involving the
+	// target, so they don't need to be authorized.
+	if handler.cors != nil && isPreflight(clientRequest, requestInfo.OriginalOrigin) {
+		return true
+	}
+
+	user, password, ok := clientRequest.BasicAuth()
+	if !ok || !credentialsEqual(user, handler.config.BasicAuthUser) || !credentialsEqual(password, handler.config.BasicAuthPassword) {
+		loggerForRequest(clientRequest).Debugln("Rejecting request: invalid or missing credentials")
+		clientResponse.Header().Set("WWW-Authenticate", `Basic realm="relay", charset="UTF-8"`)
+		handler.writeError(clientResponse, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	if !handler.config.BasicAuthForward {
+		clientRequest.Header.Del("Authorization")
+	}
+	return true
+}
+
+// credentialsEqual compares a provided credential with the expected one in
+// constant time. Both are hashed first so that the comparison doesn't reveal
+// the expected credential's length, either.
+func credentialsEqual(provided string, expected string) bool {
+	providedHash := sha256.Sum256([]byte(provided))
+	expectedHash := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(providedHash[:], expectedHash[:]) == 1
+}
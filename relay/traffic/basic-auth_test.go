@@ -0,0 +1,199 @@
+package traffic_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/plugins/traffic/headers-plugin"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"github.com/fullstorydev/relay-core/relay/traffic"
+)
+
+func TestBasicAuth(t *testing.T) {
+	const authConfig = `relay:
+                           basic-auth-user: relay-user
+                           basic-auth-pass: relay-pass
+    `
+
+	testCases := []struct {
+		desc                  string
+		config                string
+		user                  string
+		password              string
+		expectedStatus        int
+		expectedAuthorization bool
+	}{
+		{
+			desc:           "Requests with valid credentials are relayed",
+			config:         authConfig,
+			user:           "relay-user",
+			password:       "relay-pass",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc:           "Requests with an invalid password are rejected",
+			config:         authConfig,
+			user:           "relay-user",
+			password:       "wrong",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			desc:           "Requests with an invalid user are rejected",
+			config:         authConfig,
+			user:           "someone-else",
+			password:       "relay-pass",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			desc:           "Requests without credentials are rejected",
+			config:         authConfig,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			desc: "Credentials are forwarded if configured",
+			config: `relay:
+                        basic-auth-user: relay-user
+                        basic-auth-pass: relay-pass
+                        basic-auth-forward: true
+            `,
+			user:                  "relay-user",
+			password:              "relay-pass",
+			expectedStatus:        http.StatusOK,
+			expectedAuthorization: true,
+		},
+		{
+			desc:                  "Requests aren't authorized by default",
+			config:                "",
+			user:                  "anyone",
+			password:              "anything",
+			expectedStatus:        http.StatusOK,
+			expectedAuthorization: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, testCase.config, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+			request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			if testCase.user != "" {
+				request.SetBasicAuth(testCase.user, testCase.password)
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+				return
+			}
+
+			if response.StatusCode == http.StatusUnauthorized {
+				if challenge := response.Header.Get("WWW-Authenticate"); challenge == "" {
+					t.Errorf("Test '%v': Expected a WWW-Authenticate challenge", testCase.desc)
+				}
+				if _, err := catcherService.LastRequest(); err == nil {
+					t.Errorf("Test '%v': Expected the request not to reach the target", testCase.desc)
+				}
+				return
+			}
+
+			lastRequest, err := catcherService.LastRequest()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading last request from catcher: %v", testCase.desc, err)
+				return
+			}
+			if authorization := lastRequest.Header.Get("Authorization") != ""; authorization != testCase.expectedAuthorization {
+				t.Errorf("Test '%v': Expected the target to receive an Authorization header: %v but got %v", testCase.desc, testCase.expectedAuthorization, authorization)
+			}
+		})
+	}
+}
+
+func TestBasicAuthWithInjectedAuthorization(t *testing.T) {
+	// The client's credentials are checked before plugins run, so an
+	// Authorization header added for the target neither replaces them nor is
+	// removed along with them.
+	configYaml := `
+relay:
+  basic-auth-user: relay-user
+  basic-auth-pass: relay-pass
+headers:
+  add-request-headers: "Authorization: Bearer upstream-token"
+`
+	plugins := []traffic.PluginFactory{
+		headers_plugin.Factory,
+	}
+
+	testCases := []struct {
+		desc           string
+		user           string
+		password       string
+		expectedStatus int
+	}{
+		{
+			desc:           "Requests with valid credentials are relayed with the injected header",
+			user:           "relay-user",
+			password:       "relay-pass",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc:           "Requests with invalid credentials are still rejected",
+			user:           "relay-user",
+			password:       "wrong",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			desc:           "Requests without credentials are still rejected",
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, configYaml, plugins, func(catcherService *catcher.Service, relayService *relay.Service) {
+			request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			if testCase.user != "" {
+				request.SetBasicAuth(testCase.user, testCase.password)
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+				return
+			}
+			if response.StatusCode == http.StatusUnauthorized {
+				if _, err := catcherService.LastRequest(); err == nil {
+					t.Errorf("Test '%v': Expected the request not to reach the target", testCase.desc)
+				}
+				return
+			}
+
+			lastRequest, err := catcherService.LastRequest()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading last request from catcher: %v", testCase.desc, err)
+				return
+			}
+			if authorization := lastRequest.Header.Get("Authorization"); authorization != "Bearer upstream-token" {
+				t.Errorf("Test '%v': Expected the target to receive Authorization 'Bearer upstream-token' but got '%v'", testCase.desc, authorization)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package traffic
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// BodyReplacement is a literal find/replace applied to relayed request bodies.
+type BodyReplacement struct {
+	From []byte
+	To   []byte
+}
+
+// replaceRequestBody applies the configured BodyReplacements to the request
+// body. Only bodies of at most MaxBodySize bytes are rewritten, since they must
+// be buffered in memory; larger bodies are relayed unchanged. Compressed bodies
+// are also relayed unchanged, since a literal replacement would corrupt them.
+func (handler *Handler) replaceRequestBody(request *http.Request) error {
+	if len(handler.config.BodyReplacements) == 0 || !methodHasBody(request.Method) {
+		return nil
+	}
+	if encoding := request.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return nil
+	}
+
+	body, err := handler.bufferRequestBody(request, handler.config.MaxBodySize)
+	if err != nil || body == nil {
+		return err
+	}
+
+	for _, replacement := range handler.config.BodyReplacements {
+		body = bytes.ReplaceAll(body, replacement.From, replacement.To)
+	}
+	setRequestBody(request, body)
+	return nil
+}
+
+// methodHasBody reports whether requests with the provided method are expected
+// to have a body.
+func methodHasBody(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	default:
+		return true
+	}
+}
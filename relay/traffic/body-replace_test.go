@@ -0,0 +1,115 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestBodyReplace(t *testing.T) {
+	const replaceConfig = `relay:
+                              body-replace: 'public.example=>internal.example,"env":"prod"=>"env":"staging"'
+    `
+
+	// The maximum body size also applies to the catcher's response, so it must
+	// be at least that large.
+	limitedConfig := fmt.Sprintf(`relay:
+                                     body-replace: 'public.example=>internal.example'
+                                     max-body-size: %v
+    `, len(catcher.IndexHTML))
+	largeBody := fmt.Sprintf(`{"host":"api.public.example","padding":"%v"}`, strings.Repeat("x", len(catcher.IndexHTML)))
+
+	testCases := []struct {
+		desc            string
+		config          string
+		contentType     string
+		contentEncoding string
+		body            string
+		expectedBody    string
+	}{
+		{
+			desc:         "Replacements are made in JSON bodies",
+			config:       replaceConfig,
+			contentType:  "application/json",
+			body:         `{"host":"api.public.example","env":"prod"}`,
+			expectedBody: `{"host":"api.internal.example","env":"staging"}`,
+		},
+		{
+			desc:         "Replacements are made in form-encoded bodies",
+			config:       replaceConfig,
+			contentType:  "application/x-www-form-urlencoded",
+			body:         "callback=https%3A%2F%2Fpublic.example%2Fdone&host=public.example",
+			expectedBody: "callback=https%3A%2F%2Finternal.example%2Fdone&host=internal.example",
+		},
+		{
+			desc:         "Bodies larger than the maximum body size are relayed unchanged",
+			config:       limitedConfig,
+			contentType:  "application/json",
+			body:         largeBody,
+			expectedBody: largeBody,
+		},
+		{
+			desc:            "Compressed bodies are relayed unchanged",
+			config:          replaceConfig,
+			contentType:     "application/json",
+			contentEncoding: "br",
+			body:            `{"host":"api.public.example"}`,
+			expectedBody:    `{"host":"api.public.example"}`,
+		},
+		{
+			desc:         "Bodies are relayed unchanged by default",
+			config:       "",
+			contentType:  "application/json",
+			body:         `{"host":"api.public.example"}`,
+			expectedBody: `{"host":"api.public.example"}`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, testCase.config, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+			request, err := http.NewRequest("POST", relayService.HttpUrl(), strings.NewReader(testCase.body))
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			request.Header.Set("Content-Type", testCase.contentType)
+			if testCase.contentEncoding != "" {
+				request.Header.Set("Content-Encoding", testCase.contentEncoding)
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error POSTing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+			if response.StatusCode != http.StatusOK {
+				t.Errorf("Test '%v': Expected status 200 but got %v", testCase.desc, response.StatusCode)
+				return
+			}
+
+			lastRequest, err := catcherService.LastRequest()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading last request from catcher: %v", testCase.desc, err)
+				return
+			}
+			if lastRequest.ContentLength != int64(len(testCase.expectedBody)) {
+				t.Errorf("Test '%v': Expected Content-Length %v but got %v", testCase.desc, len(testCase.expectedBody), lastRequest.ContentLength)
+			}
+
+			body, err := catcherService.LastRequestBody()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading last request body from catcher: %v", testCase.desc, err)
+				return
+			}
+			if string(body) != testCase.expectedBody {
+				t.Errorf("Test '%v': Expected body '%v' but got '%v'", testCase.desc, testCase.expectedBody, string(body))
+			}
+		})
+	}
+}
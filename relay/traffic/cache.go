@@ -0,0 +1,208 @@
+package traffic
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheHeaderName is the response header which tells clients whether a
+// response was served from the relay's cache ("HIT") or from the target
+// ("MISS").
+const CacheHeaderName = "X-Cache"
+
+// responseCache is an in-memory LRU cache of responses to GET requests. It
+// holds at most size responses, each no larger than MaxBodySize; when it's
+// full, the least recently used response is evicted. Responses are only cached
+// if their Cache-Control or Expires headers allow a shared cache to store them,
+// and only for as long as those headers say they're fresh. A size of zero
+// disables the cache.
+type responseCache struct {
+	entries map[string]*list.Element
+	lru     *list.List // Values are *cachedResponse, most recently used first.
+	mutex   sync.Mutex
+	size    int
+}
+
+type cachedResponse struct {
+	body    []byte
+	expires time.Time
+	header  http.Header
+	key     string
+	status  int
+	stored  time.Time
+}
+
+func newResponseCache(size int) *responseCache {
+	return &responseCache{
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		size:    size,
+	}
+}
+
+// cacheKey returns the key under which the response to the provided request is
+// cached, or the empty string if the request may not be served from the cache.
+// The key is based on the URL the client requested, rather than the target's
+// URL, since the relayed response may have been rewritten for that host.
+func (cache *responseCache) cacheKey(request *http.Request, requestInfo RequestInfo) string {
+	if cache.size <= 0 || request.Method != http.MethodGet {
+		return ""
+	}
+	// Responses to authorized requests may be specific to the client.
+	if request.Header.Get("Authorization") != "" {
+		return ""
+	}
+	if directives := parseCacheControl(request.Header); directives.has("no-store") || directives.has("no-cache") {
+		return ""
+	}
+	return request.Method + " " + requestInfo.OriginalHost + requestInfo.OriginalURL.RequestURI()
+}
+
+// serve writes the cached response for the provided key, if there's a fresh
+// one, and reports whether it did.
+func (cache *responseCache) serve(response http.ResponseWriter, key string) bool {
+	cache.mutex.Lock()
+	element := cache.entries[key]
+	var entry *cachedResponse
+	if element != nil {
+		entry = element.Value.(*cachedResponse)
+		if time.Now().Before(entry.expires) {
+			cache.lru.MoveToFront(element)
+		} else {
+			cache.lru.Remove(element)
+			delete(cache.entries, key)
+			entry = nil
+		}
+	}
+	cache.mutex.Unlock()
+
+	if entry == nil {
+		return false
+	}
+	for name, values := range entry.header {
+		for _, value := range values {
+			response.Header().Add(name, value)
+		}
+	}
+	response.Header().Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+	response.Header().Set(CacheHeaderName, "HIT")
+	response.WriteHeader(entry.status)
+	response.Write(entry.body)
+	return true
+}
+
+// store caches the provided response under the provided key if it's
+// cacheable. Its body is read into memory, and replaced so that it can still
+// be relayed. The response's headers should already be in the form they'll be
+// relayed in.
+func (cache *responseCache) store(key string, response *http.Response, maxBodySize int64) error {
+	if response.StatusCode != http.StatusOK ||
+		response.ContentLength < 0 || response.ContentLength > maxBodySize ||
+		response.Header.Get("Set-Cookie") != "" ||
+		response.Header.Get("Vary") != "" {
+		return nil
+	}
+	now := time.Now()
+	lifetime := freshnessLifetime(response.Header, now)
+	if lifetime <= 0 {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, response.ContentLength))
+	if err != nil {
+		return err
+	}
+	response.Body = struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(bytes.NewReader(body), response.Body),
+		Closer: response.Body,
+	}
+	if int64(len(body)) != response.ContentLength {
+		// The body is incomplete; relaying it will report the error.
+		return nil
+	}
+
+	entry := &cachedResponse{
+		body:    body,
+		expires: now.Add(lifetime),
+		header:  response.Header.Clone(),
+		key:     key,
+		status:  response.StatusCode,
+		stored:  now,
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if element := cache.entries[key]; element != nil {
+		cache.lru.Remove(element)
+	}
+	cache.entries[key] = cache.lru.PushFront(entry)
+	for cache.lru.Len() > cache.size {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cachedResponse).key)
+	}
+	return nil
+}
+
+// freshnessLifetime returns how long a shared cache may serve a response with
+// the provided headers, following RFC 9111. Responses marked no-store,
+// private, or no-cache aren't cached at all.
+func freshnessLifetime(header http.Header, now time.Time) time.Duration {
+	directives := parseCacheControl(header)
+	if directives.has("no-store") || directives.has("private") || directives.has("no-cache") {
+		return 0
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[name]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	expires := header.Get("Expires")
+	if expires == "" {
+		return 0
+	}
+	expiresAt, err := http.ParseTime(expires)
+	if err != nil {
+		return 0
+	}
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		now = date
+	}
+	return expiresAt.Sub(now)
+}
+
+// cacheControl maps the names of Cache-Control directives to their values,
+// which are empty for directives without one.
+type cacheControl map[string]string
+
+func (directives cacheControl) has(name string) bool {
+	_, ok := directives[name]
+	return ok
+}
+
+func parseCacheControl(header http.Header) cacheControl {
+	directives := cacheControl{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return directives
+}
@@ -0,0 +1,167 @@
+package traffic_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"github.com/fullstorydev/relay-core/relay/traffic"
+)
+
+func TestResponseCache(t *testing.T) {
+	// The target responds to each path with the Cache-Control header named by
+	// the path, and a body which counts the requests it has received.
+	requestCount := &atomic.Int64{}
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		count := requestCount.Add(1)
+		switch request.URL.Path {
+		case "/max-age":
+			response.Header().Set("Cache-Control", "public, max-age=60")
+		case "/expires":
+			response.Header().Set("Expires", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+		case "/no-store":
+			response.Header().Set("Cache-Control", "no-store")
+		case "/private":
+			response.Header().Set("Cache-Control", "private, max-age=60")
+		case "/stale":
+			response.Header().Set("Cache-Control", "max-age=0")
+		}
+		response.Write([]byte(fmt.Sprintf("response %v", count)))
+	}))
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+                                  cache-size: 10
+    `, target.URL)
+
+	testCases := []struct {
+		desc         string
+		path         string
+		expectCached bool
+	}{
+		{
+			desc:         "Responses with max-age are cached",
+			path:         "/max-age",
+			expectCached: true,
+		},
+		{
+			desc:         "Responses with a future Expires header are cached",
+			path:         "/expires",
+			expectCached: true,
+		},
+		{
+			desc:         "Responses marked no-store aren't cached",
+			path:         "/no-store",
+			expectCached: false,
+		},
+		{
+			desc:         "Responses marked private aren't cached",
+			path:         "/private",
+			expectCached: false,
+		},
+		{
+			desc:         "Stale responses aren't cached",
+			path:         "/stale",
+			expectCached: false,
+		},
+		{
+			desc:         "Responses without caching headers aren't cached",
+			path:         "/",
+			expectCached: false,
+		},
+	}
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		get := func(path string) (string, string) {
+			response, err := http.Get(relayService.HttpUrl() + path)
+			if err != nil {
+				t.Errorf("Error GETing %v: %v", path, err)
+				return "", ""
+			}
+			defer response.Body.Close()
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Errorf("Error reading response body for %v: %v", path, err)
+			}
+			return string(body), response.Header.Get(traffic.CacheHeaderName)
+		}
+
+		firstBodies := map[string]string{}
+		for _, testCase := range testCases {
+			firstBody, firstCache := get(testCase.path)
+			secondBody, secondCache := get(testCase.path)
+			firstBodies[testCase.path] = firstBody
+
+			if firstCache != "MISS" {
+				t.Errorf("Test '%v': Expected the first response to be a MISS but got '%v'", testCase.desc, firstCache)
+			}
+			if testCase.expectCached {
+				if secondCache != "HIT" || secondBody != firstBody {
+					t.Errorf("Test '%v': Expected the cached response '%v' but got '%v' (%v)", testCase.desc, firstBody, secondBody, secondCache)
+				}
+			} else if secondCache != "MISS" || secondBody == firstBody {
+				t.Errorf("Test '%v': Expected a fresh response but got '%v' (%v)", testCase.desc, secondBody, secondCache)
+			}
+		}
+
+		// Cached responses are served even once the target is gone.
+		target.Close()
+		for _, testCase := range testCases {
+			if !testCase.expectCached {
+				continue
+			}
+			if body, cache := get(testCase.path); cache != "HIT" || body != firstBodies[testCase.path] {
+				t.Errorf("Test '%v': Expected the cached response '%v' after the target stopped but got '%v' (%v)", testCase.desc, firstBodies[testCase.path], body, cache)
+			}
+		}
+	})
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	requestCount := &atomic.Int64{}
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requestCount.Add(1)
+		response.Header().Set("Cache-Control", "max-age=60")
+		response.Write([]byte(request.URL.Path))
+	}))
+	defer target.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+                                  cache-size: 2
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		// Requesting /c evicts /b, since /a was used more recently.
+		for _, path := range []string{"/a", "/b", "/a", "/c"} {
+			if body := getBody(relayService.HttpUrl()+path, t); body == nil {
+				return
+			}
+		}
+		if count := requestCount.Load(); count != 3 {
+			t.Errorf("Expected the target to receive 3 requests but it received %v", count)
+		}
+
+		for _, path := range []string{"/a", "/c"} {
+			if body := getBody(relayService.HttpUrl()+path, t); body == nil {
+				return
+			}
+		}
+		if count := requestCount.Load(); count != 3 {
+			t.Errorf("Expected cached responses to be served, but the target received %v requests", count)
+		}
+
+		if body := getBody(relayService.HttpUrl()+"/b", t); body == nil {
+			return
+		}
+		if count := requestCount.Load(); count != 4 {
+			t.Errorf("Expected the evicted response to be requested again, but the target received %v requests", count)
+		}
+	})
+}
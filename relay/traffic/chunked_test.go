@@ -0,0 +1,187 @@
+package traffic_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+// chunkedEchoServer starts a target which echoes request bodies, and reports
+// how each body was framed in the X-Received-Length and
+// X-Received-Transfer-Encoding response headers.
+func chunkedEchoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		response.Header().Set("X-Received-Length", fmt.Sprint(request.ContentLength))
+		response.Header().Set("X-Received-Transfer-Encoding", strings.Join(request.TransferEncoding, ","))
+		response.Write(body)
+	}))
+}
+
+func TestChunkedRequestBody(t *testing.T) {
+	target := chunkedEchoServer()
+	defer target.Close()
+
+	body := strings.Repeat("public.example ", 100)
+
+	testCases := []struct {
+		desc                     string
+		options                  string
+		expectedStatus           int
+		expectedBody             string
+		expectedLength           string
+		expectedTransferEncoding string
+	}{
+		{
+			desc:                     "Chunked bodies are relayed chunked",
+			expectedStatus:           http.StatusOK,
+			expectedBody:             body,
+			expectedLength:           "-1",
+			expectedTransferEncoding: "chunked",
+		},
+		{
+			desc:                     "Chunked bodies within the request body limit are relayed with a Content-Length",
+			options:                  "max-request-body-size: 10000",
+			expectedStatus:           http.StatusOK,
+			expectedBody:             body,
+			expectedLength:           fmt.Sprint(len(body)),
+			expectedTransferEncoding: "",
+		},
+		{
+			desc:           "Chunked bodies over the request body limit are rejected",
+			options:        "max-request-body-size: 100",
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			desc:                     "Replacements are made in chunked bodies",
+			options:                  "body-replace: 'public.example=>internal.example'",
+			expectedStatus:           http.StatusOK,
+			expectedBody:             strings.Repeat("internal.example ", 100),
+			expectedLength:           fmt.Sprint(len(strings.Repeat("internal.example ", 100))),
+			expectedTransferEncoding: "",
+		},
+		{
+			desc:                     "Chunked bodies can be retried",
+			options:                  "max-retries: 2",
+			expectedStatus:           http.StatusOK,
+			expectedBody:             body,
+			expectedLength:           "-1",
+			expectedTransferEncoding: "chunked",
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      %v
+        `, target.URL, testCase.options)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			// Hiding the reader's type prevents the client from determining
+			// the body's length, so it's sent chunked.
+			requestBody := struct{ io.Reader }{strings.NewReader(body)}
+			request, err := http.NewRequest("PUT", relayService.HttpUrl(), requestBody)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+				return
+			}
+			if response.StatusCode != http.StatusOK {
+				return
+			}
+
+			responseBody, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Errorf("Test '%v': Error reading response body: %v", testCase.desc, err)
+			} else if string(responseBody) != testCase.expectedBody {
+				t.Errorf("Test '%v': Expected body '%v' but got '%s'", testCase.desc, testCase.expectedBody, responseBody)
+			}
+			if length := response.Header.Get("X-Received-Length"); length != testCase.expectedLength {
+				t.Errorf("Test '%v': Expected the target to receive length %v but got %v", testCase.desc, testCase.expectedLength, length)
+			}
+			if encoding := response.Header.Get("X-Received-Transfer-Encoding"); encoding != testCase.expectedTransferEncoding {
+				t.Errorf("Test '%v': Expected the target to receive Transfer-Encoding '%v' but got '%v'", testCase.desc, testCase.expectedTransferEncoding, encoding)
+			}
+		})
+	}
+}
+
+func TestChunkedRequestBodyIsStreamed(t *testing.T) {
+	// The target reports the first chunk of the body as soon as it arrives.
+	firstChunks := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		buffer := make([]byte, 5)
+		if _, err := io.ReadFull(request.Body, buffer); err != nil {
+			firstChunks <- ""
+			return
+		}
+		firstChunks <- string(buffer)
+		io.Copy(io.Discard, request.Body)
+		response.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		bodyReader, bodyWriter := io.Pipe()
+		request, err := http.NewRequest("POST", relayService.HttpUrl(), bodyReader)
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+
+		responses := make(chan *http.Response, 1)
+		go func() {
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Error sending request: %v", err)
+				responses <- nil
+				return
+			}
+			responses <- response
+		}()
+
+		// The first chunk must reach the target before the body is complete.
+		bodyWriter.Write([]byte("first"))
+		select {
+		case firstChunk := <-firstChunks:
+			if firstChunk != "first" {
+				t.Errorf("Expected the target to receive 'first' but got '%v'", firstChunk)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("The first chunk didn't reach the target before the body was complete")
+		}
+		bodyWriter.Write([]byte("second"))
+		bodyWriter.Close()
+
+		if response := <-responses; response != nil {
+			response.Body.Close()
+			if response.StatusCode != http.StatusOK {
+				t.Errorf("Expected status 200 but got %v", response.StatusCode)
+			}
+		}
+	})
+}
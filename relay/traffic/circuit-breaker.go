@@ -0,0 +1,123 @@
+package traffic
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreaker stops the relay from sending requests to targets which are
+// failing. Each target host has its own circuit. After threshold consecutive
+// requests to a host fail, its circuit opens, and requests to it are rejected
+// immediately rather than waiting for another failure. Once cooldown has
+// passed, the circuit is half-open: a single trial request is allowed through,
+// and its outcome determines whether the circuit closes again or reopens for
+// another cooldown period.
+//
+// Failures only count as consecutive if each occurs within cooldown of the
+// previous one, so occasional failures spread out over time never open the
+// circuit. A threshold of zero disables the breaker.
+type circuitBreaker struct {
+	cooldown  time.Duration
+	circuits  map[string]*hostCircuit
+	mutex     sync.Mutex
+	threshold int
+}
+
+type hostCircuit struct {
+	failures    int       // The number of consecutive failures.
+	lastFailure time.Time // When the most recent failure occurred.
+	open        bool      // If true, requests are rejected until the cooldown has passed.
+	openedAt    time.Time // When the circuit last opened.
+	trialActive bool      // If true, a trial request is in flight while the circuit is half-open.
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		cooldown:  cooldown,
+		circuits:  map[string]*hostCircuit{},
+		threshold: threshold,
+	}
+}
+
+// allow reports whether a request to the provided host may be sent. Every
+// allowed request must be followed by a call to recordSuccess, recordFailure,
+// or abandon once its outcome is known.
+func (breaker *circuitBreaker) allow(host string) bool {
+	if breaker.threshold <= 0 {
+		return true
+	}
+
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	circuit := breaker.circuits[host]
+	if circuit == nil || !circuit.open {
+		return true
+	}
+	if time.Since(circuit.openedAt) < breaker.cooldown || circuit.trialActive {
+		return false
+	}
+	circuit.trialActive = true
+	return true
+}
+
+// recordSuccess closes the circuit for the provided host.
+func (breaker *circuitBreaker) recordSuccess(host string) {
+	if breaker.threshold <= 0 {
+		return
+	}
+
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if circuit := breaker.circuits[host]; circuit != nil && circuit.open {
+		logger.Printf("Circuit closed for %v", host)
+	}
+	delete(breaker.circuits, host)
+}
+
+// recordFailure counts a failed request to the provided host, opening its
+// circuit if the threshold has been reached or if the request was a trial.
+func (breaker *circuitBreaker) recordFailure(host string) {
+	if breaker.threshold <= 0 {
+		return
+	}
+
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	now := time.Now()
+	circuit := breaker.circuits[host]
+	if circuit == nil {
+		circuit = &hostCircuit{}
+		breaker.circuits[host] = circuit
+	}
+	if now.Sub(circuit.lastFailure) > breaker.cooldown {
+		circuit.failures = 0
+	}
+	circuit.failures++
+	circuit.lastFailure = now
+
+	if circuit.trialActive || circuit.failures >= breaker.threshold {
+		if !circuit.open {
+			logger.Warnf("Circuit opened for %v after %v consecutive failures", host, circuit.failures)
+		}
+		circuit.open = true
+		circuit.openedAt = now
+		circuit.trialActive = false
+	}
+}
+
+// abandon records that a request to the provided host ended without revealing
+// anything about the host's health - for example, because the client went
+// away. If the request was a trial, another request may take its place.
+func (breaker *circuitBreaker) abandon(host string) {
+	if breaker.threshold <= 0 {
+		return
+	}
+
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if circuit := breaker.circuits[host]; circuit != nil {
+		circuit.trialActive = false
+	}
+}
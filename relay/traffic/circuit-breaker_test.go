@@ -0,0 +1,101 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	// Reserve a port and then release it, so that nothing is listening there
+	// until the test starts the target.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error reserving port: %v", err)
+	}
+	targetAddress := listener.Addr().String()
+	listener.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: http://%v
+                                  circuit-breaker-threshold: 2
+                                  circuit-breaker-cooldown: 200ms
+    `, targetAddress)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		expectStatus := func(desc string, expectedStatus int) {
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", desc, err)
+				return
+			}
+			response.Body.Close()
+			if response.StatusCode != expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", desc, expectedStatus, response.StatusCode)
+			}
+		}
+
+		expectStatus("The first failure is reported", 502)
+		expectStatus("The second failure is reported and opens the circuit", 502)
+		expectStatus("Requests are rejected while the circuit is open", 503)
+
+		time.Sleep(250 * time.Millisecond)
+		expectStatus("A failed trial request is reported", 502)
+		expectStatus("A failed trial request reopens the circuit", 503)
+
+		// Bring the target up.
+		listener, err := net.Listen("tcp", targetAddress)
+		if err != nil {
+			t.Errorf("Error starting target: %v", err)
+			return
+		}
+		target := &httptest.Server{
+			Listener: listener,
+			Config: &http.Server{Handler: http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				response.Write([]byte("OK"))
+			})},
+		}
+		target.Start()
+		defer target.Close()
+
+		expectStatus("Requests are rejected until the cooldown has passed", 503)
+
+		time.Sleep(250 * time.Millisecond)
+		expectStatus("A successful trial request is relayed", 200)
+		expectStatus("A successful trial request closes the circuit", 200)
+	})
+}
+
+func TestCircuitBreakerDisabledByDefault(t *testing.T) {
+	// Reserve a port and then release it, so that nothing is listening there.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error reserving port: %v", err)
+	}
+	targetURL := fmt.Sprintf("http://%v", listener.Addr())
+	listener.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+    `, targetURL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		for i := 0; i < 10; i++ {
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Error GETing: %v", err)
+				return
+			}
+			response.Body.Close()
+			if response.StatusCode != 502 {
+				t.Errorf("Expected status 502 for request %v but got %v", i, response.StatusCode)
+			}
+		}
+	})
+}
@@ -0,0 +1,92 @@
+package traffic_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestClientKeepAlive(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("OK"))
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc         string
+		keepAlive    bool
+		expectClose  bool
+		expectReused bool
+	}{
+		{
+			desc:         "Client connections are kept alive by default",
+			keepAlive:    true,
+			expectClose:  false,
+			expectReused: true,
+		},
+		{
+			desc:         "Client connections are closed if keep-alive is disabled",
+			keepAlive:    false,
+			expectClose:  true,
+			expectReused: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      client-keepalive: %v
+        `, target.URL, testCase.keepAlive)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			client := &http.Client{Transport: &http.Transport{}}
+			defer client.CloseIdleConnections()
+
+			// The second request reuses the first request's connection if
+			// the relay kept it alive.
+			var reused bool
+			for i := 0; i < 2; i++ {
+				trace := &httptrace.ClientTrace{
+					GotConn: func(info httptrace.GotConnInfo) {
+						reused = info.Reused
+					},
+				}
+				request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+				if err != nil {
+					t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+					return
+				}
+				request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+
+				response, err := client.Do(request)
+				if err != nil {
+					t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+					return
+				}
+				io.Copy(io.Discard, response.Body)
+				response.Body.Close()
+
+				// The client removes "Connection: close" from the response's
+				// headers and reports it via the Close field instead.
+				if response.Close != testCase.expectClose {
+					t.Errorf(
+						"Test '%v': Expected a Connection: close header %v but got %v",
+						testCase.desc,
+						testCase.expectClose,
+						response.Close,
+					)
+				}
+			}
+
+			if reused != testCase.expectReused {
+				t.Errorf("Test '%v': Expected connection reuse %v but got %v", testCase.desc, testCase.expectReused, reused)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestForceClientScheme(t *testing.T) {
+	// The target reports the X-Forwarded-Proto header it received, and
+	// redirects requests for /redirect to another page on its own host.
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("X-Received-Proto", request.Header.Get("X-Forwarded-Proto"))
+		if request.URL.Path == "/redirect" {
+			http.Redirect(response, request, fmt.Sprintf("http://%v/landing", request.Host), http.StatusFound)
+			return
+		}
+		response.Write([]byte("OK"))
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc             string
+		scheme           string
+		expectedProto    string
+		expectedLocation string
+	}{
+		{
+			desc:             "The detected scheme is used by default",
+			scheme:           "",
+			expectedProto:    "http",
+			expectedLocation: "http",
+		},
+		{
+			desc:             "The forced scheme is used for X-Forwarded-Proto and redirects",
+			scheme:           "https",
+			expectedProto:    "https",
+			expectedLocation: "https",
+		},
+	}
+
+	// Redirects are inspected rather than followed.
+	client := &http.Client{
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      force-client-scheme: '%v'
+        `, target.URL, testCase.scheme)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			response, err := client.Get(relayService.HttpUrl() + "/redirect")
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			if proto := response.Header.Get("X-Received-Proto"); proto != testCase.expectedProto {
+				t.Errorf("Test '%v': Expected X-Forwarded-Proto '%v' but got '%v'", testCase.desc, testCase.expectedProto, proto)
+			}
+
+			location, err := url.Parse(response.Header.Get("Location"))
+			if err != nil {
+				t.Errorf("Test '%v': Error parsing Location: %v", testCase.desc, err)
+				return
+			}
+			relayURL, _ := url.Parse(relayService.HttpUrl())
+			if location.Scheme != testCase.expectedLocation || location.Host != relayURL.Host || location.Path != "/landing" {
+				t.Errorf(
+					"Test '%v': Expected a redirect to %v://%v/landing but got '%v'",
+					testCase.desc,
+					testCase.expectedLocation,
+					relayURL.Host,
+					location,
+				)
+			}
+		})
+	}
+}
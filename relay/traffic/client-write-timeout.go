@@ -0,0 +1,58 @@
+package traffic
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// deadlineWriter extends the client connection's write deadline before each
+// write, so that a write blocked by a client which has stopped reading fails
+// once the timeout passes, rather than blocking indefinitely.
+type deadlineWriter struct {
+	controller  *http.ResponseController
+	timeout     time.Duration
+	unsupported bool // Set if the connection doesn't support write deadlines.
+	writer      io.Writer
+}
+
+func (writer *deadlineWriter) Write(data []byte) (int, error) {
+	if !writer.unsupported {
+		if err := writer.controller.SetWriteDeadline(time.Now().Add(writer.timeout)); err != nil {
+			writer.unsupported = true
+		}
+	}
+	return writer.writer.Write(data)
+}
+
+// clearDeadline removes the write deadline, so that it doesn't affect later
+// requests on the same connection.
+func (writer *deadlineWriter) clearDeadline() {
+	if !writer.unsupported {
+		writer.controller.SetWriteDeadline(time.Time{})
+	}
+}
+
+// withClientWriteTimeout returns a writer which writes to the provided writer,
+// enforcing ClientWriteTimeout on each write of the response body to the
+// client. Since response bodies are streamed from the target, a client which
+// reads very slowly would otherwise tie up the connection to the target too.
+// When a write times out it fails, and the caller aborts the response, which
+// closes both connections.
+//
+// The returned function must be called once the body has been written. If no
+// timeout is configured, the writer is returned unchanged. The timeout replaces
+// the server's write timeout while the body is being written.
+func (handler *Handler) withClientWriteTimeout(clientResponse http.ResponseWriter, writer io.Writer) (io.Writer, func()) {
+	timeout := handler.config.ClientWriteTimeout
+	if timeout <= 0 {
+		return writer, func() {}
+	}
+
+	deadlineWriter := &deadlineWriter{
+		controller: http.NewResponseController(clientResponse),
+		timeout:    timeout,
+		writer:     writer,
+	}
+	return deadlineWriter, deadlineWriter.clearDeadline
+}
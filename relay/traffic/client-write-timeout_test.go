@@ -0,0 +1,110 @@
+package traffic_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+// zeroReader is an endless source of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(data []byte) (int, error) {
+	for i := range data {
+		data[i] = 0
+	}
+	return len(data), nil
+}
+
+func TestClientWriteTimeout(t *testing.T) {
+	// The response body is much larger than the socket buffers between the
+	// relay and the client, so relaying it blocks once the client stops
+	// reading. The target reports when writing the body fails, which happens
+	// when the relay closes its connection.
+	const bodySize = 256 * 1024 * 1024
+	targetDone := make(chan error, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Length", strconv.Itoa(bodySize))
+		_, err := io.CopyN(response, zeroReader{}, bodySize)
+		targetDone <- err
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc     string
+		streamed bool
+	}{
+		{
+			desc: "A stalled client is abandoned when the body has a known length",
+		},
+		{
+			desc:     "A stalled client is abandoned when the body is streamed",
+			streamed: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		targetURL := target.URL
+		if testCase.streamed {
+			// A target without a Content-Length is relayed via a second
+			// server which streams the first one's body.
+			streamingTarget := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				upstream, err := http.Get(target.URL)
+				if err != nil {
+					response.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				defer upstream.Body.Close()
+				response.WriteHeader(http.StatusOK)
+				io.Copy(response, upstream.Body)
+			}))
+			defer streamingTarget.Close()
+			targetURL = streamingTarget.URL
+		}
+
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      max-body-size: %v
+                                      client-write-timeout: 200ms
+        `, targetURL, 2*bodySize)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			conn, err := net.Dial("tcp", relayService.Address())
+			if err != nil {
+				t.Errorf("Test '%v': Error connecting to relay: %v", testCase.desc, err)
+				return
+			}
+			defer conn.Close()
+
+			// Read the response headers, then stop reading.
+			fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %v\r\n\r\n", relayService.Address())
+			response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error reading response: %v", testCase.desc, err)
+				return
+			}
+			if response.StatusCode != http.StatusOK {
+				t.Errorf("Test '%v': Expected status 200 but got %v", testCase.desc, response.StatusCode)
+				return
+			}
+
+			select {
+			case err := <-targetDone:
+				if err == nil {
+					t.Errorf("Test '%v': Expected the relay to abandon the response, but the target sent all of it", testCase.desc)
+				}
+			case <-time.After(10 * time.Second):
+				t.Errorf("Test '%v': Expected the relay to give up on the stalled client", testCase.desc)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package traffic
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressibleContentTypes lists the media types of responses which the relay
+// compresses. Other types, like images and video, are usually compressed
+// already. Types with a "+json" or "+xml" suffix are also compressed.
+var compressibleContentTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+	"text/css":               true,
+	"text/csv":               true,
+	"text/html":              true,
+	"text/javascript":        true,
+	"text/plain":             true,
+	"text/xml":               true,
+}
+
+// shouldCompress reports whether the relay should gzip the target's response.
+// Only uncompressed responses of a compressible type are compressed, and only
+// if the client accepts gzip, as reported by acceptsGzip. Responses whose length
+// is known must be at least CompressMinSize bytes; streamed responses are
+// always compressed, since their length isn't known in advance.
+func (handler *Handler) shouldCompress(clientAcceptsGzip bool, targetResponse *http.Response) bool {
+	if !handler.config.CompressResponse || !clientAcceptsGzip {
+		return false
+	}
+	if encoding := targetResponse.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+	switch targetResponse.StatusCode {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		return false
+	}
+	if length := targetResponse.ContentLength; length >= 0 && (length < handler.config.CompressMinSize || length > handler.config.MaxBodySize) {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(targetResponse.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return compressibleContentTypes[mediaType] || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// acceptsGzip reports whether the provided request headers list gzip in
+// Accept-Encoding, without a quality value of zero.
+func acceptsGzip(header http.Header) bool {
+	for _, value := range header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			if quality, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				if q, err := strconv.ParseFloat(quality, 64); err == nil && q == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// compressResponse updates the target's response headers to describe a gzipped
+// body, and returns a writer which compresses the body as it's relayed to the
+// client. The writer must be closed once the body has been written.
+func compressResponse(clientResponse http.ResponseWriter, targetResponse *http.Response) *gzipResponseWriter {
+	targetResponse.Header.Del("Content-Length")
+	targetResponse.Header.Set("Content-Encoding", "gzip")
+	targetResponse.Header.Add("Vary", "Accept-Encoding")
+
+	// A strong ETag identifies an exact sequence of bytes, which the
+	// compressed body no longer is.
+	if etag := targetResponse.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		targetResponse.Header.Set("ETag", "W/"+etag)
+	}
+	return &gzipResponseWriter{ResponseWriter: clientResponse}
+}
+
+// gzipResponseWriter gzips the response body written to it. Since the length
+// of the compressed body isn't known in advance, any Content-Length header is
+// removed when the response header is written.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gzipWriter  *gzip.Writer // Created by the first write, so that responses without a body stay empty.
+	wroteHeader bool
+}
+
+func (writer *gzipResponseWriter) WriteHeader(status int) {
+	if status >= 200 {
+		writer.wroteHeader = true
+		writer.Header().Del("Content-Length")
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !writer.wroteHeader {
+		writer.WriteHeader(http.StatusOK)
+	}
+	if writer.gzipWriter == nil {
+		writer.gzipWriter = gzip.NewWriter(writer.ResponseWriter)
+	}
+	return writer.gzipWriter.Write(data)
+}
+
+// Flush sends everything written so far to the client, so that streamed
+// responses aren't delayed by compression.
+func (writer *gzipResponseWriter) Flush() {
+	if writer.gzipWriter != nil {
+		writer.gzipWriter.Flush()
+	}
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close finishes the compressed body, if anything was written.
+func (writer *gzipResponseWriter) Close() error {
+	if writer.gzipWriter == nil {
+		return nil
+	}
+	return writer.gzipWriter.Close()
+}
+
+// Unwrap returns the underlying http.ResponseWriter. This allows
+// http.ResponseController to access its features.
+func (writer *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
@@ -0,0 +1,189 @@
+package traffic_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestCompressResponse(t *testing.T) {
+	largeHTML := "<html>" + strings.Repeat("<p>Hello, world!</p>", 200) + "</html>"
+	var gzippedHTML bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzippedHTML)
+	gzipWriter.Write([]byte(largeHTML))
+	gzipWriter.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/html", func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "text/html; charset=utf-8")
+		response.Header().Set("ETag", `"v1"`)
+		io.WriteString(response, largeHTML)
+	})
+	mux.HandleFunc("/small", func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "text/html")
+		io.WriteString(response, "<html>Hi</html>")
+	})
+	mux.HandleFunc("/image", func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "image/png")
+		io.WriteString(response, largeHTML)
+	})
+	mux.HandleFunc("/gzipped", func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "text/html")
+		response.Header().Set("Content-Encoding", "gzip")
+		response.Write(gzippedHTML.Bytes())
+	})
+	mux.HandleFunc("/stream", func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "application/json")
+		for i := 0; i < 3; i++ {
+			io.WriteString(response, largeHTML[:100])
+			response.(http.Flusher).Flush()
+		}
+	})
+	target := httptest.NewServer(mux)
+	defer target.Close()
+
+	testCases := []struct {
+		desc             string
+		compress         bool
+		whitelist        string
+		path             string
+		acceptEncoding   string
+		expectCompressed bool
+		expectedEncoding string
+		expectedBody     string
+	}{
+		{
+			desc:             "Text responses are compressed for clients which accept gzip",
+			compress:         true,
+			path:             "/html",
+			acceptEncoding:   "gzip, deflate",
+			expectCompressed: true,
+			expectedBody:     largeHTML,
+		},
+		{
+			desc:           "Responses aren't compressed if compression is disabled",
+			path:           "/html",
+			acceptEncoding: "gzip",
+			expectedBody:   largeHTML,
+		},
+		{
+			desc:           "Responses aren't compressed for clients which don't accept gzip",
+			compress:       true,
+			path:           "/html",
+			acceptEncoding: "deflate",
+			expectedBody:   largeHTML,
+		},
+		{
+			desc:           "Responses aren't compressed for clients which refuse gzip",
+			compress:       true,
+			path:           "/html",
+			acceptEncoding: "gzip;q=0, deflate",
+			expectedBody:   largeHTML,
+		},
+		{
+			desc:           "Small responses aren't compressed",
+			compress:       true,
+			path:           "/small",
+			acceptEncoding: "gzip",
+			expectedBody:   "<html>Hi</html>",
+		},
+		{
+			desc:           "Binary responses aren't compressed",
+			compress:       true,
+			path:           "/image",
+			acceptEncoding: "gzip",
+			expectedBody:   largeHTML,
+		},
+		{
+			desc:             "Compressed responses aren't compressed again",
+			compress:         true,
+			path:             "/gzipped",
+			acceptEncoding:   "gzip",
+			expectedEncoding: "gzip",
+			expectedBody:     gzippedHTML.String(),
+		},
+		{
+			desc:             "Responses are compressed if Accept-Encoding isn't whitelisted",
+			compress:         true,
+			whitelist:        "Accept",
+			path:             "/html",
+			acceptEncoding:   "gzip",
+			expectCompressed: true,
+			expectedBody:     largeHTML,
+		},
+		{
+			desc:             "Streamed responses are compressed",
+			compress:         true,
+			path:             "/stream",
+			acceptEncoding:   "gzip",
+			expectCompressed: true,
+			expectedBody:     strings.Repeat(largeHTML[:100], 3),
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      compress-response: %v
+                                      request-header-whitelist: '%v'
+        `, target.URL, testCase.compress, testCase.whitelist)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			request, err := http.NewRequest("GET", relayService.HttpUrl()+testCase.path, nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			// Setting Accept-Encoding explicitly stops the client from
+			// decompressing the response itself.
+			request.Header.Set("Accept-Encoding", testCase.acceptEncoding)
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+
+			body := io.Reader(response.Body)
+			encoding := response.Header.Get("Content-Encoding")
+			if testCase.expectCompressed {
+				if encoding != "gzip" {
+					t.Errorf("Test '%v': Expected Content-Encoding 'gzip' but got '%v'", testCase.desc, encoding)
+					return
+				}
+				if response.ContentLength != -1 {
+					t.Errorf("Test '%v': Expected no Content-Length but got %v", testCase.desc, response.ContentLength)
+				}
+				if vary := response.Header.Get("Vary"); vary != "Accept-Encoding" {
+					t.Errorf("Test '%v': Expected Vary 'Accept-Encoding' but got '%v'", testCase.desc, vary)
+				}
+				if etag := response.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+					t.Errorf("Test '%v': Expected a weak ETag but got '%v'", testCase.desc, etag)
+				}
+				gzipReader, err := gzip.NewReader(response.Body)
+				if err != nil {
+					t.Errorf("Test '%v': Error reading gzipped body: %v", testCase.desc, err)
+					return
+				}
+				body = gzipReader
+			} else if encoding != testCase.expectedEncoding {
+				t.Errorf("Test '%v': Expected Content-Encoding '%v' but got '%v'", testCase.desc, testCase.expectedEncoding, encoding)
+			}
+
+			bodyBytes, err := io.ReadAll(body)
+			if err != nil {
+				t.Errorf("Test '%v': Error reading body: %v", testCase.desc, err)
+			} else if string(bodyBytes) != testCase.expectedBody {
+				t.Errorf("Test '%v': Expected body of length %v but got one of length %v", testCase.desc, len(testCase.expectedBody), len(bodyBytes))
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package traffic
+
+import (
+	"context"
+	"time"
+)
+
+// concurrencyLimiter caps the number of requests which are in flight to the
+// targets at once. Requests beyond the limit queue for a free slot, waiting up
+// to queueTimeout. A limit of zero disables the limiter.
+type concurrencyLimiter struct {
+	queueTimeout time.Duration
+	slots        chan struct{} // Holds a value for each slot in use. Nil if there's no limit.
+}
+
+func newConcurrencyLimiter(limit int, queueTimeout time.Duration) *concurrencyLimiter {
+	limiter := &concurrencyLimiter{queueTimeout: queueTimeout}
+	if limit > 0 {
+		limiter.slots = make(chan struct{}, limit)
+	}
+	return limiter
+}
+
+// acquire claims a slot for a request, waiting up to the queue timeout for one
+// to become free. It returns false if no slot was free in time, or if the
+// provided context ended first. Otherwise, the caller must call the returned
+// function once it's finished with the target.
+func (limiter *concurrencyLimiter) acquire(ctx context.Context) (func(), bool) {
+	if limiter.slots == nil {
+		return func() {}, true
+	}
+	release := func() { <-limiter.slots }
+
+	select {
+	case limiter.slots <- struct{}{}:
+		return release, true
+	default:
+	}
+	if limiter.queueTimeout <= 0 {
+		return nil, false
+	}
+
+	timer := time.NewTimer(limiter.queueTimeout)
+	defer timer.Stop()
+	select {
+	case limiter.slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
@@ -0,0 +1,211 @@
+package traffic_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestMaxConcurrent(t *testing.T) {
+	// The target sends its response headers immediately, but holds the body
+	// open for the duration in the 'hold' query parameter. It records the
+	// largest number of requests it has handled at once.
+	var inFlight, maxInFlight atomic.Int64
+	started := make(chan struct{}, 10)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			previous := maxInFlight.Load()
+			if current <= previous || maxInFlight.CompareAndSwap(previous, current) {
+				break
+			}
+		}
+		started <- struct{}{}
+
+		hold, _ := time.ParseDuration(request.URL.Query().Get("hold"))
+		response.Write([]byte("Hello"))
+		response.(http.Flusher).Flush()
+		time.Sleep(hold)
+		response.Write([]byte(", world"))
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc             string
+		maxConcurrent    int
+		queueTimeout     string
+		hold             string
+		expectedStatus   int
+		expectedInFlight int64
+	}{
+		{
+			desc:             "Requests over the limit are rejected",
+			maxConcurrent:    1,
+			queueTimeout:     "0s",
+			hold:             "300ms",
+			expectedStatus:   http.StatusServiceUnavailable,
+			expectedInFlight: 1,
+		},
+		{
+			desc:             "Requests over the limit wait for a free slot",
+			maxConcurrent:    1,
+			queueTimeout:     "2s",
+			hold:             "200ms",
+			expectedStatus:   http.StatusOK,
+			expectedInFlight: 1,
+		},
+		{
+			desc:             "Queued requests are rejected if no slot frees up in time",
+			maxConcurrent:    1,
+			queueTimeout:     "100ms",
+			hold:             "1s",
+			expectedStatus:   http.StatusServiceUnavailable,
+			expectedInFlight: 1,
+		},
+		{
+			desc:             "Requests aren't limited by default",
+			maxConcurrent:    0,
+			queueTimeout:     "0s",
+			hold:             "300ms",
+			expectedStatus:   http.StatusOK,
+			expectedInFlight: 2,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      max-concurrent: %v
+                                      queue-timeout: %v
+        `, target.URL, testCase.maxConcurrent, testCase.queueTimeout)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			maxInFlight.Store(0)
+
+			// The first request occupies a slot until its body is complete.
+			firstDone := make(chan error, 1)
+			go func() {
+				response, err := http.Get(relayService.HttpUrl() + "?hold=" + testCase.hold)
+				if err == nil {
+					_, err = io.ReadAll(response.Body)
+					response.Body.Close()
+				}
+				firstDone <- err
+			}()
+			<-started
+
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+			} else {
+				io.ReadAll(response.Body)
+				response.Body.Close()
+				if response.StatusCode != testCase.expectedStatus {
+					t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+				}
+			}
+
+			if err := <-firstDone; err != nil {
+				t.Errorf("Test '%v': Error relaying the first request: %v", testCase.desc, err)
+			}
+			for len(started) > 0 {
+				<-started
+			}
+			if actual := maxInFlight.Load(); actual != testCase.expectedInFlight {
+				t.Errorf("Test '%v': Expected at most %v requests in flight but got %v", testCase.desc, testCase.expectedInFlight, actual)
+			}
+		})
+	}
+}
+
+func TestMaxConcurrentWithHalfOpenCircuit(t *testing.T) {
+	// Reserve a port and then release it, so that nothing is listening there
+	// until the test starts the target.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error reserving port: %v", err)
+	}
+	targetAddress := listener.Addr().String()
+	listener.Close()
+
+	// Requests routed to the slow target hold their slot until it's released.
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	slowTarget := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		started <- struct{}{}
+		<-release
+		response.Write([]byte("OK"))
+	}))
+	defer slowTarget.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: http://%v
+                                  path-map:
+                                    - path: /slow
+                                      target: %v
+                                  circuit-breaker-threshold: 1
+                                  circuit-breaker-cooldown: 100ms
+                                  max-concurrent: 1
+                                  queue-timeout: 0s
+    `, targetAddress, slowTarget.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		expectStatus := func(desc string, expectedStatus int) {
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", desc, err)
+				return
+			}
+			response.Body.Close()
+			if response.StatusCode != expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", desc, expectedStatus, response.StatusCode)
+			}
+		}
+
+		expectStatus("The first failure opens the circuit", 502)
+		time.Sleep(150 * time.Millisecond)
+
+		// While the circuit is half-open, the only slot is taken, so the trial
+		// request is rejected before it reaches the target.
+		slowDone := make(chan error, 1)
+		go func() {
+			response, err := http.Get(relayService.HttpUrl() + "/slow")
+			if err == nil {
+				response.Body.Close()
+			}
+			slowDone <- err
+		}()
+		<-started
+		expectStatus("A trial request is rejected if no slot is free", 503)
+		close(release)
+		if err := <-slowDone; err != nil {
+			t.Errorf("Error relaying the slow request: %v", err)
+		}
+
+		// Bring the target up.
+		listener, err := net.Listen("tcp", targetAddress)
+		if err != nil {
+			t.Errorf("Error starting target: %v", err)
+			return
+		}
+		target := &httptest.Server{
+			Listener: listener,
+			Config: &http.Server{Handler: http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				response.Write([]byte("OK"))
+			})},
+		}
+		target.Start()
+		defer target.Close()
+
+		expectStatus("A rejected trial request doesn't keep the circuit open", 200)
+	})
+}
@@ -0,0 +1,79 @@
+package traffic_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"golang.org/x/net/websocket"
+)
+
+func TestConnectAddress(t *testing.T) {
+	// The target records the Host header of each request and the server name
+	// sent via SNI during each handshake. Its logical host doesn't exist, so
+	// the relay can only reach it via the connect address.
+	hosts := make(chan string, 10)
+	serverNames := make(chan string, 10)
+	mux := http.NewServeMux()
+	mux.Handle("/echo", websocket.Handler(catcher.EchoServer))
+	mux.HandleFunc("/", func(response http.ResponseWriter, request *http.Request) {
+		hosts <- request.Host
+		response.WriteHeader(http.StatusOK)
+	})
+	target := httptest.NewUnstartedServer(mux)
+	target.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	}
+	target.StartTLS()
+	defer target.Close()
+
+	targetURL, err := url.Parse(target.URL)
+	if err != nil {
+		t.Fatalf("Error parsing target URL: %v", err)
+	}
+	targetHost := "relay-target.invalid:" + targetURL.Port()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: https://%v
+                                  connect-addr: %v
+                                  tls-verify: false
+    `, targetHost, targetURL.Host)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		response, err := http.Get(relayService.HttpUrl())
+		if err != nil {
+			t.Fatalf("Error GETing: %v", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 but got %v", response.StatusCode)
+		}
+		if host := <-hosts; host != targetHost {
+			t.Errorf("Expected Host header '%v' but got '%v'", targetHost, host)
+		}
+		if serverName := <-serverNames; serverName != "relay-target.invalid" {
+			t.Errorf("Expected server name 'relay-target.invalid' but got '%v'", serverName)
+		}
+
+		ws, err := websocket.Dial(fmt.Sprintf("%v/echo", relayService.WsUrl()), "", relayService.HttpUrl())
+		if err != nil {
+			t.Fatalf("Error dialing websocket: %v", err)
+		}
+		defer ws.Close()
+		if err := testEcho(ws, "Ten-four"); err != nil {
+			t.Errorf("Error in websocket echo: %v", err)
+		}
+		if serverName := <-serverNames; serverName != "relay-target.invalid" {
+			t.Errorf("Expected websocket server name 'relay-target.invalid' but got '%v'", serverName)
+		}
+	})
+}
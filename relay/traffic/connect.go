@@ -0,0 +1,93 @@
+package traffic
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay/logging"
+)
+
+// handleConnect establishes a tunnel to the destination named by a CONNECT
+// request, allowing the relay to act as a forward proxy. Once the tunnel is
+// established, data is relayed in both directions, just like a websocket, until
+// either side closes its connection. CONNECT requests are refused unless
+// AllowConnect is set, since they can be used to reach any host the relay can.
+func (handler *Handler) handleConnect(clientResponse http.ResponseWriter, clientRequest *http.Request, requestInfo RequestInfo) bool {
+	requestLogger := loggerForRequest(clientRequest)
+
+	if !handler.config.AllowConnect {
+		requestLogger.Warnln("Rejecting CONNECT request: CONNECT is not allowed")
+		handler.writeError(clientResponse, "CONNECT is not allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+
+	// The destination comes from the request the client sent, since the URL
+	// has been rewritten to point to the target.
+	destination := requestInfo.OriginalURL.Host
+	if _, _, err := net.SplitHostPort(destination); err != nil {
+		requestLogger.With(logging.Fields{"error": err}).Warnf("Rejecting CONNECT request: invalid destination %v", destination)
+		handler.writeError(clientResponse, fmt.Sprintf("Invalid CONNECT destination %v", destination), http.StatusBadRequest)
+		return true
+	}
+	requestLogger.Debugln("Tunneling to:", destination)
+
+	if !handler.trackConnection() {
+		requestLogger.Warnln("Rejecting CONNECT request: the relay is shutting down")
+		handler.writeError(clientResponse, "The relay is shutting down", http.StatusServiceUnavailable)
+		return true
+	}
+	defer handler.connections.Done()
+
+	targetConn, err := handler.dialer.DialContext(clientRequest.Context(), "tcp", destination)
+	if err != nil {
+		requestLogger.With(logging.Fields{"error": err}).Errorln("Error setting up tunnel", err)
+		handler.metrics.UpstreamError()
+		handler.writeError(clientResponse, fmt.Sprintf("Could not connect to %v: %v", destination, err), http.StatusBadGateway)
+		return true
+	}
+
+	hij, ok := clientResponse.(http.Hijacker)
+	if !ok {
+		targetConn.Close()
+		requestLogger.Errorln("httpserver does not support hijacking")
+		handler.writeError(clientResponse, "Does not support hijacking", 500)
+		return true
+	}
+
+	// The tunnel's response is written directly to the hijacked connection,
+	// so it's recorded here to be logged accurately.
+	if recorder, ok := clientResponse.(*responseRecorder); ok {
+		recorder.status = http.StatusOK
+	}
+
+	clientConn, clientBuffer, err := hij.Hijack()
+	if err != nil {
+		targetConn.Close()
+		requestLogger.With(logging.Fields{"error": err}).Errorln("Cannot hijack connection ", err)
+		handler.writeError(clientResponse, "Could not hijack", 500)
+		return true
+	}
+
+	if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		requestLogger.With(logging.Fields{"error": err}).Errorln("Could not write CONNECT response", err)
+		clientConn.Close()
+		targetConn.Close()
+		return true
+	}
+
+	// The client may have sent data right after its request, which the server
+	// will already have read into its buffer.
+	start := time.Now()
+	toTarget, toClient := relayConnection(
+		&bufferedConn{Conn: clientConn, reader: clientBuffer.Reader},
+		targetConn,
+		handler.config.WebSocketBufferSize,
+		handler.config.WebSocketIdleTimeout,
+		handler.closeConnections,
+	)
+	logConnectionClosed(requestLogger, "Tunnel", destination, start, toTarget, toClient)
+	return true
+}
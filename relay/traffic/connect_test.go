@@ -0,0 +1,119 @@
+package traffic_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestConnect(t *testing.T) {
+	// The destination echoes back everything it receives.
+	echoListener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error starting echo server: %v", err)
+	}
+	defer echoListener.Close()
+	go func() {
+		for {
+			conn, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// Reserve a port and then release it, so that tunnels to it fail.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error reserving port: %v", err)
+	}
+	unreachableAddress := listener.Addr().String()
+	listener.Close()
+
+	testCases := []struct {
+		desc           string
+		allowConnect   bool
+		destination    string
+		expectedStatus int
+	}{
+		{
+			desc:           "Tunnels are established if CONNECT is allowed",
+			allowConnect:   true,
+			destination:    echoListener.Addr().String(),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc:           "CONNECT requests are refused by default",
+			allowConnect:   false,
+			destination:    echoListener.Addr().String(),
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			desc:           "Unreachable destinations are reported",
+			allowConnect:   true,
+			destination:    unreachableAddress,
+			expectedStatus: http.StatusBadGateway,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: http://localhost:12345
+                                      allow-connect: %v
+        `, testCase.allowConnect)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			conn, err := net.Dial("tcp", relayService.HttpUrl()[len("http://"):])
+			if err != nil {
+				t.Errorf("Test '%v': Error connecting to relay: %v", testCase.desc, err)
+				return
+			}
+			defer conn.Close()
+
+			request := fmt.Sprintf("CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", testCase.destination, testCase.destination)
+			if _, err := io.WriteString(conn, request); err != nil {
+				t.Errorf("Test '%v': Error writing CONNECT request: %v", testCase.desc, err)
+				return
+			}
+
+			reader := bufio.NewReader(conn)
+			response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+			if err != nil {
+				t.Errorf("Test '%v': Error reading CONNECT response: %v", testCase.desc, err)
+				return
+			}
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+				return
+			}
+			if response.StatusCode != http.StatusOK {
+				return
+			}
+
+			const message = "Hello through the tunnel\n"
+			if _, err := io.WriteString(conn, message); err != nil {
+				t.Errorf("Test '%v': Error writing to tunnel: %v", testCase.desc, err)
+				return
+			}
+			echoed, err := reader.ReadString('\n')
+			if err != nil {
+				t.Errorf("Test '%v': Error reading from tunnel: %v", testCase.desc, err)
+				return
+			}
+			if echoed != message {
+				t.Errorf("Test '%v': Expected '%v' but got '%v'", testCase.desc, strings.TrimSpace(message), strings.TrimSpace(echoed))
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package traffic
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay/logging"
+)
+
+// traceConnections instruments the request, if TraceConnections is set, to
+// record whether the connection used to send it to the target was reused or
+// freshly dialed, along with how long DNS resolution and connecting took. The
+// results feed the upstream connection metrics and a debug log line, which
+// help when tuning the connection pool settings.
+func (handler *Handler) traceConnections(request *http.Request, requestLogger *logging.Logger) *http.Request {
+	if !handler.config.TraceConnections {
+		return request
+	}
+
+	// The connect hooks may be invoked concurrently when several addresses
+	// are dialed at once.
+	var mutex sync.Mutex
+	var dnsStart, connectStart time.Time
+	var dnsTime, connectTime time.Duration
+
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			dnsTime = time.Since(dnsStart)
+		},
+		ConnectStart: func(network, address string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if connectStart.IsZero() {
+				connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(network, address string, err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err == nil {
+				connectTime = time.Since(connectStart)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			handler.metrics.UpstreamConnection(info.Reused)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if info.Reused {
+				requestLogger.Debugf("Reused connection to %v, idle for %v", info.Conn.RemoteAddr(), info.IdleTime)
+			} else {
+				requestLogger.Debugf(
+					"New connection to %v: DNS took %v, connecting took %v",
+					info.Conn.RemoteAddr(),
+					dnsTime,
+					connectTime,
+				)
+			}
+		},
+	}
+	return request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+}
@@ -0,0 +1,83 @@
+package traffic_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/logging"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestTraceConnections(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("OK"))
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc          string
+		trace         bool
+		expectedLines []string
+	}{
+		{
+			desc:  "Connections aren't traced by default",
+			trace: false,
+			expectedLines: []string{
+				`relay_upstream_connections_total{reused="false"} 0`,
+				`relay_upstream_connections_total{reused="true"} 0`,
+			},
+		},
+		{
+			desc:  "Sequential requests reuse the first connection",
+			trace: true,
+			expectedLines: []string{
+				`relay_upstream_connections_total{reused="false"} 1`,
+				`relay_upstream_connections_total{reused="true"} 2`,
+			},
+		},
+	}
+
+	defer logging.SetOutput(os.Stdout)
+	defer logging.SetLevel(logging.InfoLevel)
+
+	for _, testCase := range testCases {
+		output := &syncBuffer{}
+		logging.SetOutput(output)
+
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      metrics-addr: localhost:0
+                                      log-level: debug
+                                      trace-connections: %v
+        `, target.URL, testCase.trace)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			for i := 0; i < 3; i++ {
+				response, err := http.Get(relayService.HttpUrl())
+				if err != nil {
+					t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+					return
+				}
+				io.Copy(io.Discard, response.Body)
+				response.Body.Close()
+			}
+
+			expectMetrics(t, relayService, testCase.expectedLines)
+
+			if logged := strings.Contains(output.String(), "New connection to "); logged != testCase.trace {
+				t.Errorf(
+					"Test '%v': Expected a new connection log line: %v, but got log output:\n%v",
+					testCase.desc,
+					testCase.trace,
+					output.String(),
+				)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package traffic
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsPolicy determines which origins browsers may access the relay from, and
+// adds the corresponding CORS headers to responses. When a policy is
+// configured, the relay handles CORS itself: it answers preflight requests
+// directly, and the target's own CORS headers are replaced.
+type corsPolicy struct {
+	allowAll bool            // If true, any origin is allowed, but without credentials.
+	origins  map[string]bool // The allowed origins, if allowAll is false.
+}
+
+// newCORSPolicy returns a policy allowing the provided origins, or nil if no
+// origins are provided. The origin "*" allows any origin.
+func newCORSPolicy(allowedOrigins []string) *corsPolicy {
+	if len(allowedOrigins) == 0 {
+		return nil
+	}
+
+	policy := &corsPolicy{origins: map[string]bool{}}
+	for _, origin := range allowedOrigins {
+		if origin == "*" {
+			policy.allowAll = true
+		}
+		policy.origins[strings.ToLower(origin)] = true
+	}
+	return policy
+}
+
+// addHeaders adds the CORS headers which allow the provided origin to read the
+// response, if the origin is allowed. Explicitly allowed origins are echoed
+// back and may send credentials; if any origin is allowed, the wildcard is
+// used instead, which browsers don't permit with credentials.
+func (policy *corsPolicy) addHeaders(header http.Header, origin string) bool {
+	header.Add("Vary", "Origin")
+	if origin == "" {
+		return false
+	}
+
+	if policy.allowAll {
+		header.Set("Access-Control-Allow-Origin", "*")
+		return true
+	}
+	if policy.origins[strings.ToLower(origin)] {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Allow-Credentials", "true")
+		return true
+	}
+	return false
+}
+
+// handlePreflight responds to a CORS preflight request. If the origin is
+// allowed, the requested method and headers are allowed as well; otherwise,
+// the response carries no CORS headers, and the browser will block the actual
+// request.
+func (policy *corsPolicy) handlePreflight(response http.ResponseWriter, request *http.Request, origin string) {
+	header := response.Header()
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	if policy.addHeaders(header, origin) {
+		header.Set("Access-Control-Allow-Methods", request.Header.Get("Access-Control-Request-Method"))
+		if requestHeaders := request.Header.Get("Access-Control-Request-Headers"); requestHeaders != "" {
+			header.Set("Access-Control-Allow-Headers", requestHeaders)
+		}
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// isPreflight reports whether the provided request is a CORS preflight request.
+func isPreflight(request *http.Request, origin string) bool {
+	return request.Method == http.MethodOptions &&
+		origin != "" &&
+		request.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// removeCORSHeaders removes the CORS headers which the relay sets from the
+// provided header, so that the target's values don't conflict with the
+// relay's.
+func removeCORSHeaders(header http.Header) {
+	header.Del("Access-Control-Allow-Credentials")
+	header.Del("Access-Control-Allow-Headers")
+	header.Del("Access-Control-Allow-Methods")
+	header.Del("Access-Control-Allow-Origin")
+}
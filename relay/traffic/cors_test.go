@@ -0,0 +1,158 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestCORS(t *testing.T) {
+	// The target sets its own CORS header, which the relay should replace when
+	// it's handling CORS itself.
+	var targetRequests atomic.Int64
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		targetRequests.Add(1)
+		response.Header().Set("Access-Control-Allow-Origin", "https://target.example")
+		response.Write([]byte("OK"))
+	}))
+	defer target.Close()
+
+	const allowedOrigin = "https://app.example.com"
+
+	testCases := []struct {
+		desc                string
+		allowOrigin         string
+		preflight           bool
+		origin              string
+		expectedStatus      int
+		expectedAllowOrigin string
+		expectCredentials   bool
+		expectTargetRequest bool
+	}{
+		{
+			desc:                "Preflight requests from allowed origins are answered by the relay",
+			allowOrigin:         allowedOrigin,
+			preflight:           true,
+			origin:              allowedOrigin,
+			expectedStatus:      http.StatusNoContent,
+			expectedAllowOrigin: allowedOrigin,
+			expectCredentials:   true,
+		},
+		{
+			desc:                "Preflight requests from other origins aren't allowed",
+			allowOrigin:         allowedOrigin,
+			preflight:           true,
+			origin:              "https://evil.example",
+			expectedStatus:      http.StatusNoContent,
+			expectedAllowOrigin: "",
+		},
+		{
+			desc:                "Preflight requests are allowed from any origin with a wildcard",
+			allowOrigin:         "*",
+			preflight:           true,
+			origin:              "https://anywhere.example",
+			expectedStatus:      http.StatusNoContent,
+			expectedAllowOrigin: "*",
+		},
+		{
+			desc:                "Responses to allowed origins carry CORS headers",
+			allowOrigin:         "https://other.example," + allowedOrigin,
+			origin:              allowedOrigin,
+			expectedStatus:      http.StatusOK,
+			expectedAllowOrigin: allowedOrigin,
+			expectCredentials:   true,
+			expectTargetRequest: true,
+		},
+		{
+			desc:                "Responses to other origins don't carry CORS headers",
+			allowOrigin:         allowedOrigin,
+			origin:              "https://evil.example",
+			expectedStatus:      http.StatusOK,
+			expectedAllowOrigin: "",
+			expectTargetRequest: true,
+		},
+		{
+			desc:                "Responses carry a wildcard if any origin is allowed",
+			allowOrigin:         "*",
+			origin:              "https://anywhere.example",
+			expectedStatus:      http.StatusOK,
+			expectedAllowOrigin: "*",
+			expectTargetRequest: true,
+		},
+		{
+			desc:                "CORS is left to the target by default",
+			allowOrigin:         "",
+			preflight:           true,
+			origin:              allowedOrigin,
+			expectedStatus:      http.StatusOK,
+			expectedAllowOrigin: "https://target.example",
+			expectTargetRequest: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      cors-allow-origin: '%v'
+        `, target.URL, testCase.allowOrigin)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			targetRequests.Store(0)
+
+			method := "GET"
+			if testCase.preflight {
+				method = "OPTIONS"
+			}
+			request, err := http.NewRequest(method, relayService.HttpUrl(), nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			request.Header.Set("Origin", testCase.origin)
+			if testCase.preflight {
+				request.Header.Set("Access-Control-Request-Method", "PUT")
+				request.Header.Set("Access-Control-Request-Headers", "X-Custom")
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+
+			allowOrigins := response.Header.Values("Access-Control-Allow-Origin")
+			if testCase.expectedAllowOrigin == "" && len(allowOrigins) != 0 {
+				t.Errorf("Test '%v': Expected no Access-Control-Allow-Origin but got %v", testCase.desc, allowOrigins)
+			} else if testCase.expectedAllowOrigin != "" && (len(allowOrigins) != 1 || allowOrigins[0] != testCase.expectedAllowOrigin) {
+				t.Errorf("Test '%v': Expected Access-Control-Allow-Origin '%v' but got %v", testCase.desc, testCase.expectedAllowOrigin, allowOrigins)
+			}
+
+			if credentials := response.Header.Get("Access-Control-Allow-Credentials") == "true"; credentials != testCase.expectCredentials {
+				t.Errorf("Test '%v': Expected credentials to be allowed: %v but got %v", testCase.desc, testCase.expectCredentials, credentials)
+			}
+
+			if testCase.preflight && testCase.allowOrigin != "" && testCase.expectedAllowOrigin != "" {
+				if methods := response.Header.Get("Access-Control-Allow-Methods"); methods != "PUT" {
+					t.Errorf("Test '%v': Expected Access-Control-Allow-Methods 'PUT' but got '%v'", testCase.desc, methods)
+				}
+				if headers := response.Header.Get("Access-Control-Allow-Headers"); headers != "X-Custom" {
+					t.Errorf("Test '%v': Expected Access-Control-Allow-Headers 'X-Custom' but got '%v'", testCase.desc, headers)
+				}
+			}
+
+			if targetRequested := targetRequests.Load() > 0; targetRequested != testCase.expectTargetRequest {
+				t.Errorf("Test '%v': Expected the target to be requested: %v but got %v", testCase.desc, testCase.expectTargetRequest, targetRequested)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package traffic
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrorFormat determines how the bodies of error responses generated by the
+// relay itself, rather than relayed from the target, are formatted.
+type ErrorFormat string
+
+const (
+	// ErrorFormatText writes the error message as plain text. This is the
+	// default.
+	ErrorFormatText ErrorFormat = "text"
+
+	// ErrorFormatJSON writes a JSON object of the form
+	// {"error": "message", "status": 502}, for clients which expect JSON.
+	ErrorFormatJSON ErrorFormat = "json"
+)
+
+// ParseErrorFormat returns the ErrorFormat with the provided name, which may be
+// "text" or "json". Names are matched case-insensitively.
+func ParseErrorFormat(name string) (ErrorFormat, error) {
+	switch format := ErrorFormat(strings.ToLower(name)); format {
+	case ErrorFormatText, ErrorFormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf(`Unknown error format "%v"; expected "text" or "json"`, name)
+	}
+}
+
+// errorBody is the body of an error response in the JSON format.
+type errorBody struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// writeError replies to the client with an error generated by the relay, using
+// the configured error format. Like http.Error, it doesn't end the request;
+// the caller shouldn't write anything further to the response.
+func (handler *Handler) writeError(clientResponse http.ResponseWriter, message string, status int) {
+	if handler.config.ErrorFormat != ErrorFormatJSON {
+		http.Error(clientResponse, message, status)
+		return
+	}
+
+	body, err := json.Marshal(errorBody{Error: message, Status: status})
+	if err != nil {
+		http.Error(clientResponse, message, status)
+		return
+	}
+	header := clientResponse.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Content-Type-Options", "nosniff")
+	clientResponse.WriteHeader(status)
+	clientResponse.Write(append(body, '\n'))
+}
@@ -0,0 +1,175 @@
+package traffic_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestErrorFormat(t *testing.T) {
+	// Nothing listens at this address, so requests relayed to it fail.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error reserving an address: %v", err)
+	}
+	unreachableTarget := "http://" + listener.Addr().String()
+	listener.Close()
+
+	// This target's responses are larger than the relay is configured to
+	// relay, whether their length is known or not.
+	largeTarget := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "text/html")
+		if request.URL.Path == "/streamed" {
+			response.(http.Flusher).Flush()
+		}
+		response.Write([]byte(strings.Repeat("Large response. ", 8)))
+	}))
+	defer largeTarget.Close()
+
+	testCases := []struct {
+		desc           string
+		config         string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectedJSON   bool
+	}{
+		{
+			desc: "Errors are plain text by default",
+			config: fmt.Sprintf(`relay:
+                                     target: %v
+            `, unreachableTarget),
+			method:         "GET",
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			desc: "An unreachable target produces a JSON error",
+			config: fmt.Sprintf(`relay:
+                                     target: %v
+                                     error-format: json
+            `, unreachableTarget),
+			method:         "GET",
+			expectedStatus: http.StatusBadGateway,
+			expectedJSON:   true,
+		},
+		{
+			desc: "An oversized request body produces a JSON error",
+			config: fmt.Sprintf(`relay:
+                                     target: %v
+                                     error-format: json
+                                     max-request-body-size: 4
+            `, unreachableTarget),
+			method:         "POST",
+			body:           "too large",
+			expectedStatus: http.StatusRequestEntityTooLarge,
+			expectedJSON:   true,
+		},
+		{
+			desc: "An oversized response body produces a JSON error",
+			config: fmt.Sprintf(`relay:
+                                     target: %v
+                                     error-format: json
+                                     max-body-size: 16
+            `, largeTarget.URL),
+			method:         "GET",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedJSON:   true,
+		},
+		{
+			desc: "An oversized buffered response body produces a JSON error",
+			config: fmt.Sprintf(`relay:
+                                     target: %v
+                                     error-format: json
+                                     max-body-size: 16
+                                     buffer-streamed-responses: true
+            `, largeTarget.URL),
+			method:         "GET",
+			path:           "/streamed",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedJSON:   true,
+		},
+		{
+			desc: "A disallowed method produces a JSON error",
+			config: fmt.Sprintf(`relay:
+                                     target: %v
+                                     error-format: json
+                                     allowed-methods: GET
+            `, unreachableTarget),
+			method:         "DELETE",
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedJSON:   true,
+		},
+		{
+			desc: "Failed authentication produces a JSON error",
+			config: fmt.Sprintf(`relay:
+                                     target: %v
+                                     error-format: json
+                                     basic-auth-user: user
+                                     basic-auth-pass: secret
+            `, unreachableTarget),
+			method:         "GET",
+			expectedStatus: http.StatusUnauthorized,
+			expectedJSON:   true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithRelay(t, testCase.config, nil, func(relayService *relay.Service) {
+			request, err := http.NewRequest(testCase.method, relayService.HttpUrl()+testCase.path, strings.NewReader(testCase.body))
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Errorf("Test '%v': Error reading response body: %v", testCase.desc, err)
+				return
+			}
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+
+			contentType := response.Header.Get("Content-Type")
+			if !testCase.expectedJSON {
+				if !strings.HasPrefix(contentType, "text/plain") {
+					t.Errorf("Test '%v': Expected a plain text error but got Content-Type '%v'", testCase.desc, contentType)
+				}
+				return
+			}
+
+			if contentType != "application/json" {
+				t.Errorf("Test '%v': Expected Content-Type 'application/json' but got '%v'", testCase.desc, contentType)
+			}
+			var errorBody map[string]interface{}
+			if err := json.Unmarshal(body, &errorBody); err != nil {
+				t.Errorf("Test '%v': Error parsing JSON error body '%s': %v", testCase.desc, body, err)
+				return
+			}
+			if len(errorBody) != 2 {
+				t.Errorf("Test '%v': Expected exactly 'error' and 'status' properties but got %v", testCase.desc, errorBody)
+			}
+			if message, ok := errorBody["error"].(string); !ok || message == "" {
+				t.Errorf("Test '%v': Expected a non-empty 'error' string but got %v", testCase.desc, errorBody["error"])
+			}
+			if status, ok := errorBody["status"].(float64); !ok || int(status) != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected 'status' %v but got %v", testCase.desc, testCase.expectedStatus, errorBody["status"])
+			}
+		})
+	}
+}
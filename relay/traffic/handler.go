@@ -1,46 +1,284 @@
 package traffic
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"net"
 	"net/http"
-	"os"
+	"net/textproto"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/fullstorydev/relay-core/relay/logging"
+	"github.com/fullstorydev/relay-core/relay/metrics"
 	"github.com/fullstorydev/relay-core/relay/version"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/http2"
 )
 
 const RelayVersionHeaderName = "X-Relay-Version"
 
-var logger = log.New(os.Stdout, "[relay-traffic] ", 0)
+// UpstreamTimeHeaderName is the response header which reports how long the
+// target took to respond, in milliseconds, if RelayOptions.TimingHeader is set.
+const UpstreamTimeHeaderName = "X-Relay-Upstream-Time"
+
+var logger = logging.New("relay-traffic")
 
 // Handler handles HTTP traffic sent to the relay. It handles the core relaying
 // process itself, and can be extended using plugins to add additional
 // functionality.
 type Handler struct {
-	config    *RelayOptions
-	plugins   []Plugin
-	transport *http.Transport
-}
-
-func NewHandler(config *RelayOptions, trafficPlugins []Plugin) *Handler {
-	return &Handler{
-		config:  config,
-		plugins: trafficPlugins,
-		transport: &http.Transport{
-			TLSClientConfig: &tls.Config{},
-			Proxy:           http.ProxyFromEnvironment,
-			IdleConnTimeout: 2 * time.Second, // TODO set from configs
+	activeRequests   atomic.Int64
+	activeWebSockets atomic.Int64
+	breaker          *circuitBreaker
+	cache            *responseCache
+	concurrency      *concurrencyLimiter
+	config           *RelayOptions
+	connectAddresses map[string]string // Maps the dial addresses of targets to the addresses actually dialed.
+	cors             *corsPolicy
+	dialer           *net.Dialer
+	health           *targetHealth
+	healthChecker    *healthChecker // Set by StartHealthChecks.
+	metrics          *metrics.Collector
+	plugins          []Plugin
+	rateLimiter      *rateLimiter
+	relayID          string                         // Identifies this relay in X-Relay-Via headers.
+	routeTransports  map[*HostRoute]*http.Transport // Transports for host routes which override the transport's timeouts.
+	socketTransports map[*Target]*http.Transport    // Transports for Unix socket targets, which aren't shared with other targets.
+	targetCounter    atomic.Uint64
+	tlsConfig        *tls.Config
+	transport        *http.Transport
+	upstreamProxy    func(*url.URL) (*url.URL, error) // If set, chooses the proxy for each request instead of the environment.
+
+	// These fields coordinate shutdown. Once shuttingDown is set, no new
+	// websockets or CONNECT tunnels are accepted; connections tracks those
+	// which are still being relayed, and closing closeConnections forcibly
+	// closes them.
+	closeConnections chan struct{}
+	connections      sync.WaitGroup
+	shutdownMutex    sync.Mutex
+	shuttingDown     bool
+}
+
+// NewHandler creates a Handler. If metricsCollector is nil, no metrics are
+// recorded.
+func NewHandler(config *RelayOptions, trafficPlugins []Plugin, metricsCollector *metrics.Collector) *Handler {
+	// The same TLS configuration is used for both HTTP and websocket traffic.
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.TLSInsecureSkipVerify,
+		RootCAs:            config.TLSRootCAs,
+		ServerName:         config.TLSServerName,
+	}
+	if config.TLSClientCertificate != nil {
+		tlsConfig.Certificates = []tls.Certificate{*config.TLSClientCertificate}
+	}
+
+	handler := &Handler{
+		breaker:          newCircuitBreaker(config.CircuitBreakerThreshold, config.CircuitBreakerCooldown),
+		cache:            newResponseCache(config.CacheSize),
+		closeConnections: make(chan struct{}),
+		concurrency:      newConcurrencyLimiter(config.MaxConcurrent, config.QueueTimeout),
+		config:           config,
+		connectAddresses: connectAddresses(config),
+		cors:             newCORSPolicy(config.CORSAllowOrigins),
+		dialer: &net.Dialer{
+			Timeout:   config.DialTimeout,
+			KeepAlive: 30 * time.Second,
 		},
+		health:      newTargetHealth(config.TargetFailThreshold, config.TargetRecovery, config.TargetHealthInterval > 0),
+		metrics:     metricsCollector,
+		plugins:     trafficPlugins,
+		rateLimiter: newRateLimiter(config.RateLimit, config.RateBurst),
+		relayID:     config.RelayID,
+		tlsConfig:   tlsConfig,
+	}
+
+	if handler.relayID == "" {
+		handler.relayID = newRequestID()
+	}
+
+	if config.UpstreamProxy != nil {
+		proxyConfig := &httpproxy.Config{
+			HTTPProxy:  config.UpstreamProxy.String(),
+			HTTPSProxy: config.UpstreamProxy.String(),
+			NoProxy:    config.NoProxy,
+		}
+		handler.upstreamProxy = proxyConfig.ProxyFunc()
+	}
+
+	handler.transport = handler.newTransport(config.DialTimeout, config.ResponseHeaderTimeout)
+	handler.routeTransports = handler.newRouteTransports()
+	handler.socketTransports = handler.newSocketTransports()
+	return handler
+}
+
+// newTransport creates a transport for requests to the targets, using the
+// provided timeouts.
+func (handler *Handler) newTransport(dialTimeout time.Duration, responseHeaderTimeout time.Duration) *http.Transport {
+	config := handler.config
+	transport := &http.Transport{
+		DialContext:           handler.dial,
+		ExpectContinueTimeout: config.ExpectContinueTimeout,
+		TLSClientConfig:       handler.tlsConfig.Clone(), // Enabling HTTP/2 modifies the transport's copy.
+		TLSHandshakeTimeout:   dialTimeout,
+		Proxy:                 handler.proxy,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+	}
+
+	// HTTP/2 is negotiated with https targets via ALPN if it's enabled;
+	// otherwise, HTTP/1.1 is always used.
+	if config.EnableHTTP2 {
+		if err := http2.ConfigureTransport(transport); err != nil {
+			logger.Errorf("Could not enable HTTP/2: %v", err)
+		}
+	}
+	return transport
+}
+
+// ReopenAccessLog reopens the access log file, if one is configured, so that
+// the log can be rotated.
+func (handler *Handler) ReopenAccessLog() error {
+	if handler.config.AccessLog == nil {
+		return nil
+	}
+	return handler.config.AccessLog.Reopen()
+}
+
+// Shutdown stops the handler from accepting new websockets and CONNECT tunnels,
+// and waits for those it's already relaying to finish. If the context expires
+// first, the remaining connections are closed and the context's error is
+// returned.
+// Ordinary HTTP requests aren't affected; the server that invokes the handler
+// is responsible for draining them. Finally, any trace spans which haven't
+// been exported yet are flushed.
+func (handler *Handler) Shutdown(ctx context.Context) error {
+	handler.shutdownMutex.Lock()
+	handler.shuttingDown = true
+	handler.shutdownMutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		handler.connections.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		logger.Warnf("Closing websockets and tunnels which didn't finish before shutdown: %v", ctx.Err())
+		close(handler.closeConnections)
+		<-drained
+		err = ctx.Err()
+	}
+
+	if tracerErr := handler.config.Tracer.Shutdown(ctx); err == nil {
+		err = tracerErr
+	}
+	return err
+}
+
+// retirePollInterval is how often Retire checks whether the handler's
+// in-flight requests have finished.
+var retirePollInterval = 10 * time.Millisecond
+
+// Retire releases the resources of a handler which has been replaced, e.g.
+// because the configuration was reloaded. It stops the handler's health checks,
+// then waits for the requests, websockets, and CONNECT tunnels it's still
+// relaying to finish. If the context expires first, the remaining websockets
+// and tunnels are closed and the context's error is returned; requests can't be
+// interrupted, so they're left to finish on their own. Finally, the handler's
+// idle connections to its targets and its access log are closed.
+func (handler *Handler) Retire(ctx context.Context) error {
+	handler.StopHealthChecks()
+
+	ticker := time.NewTicker(retirePollInterval)
+	defer ticker.Stop()
+	for handler.activeRequests.Load() > 0 && ctx.Err() == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+
+	err := handler.Shutdown(ctx)
+	handler.transport.CloseIdleConnections()
+	for _, transport := range handler.routeTransports {
+		transport.CloseIdleConnections()
+	}
+	for _, transport := range handler.socketTransports {
+		transport.CloseIdleConnections()
+	}
+	if handler.config.AccessLog != nil {
+		handler.config.AccessLog.Close()
 	}
+	return err
 }
 
-func (handler *Handler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+func (handler *Handler) ServeHTTP(clientResponse http.ResponseWriter, request *http.Request) {
+	// In-flight requests are counted so that Retire can wait for them.
+	handler.activeRequests.Add(1)
+	defer handler.activeRequests.Add(-1)
+
+	// Record the status of the response so that it can be logged.
+	response := &responseRecorder{ResponseWriter: clientResponse}
+
+	start := time.Now()
+	clientAddr := clientAddress(request, handler.config.TrustForwarded)
+	request = handler.assignRequestID(response, request)
+
+	// The access log entry is captured before the request is modified, so that
+	// it describes the request the client actually sent.
+	var accessLogEntry *accessLogEntry
+	if handler.config.AccessLog != nil {
+		accessLogEntry = newAccessLogEntry(request, clientAddr, start)
+	}
+
+	defer func() {
+		handler.metrics.ObserveRequest(request.Method, response.status, time.Since(start))
+		if accessLogEntry != nil {
+			handler.config.AccessLog.write(accessLogEntry, response.status, response.bytes)
+		}
+	}()
+
+	// Rate limiting happens first, so that rejected requests are as cheap as
+	// possible.
+	if allowed, retryAfter := handler.rateLimiter.allow(clientAddr); !allowed {
+		loggerForRequest(request).Debugf("Rejecting request from %v: rate limit exceeded", request.RemoteAddr)
+		response.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		handler.writeError(response, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	// The target is chosen before cookies are dropped, since it may depend on
+	// a sticky session cookie.
+	route := handler.matchHostRoute(request.Host)
+	var pathRoute *PathRoute
+	if route == nil {
+		pathRoute = handler.matchPathRoute(request.URL.Path)
+	}
+	target, setStickyCookie := handler.selectTarget(request, route, pathRoute)
+	if route != nil {
+		request = withHostRoute(request, route)
+	}
+	if target != nil {
+		request = withTarget(request, target)
+	}
+
 	// Drop all cookies; because the relay generally runs in a first-party
 	// context, the risk of receiving cookies intended for other services is
 	// high, so relaying them is a potential privacy and security risk. (In
@@ -50,42 +288,143 @@ func (handler *Handler) ServeHTTP(response http.ResponseWriter, request *http.Re
 	request.Header.Del("Cookie")
 
 	// Rewrite the request URL to point to the relay target. Plugins may change
-	// these values to direct certain requests differently.
+	// these values to direct certain requests differently. Only the scheme and
+	// host are changed; the path (including its original encoding, which is
+	// kept in RawPath) and the raw query string are relayed byte-for-byte,
+	// except that a path route's prefix is removed if the route strips it, and
+	// the target's path, if it has one, is prepended to the path.
+	// The Host header omits the target's port if it's the default for its
+	// scheme; if PreserveHost is set, the client's Host header is kept instead.
+	originalHost := request.Host
 	originalURL := *request.URL
-	request.URL.Scheme = handler.config.TargetScheme
-	request.URL.Host = handler.config.TargetHost
-	request.Host = handler.config.TargetHost
+	if target != nil {
+		request.URL.Scheme = target.Scheme
+		request.URL.Host = target.Host
+		if !handler.config.PreserveHost {
+			request.Host, _ = normalizeHost(target.Scheme, target.Host)
+		}
+		if pathRoute != nil && pathRoute.StripPrefix {
+			pathRoute.stripPrefix(request.URL)
+		}
+		target.prefixPath(request.URL)
+	}
+
+	// The client's Origin is kept so that a host route can restore it if a
+	// plugin changes it.
+	originalOrigin := request.Header.Get("Origin")
+
+	requestInfo := RequestInfo{
+		OriginalCookieHeaders: originalCookieHeaders,
+		OriginalHost:          originalHost,
+		OriginalOrigin:        originalOrigin,
+		OriginalURL:           &originalURL,
+	}
+	if setStickyCookie {
+		requestInfo.stickyTarget = target
+	}
+
+	// The client is checked before plugins run, since a plugin may set an
+	// Authorization header of its own for the target, which must neither be
+	// mistaken for the client's credentials nor removed along with them.
+	if !handler.permitClient(response, request) || !handler.authorize(response, request, requestInfo) {
+		requestInfo.Serviced = true
+	}
 
-	serviced := false
 	for _, trafficPlugin := range handler.plugins {
-		if trafficPlugin.HandleRequest(response, request, RequestInfo{
-			OriginalCookieHeaders: originalCookieHeaders,
-			OriginalURL:           &originalURL,
-			Serviced:              serviced,
-		}) {
-			serviced = true
+		if trafficPlugin.HandleRequest(response, request, requestInfo) {
+			requestInfo.Serviced = true
 		}
 	}
 
-	if handler.HandleRequest(response, request, serviced) {
-		serviced = true
+	// A host route's origin mode is applied after plugins run, so that it
+	// takes precedence over the mode configured for the headers plugin.
+	if route != nil && route.OriginMode != "" {
+		route.OriginMode.Apply(request, originalOrigin)
+	}
+
+	if handler.HandleRequest(response, request, requestInfo) {
+		requestInfo.Serviced = true
 	}
+	serviced := requestInfo.Serviced
 
-	if serviced {
-		logger.Printf("%s %s %s: serviced", request.Method, request.Host, request.URL)
+	if !serviced {
+		handler.writeError(response, "404 page not found", http.StatusNotFound)
+	}
+
+	// Each request is only logged at debug level, since logging routine
+	// traffic is expensive and noisy. Requests which couldn't be serviced, and
+	// requests slower than SlowRequestThreshold, are unusual enough to always
+	// be logged.
+	duration := time.Since(start)
+	slow := handler.config.SlowRequestThreshold > 0 && duration > handler.config.SlowRequestThreshold
+	if serviced && !slow && !logging.Enabled(logging.DebugLevel) {
+		return
+	}
+	requestLogger := loggerForRequest(request).With(logging.Fields{
+		"duration": duration.Seconds(),
+		"host":     request.Host,
+		"status":   response.status,
+	})
+	if !serviced {
+		requestLogger.Warnf("%s %s %s: not serviced", request.Method, request.Host, request.URL)
+	} else if slow {
+		requestLogger.Warnf("%s %s %s: slow request serviced with status %v in %v", request.Method, request.Host, request.URL, response.status, duration)
 	} else {
-		logger.Printf("%s %s %s: not serviced", request.Method, request.Host, request.URL)
-		http.NotFound(response, request)
+		requestLogger.Debugf("%s %s %s: serviced with status %v in %v", request.Method, request.Host, request.URL, response.status, duration)
 	}
 }
 
-func (handler *Handler) HandleRequest(clientResponse http.ResponseWriter, clientRequest *http.Request, serviced bool) bool {
-	if serviced {
+func (handler *Handler) HandleRequest(clientResponse http.ResponseWriter, clientRequest *http.Request, requestInfo RequestInfo) bool {
+	if requestInfo.Serviced {
 		return false
 	}
 
+	if !handler.allowMethod(clientResponse, clientRequest, requestInfo) {
+		return true
+	}
+
+	// In maintenance mode, nothing is relayed, including CONNECT requests.
+	if handler.handleMaintenance(clientResponse, clientRequest) {
+		return true
+	}
+
+	// CONNECT requests name their own destination rather than being relayed
+	// to the target.
+	if clientRequest.Method == http.MethodConnect {
+		return handler.handleConnect(clientResponse, clientRequest, requestInfo)
+	}
+
+	// The sticky session cookie is only set once the request is authorized
+	// and will be relayed to its target.
+	handler.setStickyCookie(clientResponse, clientRequest, requestInfo)
+
+	// This should be prevented by configuration validation, but if the relay
+	// somehow ends up without a target, report that clearly rather than
+	// failing in a more confusing way below.
+	if len(handler.config.Targets) == 0 {
+		logger.Errorf("Cannot relay request for %v: no relay target is configured", clientRequest.URL)
+		handler.writeError(clientResponse, "The relay target is not configured", http.StatusServiceUnavailable)
+		return true
+	}
+
 	if !clientRequest.URL.IsAbs() {
-		http.Error(clientResponse, fmt.Sprintf("Cannot respond to relative (non-absolute) requests: %v", clientRequest.URL), 500)
+		handler.writeError(clientResponse, fmt.Sprintf("Cannot respond to relative (non-absolute) requests: %v", clientRequest.URL), 500)
+		return true
+	}
+
+	// A relay which is its own target, directly or through other relays, would
+	// otherwise relay the same request forever.
+	if handler.isLoop(clientRequest) {
+		loggerForRequest(clientRequest).Errorf("Rejecting request for %v: it has already passed through this relay (ID %v)", clientRequest.URL, handler.relayID)
+		handler.writeError(clientResponse, "Relay loop detected", http.StatusLoopDetected)
+		return true
+	}
+
+	// Both HTTP requests and websocket upgrades buffer the request's headers,
+	// so oversized headers are rejected before either happens.
+	if maxBytes := handler.config.MaxHeaderBytes; maxBytes > 0 && headerSize(clientRequest.Header) > maxBytes {
+		loggerForRequest(clientRequest).Warnf("Request headers exceed the limit of %v bytes", maxBytes)
+		handler.writeError(clientResponse, "Request headers too large", http.StatusRequestHeaderFieldsTooLarge)
 		return true
 	}
 
@@ -94,7 +433,7 @@ func (handler *Handler) HandleRequest(clientResponse http.ResponseWriter, client
 	if clientRequest.Header.Get("Upgrade") == "websocket" {
 		return handler.handleUpgrade(clientResponse, clientRequest)
 	} else {
-		return handler.handleHttp(clientResponse, clientRequest)
+		return handler.handleHttp(clientResponse, clientRequest, requestInfo)
 	}
 }
 
@@ -105,118 +444,742 @@ func (handler *Handler) addRelayHeaders(clientRequest *http.Request) {
 	if len(remoteAddrTokens) > 0 {
 		clientRequest.Header.Add("X-Forwarded-Port", remoteAddrTokens[1])
 	}
-	clientRequest.Header.Add("X-Forwarded-Proto", strings.ToLower(strings.Split(clientRequest.Proto, "/")[0]))
+	// Behind a TLS-terminating load balancer, the relay can't detect that
+	// the client used https, so the scheme may be configured instead.
+	if scheme := handler.config.ForceClientScheme; scheme != "" {
+		clientRequest.Header.Add("X-Forwarded-Proto", scheme)
+	} else {
+		clientRequest.Header.Add("X-Forwarded-Proto", strings.ToLower(strings.Split(clientRequest.Proto, "/")[0]))
+	}
 
 	// Add X-Relay-Version header
 	clientRequest.Header.Add(RelayVersionHeaderName, version.RelayRelease)
+
+	// Record this relay's ID so that loops can be detected.
+	clientRequest.Header.Add(RelayViaHeaderName, handler.relayID)
 }
 
-func (handler *Handler) handleHttp(clientResponse http.ResponseWriter, clientRequest *http.Request) bool {
-	targetResponse, err := handler.transport.RoundTrip(clientRequest)
+func (handler *Handler) handleHttp(clientResponse http.ResponseWriter, clientRequest *http.Request, requestInfo RequestInfo) bool {
+	requestLogger := loggerForRequest(clientRequest)
+
+	removeHopByHopHeaders(clientRequest.Header)
+	handler.overrideUserAgent(clientRequest)
+
+	// The server closes the connection after sending a response with this
+	// header, whatever the response is.
+	if handler.config.DisableClientKeepAlive {
+		clientResponse.Header().Set("Connection", "close")
+	}
+
+	// A client which sends "Expect: 100-continue" waits for 100 Continue before
+	// sending the request body. The server sends it when the body is first
+	// read, which normally happens once the target has sent its own 100
+	// Continue, so the target decides whether the body is wanted. If the relay
+	// is configured to send the body without waiting, the expectation is
+	// answered by the relay alone, so it isn't relayed.
+	if handler.config.ExpectContinueTimeout == 0 {
+		clientRequest.Header.Del("Expect")
+	}
+
+	// When a CORS policy is configured, the relay answers preflight requests
+	// itself, and its CORS headers are added to every response. The client's
+	// original Origin is used, since plugins may have changed the header.
+	if handler.cors != nil {
+		if isPreflight(clientRequest, requestInfo.OriginalOrigin) {
+			handler.cors.handlePreflight(clientResponse, clientRequest, requestInfo.OriginalOrigin)
+			return true
+		}
+		handler.cors.addHeaders(clientResponse.Header(), requestInfo.OriginalOrigin)
+	}
+
+	if !handler.limitRequestBody(clientRequest) {
+		requestLogger.Warnf("Request body exceeds the limit of %v bytes", handler.config.MaxRequestBodySize)
+		handler.writeError(clientResponse, "Request body too large", http.StatusRequestEntityTooLarge)
+		return true
+	}
+
+	if err := handler.replaceRequestBody(clientRequest); err != nil {
+		requestLogger.With(logging.Fields{"error": err}).Warnf("Could not read request body: %v", err)
+		handler.writeError(clientResponse, "Could not read request body", http.StatusBadRequest)
+		return true
+	}
+
+	// Fresh cached responses are served without contacting the target, even
+	// if it's failing.
+	cacheKey := handler.cache.cacheKey(clientRequest, requestInfo)
+	if cacheKey != "" {
+		if handler.cache.serve(clientResponse, cacheKey) {
+			requestLogger.Debugf("Serving cached response for %v", cacheKey)
+			return true
+		}
+		clientResponse.Header().Set(CacheHeaderName, "MISS")
+	}
+
+	// If the target has been failing, fail fast rather than adding to its
+	// load and making the client wait for another failure.
+	targetHost := clientRequest.URL.Host
+	if !handler.breaker.allow(targetHost) {
+		requestLogger.Debugf("Rejecting request: the circuit for %v is open", targetHost)
+		handler.writeError(clientResponse, fmt.Sprintf("%v is unavailable", targetHost), http.StatusServiceUnavailable)
+		return true
+	}
+
+	// The timeout covers the whole exchange with the target, including reading
+	// the response body, so a target which streams its response too slowly is
+	// also cut off. The client's own context is kept so that timeouts can be
+	// distinguished from clients going away.
+	clientContext := clientRequest.Context()
+	if requestTimeout := handler.requestTimeout(clientContext); requestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(clientContext, requestTimeout)
+		defer cancel()
+		clientRequest = clientRequest.WithContext(ctx)
+	}
+
+	// If the number of requests in flight to the targets is limited, wait for
+	// a slot. The slot is held until the response body has been relayed. A
+	// request which doesn't get a slot never reaches the target, so if it was
+	// the breaker's trial request, another request must be allowed to try.
+	release, acquired := handler.concurrency.acquire(clientRequest.Context())
+	if !acquired {
+		handler.breaker.abandon(targetHost)
+		requestLogger.Debugf("Rejecting request: the limit of %v concurrent requests has been reached", handler.config.MaxConcurrent)
+		handler.writeError(clientResponse, "Too many concurrent requests", http.StatusServiceUnavailable)
+		return true
+	}
+	defer release()
+
+	clientRequest = relayInformationalResponses(clientResponse, clientRequest)
+
+	// The whitelist is applied only now, since CORS preflights and the cache
+	// key above depend on the client's original headers. Whether the response
+	// may be compressed also depends on them, so that's noted first.
+	clientAcceptsGzip := acceptsGzip(clientRequest.Header)
+	handler.applyRequestHeaderWhitelist(clientRequest)
+	handler.signRequest(clientRequest)
+
+	reportPrimaryStatus := handler.startShadowRequest(clientRequest, requestLogger)
+
+	clientRequest = handler.traceConnections(clientRequest, requestLogger)
+
+	span := handler.config.Tracer.StartClientSpan(clientRequest)
+	roundTripStart := time.Now()
+	targetResponse, attempts, err := handler.roundTripWithRetries(clientRequest, requestLogger)
+	upstreamTime := time.Since(roundTripStart)
 	if err != nil {
-		logger.Printf("Cannot read response from server %v", err)
-		return false
+		span.EndHTTP(0, err)
+		if clientContext.Err() != nil {
+			handler.breaker.abandon(targetHost)
+		} else {
+			handler.breaker.recordFailure(targetHost)
+			handler.health.recordFailure(targetHost)
+		}
+		reportPrimaryStatus(0)
+		requestLogger.With(logging.Fields{"attempts": attempts, "error": err}).Errorf("Cannot read response from server %v", err)
+		handler.metrics.UpstreamError()
+		if handler.config.MaxRetries > 0 {
+			clientResponse.Header().Set(AttemptsHeaderName, strconv.Itoa(attempts))
+		}
+		if isTimeout(err) {
+			handler.writeError(clientResponse, fmt.Sprintf("Timed out waiting for %v", clientRequest.URL.Host), http.StatusGatewayTimeout)
+			return true
+		}
+		handler.writeError(clientResponse, fmt.Sprintf("Could not reach %v", clientRequest.URL.Host), http.StatusBadGateway)
+		return true
 	}
 	defer targetResponse.Body.Close()
+	span.EndHTTP(targetResponse.StatusCode, nil)
+	if attempts > 1 {
+		clientResponse.Header().Set(AttemptsHeaderName, strconv.Itoa(attempts))
+	}
+	// A retry status is relayed if it's the last response, but it still
+	// counts against the target.
+	if handler.isRetryableStatus(targetResponse.StatusCode) {
+		handler.breaker.recordFailure(targetHost)
+		handler.health.recordFailure(targetHost)
+	} else {
+		handler.breaker.recordSuccess(targetHost)
+		handler.health.recordSuccess(targetHost)
+	}
+	reportPrimaryStatus(targetResponse.StatusCode)
 
 	// Set the relayed headers
+	removeHopByHopHeaders(targetResponse.Header)
+	for _, headerName := range handler.config.StripResponseHeaders {
+		targetResponse.Header.Del(headerName)
+	}
+	// The request ID has already been set on the client response; a copy
+	// echoed by the target would duplicate it.
+	targetResponse.Header.Del(handler.config.RequestIDHeader)
+	if handler.cors != nil {
+		removeCORSHeaders(targetResponse.Header)
+	}
+	handler.rewriteRedirectLocation(targetResponse, clientRequest, requestInfo.OriginalHost)
+	handler.rewriteSetCookieHeaders(targetResponse, clientRequest)
+	if err := handler.rewriteResponseURLs(targetResponse, clientRequest, requestInfo.OriginalHost); err != nil {
+		requestLogger.With(logging.Fields{"error": err, "status": targetResponse.StatusCode}).Errorf("Error reading response body to rewrite URLs: %s", err)
+		handler.writeError(clientResponse, "Could not read response body", http.StatusBadGateway)
+		return true
+	}
+	if cacheKey != "" {
+		if err := handler.cache.store(cacheKey, targetResponse, handler.config.MaxBodySize); err != nil {
+			requestLogger.With(logging.Fields{"error": err, "status": targetResponse.StatusCode}).Errorf("Error reading response body to cache it: %s", err)
+			handler.writeError(clientResponse, "Could not read response body", http.StatusBadGateway)
+			return true
+		}
+	}
+	if handler.shouldCompress(clientAcceptsGzip, targetResponse) {
+		gzipResponse := compressResponse(clientResponse, targetResponse)
+		defer gzipResponse.Close()
+		clientResponse = gzipResponse
+	}
 	for key, values := range targetResponse.Header {
 		for _, value := range values {
 			clientResponse.Header().Add(key, value)
 		}
 	}
+	if handler.config.TimingHeader {
+		// The time runs until the target's response headers arrive, including
+		// any retries. It's set after the target's headers are copied so that
+		// a value from another relay upstream is replaced.
+		clientResponse.Header().Set(UpstreamTimeHeaderName, strconv.FormatInt(upstreamTime.Milliseconds(), 10))
+	}
+	if clientRequest.Method != http.MethodHead {
+		announceTrailers(clientResponse, targetResponse)
+	}
 
-	if targetResponse.ContentLength > handler.config.MaxBodySize {
-		clientResponse.WriteHeader(http.StatusServiceUnavailable)
-		clientResponse.Write([]byte("Response body content-length was too large"))
+	// The bytes read from the target's body are counted the same way however
+	// it's relayed below.
+	responseBody := &countingReadCloser{ReadCloser: targetResponse.Body}
+	targetResponse.Body = responseBody
+	defer func() {
+		handler.observeResponseSize(responseBody.bytes, targetResponse.StatusCode, requestLogger)
+	}()
+
+	if clientRequest.Method == http.MethodHead {
+		// Responses to HEAD requests never have a body, even if the target
+		// advertises a Content-Length, so there's nothing to relay beyond the
+		// status and headers. The Content-Length is relayed as-is.
+		clientResponse.WriteHeader(targetResponse.StatusCode)
+	} else if targetResponse.ContentLength > handler.config.MaxBodySize {
+		handler.writeError(clientResponse, "Response body content-length was too large", http.StatusServiceUnavailable)
 	} else if targetResponse.ContentLength > 0 {
 		clientResponse.WriteHeader(targetResponse.StatusCode)
-		if _, err := io.CopyN(clientResponse, targetResponse.Body, targetResponse.ContentLength); err != nil {
-			logger.Printf("Error relaying response body to client: %s", err)
+		clientWriter, clearDeadline := handler.withClientWriteTimeout(clientResponse, clientResponse)
+		defer clearDeadline()
+		if written, err := io.CopyN(clientWriter, targetResponse.Body, targetResponse.ContentLength); err != nil {
+			// The status and headers have already been sent, so the only way to
+			// signal failure is to abort the response; this closes the client
+			// connection, so the client sees a failed transfer and doesn't wait
+			// for bytes that will never arrive.
+			requestLogger.With(logging.Fields{"error": err, "status": targetResponse.StatusCode}).Errorf(
+				"Error relaying response body to client: expected %v bytes but relayed %v: %s",
+				targetResponse.ContentLength,
+				written,
+				err,
+			)
+			panic(http.ErrAbortHandler)
 		}
+		// If the target sends more bytes than it advertised, the extra bytes
+		// aren't part of this response; the transport stops reading the body at
+		// the Content-Length and never reuses the connection, so they're
+		// discarded rather than leaking into another response.
 	} else if targetResponse.ContentLength < 0 {
-		clientResponse.WriteHeader(targetResponse.StatusCode)
-		if _, err := io.CopyN(clientResponse, targetResponse.Body, handler.config.MaxBodySize); err != nil {
-			logger.Printf("Error relaying response body with unknown content-length: %s", err)
+		// This is the usual case for streamed responses, including most HTTP/2
+		// responses.
+		if handler.config.BufferStreamedResponses && !isEventStream(targetResponse) {
+			handler.bufferResponseBody(clientResponse, targetResponse, requestLogger)
+		} else {
+			handler.streamResponseBody(clientResponse, targetResponse, requestLogger)
 		}
 	} else {
 		clientResponse.WriteHeader(targetResponse.StatusCode)
 	}
+	relayTrailers(clientResponse, targetResponse)
+	return true
+}
+
+// headerSize returns the length in bytes of the provided headers when they're
+// serialized, as by http.Header.Write, without actually serializing them.
+func headerSize(header http.Header) int {
+	size := 0
+	for key, values := range header {
+		for _, value := range values {
+			size += len(key) + len(": ") + len(value) + len("\r\n")
+		}
+	}
+	return size
+}
+
+// limitRequestBody enforces MaxRequestBodySize, returning false if the request
+// body is too large. Bodies with an unknown length are read into memory, up to
+// the limit, so that nothing is sent to the target if the limit is exceeded.
+func (handler *Handler) limitRequestBody(clientRequest *http.Request) bool {
+	maxSize := handler.config.MaxRequestBodySize
+	if maxSize <= 0 || clientRequest.Body == nil || clientRequest.Body == http.NoBody {
+		return true
+	}
+	if clientRequest.ContentLength > maxSize {
+		return false
+	}
+	if clientRequest.ContentLength >= 0 {
+		// The server won't read past the declared length, so the body can be
+		// streamed.
+		return true
+	}
+
+	body, err := io.ReadAll(io.LimitReader(clientRequest.Body, maxSize+1))
+	clientRequest.Body.Close()
+	if err != nil || int64(len(body)) > maxSize {
+		return false
+	}
+	setRequestBody(clientRequest, body)
 	return true
 }
 
+// setRequestBody replaces the request's body with one which has been read into
+// memory. Since its length is now known, it's relayed with a Content-Length
+// rather than chunked, even if the client sent it chunked. Request bodies are
+// otherwise streamed to the target as they arrive.
+func setRequestBody(request *http.Request, body []byte) {
+	if len(body) == 0 {
+		request.Body = http.NoBody
+	} else {
+		request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	request.ContentLength = int64(len(body))
+	request.TransferEncoding = nil
+}
+
 func (handler *Handler) handleUpgrade(clientResponse http.ResponseWriter, clientRequest *http.Request) bool {
-	logger.Println("Upgrading to websocket:", clientRequest.URL)
+	requestLogger := loggerForRequest(clientRequest)
+	requestLogger.Debugln("Upgrading to websocket:", clientRequest.URL)
+
+	if !handler.trackConnection() {
+		requestLogger.Warnln("Rejecting websocket: the relay is shutting down")
+		handler.writeError(clientResponse, "The relay is shutting down", http.StatusServiceUnavailable)
+		return true
+	}
+	defer handler.connections.Done()
+
+	// Each relayed websocket holds open two connections for as long as it
+	// lasts, so their number may be limited to avoid exhausting resources. The
+	// count is decremented when this function returns, even if it panics.
+	activeWebSockets := handler.activeWebSockets.Add(1)
+	defer handler.activeWebSockets.Add(-1)
+	if maxConnections := handler.config.MaxWebSocketConnections; maxConnections > 0 && activeWebSockets > int64(maxConnections) {
+		requestLogger.Warnf("Rejecting websocket: the limit of %v connections has been reached", maxConnections)
+		handler.writeError(clientResponse, "Too many websocket connections", http.StatusServiceUnavailable)
+		return true
+	}
 
 	// Connect to the target WS service
 	var targetConn net.Conn
 	var err error
 	if clientRequest.URL.Scheme == "https" {
-		targetConn, err = tls.Dial("tcp", clientRequest.URL.Host, &tls.Config{})
+		// Websockets use the same TLS configuration as HTTP traffic. The
+		// target's host name is sent via SNI and used to verify its
+		// certificate.
+		targetConn, err = handler.dialTLS(clientRequest.Context(), dialAddress(clientRequest.URL), clientRequest.URL.Hostname())
 		if err != nil {
-			logger.Println("Error setting up target tls websocket", err)
-			http.Error(clientResponse, fmt.Sprintf("Could not dial connect %v: %v", clientRequest.URL.Host, err), 404)
+			requestLogger.With(logging.Fields{"error": err}).Errorln("Error setting up target tls websocket", err)
+			handler.metrics.UpstreamError()
+			handler.writeError(clientResponse, fmt.Sprintf("Could not connect to %v: %v", clientRequest.URL.Host, err), http.StatusBadGateway)
 			return true
 		}
 	} else {
-		targetConn, err = net.Dial("tcp", clientRequest.URL.Host)
+		targetConn, err = handler.dial(clientRequest.Context(), "tcp", dialAddress(clientRequest.URL))
 		if err != nil {
-			logger.Println("Error setting up target websocket", err)
-			http.Error(clientResponse, fmt.Sprintf("Could not dial connect %v: %v", clientRequest.URL.Host, err), 404)
+			requestLogger.With(logging.Fields{"error": err}).Errorln("Error setting up target websocket", err)
+			handler.metrics.UpstreamError()
+			handler.writeError(clientResponse, fmt.Sprintf("Could not connect to %v: %v", clientRequest.URL.Host, err), http.StatusBadGateway)
 			return true
 		}
 	}
 
-	// Write the original client request to the target
-	requestLine := fmt.Sprintf("%v %v %v\r\nHost: %v\r\n", clientRequest.Method, clientRequest.URL.String(), clientRequest.Proto, clientRequest.Host)
+	// Write the original client request to the target. The request target is
+	// in absolute form, which takes precedence over the Host header, so its
+	// host is normalized in the same way. If the client's Host header is
+	// preserved, the origin form is used instead, so that the Host header
+	// stands.
+	requestURL := *clientRequest.URL
+	requestURL.Host, _ = normalizeHost(requestURL.Scheme, requestURL.Host)
+	requestTarget := requestURL.String()
+	if handler.config.PreserveHost {
+		requestTarget = requestURL.RequestURI()
+	}
+	requestLine := fmt.Sprintf("%v %v %v\r\nHost: %v\r\n", clientRequest.Method, requestTarget, clientRequest.Proto, clientRequest.Host)
 	if _, err := io.WriteString(targetConn, requestLine); err != nil {
-		logger.Printf("Could not write the WS request: %v", err)
-		http.Error(clientResponse, fmt.Sprintf("Could not write the WS request: %v %v", clientRequest.URL.Host, err), 500)
+		requestLogger.With(logging.Fields{"error": err}).Errorf("Could not write the WS request: %v", err)
+		handler.writeError(clientResponse, fmt.Sprintf("Could not write the WS request: %v %v", clientRequest.URL.Host, err), 500)
 		return true
 	}
+	// The client's headers are relayed verbatim, including the extensions it
+	// offers in Sec-WebSocket-Extensions, so that extensions like
+	// permessage-deflate are negotiated end to end. Since frames are relayed as
+	// raw bytes, the relay never needs to understand the extensions itself.
 	headerBuffer := new(bytes.Buffer)
 	if err := clientRequest.Header.Write(headerBuffer); err != nil {
-		logger.Println("Could not write WS header to buffer", err)
-		http.Error(clientResponse, fmt.Sprintf("Could not write the WS header: %v %v", clientRequest.URL.Host, err), 500)
+		requestLogger.With(logging.Fields{"error": err}).Errorln("Could not write WS header to buffer", err)
+		handler.writeError(clientResponse, fmt.Sprintf("Could not write the WS header: %v %v", clientRequest.URL.Host, err), 500)
 		return true
 	}
 	_, err = headerBuffer.WriteTo(targetConn)
 	if err != nil {
-		logger.Println("Could not write WS header to target", err)
-		http.Error(clientResponse, fmt.Sprintf("Could not write the final header line: %v %v", clientRequest.URL.Host, err), 500)
+		requestLogger.With(logging.Fields{"error": err}).Errorln("Could not write WS header to target", err)
+		handler.writeError(clientResponse, fmt.Sprintf("Could not write the final header line: %v %v", clientRequest.URL.Host, err), 500)
 		return true
 	}
 	_, err = io.WriteString(targetConn, "\r\n")
 	if err != nil {
-		logger.Println("Could not complete WS header", err)
-		http.Error(clientResponse, fmt.Sprintf("Could not write the final header line: %v %v", clientRequest.URL.Host, err), 500)
+		requestLogger.With(logging.Fields{"error": err}).Errorln("Could not complete WS header", err)
+		handler.writeError(clientResponse, fmt.Sprintf("Could not write the final header line: %v %v", clientRequest.URL.Host, err), 500)
+		return true
+	}
+
+	// The target's handshake response is parsed and relayed to the client
+	// explicitly, so that the subprotocol and extensions the target chose in
+	// Sec-WebSocket-Protocol and Sec-WebSocket-Extensions reach the client
+	// intact.
+	targetReader := bufio.NewReader(targetConn)
+	targetResponse, err := http.ReadResponse(targetReader, clientRequest)
+	if err != nil {
+		targetConn.Close()
+		requestLogger.With(logging.Fields{"error": err}).Errorln("Could not read the WS handshake response", err)
+		handler.metrics.UpstreamError()
+		handler.writeError(clientResponse, fmt.Sprintf("Could not read the WS handshake response: %v %v", clientRequest.URL.Host, err), http.StatusBadGateway)
+		return true
+	}
+
+	// If the target refused the upgrade, its response is relayed like any
+	// other, so that the client learns why.
+	if targetResponse.StatusCode != http.StatusSwitchingProtocols {
+		defer targetConn.Close()
+		requestLogger.Warnf("Target refused websocket upgrade with status %v", targetResponse.StatusCode)
+		removeHopByHopHeaders(targetResponse.Header)
+		targetResponse.Header.Del(handler.config.RequestIDHeader)
+		for key, values := range targetResponse.Header {
+			for _, value := range values {
+				clientResponse.Header().Add(key, value)
+			}
+		}
+		handler.bufferResponseBody(clientResponse, targetResponse, requestLogger)
 		return true
 	}
 
 	hij, ok := clientResponse.(http.Hijacker)
 	if !ok {
-		logger.Println("httpserver does not support hijacking")
-		http.Error(clientResponse, "Does not support hijacking", 500)
+		targetConn.Close()
+		requestLogger.Errorln("httpserver does not support hijacking")
+		handler.writeError(clientResponse, "Does not support hijacking", 500)
 		return true
 	}
 
-	clientConn, _, err := hij.Hijack()
+	clientConn, clientBuffer, err := hij.Hijack()
 	if err != nil {
-		logger.Println("Cannot hijack connection ", err)
-		http.Error(clientResponse, "Could not hijack", 500)
+		targetConn.Close()
+		requestLogger.With(logging.Fields{"error": err}).Errorln("Cannot hijack connection ", err)
+		handler.writeError(clientResponse, "Could not hijack", 500)
+		return true
+	}
+
+	if err := writeHandshakeResponse(clientConn, targetResponse); err != nil {
+		requestLogger.With(logging.Fields{"error": err}).Errorln("Could not write the WS handshake response", err)
+		clientConn.Close()
+		targetConn.Close()
 		return true
 	}
 
-	// And then relay everything between the client and target
-	go transfer(targetConn, clientConn)
-	transfer(clientConn, targetConn)
+	handler.metrics.WebSocketOpened()
+	defer handler.metrics.WebSocketClosed()
+
+	// And then relay everything between the client and target, including
+	// anything either side sent which was buffered during the handshake.
+	start := time.Now()
+	toTarget, toClient := relayConnection(
+		&bufferedConn{Conn: clientConn, reader: clientBuffer.Reader},
+		&bufferedConn{Conn: targetConn, reader: targetReader},
+		handler.config.WebSocketBufferSize,
+		handler.config.WebSocketIdleTimeout,
+		handler.closeConnections,
+	)
+	logConnectionClosed(requestLogger, "Websocket", clientRequest.URL.String(), start, toTarget, toClient)
+	return true
+}
+
+// logConnectionClosed logs a summary of a websocket or CONNECT tunnel once it
+// closes, which helps to diagnose connections that stall or carry far more
+// data than expected.
+func logConnectionClosed(requestLogger *logging.Logger, kind string, target string, start time.Time, toTarget int64, toClient int64) {
+	requestLogger.With(logging.Fields{
+		"bytes_to_client": toClient,
+		"bytes_to_target": toTarget,
+		"duration":        time.Since(start).Seconds(),
+		"target":          target,
+	}).Printf("%v to %v closed after relaying %v bytes to the target and %v bytes to the client", kind, target, toTarget, toClient)
+}
+
+// writeHandshakeResponse writes the status line and headers of a websocket
+// handshake response to the provided writer.
+func writeHandshakeResponse(writer io.Writer, response *http.Response) error {
+	if _, err := fmt.Fprintf(writer, "HTTP/1.1 %v\r\n", response.Status); err != nil {
+		return err
+	}
+	if err := response.Header.Write(writer); err != nil {
+		return err
+	}
+	_, err := io.WriteString(writer, "\r\n")
+	return err
+}
+
+// trackConnection registers a long-lived connection, like a websocket or a
+// CONNECT tunnel, so that shutdown can wait for it to finish. It returns false
+// if the relay is shutting down, in which case the connection should be
+// refused; otherwise, the caller must call connections.Done() once the
+// connection ends.
+func (handler *Handler) trackConnection() bool {
+	handler.shutdownMutex.Lock()
+	defer handler.shutdownMutex.Unlock()
+	if handler.shuttingDown {
+		return false
+	}
+	handler.connections.Add(1)
 	return true
 }
 
-func transfer(destination io.WriteCloser, source io.ReadCloser) {
+// dial connects to the provided address. Connections to Unix socket targets are
+// made via their sockets, and addresses of targets with a
+// connect address are dialed via that address; everything else is dialed
+// normally.
+func (handler *Handler) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	dialer := handler.dialer
+	if timeout := handler.dialTimeout(ctx); timeout != dialer.Timeout {
+		// The request matched a host route with its own dial timeout.
+		routeDialer := *dialer
+		routeDialer.Timeout = timeout
+		dialer = &routeDialer
+	}
+	if target := socketTarget(ctx, address); target != nil {
+		return dialer.DialContext(ctx, "unix", target.SocketPath)
+	}
+	if connectAddress, ok := handler.connectAddresses[address]; ok {
+		address = connectAddress
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// dialTLS connects to the provided address like dial, then performs a TLS
+// handshake, sending serverName via SNI and using it to verify the target's
+// certificate. The dial timeout covers both the connection and the handshake.
+func (handler *Handler) dialTLS(ctx context.Context, address string, serverName string) (net.Conn, error) {
+	if dialTimeout := handler.dialTimeout(ctx); dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+	}
+
+	conn, err := handler.dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := handler.tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = serverName
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// proxy returns the proxy to use for the provided request. If an upstream proxy
+// is configured, it's used for all requests except those to hosts excluded by
+// NoProxy; otherwise, the proxy is configured by the environment. Requests to
+// Unix socket targets and to targets with a connect address never use a proxy.
+func (handler *Handler) proxy(request *http.Request) (*url.URL, error) {
+	if socketTarget(request.Context(), dialAddress(request.URL)) != nil {
+		return nil, nil
+	}
+	if _, ok := handler.connectAddresses[dialAddress(request.URL)]; ok {
+		return nil, nil
+	}
+	if handler.upstreamProxy != nil {
+		return handler.upstreamProxy(request.URL)
+	}
+	return http.ProxyFromEnvironment(request)
+}
+
+// connectAddresses returns a map from the dial address of each target in the
+// provided configuration to the connect address which should be dialed
+// instead, if one is configured. Unix socket targets are unaffected.
+func connectAddresses(config *RelayOptions) map[string]string {
+	addresses := map[string]string{}
+	if config.ConnectAddress == "" {
+		return addresses
+	}
+	for _, target := range config.Targets {
+		if target.SocketPath == "" {
+			addresses[dialAddress(&url.URL{Scheme: target.Scheme, Host: target.Host})] = config.ConnectAddress
+		}
+	}
+	return addresses
+}
+
+// dialAddress returns the host and port to dial to reach the provided URL,
+// using the default port for its scheme if it doesn't specify one.
+func dialAddress(targetURL *url.URL) string {
+	_, address := normalizeHost(targetURL.Scheme, targetURL.Host)
+	return address
+}
+
+// hopByHopHeaders lists headers which apply only to a single connection, and
+// therefore must not be relayed. See RFC 7230, section 6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the standard hop-by-hop headers, along with any
+// headers listed in the Connection header, from the provided headers.
+func removeHopByHopHeaders(header http.Header) {
+	// A "TE: trailers" header indicates that trailers are supported end to end,
+	// rather than describing the connection, so it's preserved.
+	acceptsTrailers := false
+	for _, value := range header.Values("Te") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(textproto.TrimString(token), "trailers") {
+				acceptsTrailers = true
+			}
+		}
+	}
+
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+
+	if acceptsTrailers {
+		header.Set("Te", "trailers")
+	}
+}
+
+// loggerForRequest returns a logger that includes details about the provided
+// request in each log line.
+func loggerForRequest(request *http.Request) *logging.Logger {
+	fields := logging.Fields{
+		"method": request.Method,
+		"url":    request.URL.String(),
+	}
+	if requestID := requestIDFromContext(request.Context()); requestID != "" {
+		fields["request_id"] = requestID
+	}
+	return logger.With(fields)
+}
+
+// isTimeout returns true if the provided error indicates that an operation
+// timed out.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// relayConnection relays data in both directions between the client and target
+// connections of a websocket or CONNECT tunnel until either side closes its
+// connection. Each direction uses a buffer of bufferSize bytes. If idleTimeout
+// is nonzero, both connections are also closed once no data has flowed in
+// either direction for that long. Both connections are also closed if
+// closeSignal is closed. relayConnection doesn't return until both directions
+// have finished.
+func relayConnection(clientConn net.Conn, targetConn net.Conn, bufferSize int, idleTimeout time.Duration, closeSignal <-chan struct{}) (toTarget int64, toClient int64) {
+	extendDeadlines := func() {}
+	if idleTimeout > 0 {
+		// The directions share a timeout, so activity in either direction
+		// extends the read deadlines of both connections.
+		extendDeadlines = func() {
+			deadline := time.Now().Add(idleTimeout)
+			clientConn.SetReadDeadline(deadline)
+			targetConn.SetReadDeadline(deadline)
+		}
+		extendDeadlines()
+	}
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-closeSignal:
+			clientConn.Close()
+			targetConn.Close()
+		case <-finished:
+		}
+	}()
+
+	upstreamFinished := make(chan struct{})
+	go func() {
+		toTarget = transfer(targetConn, clientConn, bufferSize, extendDeadlines)
+		close(upstreamFinished)
+	}()
+	toClient = transfer(clientConn, targetConn, bufferSize, extendDeadlines)
+	<-upstreamFinished
+	return toTarget, toClient
+}
+
+// bufferedConn is a net.Conn whose reads are served from a buffered reader
+// wrapping the connection, so that data which was buffered while parsing the
+// start of the connection isn't lost.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(data []byte) (int, error) {
+	return conn.reader.Read(data)
+}
+
+// transfer copies data from the source to the destination using a buffer of
+// bufferSize bytes, invoking onActivity whenever data is read. It returns the
+// number of bytes written to the destination. When the copy ends, for any
+// reason, both connections are closed, which also ends the copy in the opposite
+// direction.
+//
+// This doesn't use io.CopyBuffer, which bypasses the buffer entirely when the
+// connections implement io.ReaderFrom, and which has no way to report
+// activity.
+func transfer(destination io.WriteCloser, source io.ReadCloser, bufferSize int, onActivity func()) (written int64) {
 	defer destination.Close()
 	defer source.Close()
-	io.Copy(destination, source)
+
+	if bufferSize <= 0 {
+		bufferSize = DefaultWebSocketBufferSize
+	}
+	buffer := make([]byte, bufferSize)
+	for {
+		read, err := source.Read(buffer)
+		if read > 0 {
+			onActivity()
+			count, err := destination.Write(buffer[:read])
+			written += int64(count)
+			if err != nil {
+				return written
+			}
+		}
+		if err != nil {
+			return written
+		}
+	}
 }
 
 /*
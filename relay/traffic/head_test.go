@@ -0,0 +1,67 @@
+package traffic_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestHeadRequest(t *testing.T) {
+	// The target advertises the length of a body which, as the response to a
+	// HEAD request, it never sends.
+	const contentLength = "1048576"
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Length", contentLength)
+		response.Header().Set("Content-Type", "application/octet-stream")
+		response.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc   string
+		config string
+	}{
+		{
+			desc: "HEAD responses are relayed without a body",
+			config: fmt.Sprintf(`relay:
+                                    target: %v
+            `, target.URL),
+		},
+		{
+			desc: "HEAD responses advertising more than the maximum body size are relayed",
+			config: fmt.Sprintf(`relay:
+                                    target: %v
+                                    max-body-size: 1024
+            `, target.URL),
+		},
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	for _, testCase := range testCases {
+		test.WithRelay(t, testCase.config, nil, func(relayService *relay.Service) {
+			response, err := client.Head(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error sending HEAD request: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != http.StatusOK {
+				t.Errorf("Test '%v': Expected status 200 but got %v", testCase.desc, response.StatusCode)
+			}
+			if length := response.Header.Get("Content-Length"); length != contentLength {
+				t.Errorf("Test '%v': Expected Content-Length %v but got '%v'", testCase.desc, contentLength, length)
+			}
+			if body, err := io.ReadAll(response.Body); err != nil || len(body) != 0 {
+				t.Errorf("Test '%v': Expected no body but got %v bytes (error: %v)", testCase.desc, len(body), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package traffic
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthChecker actively checks the health of the default targets by sending
+// each of them a GET request for TargetHealthPath every TargetHealthInterval.
+// A target whose response doesn't have TargetHealthStatus, or which can't be
+// reached at all, is marked down until a later check succeeds.
+type healthChecker struct {
+	handler  *Handler
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  sync.WaitGroup
+}
+
+// StartHealthChecks starts actively checking the health of the targets in the
+// background, if TargetHealthInterval is set. The checks continue until
+// StopHealthChecks is called.
+func (handler *Handler) StartHealthChecks() {
+	if handler.config.TargetHealthInterval <= 0 || handler.healthChecker != nil {
+		return
+	}
+
+	checker := &healthChecker{
+		handler: handler,
+		stop:    make(chan struct{}),
+	}
+	checker.stopped.Add(1)
+	go checker.run()
+	handler.healthChecker = checker
+}
+
+// StopHealthChecks stops the health checks started by StartHealthChecks and
+// waits for any check in progress to finish.
+func (handler *Handler) StopHealthChecks() {
+	if checker := handler.healthChecker; checker != nil {
+		checker.stopOnce.Do(func() { close(checker.stop) })
+		checker.stopped.Wait()
+	}
+}
+
+func (checker *healthChecker) run() {
+	defer checker.stopped.Done()
+
+	interval := checker.handler.config.TargetHealthInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		checker.checkAll()
+		select {
+		case <-ticker.C:
+		case <-checker.stop:
+			return
+		}
+	}
+}
+
+// checkAll checks every default target concurrently, and waits for the checks
+// to finish. Each check may take at most one interval.
+func (checker *healthChecker) checkAll() {
+	ctx, cancel := context.WithTimeout(context.Background(), checker.handler.config.TargetHealthInterval)
+	defer cancel()
+
+	var checks sync.WaitGroup
+	for _, target := range checker.handler.config.Targets {
+		checks.Add(1)
+		go func(target *Target) {
+			defer checks.Done()
+			checker.check(ctx, target)
+		}(target)
+	}
+	checks.Wait()
+}
+
+func (checker *healthChecker) check(ctx context.Context, target *Target) {
+	config := checker.handler.config
+	health := checker.handler.health
+
+	var failure string
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target.Scheme+"://"+target.Host+config.TargetHealthPath, nil)
+	if err == nil {
+		// Unix socket targets are checked via their sockets.
+		request = withTarget(request, target)
+	}
+	if err != nil {
+		failure = err.Error()
+	} else if response, err := checker.handler.transportFor(request).RoundTrip(request); err != nil {
+		failure = err.Error()
+	} else {
+		response.Body.Close()
+		if response.StatusCode != config.TargetHealthStatus {
+			failure = response.Status
+		}
+	}
+
+	wasHealthy := health.healthy(target.Host)
+	health.setDown(target.Host, failure != "")
+	if failure != "" && wasHealthy {
+		logger.Warnf("Target %v failed its health check: %v", target, failure)
+	} else if failure == "" && !wasHealthy {
+		logger.Printf("Target %v passed its health check", target)
+	}
+}
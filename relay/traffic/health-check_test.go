@@ -0,0 +1,73 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestTargetHealthChecks(t *testing.T) {
+	// Each target counts the requests it receives, apart from health checks,
+	// which it answers according to its health.
+	type healthTarget struct {
+		server       *httptest.Server
+		healthy      atomic.Bool
+		requestCount atomic.Int64
+	}
+	var targets [2]*healthTarget
+	for i := range targets {
+		target := &healthTarget{}
+		target.healthy.Store(true)
+		target.server = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			if request.URL.Path == "/healthz" {
+				if !target.healthy.Load() {
+					response.WriteHeader(http.StatusServiceUnavailable)
+				}
+				return
+			}
+			target.requestCount.Add(1)
+		}))
+		defer target.server.Close()
+		targets[i] = target
+	}
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v,%v
+                                  target-health-interval: 50ms
+                                  target-health-path: /healthz
+    `, targets[0].server.URL, targets[1].server.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		expectRequestCounts := func(desc string, expectedCounts [2]int64) {
+			for _, target := range targets {
+				target.requestCount.Store(0)
+			}
+			for i := 0; i < 10; i++ {
+				if body := getBody(relayService.HttpUrl(), t); body == nil {
+					return
+				}
+			}
+			for i, target := range targets {
+				if count := target.requestCount.Load(); count != expectedCounts[i] {
+					t.Errorf("Test '%v': Expected target %v to receive %v requests but it received %v", desc, i, expectedCounts[i], count)
+				}
+			}
+		}
+
+		expectRequestCounts("Healthy targets share traffic", [2]int64{5, 5})
+
+		targets[1].healthy.Store(false)
+		time.Sleep(150 * time.Millisecond)
+		expectRequestCounts("Targets which fail their health checks are skipped", [2]int64{10, 0})
+
+		targets[1].healthy.Store(true)
+		time.Sleep(150 * time.Millisecond)
+		expectRequestCounts("Targets which pass their health checks again rejoin the rotation", [2]int64{5, 5})
+	})
+}
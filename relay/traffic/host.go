@@ -0,0 +1,51 @@
+package traffic
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+// hasPort matches hosts which include an explicit port, like "example.com:8080"
+// or "[::1]:8080".
+var hasPort = regexp.MustCompile(`:\d+$`)
+
+// normalizeHost returns two forms of a host for a target with the provided
+// scheme. headerHost is the form sent in the Host and Origin headers: the
+// scheme's default port is omitted, but any other explicit port is preserved.
+// address is the form to dial, which always includes a port, using the
+// scheme's default port if the host doesn't specify one.
+func normalizeHost(scheme string, host string) (headerHost string, address string) {
+	defaultPort := "80"
+	if scheme == "https" || scheme == "wss" {
+		defaultPort = "443"
+	}
+
+	if !hasPort.MatchString(host) {
+		hostname := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		return host, net.JoinHostPort(hostname, defaultPort)
+	}
+
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		// The host is malformed; leave it alone and let dialing fail.
+		return host, host
+	}
+	if port != defaultPort {
+		return host, host
+	}
+	if strings.Contains(hostname, ":") {
+		// IPv6 addresses must remain bracketed.
+		return "[" + hostname + "]", host
+	}
+	return hostname, host
+}
+
+// sameHost reports whether two hosts, used with the provided schemes, are the
+// same once the default port for each scheme is omitted. Hosts are compared
+// case-insensitively.
+func sameHost(schemeA string, hostA string, schemeB string, hostB string) bool {
+	headerHostA, _ := normalizeHost(schemeA, hostA)
+	headerHostB, _ := normalizeHost(schemeB, hostB)
+	return strings.EqualFold(headerHostA, headerHostB)
+}
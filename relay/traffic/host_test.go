@@ -0,0 +1,128 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"golang.org/x/net/websocket"
+)
+
+func TestTargetHostNormalization(t *testing.T) {
+	// The targets record the Host header of each request, including websocket
+	// handshakes. Their logical host doesn't exist, so the relay reaches them
+	// via the connect address, which lets the tests use default ports.
+	hosts := make(chan string, 10)
+	mux := http.NewServeMux()
+	echo := websocket.Handler(catcher.EchoServer)
+	mux.HandleFunc("/echo", func(response http.ResponseWriter, request *http.Request) {
+		hosts <- request.Host
+		echo.ServeHTTP(response, request)
+	})
+	mux.HandleFunc("/", func(response http.ResponseWriter, request *http.Request) {
+		hosts <- request.Host
+		response.WriteHeader(http.StatusOK)
+	})
+	httpTarget := httptest.NewServer(mux)
+	defer httpTarget.Close()
+	httpsTarget := httptest.NewTLSServer(mux)
+	defer httpsTarget.Close()
+
+	testCases := []struct {
+		desc         string
+		target       string
+		expectedHost string
+	}{
+		{
+			desc:         "An http target without a port",
+			target:       "http://relay-target.invalid",
+			expectedHost: "relay-target.invalid",
+		},
+		{
+			desc:         "An http target with the default port",
+			target:       "http://relay-target.invalid:80",
+			expectedHost: "relay-target.invalid",
+		},
+		{
+			desc:         "An http target with an explicit port",
+			target:       "http://relay-target.invalid:8080",
+			expectedHost: "relay-target.invalid:8080",
+		},
+		{
+			desc:         "An http target with the https default port",
+			target:       "http://relay-target.invalid:443",
+			expectedHost: "relay-target.invalid:443",
+		},
+		{
+			desc:         "An https target without a port",
+			target:       "https://relay-target.invalid",
+			expectedHost: "relay-target.invalid",
+		},
+		{
+			desc:         "An https target with the default port",
+			target:       "https://relay-target.invalid:443",
+			expectedHost: "relay-target.invalid",
+		},
+		{
+			desc:         "An https target with an explicit port",
+			target:       "https://relay-target.invalid:8443",
+			expectedHost: "relay-target.invalid:8443",
+		},
+		{
+			desc:         "An https target with the http default port",
+			target:       "https://relay-target.invalid:80",
+			expectedHost: "relay-target.invalid:80",
+		},
+	}
+
+	for _, testCase := range testCases {
+		targetURL, err := url.Parse(testCase.target)
+		if err != nil {
+			t.Fatalf("Test '%v': Error parsing target: %v", testCase.desc, err)
+		}
+		connectAddress := httpTarget.Listener.Addr().String()
+		if targetURL.Scheme == "https" {
+			connectAddress = httpsTarget.Listener.Addr().String()
+		}
+
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      connect-addr: %v
+                                      tls-verify: false
+        `, testCase.target, connectAddress)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+			if response.StatusCode != http.StatusOK {
+				t.Errorf("Test '%v': Expected status 200 but got %v", testCase.desc, response.StatusCode)
+				return
+			}
+			if host := <-hosts; host != testCase.expectedHost {
+				t.Errorf("Test '%v': Expected Host header '%v' but got '%v'", testCase.desc, testCase.expectedHost, host)
+			}
+
+			ws, err := websocket.Dial(fmt.Sprintf("%v/echo", relayService.WsUrl()), "", relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error dialing websocket: %v", testCase.desc, err)
+				return
+			}
+			defer ws.Close()
+			if err := testEcho(ws, "Ten-four"); err != nil {
+				t.Errorf("Test '%v': Error in websocket echo: %v", testCase.desc, err)
+			}
+			if host := <-hosts; host != testCase.expectedHost {
+				t.Errorf("Test '%v': Expected websocket Host header '%v' but got '%v'", testCase.desc, testCase.expectedHost, host)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package traffic
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+)
+
+// relayInformationalResponses returns a copy of the provided request which
+// relays informational (1xx) responses from the target, like 103 Early Hints,
+// to the client as soon as they arrive, ahead of the final response.
+//
+// 100 Continue isn't relayed, since the server sends it to the client itself
+// when the request body is first read, which the transport only does once the
+// target has sent 100 Continue or ExpectContinueTimeout has passed.
+// 101 Switching Protocols is only sent in response to upgrades, which aren't
+// relayed this way.
+func relayInformationalResponses(clientResponse http.ResponseWriter, clientRequest *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusContinue || code == http.StatusSwitchingProtocols {
+				return nil
+			}
+
+			// The server sends the current response headers along with an
+			// informational response, so they're temporarily replaced with the
+			// target's headers. The originals are restored afterwards, so that
+			// the final response only includes the headers meant for it.
+			responseHeader := clientResponse.Header()
+			savedHeader := responseHeader.Clone()
+			for key := range responseHeader {
+				delete(responseHeader, key)
+			}
+			for key, values := range header {
+				responseHeader[key] = append([]string{}, values...)
+			}
+			removeHopByHopHeaders(responseHeader)
+
+			clientResponse.WriteHeader(code)
+
+			for key := range responseHeader {
+				delete(responseHeader, key)
+			}
+			for key, values := range savedHeader {
+				responseHeader[key] = values
+			}
+			return nil
+		},
+	}
+	return clientRequest.WithContext(httptrace.WithClientTrace(clientRequest.Context(), trace))
+}
@@ -0,0 +1,234 @@
+package traffic_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestEarlyHints(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		response.WriteHeader(http.StatusEarlyHints)
+
+		response.Header().Del("Link")
+		response.Header().Set("Content-Type", "text/plain")
+		response.WriteHeader(http.StatusOK)
+		response.Write([]byte("Final response"))
+	}))
+	defer target.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		var informationalStatuses []int
+		var earlyHintsHeader textproto.MIMEHeader
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				informationalStatuses = append(informationalStatuses, code)
+				if code == http.StatusEarlyHints {
+					earlyHintsHeader = header
+				}
+				return nil
+			},
+		}
+
+		request, err := http.NewRequestWithContext(
+			httptrace.WithClientTrace(context.Background(), trace),
+			"GET",
+			relayService.HttpUrl(),
+			nil,
+		)
+		if err != nil {
+			t.Errorf("Error creating request: %v", err)
+			return
+		}
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Errorf("Error GETing: %v", err)
+			return
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Errorf("Error reading body: %v", err)
+			return
+		}
+
+		if !reflect.DeepEqual(informationalStatuses, []int{http.StatusEarlyHints}) {
+			t.Errorf("Expected a single 103 response but got %v", informationalStatuses)
+		}
+		if link := earlyHintsHeader.Get("Link"); link != "</style.css>; rel=preload; as=style" {
+			t.Errorf("Expected Link header in 103 response but got '%v'", link)
+		}
+
+		if response.StatusCode != 200 || string(body) != "Final response" {
+			t.Errorf("Unexpected final response %v with body '%v'", response, string(body))
+		}
+		if link := response.Header.Get("Link"); link != "" {
+			t.Errorf("Expected no Link header in final response but got '%v'", link)
+		}
+		if contentType := response.Header.Get("Content-Type"); contentType != "text/plain" {
+			t.Errorf("Expected Content-Type 'text/plain' in final response but got '%v'", contentType)
+		}
+	})
+}
+
+func TestExpectContinue(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		response.Write(body)
+	}))
+	defer target.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		// The client waits for 100 Continue before sending the body.
+		client := &http.Client{
+			Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second},
+		}
+
+		request, err := http.NewRequest("POST", relayService.HttpUrl(), strings.NewReader("Request body"))
+		if err != nil {
+			t.Errorf("Error creating request: %v", err)
+			return
+		}
+		request.Header.Set("Expect", "100-continue")
+
+		start := time.Now()
+		response, err := client.Do(request)
+		if err != nil {
+			t.Errorf("Error POSTing: %v", err)
+			return
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Errorf("Error reading body: %v", err)
+			return
+		}
+
+		if response.StatusCode != 200 || string(body) != "Request body" {
+			t.Errorf("Unexpected response %v with body '%v'", response, string(body))
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Expected 100 Continue to be sent promptly, but the request took %v", elapsed)
+		}
+	})
+}
+
+func TestExpectContinueRelayed(t *testing.T) {
+	// The target records whether it was asked to continue. It accepts requests
+	// to /accept, but rejects requests to /reject without reading their bodies.
+	expectations := make(chan string, 10)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		expectations <- request.Header.Get("Expect")
+		if request.URL.Path == "/reject" {
+			response.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(request.Body)
+		response.Write(body)
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc                  string
+		expectContinueTimeout string
+		path                  string
+		expectedStatus        int
+		expectedExpectation   string
+		expectContinue        bool
+	}{
+		{
+			desc:                  "The target's 100 Continue is relayed to the client",
+			expectContinueTimeout: "1s",
+			path:                  "/accept",
+			expectedStatus:        http.StatusOK,
+			expectedExpectation:   "100-continue",
+			expectContinue:        true,
+		},
+		{
+			desc:                  "The body isn't sent if the target rejects the request",
+			expectContinueTimeout: "1s",
+			path:                  "/reject",
+			expectedStatus:        http.StatusUnauthorized,
+			expectedExpectation:   "100-continue",
+			expectContinue:        false,
+		},
+		{
+			desc:                  "The relay answers the expectation itself if configured to",
+			expectContinueTimeout: "0s",
+			path:                  "/reject",
+			expectedStatus:        http.StatusUnauthorized,
+			expectedExpectation:   "",
+			expectContinue:        true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      expect-continue-timeout: %v
+        `, target.URL, testCase.expectContinueTimeout)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			// The client waits for 100 Continue before sending the body.
+			client := &http.Client{
+				Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second},
+			}
+
+			got100Continue := false
+			trace := &httptrace.ClientTrace{
+				Got100Continue: func() {
+					got100Continue = true
+				},
+			}
+			ctx := httptrace.WithClientTrace(context.Background(), trace)
+			request, err := http.NewRequestWithContext(ctx, "POST", relayService.HttpUrl()+testCase.path, strings.NewReader("Request body"))
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			request.Header.Set("Expect", "100-continue")
+
+			start := time.Now()
+			response, err := client.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error POSTing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+			if got100Continue != testCase.expectContinue {
+				t.Errorf("Test '%v': Expected 100 Continue to be received: %v but got %v", testCase.desc, testCase.expectContinue, got100Continue)
+			}
+			if expectation := <-expectations; expectation != testCase.expectedExpectation {
+				t.Errorf("Test '%v': Expected the target to receive Expect '%v' but got '%v'", testCase.desc, testCase.expectedExpectation, expectation)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("Test '%v': Expected the request to finish promptly, but it took %v", testCase.desc, elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package traffic
+
+import (
+	"net"
+	"net/http"
+)
+
+// permitClient checks the client's IP address against AllowCIDRs and
+// DenyCIDRs, and responds with a 403 if the client may not use the relay. It
+// returns true if the request may proceed. Denied ranges take precedence over
+// allowed ones, and if no allowed ranges are configured, every address which
+// isn't denied is allowed. The client is identified as for rate limiting, so
+// X-Forwarded-For is only used if TrustForwarded is set.
+func (handler *Handler) permitClient(clientResponse http.ResponseWriter, clientRequest *http.Request) bool {
+	allow, deny := handler.config.AllowCIDRs, handler.config.DenyCIDRs
+	if len(allow) == 0 && len(deny) == 0 {
+		return true
+	}
+
+	address := clientAddress(clientRequest, handler.config.TrustForwarded)
+	ip := net.ParseIP(address)
+	permitted := ip != nil && !containsIP(deny, ip) && (len(allow) == 0 || containsIP(allow, ip))
+	if !permitted {
+		loggerForRequest(clientRequest).Debugf("Rejecting request from %v: address is not allowed", address)
+		handler.writeError(clientResponse, "Forbidden", http.StatusForbidden)
+	}
+	return permitted
+}
+
+// containsIP reports whether any of the provided networks contains the
+// provided IP address.
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
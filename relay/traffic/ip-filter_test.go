@@ -0,0 +1,118 @@
+package traffic_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestIPFilter(t *testing.T) {
+	// Test clients connect from 127.0.0.1; other addresses, including IPv6
+	// addresses, are provided via X-Forwarded-For.
+	testCases := []struct {
+		desc           string
+		config         string
+		forwardedFor   string
+		expectedStatus int
+	}{
+		{
+			desc: "Clients in an allowed range are relayed",
+			config: `relay:
+                        allow-cidrs: 10.0.0.0/8,127.0.0.0/8
+            `,
+			expectedStatus: 200,
+		},
+		{
+			desc: "Clients outside the allowed ranges are rejected",
+			config: `relay:
+                        allow-cidrs: 10.0.0.0/8
+            `,
+			expectedStatus: 403,
+		},
+		{
+			desc: "Clients in a denied range are rejected",
+			config: `relay:
+                        deny-cidrs: 127.0.0.1
+            `,
+			expectedStatus: 403,
+		},
+		{
+			desc: "Clients outside the denied ranges are relayed",
+			config: `relay:
+                        deny-cidrs: 10.0.0.0/8
+            `,
+			expectedStatus: 200,
+		},
+		{
+			desc: "Denied ranges take precedence over allowed ranges",
+			config: `relay:
+                        allow-cidrs: 127.0.0.0/8
+                        deny-cidrs: 127.0.0.1/32
+            `,
+			expectedStatus: 403,
+		},
+		{
+			desc: "IPv6 clients in an allowed range are relayed",
+			config: `relay:
+                        allow-cidrs: 10.0.0.0/8,2001:db8::/32
+                        trust-forwarded: true
+            `,
+			forwardedFor:   "2001:db8::1",
+			expectedStatus: 200,
+		},
+		{
+			desc: "IPv6 clients outside the allowed ranges are rejected",
+			config: `relay:
+                        allow-cidrs: 10.0.0.0/8,2001:db8::/32
+                        trust-forwarded: true
+            `,
+			forwardedFor:   "2001:db9::1",
+			expectedStatus: 403,
+		},
+		{
+			desc: "IPv6 clients in a denied range are rejected",
+			config: `relay:
+                        allow-cidrs: 2001:db8::/32
+                        deny-cidrs: 2001:db8:1::/48
+                        trust-forwarded: true
+            `,
+			forwardedFor:   "2001:db8:1::1",
+			expectedStatus: 403,
+		},
+		{
+			desc: "X-Forwarded-For is ignored unless it's trusted",
+			config: `relay:
+                        deny-cidrs: 10.0.0.0/8
+            `,
+			forwardedFor:   "10.0.0.1",
+			expectedStatus: 200,
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, testCase.config, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+			request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			if testCase.forwardedFor != "" {
+				request.Header.Set("X-Forwarded-For", testCase.forwardedFor)
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package traffic
+
+import (
+	"net/http"
+	"strings"
+)
+
+// RelayViaHeaderName is the header in which each relay a request passes through
+// records its ID, so that a relay which sees a request a second time can tell
+// that it's part of a loop.
+const RelayViaHeaderName = "X-Relay-Via"
+
+// isLoop reports whether the provided request has already passed through this
+// relay, according to its X-Relay-Via headers. The header may be repeated, and
+// each value may be a comma-separated list of IDs.
+func (handler *Handler) isLoop(request *http.Request) bool {
+	for _, value := range request.Header.Values(RelayViaHeaderName) {
+		for _, relayID := range strings.Split(value, ",") {
+			if strings.TrimSpace(relayID) == handler.relayID {
+				return true
+			}
+		}
+	}
+	return false
+}
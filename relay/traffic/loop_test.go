@@ -0,0 +1,112 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"github.com/fullstorydev/relay-core/relay/traffic"
+)
+
+func TestSelfReferentialRelay(t *testing.T) {
+	// The target sends each request straight back to the relay, headers and
+	// all, and responds with whatever the relay responds with.
+	var relayURL string
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		loopRequest, err := http.NewRequest(request.Method, relayURL+request.URL.Path, nil)
+		if err != nil {
+			http.Error(response, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		loopRequest.Header = request.Header.Clone()
+		loopResponse, err := http.DefaultClient.Do(loopRequest)
+		if err != nil {
+			http.Error(response, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		loopResponse.Body.Close()
+		response.WriteHeader(loopResponse.StatusCode)
+	}))
+	defer target.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		relayURL = relayService.HttpUrl()
+		response, err := http.Get(relayURL + "/loop")
+		if err != nil {
+			t.Fatalf("Error GETing: %v", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusLoopDetected {
+			t.Errorf("Expected status 508 but got %v", response.StatusCode)
+		}
+	})
+}
+
+func TestChainedRelays(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		firstID        string
+		secondID       string
+		expectedStatus int
+	}{
+		{
+			desc:           "Chained relays with distinct IDs relay requests",
+			firstID:        "first",
+			secondID:       "second",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc:           "Chained relays sharing an ID detect a loop",
+			firstID:        "same",
+			secondID:       "same",
+			expectedStatus: http.StatusLoopDetected,
+		},
+	}
+
+	for _, testCase := range testCases {
+		secondConfig := fmt.Sprintf(`relay:
+                                        relay-id: %v
+        `, testCase.secondID)
+
+		test.WithCatcherAndRelay(t, secondConfig, nil, func(catcherService *catcher.Service, secondRelay *relay.Service) {
+			firstConfig := fmt.Sprintf(`relay:
+                                           target: %v
+                                           relay-id: %v
+            `, secondRelay.HttpUrl(), testCase.firstID)
+
+			test.WithRelay(t, firstConfig, nil, func(firstRelay *relay.Service) {
+				response, err := http.Get(firstRelay.HttpUrl())
+				if err != nil {
+					t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+					return
+				}
+				response.Body.Close()
+				if response.StatusCode != testCase.expectedStatus {
+					t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+					return
+				}
+				if testCase.expectedStatus != http.StatusOK {
+					return
+				}
+
+				lastRequest, err := catcherService.LastRequest()
+				if err != nil {
+					t.Errorf("Test '%v': Error reading last request from catcher: %v", testCase.desc, err)
+					return
+				}
+				via := lastRequest.Header.Values(traffic.RelayViaHeaderName)
+				if len(via) != 2 || via[0] != testCase.firstID || via[1] != testCase.secondID {
+					t.Errorf("Test '%v': Expected %v headers [%v %v] but got %v", testCase.desc, traffic.RelayViaHeaderName, testCase.firstID, testCase.secondID, via)
+				}
+			})
+		})
+	}
+}
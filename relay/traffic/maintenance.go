@@ -0,0 +1,36 @@
+package traffic
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// handleMaintenance responds to the request on the target's behalf if the
+// relay is in maintenance mode, returning true if it did. Websocket upgrades
+// receive the same response, which refuses them.
+func (handler *Handler) handleMaintenance(clientResponse http.ResponseWriter, clientRequest *http.Request) bool {
+	if !handler.config.Maintenance {
+		return false
+	}
+
+	loggerForRequest(clientRequest).Debugf("Rejecting request for %v: the relay is in maintenance mode", clientRequest.URL)
+	if retryAfter := handler.config.MaintenanceRetryAfter; retryAfter > 0 {
+		clientResponse.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+
+	status := handler.config.MaintenanceStatus
+	if handler.config.MaintenanceBody == "" {
+		handler.writeError(clientResponse, "The service is down for maintenance", status)
+		return true
+	}
+
+	// The body's Content-Type is detected from its contents, so that it may be
+	// e.g. HTML or JSON.
+	clientResponse.WriteHeader(status)
+	if clientRequest.Method != http.MethodHead {
+		io.WriteString(clientResponse, handler.config.MaintenanceBody)
+	}
+	return true
+}
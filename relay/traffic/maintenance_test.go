@@ -0,0 +1,114 @@
+package traffic_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestMaintenance(t *testing.T) {
+	testCases := []struct {
+		desc               string
+		config             string
+		expectedStatus     int
+		expectedBody       string
+		expectedRetryAfter string
+		expectRelayed      bool
+	}{
+		{
+			desc: "Requests are relayed when maintenance mode is off",
+			config: `relay:
+                        maintenance: false
+            `,
+			expectedStatus: http.StatusOK,
+			expectRelayed:  true,
+		},
+		{
+			desc: "Requests receive a 503 in maintenance mode",
+			config: `relay:
+                        maintenance: true
+            `,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   "The service is down for maintenance\n",
+		},
+		{
+			desc: "The maintenance status, body, and Retry-After can be configured",
+			config: `relay:
+                        maintenance: true
+                        maintenance-status: 502
+                        maintenance-body: '{"message": "Back soon"}'
+                        maintenance-retry-after: 90s
+            `,
+			expectedStatus:     http.StatusBadGateway,
+			expectedBody:       `{"message": "Back soon"}`,
+			expectedRetryAfter: "90",
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, testCase.config, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Errorf("Test '%v': Error reading response body: %v", testCase.desc, err)
+				return
+			}
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+			if testCase.expectedBody != "" && string(body) != testCase.expectedBody {
+				t.Errorf("Test '%v': Expected body '%v' but got '%s'", testCase.desc, testCase.expectedBody, body)
+			}
+			if retryAfter := response.Header.Get("Retry-After"); retryAfter != testCase.expectedRetryAfter {
+				t.Errorf("Test '%v': Expected Retry-After '%v' but got '%v'", testCase.desc, testCase.expectedRetryAfter, retryAfter)
+			}
+
+			_, err = catcherService.LastRequest()
+			if relayed := err == nil; relayed != testCase.expectRelayed {
+				t.Errorf("Test '%v': Expected relayed to be %v but it was %v", testCase.desc, testCase.expectRelayed, relayed)
+			}
+
+			// Websocket upgrades are refused with the same status.
+			if !testCase.expectRelayed {
+				if status := webSocketUpgradeStatus(t, relayService); status != testCase.expectedStatus {
+					t.Errorf("Test '%v': Expected websocket upgrade status %v but got %v", testCase.desc, testCase.expectedStatus, status)
+				}
+				if _, err := catcherService.LastRequest(); err == nil {
+					t.Errorf("Test '%v': Expected the websocket upgrade not to be relayed", testCase.desc)
+				}
+			}
+		})
+	}
+}
+
+func TestMaintenanceJSONError(t *testing.T) {
+	configYaml := `relay:
+                      maintenance: true
+                      error-format: json
+    `
+	test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		response, err := http.Get(relayService.HttpUrl())
+		if err != nil {
+			t.Fatalf("Error GETing: %v", err)
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatalf("Error reading response body: %v", err)
+		}
+		if !strings.Contains(string(body), `"status":503`) {
+			t.Errorf("Expected a JSON error body but got '%s'", body)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package traffic_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestMetrics(t *testing.T) {
+	configYaml := `relay:
+                      metrics-addr: localhost:0
+    `
+
+	test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		for i := 0; i < 3; i++ {
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Error GETing: %v", err)
+				return
+			}
+			response.Body.Close()
+		}
+
+		response, err := http.Post(relayService.HttpUrl(), "text/plain", strings.NewReader("Hello"))
+		if err != nil {
+			t.Errorf("Error POSTing: %v", err)
+			return
+		}
+		response.Body.Close()
+
+		expectMetrics(t, relayService, []string{
+			`relay_requests_total{method="GET",status="2xx"} 3`,
+			`relay_requests_total{method="POST",status="2xx"} 1`,
+			`relay_request_duration_seconds_count 4`,
+			`relay_response_size_bytes_count 4`,
+			`relay_upstream_errors_total 0`,
+			`relay_active_websocket_connections 0`,
+		})
+	})
+}
+
+func TestMetricsUpstreamErrors(t *testing.T) {
+	// Reserve a port and then release it, so that nothing is listening there.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error reserving port: %v", err)
+	}
+	targetURL := fmt.Sprintf("http://%v", listener.Addr())
+	listener.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  metrics-addr: localhost:0
+                                  target: %v
+    `, targetURL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		response, err := http.Get(relayService.HttpUrl())
+		if err != nil {
+			t.Errorf("Error GETing: %v", err)
+			return
+		}
+		response.Body.Close()
+
+		expectMetrics(t, relayService, []string{
+			`relay_requests_total{method="GET",status="5xx"} 1`,
+			`relay_upstream_errors_total 1`,
+		})
+	})
+}
+
+func TestMetricsDisabledByDefault(t *testing.T) {
+	test.WithCatcherAndRelay(t, "", nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		if address := relayService.MetricsAddress(); address != "" {
+			t.Errorf("Expected metrics to be disabled, but they're served at '%v'", address)
+		}
+	})
+}
+
+// expectMetrics scrapes the relay's metrics until they include all of the
+// expected lines. Metrics are recorded after the response is sent, so they may
+// briefly lag behind the requests the test has made.
+func expectMetrics(t *testing.T, relayService *relay.Service, expectedLines []string) {
+	var output string
+	for attempt := 0; attempt < 50; attempt++ {
+		output = scrapeMetrics(t, relayService)
+		if containsLines(output, expectedLines) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected metrics lines '%v' in output:\n%v", expectedLines, output)
+}
+
+func containsLines(output string, expectedLines []string) bool {
+	for _, expectedLine := range expectedLines {
+		if !strings.Contains(output, expectedLine+"\n") {
+			return false
+		}
+	}
+	return true
+}
+
+func scrapeMetrics(t *testing.T, relayService *relay.Service) string {
+	response, err := http.Get(fmt.Sprintf("http://%v/metrics", relayService.MetricsAddress()))
+	if err != nil {
+		t.Errorf("Error scraping metrics: %v", err)
+		return ""
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Errorf("Error reading metrics: %v", err)
+		return ""
+	}
+	return string(body)
+}
@@ -0,0 +1,149 @@
+package traffic_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"golang.org/x/net/websocket"
+)
+
+func TestTLSClientCertificate(t *testing.T) {
+	clientCert, certFile, keyFile := writeClientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	// The target serves both plain requests and websockets, but only to
+	// clients which present the expected certificate.
+	mux := http.NewServeMux()
+	mux.Handle("/echo", websocket.Handler(catcher.EchoServer))
+	mux.HandleFunc("/", func(response http.ResponseWriter, request *http.Request) {
+		response.WriteHeader(http.StatusOK)
+	})
+	target := httptest.NewUnstartedServer(mux)
+	target.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	target.StartTLS()
+	defer target.Close()
+
+	testCases := []struct {
+		desc          string
+		config        string
+		expectSuccess bool
+	}{
+		{
+			desc: "Targets requiring a client certificate reject the relay by default",
+			config: fmt.Sprintf(`relay:
+                                    target: %v
+                                    tls-verify: false
+            `, target.URL),
+			expectSuccess: false,
+		},
+		{
+			desc: "The configured client certificate is presented to the target",
+			config: fmt.Sprintf(`relay:
+                                    target: %v
+                                    tls-verify: false
+                                    tls-client-cert-file: %v
+                                    tls-client-key-file: %v
+            `, target.URL, certFile, keyFile),
+			expectSuccess: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithRelay(t, testCase.config, nil, func(relayService *relay.Service) {
+			expectedStatus := http.StatusBadGateway
+			if testCase.expectSuccess {
+				expectedStatus = http.StatusOK
+			}
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+			if response.StatusCode != expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, expectedStatus, response.StatusCode)
+			}
+
+			if !testCase.expectSuccess {
+				if status := webSocketUpgradeStatus(t, relayService); status != http.StatusBadGateway {
+					t.Errorf("Test '%v': Expected websocket upgrade status 502 but got %v", testCase.desc, status)
+				}
+				return
+			}
+			ws, err := websocket.Dial(fmt.Sprintf("%v/echo", relayService.WsUrl()), "", relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error dialing websocket: %v", testCase.desc, err)
+				return
+			}
+			defer ws.Close()
+			if err := testEcho(ws, "Breaker breaker"); err != nil {
+				t.Errorf("Test '%v': Error in echo: %v", testCase.desc, err)
+			}
+		})
+	}
+}
+
+// writeClientCertificate generates a self-signed client certificate and writes
+// it and its private key to PEM files, returning the certificate and the paths
+// to the files.
+func writeClientCertificate(t *testing.T) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "relay"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		t.Fatalf("Error parsing certificate: %v", err)
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshaling key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("Error writing certificate file: %v", err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("Error writing key file: %v", err)
+	}
+	return cert, certFile, keyFile
+}
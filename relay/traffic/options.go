@@ -1,20 +1,151 @@
 package traffic
 
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay/tracing"
+)
+
 // RelayOptions contains configuration options for the core relay code.
 //
 // It's preferable to keep the core relay code simple; before adding a new
 // option here, consider whether you could implement the same functionality as a
 // plugin.
 type RelayOptions struct {
-	MaxBodySize  int64  // Maximum length in bytes of relayed bodies.
-	TargetHost   string // The host to relay traffic to. (e.g. 192.168.0.1:1234)
-	TargetScheme string // The scheme ('http' or 'https') to use to communicate with the target host.
+	AccessLog               *AccessLog        // If set, a line is written to this log for each request.
+	AllowCIDRs              []*net.IPNet      // If set, only clients with addresses in these networks may use the relay.
+	AllowConnect            bool              // If true, CONNECT requests are tunneled to the host and port they name.
+	AllowedMethods          []string          // If set, requests with other methods receive a 405 response. Methods are case-sensitive.
+	BasicAuthForward        bool              // If true, the client's Authorization header is relayed to the target after it's validated.
+	BasicAuthPassword       string            // The password clients must provide if BasicAuthUser is set.
+	BasicAuthUser           string            // If set, clients must provide these Basic Auth credentials to use the relay.
+	BodyReplacements        []BodyReplacement // Literal replacements applied to request bodies of at most MaxBodySize bytes.
+	BufferStreamedResponses bool              // If true, responses of unknown length are buffered and relayed with a Content-Length.
+	CORSAllowOrigins        []string          // Origins which browsers may access the relay from; "*" allows any. If empty, CORS is left to the target.
+	CacheSize               int               // Maximum number of responses to GET requests kept in the response cache. Zero disables the cache.
+	CircuitBreakerCooldown  time.Duration     // How long a target's circuit stays open before a trial request is allowed.
+	CircuitBreakerThreshold int               // Consecutive failures which open a target's circuit. Zero disables the circuit breaker.
+	ClientWriteTimeout      time.Duration     // How long a write of a response body to the client may block before the response is aborted. Zero means no timeout.
+	CompressMinSize         int64             // The minimum length in bytes of responses compressed when CompressResponse is set.
+	CompressResponse        bool              // If true, uncompressed text responses are gzipped for clients which accept gzip.
+	ConnectAddress          string            // If set, connections to Targets are made to this address instead; the targets' hosts are still used for the Host header and SNI.
+	CookieDomain            string            // If set, cookies the target scopes to its own host are rescoped to this domain.
+	CookiePath              string            // If set, the path of each cookie set by the target is replaced with this path.
+	DenyCIDRs               []*net.IPNet      // Clients with addresses in these networks may not use the relay, even if they're in AllowCIDRs.
+	DialTimeout             time.Duration     // How long to wait for a connection (including the TLS handshake) to the target.
+	DisableClientKeepAlive  bool              // If true, client connections are closed after each HTTP response, rather than being kept alive.
+	EnableHTTP2             bool              // If true, HTTP/2 is negotiated with https targets that support it.
+	ErrorFormat             ErrorFormat       // How the bodies of error responses generated by the relay are formatted. Defaults to plain text.
+	ExpectContinueTimeout   time.Duration     // How long to wait for the target's 100 Continue before sending a request body anyway. Zero means the relay answers "Expect: 100-continue" itself.
+	ForceClientScheme       string            // If set, the scheme ("http" or "https") clients are assumed to use, for X-Forwarded-Proto and rewritten URLs, instead of the detected one.
+	HMACHeader              string            // The header which carries the HMAC signature of each request if HMACSecret is set.
+	HMACSecret              string            // If set, HTTP requests to the target are signed with this secret using HMAC-SHA256.
+	HostRoutes              []*HostRoute      // Routes which send requests for particular hosts to specific targets.
+	IdleConnTimeout         time.Duration     // How long idle connections to the target are kept open.
+	LargeResponseThreshold  int64             // Responses with bodies larger than this many bytes are logged as warnings. Zero disables the warnings.
+	Maintenance             bool              // If true, every request receives a MaintenanceStatus response without contacting the target.
+	MaintenanceBody         string            // The body of maintenance responses. If empty, a short error message is used.
+	MaintenanceRetryAfter   time.Duration     // If set, maintenance responses include a Retry-After header with this delay.
+	MaintenanceStatus       int               // The status of maintenance responses.
+	MaxBodySize             int64             // Maximum length in bytes of relayed bodies.
+	MaxConcurrent           int               // The maximum number of HTTP requests in flight to the targets at once. Zero means there's no limit.
+	MaxConnsPerHost         int               // Maximum number of connections to each target. Zero means no limit.
+	MaxHeaderBytes          int               // Maximum length in bytes of a request's serialized headers. Zero means no limit.
+	MaxIdleConns            int               // Maximum number of idle connections kept open across all targets.
+	MaxIdleConnsPerHost     int               // Maximum number of idle connections kept open to each target.
+	MaxRequestBodySize      int64             // Maximum length in bytes of request bodies. Zero means no limit.
+	MaxRetries              int               // How many times to retry idempotent requests after a connection failure.
+	MaxWebSocketConnections int               // Maximum number of concurrently relayed websockets. Zero means no limit.
+	NoProxy                 string            // Hosts which bypass UpstreamProxy, in the format of the NO_PROXY environment variable.
+	PathRoutes              []*PathRoute      // Routes which send requests for particular path prefixes to specific targets. Host routes take precedence.
+	PreserveHost            bool              // If true, the client's Host header is relayed to the target instead of the target's host.
+	PublicHost              string            // The host clients use to reach the relay. If empty, the client's Host header is used.
+	PublicScheme            string            // The scheme clients use to reach the relay. If empty, redirect schemes are unchanged.
+	QueueTimeout            time.Duration     // How long a request waits for a slot when MaxConcurrent requests are in flight before it's rejected.
+	RateBurst               int               // The number of requests a client may make in a burst. Defaults to the rate limit, rounded up.
+	RateLimit               float64           // Requests per second allowed from each client. Zero means there's no limit.
+	RelayID                 string            // Identifies this relay in the X-Relay-Via header used to detect loops. If empty, a random ID is generated.
+	RequestHeaderWhitelist  []string          // If set, only these request headers are relayed to the target, along with those the relay depends on.
+	RequestIDHeader         string            // The header which carries each request's correlation ID. IDs are generated for requests without one.
+	RequestTimeout          time.Duration     // How long an HTTP request to the target may take, including its response body. Zero means no timeout.
+	ResponseHeaderTimeout   time.Duration     // How long to wait for the target's response headers. Zero means no timeout.
+	ResponseReplace         bool              // If true, absolute URLs referring to the target in text responses are rewritten to refer to the relay's public host.
+	RetryBackoff            time.Duration     // How long to wait before the first retry. The delay doubles for each later retry.
+	RetryBufferLimit        int64             // Request bodies up to this many bytes are buffered so they can be resent. Larger bodies are streamed and not retried.
+	RetryOnStatus           []int             // Statuses from the target which cause idempotent requests to be retried, like connection failures.
+	ShadowTarget            *Target           // If set, a copy of each HTTP request is sent here, and the response is discarded.
+	SlowRequestThreshold    time.Duration     // Requests which take longer than this are logged as warnings. Zero disables the warnings.
+	SplitBuckets            []*SplitBucket    // Ranges of split header buckets which are relayed to specific targets rather than the default targets.
+	SplitHeader             string            // If set, requests are assigned to SplitBuckets by a hash of this header's value.
+	StickyCookie            string            // If set, the name of a cookie used to keep each client on the same target.
+	StripResponseHeaders    []string          // Headers which should be removed from responses before they're relayed.
+	TargetFailThreshold     int               // Consecutive failures after which a default target is skipped during selection. Zero disables passive health checking.
+	TargetHealthInterval    time.Duration     // How often each default target is sent a health check. Zero disables active health checking.
+	TargetHealthPath        string            // The path requested by health checks.
+	TargetHealthStatus      int               // The status which healthy targets respond to health checks with.
+	TargetRecovery          time.Duration     // How long an unhealthy target is skipped before it's tried again.
+	Targets                 []*Target         // The targets to relay traffic to. Requests are distributed among them round-robin.
+	TimingHeader            bool              // If true, responses report how long the target took to respond in the X-Relay-Upstream-Time header.
+	TLSClientCertificate    *tls.Certificate  // If set, this certificate is presented to targets which request one.
+	TLSInsecureSkipVerify   bool              // If true, the target's TLS certificate is not verified.
+	TLSRootCAs              *x509.CertPool    // CAs used to verify the target's TLS certificate. If nil, the system CAs are used.
+	TLSServerName           string            // If set, the name sent via SNI and used to verify the certificates of https targets, instead of their hosts.
+	TraceConnections        bool              // If true, whether connections to the target are reused is recorded in metrics and debug logs, along with DNS and connect times.
+	Tracer                  *tracing.Tracer   // If set, a span is recorded for each HTTP request sent to a target.
+	TrustForwarded          bool              // If true, clients are identified by the first address in X-Forwarded-For, if present.
+	UpstreamProxy           *url.URL          // If set, requests to the target are sent through this proxy rather than one configured by the environment.
+	UserAgent               string            // If set, replaces the User-Agent header of HTTP requests. UserAgentNone removes it.
+	WebSocketBufferSize     int               // Size in bytes of the buffer used to relay each direction of a websocket or CONNECT tunnel.
+	WebSocketIdleTimeout    time.Duration     // How long a relayed websocket may be idle before it's closed. Zero means no timeout.
 }
 
-const DefaultMaxBodySize int64 = 1024 * 2048 // 2MB
+const (
+	DefaultCircuitBreakerCooldown       = 30 * time.Second
+	DefaultCompressMinSize        int64 = 1024
+	DefaultDialTimeout                  = 30 * time.Second
+	DefaultExpectContinueTimeout        = 1 * time.Second
+	DefaultIdleConnTimeout              = 2 * time.Second
+	DefaultMaintenanceStatus            = http.StatusServiceUnavailable
+	DefaultMaxBodySize            int64 = 1024 * 2048 // 2MB
+	DefaultMaxIdleConns                 = 256
+	DefaultMaxIdleConnsPerHost          = 64
+	DefaultRequestIDHeader              = "X-Request-ID"
+	DefaultRetryBackoff                 = 100 * time.Millisecond
+	DefaultRetryBufferLimit       int64 = 1024 * 2048 // 2MB
+	DefaultTargetHealthPath             = "/"
+	DefaultTargetHealthStatus           = http.StatusOK
+	DefaultTargetRecovery               = 30 * time.Second
+	DefaultWebSocketBufferSize          = 32 * 1024
+
+	// The bounds on WebSocketBufferSize. Tiny buffers make relaying very
+	// inefficient, while huge ones use a lot of memory, since each relayed
+	// connection needs two of them.
+	MinWebSocketBufferSize = 1024
+	MaxWebSocketBufferSize = 1024 * 1024
+)
 
 func NewDefaultRelayOptions() *RelayOptions {
 	return &RelayOptions{
-		MaxBodySize: DefaultMaxBodySize,
+		CircuitBreakerCooldown: DefaultCircuitBreakerCooldown,
+		CompressMinSize:        DefaultCompressMinSize,
+		DialTimeout:            DefaultDialTimeout,
+		ExpectContinueTimeout:  DefaultExpectContinueTimeout,
+		IdleConnTimeout:        DefaultIdleConnTimeout,
+		MaintenanceStatus:      DefaultMaintenanceStatus,
+		MaxBodySize:            DefaultMaxBodySize,
+		MaxIdleConns:           DefaultMaxIdleConns,
+		MaxIdleConnsPerHost:    DefaultMaxIdleConnsPerHost,
+		RequestIDHeader:        DefaultRequestIDHeader,
+		RetryBackoff:           DefaultRetryBackoff,
+		RetryBufferLimit:       DefaultRetryBufferLimit,
+		TargetHealthPath:       DefaultTargetHealthPath,
+		TargetHealthStatus:     DefaultTargetHealthStatus,
+		TargetRecovery:         DefaultTargetRecovery,
+		WebSocketBufferSize:    DefaultWebSocketBufferSize,
 	}
 }
@@ -0,0 +1,53 @@
+package traffic
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// OriginMode determines what happens to the Origin header of relayed requests.
+type OriginMode string
+
+const (
+	// OriginModePassthrough relays the client's Origin header unchanged.
+	OriginModePassthrough OriginMode = "passthrough"
+
+	// OriginModeTarget replaces the Origin header with the origin of the
+	// target the request is relayed to.
+	OriginModeTarget OriginMode = "target"
+
+	// OriginModeNone removes the Origin header.
+	OriginModeNone OriginMode = "none"
+)
+
+// ParseOriginMode returns the OriginMode with the provided name, which may be
+// "passthrough", "target", or "none". Names are matched case-insensitively.
+func ParseOriginMode(name string) (OriginMode, error) {
+	switch mode := OriginMode(strings.ToLower(name)); mode {
+	case OriginModePassthrough, OriginModeTarget, OriginModeNone:
+		return mode, nil
+	default:
+		return "", fmt.Errorf(`Unknown origin mode "%v"; expected "passthrough", "target", or "none"`, name)
+	}
+}
+
+// Apply updates the Origin header of the provided request according to this
+// mode. The request's URL must already refer to the target. clientOrigin is the
+// Origin the client sent, or the empty string if it didn't send one; in
+// passthrough mode, it's restored in case an earlier step changed the header.
+func (mode OriginMode) Apply(request *http.Request, clientOrigin string) {
+	switch mode {
+	case OriginModePassthrough:
+		if clientOrigin == "" {
+			request.Header.Del("Origin")
+		} else {
+			request.Header.Set("Origin", clientOrigin)
+		}
+	case OriginModeTarget:
+		host, _ := normalizeHost(request.URL.Scheme, request.URL.Host)
+		request.Header.Set("Origin", fmt.Sprintf("%v://%v", request.URL.Scheme, host))
+	case OriginModeNone:
+		request.Header.Del("Origin")
+	}
+}
@@ -0,0 +1,115 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/plugins/traffic/headers-plugin"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"github.com/fullstorydev/relay-core/relay/traffic"
+)
+
+func TestRouteOriginMode(t *testing.T) {
+	origins := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		origins <- request.Header.Get("Origin")
+	}))
+	defer target.Close()
+
+	targetURL, err := url.Parse(target.URL)
+	if err != nil {
+		t.Fatalf("Error parsing target URL: %v", err)
+	}
+	targetOrigin := fmt.Sprintf("http://%v", targetURL.Host)
+	const clientOrigin = "https://app.example.com"
+
+	// Each route sends requests to the same target, but handles the Origin
+	// header differently.
+	hostMap := fmt.Sprintf(`
+                                      - host: target.example.com
+                                        target: %v
+                                        origin-mode: target
+                                      - host: none.example.com
+                                        target: %v
+                                        origin-mode: none
+                                      - host: passthrough.example.com
+                                        target: %v
+                                        origin-mode: passthrough
+                                      - host: default.example.com
+                                        target: %v
+    `, target.URL, target.URL, target.URL, target.URL)
+
+	testCases := []struct {
+		desc           string
+		pluginConfig   string
+		host           string
+		expectedOrigin string
+	}{
+		{
+			desc:           "A route can replace the Origin with the target's origin",
+			host:           "target.example.com",
+			expectedOrigin: targetOrigin,
+		},
+		{
+			desc:           "A route can remove the Origin",
+			host:           "none.example.com",
+			expectedOrigin: "",
+		},
+		{
+			desc:           "Routes without an origin mode relay the Origin by default",
+			host:           "default.example.com",
+			expectedOrigin: clientOrigin,
+		},
+		{
+			desc:           "Requests which match no route relay the Origin by default",
+			host:           "other.example.com",
+			expectedOrigin: clientOrigin,
+		},
+		{
+			desc:           "A route's origin mode overrides the headers plugin",
+			pluginConfig:   "headers:\n  origin-mode: none\n",
+			host:           "passthrough.example.com",
+			expectedOrigin: clientOrigin,
+		},
+		{
+			desc:           "Routes without an origin mode use the headers plugin's mode",
+			pluginConfig:   "headers:\n  origin-mode: none\n",
+			host:           "default.example.com",
+			expectedOrigin: "",
+		},
+	}
+
+	plugins := []traffic.PluginFactory{headers_plugin.Factory}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      host-map: %v
+`, target.URL, hostMap) + testCase.pluginConfig
+
+		test.WithRelay(t, configYaml, plugins, func(relayService *relay.Service) {
+			request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			request.Host = testCase.host
+			request.Header.Set("Origin", clientOrigin)
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			if origin := <-origins; origin != testCase.expectedOrigin {
+				t.Errorf("Test '%v': Expected Origin '%v' but got '%v'", testCase.desc, testCase.expectedOrigin, origin)
+			}
+		})
+	}
+}
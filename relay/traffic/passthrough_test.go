@@ -0,0 +1,94 @@
+package traffic_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestRequestURIPassthrough(t *testing.T) {
+	receivedURIs := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		receivedURIs <- request.RequestURI
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc       string
+		requestURI string
+	}{
+		{
+			desc:       "Plus signs and encoded spaces are distinct",
+			requestURI: "/search?q=a+b&r=a%20b&s=a%2Bb",
+		},
+		{
+			desc:       "Repeated query keys are preserved in order",
+			requestURI: "/search?tag=b&tag=a&tag=b",
+		},
+		{
+			desc:       "Empty and missing values are preserved",
+			requestURI: "/search?a=&b&=c&&d=",
+		},
+		{
+			desc:       "Unusual but valid query characters are preserved",
+			requestURI: "/search?a=%7e~&b=%2f/&c=;&d=%3D=?",
+		},
+		{
+			desc:       "Percent-encoded path segments are preserved",
+			requestURI: "/files/a%2Fb/c%20d/e+f/%7euser",
+		},
+		{
+			desc:       "Paths are not cleaned",
+			requestURI: "/a//b/./c/../d",
+		},
+		{
+			desc:       "An empty query string is preserved",
+			requestURI: "/search?",
+		},
+	}
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		for _, testCase := range testCases {
+			// The request is written by hand, since http.Client might
+			// normalize the URI itself.
+			conn, err := net.Dial("tcp", relayService.Address())
+			if err != nil {
+				t.Errorf("Test '%v': Error connecting to relay: %v", testCase.desc, err)
+				continue
+			}
+			fmt.Fprintf(conn, "GET %v HTTP/1.1\r\nHost: %v\r\nConnection: close\r\n\r\n", testCase.requestURI, relayService.Address())
+
+			response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			conn.Close()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading response: %v", testCase.desc, err)
+				continue
+			}
+			response.Body.Close()
+
+			if response.StatusCode != 200 {
+				t.Errorf("Test '%v': Expected 200 response: %v", testCase.desc, response)
+				continue
+			}
+
+			if receivedURI := <-receivedURIs; receivedURI != testCase.requestURI {
+				t.Errorf(
+					"Test '%v': Expected target to receive '%v' but got '%v'",
+					testCase.desc,
+					testCase.requestURI,
+					receivedURI,
+				)
+			}
+		}
+	})
+}
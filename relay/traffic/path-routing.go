@@ -0,0 +1,63 @@
+package traffic
+
+import (
+	"net/url"
+	"strings"
+)
+
+// PathRoute directs requests whose path starts with a particular prefix to a
+// specific target, rather than to the default targets.
+type PathRoute struct {
+	// The path prefix to match, like "/api". Prefixes match whole path
+	// segments, so "/api" matches "/api" and "/api/users", but not "/apis".
+	Prefix string
+
+	// If true, the prefix is removed from the path of matching requests before
+	// they're relayed, so that "/api/users" is relayed as "/users". The
+	// target's own path, if it has one, is prepended afterwards.
+	StripPrefix bool
+
+	// The target to relay matching requests to.
+	Target *Target
+}
+
+// Matches reports whether the provided path starts with this route's prefix.
+func (route *PathRoute) Matches(path string) bool {
+	prefix := route.trimmedPrefix()
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// trimmedPrefix returns the route's prefix without a trailing slash, so that
+// "/api" and "/api/" are equivalent.
+func (route *PathRoute) trimmedPrefix() string {
+	return strings.TrimSuffix(route.Prefix, "/")
+}
+
+// stripPrefix removes the route's prefix from the provided URL's path. If the
+// URL has a RawPath which doesn't start with the escaped prefix, it's dropped,
+// and the path is relayed in its default encoding.
+func (route *PathRoute) stripPrefix(requestURL *url.URL) {
+	prefix := route.trimmedPrefix()
+	requestURL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(requestURL.Path, prefix), "/")
+	if requestURL.RawPath != "" {
+		escapedPrefix := (&url.URL{Path: prefix}).EscapedPath()
+		if rawPath, found := strings.CutPrefix(requestURL.RawPath, escapedPrefix); found {
+			requestURL.RawPath = "/" + strings.TrimPrefix(rawPath, "/")
+		} else {
+			requestURL.RawPath = ""
+		}
+	}
+}
+
+// matchPathRoute returns the path route which matches the provided path, or nil
+// if none does. The route with the longest matching prefix is chosen, so that
+// more specific routes take precedence regardless of their order.
+func (handler *Handler) matchPathRoute(path string) *PathRoute {
+	var match *PathRoute
+	for _, route := range handler.config.PathRoutes {
+		if route.Matches(path) && (match == nil || len(route.trimmedPrefix()) > len(match.trimmedPrefix())) {
+			match = route
+		}
+	}
+	return match
+}
@@ -0,0 +1,170 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestPathRouting(t *testing.T) {
+	// Each target records the paths of the requests it receives.
+	type receivedRequest struct {
+		target int
+		path   string
+	}
+	received := make(chan receivedRequest, 10)
+	var targetURLs []string
+	for i := 0; i < 3; i++ {
+		index := i
+		target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			received <- receivedRequest{target: index, path: request.URL.Path}
+			response.Write([]byte("OK"))
+		}))
+		defer target.Close()
+		targetURLs = append(targetURLs, target.URL)
+	}
+
+	testCases := []struct {
+		desc           string
+		pathMap        string
+		path           string
+		expectedTarget int
+		expectedPath   string
+	}{
+		{
+			desc: "Requests matching a prefix are routed to its target",
+			pathMap: fmt.Sprintf(`
+                                      - path: /api
+                                        target: %v
+                                      - path: /static
+                                        target: %v
+            `, targetURLs[1], targetURLs[2]),
+			path:           "/static/app.js",
+			expectedTarget: 2,
+			expectedPath:   "/static/app.js",
+		},
+		{
+			desc: "A prefix matches the path which equals it",
+			pathMap: fmt.Sprintf(`
+                                      - path: /api/
+                                        target: %v
+            `, targetURLs[1]),
+			path:           "/api",
+			expectedTarget: 1,
+			expectedPath:   "/api",
+		},
+		{
+			desc: "The longest matching prefix wins",
+			pathMap: fmt.Sprintf(`
+                                      - path: /api
+                                        target: %v
+                                      - path: /api/v2
+                                        target: %v
+            `, targetURLs[1], targetURLs[2]),
+			path:           "/api/v2/users",
+			expectedTarget: 2,
+			expectedPath:   "/api/v2/users",
+		},
+		{
+			desc: "The longest matching prefix wins regardless of order",
+			pathMap: fmt.Sprintf(`
+                                      - path: /api/v2
+                                        target: %v
+                                      - path: /api
+                                        target: %v
+            `, targetURLs[2], targetURLs[1]),
+			path:           "/api/v1/users",
+			expectedTarget: 1,
+			expectedPath:   "/api/v1/users",
+		},
+		{
+			desc: "Prefixes only match whole path segments",
+			pathMap: fmt.Sprintf(`
+                                      - path: /api
+                                        target: %v
+            `, targetURLs[1]),
+			path:           "/apis",
+			expectedTarget: 0,
+			expectedPath:   "/apis",
+		},
+		{
+			desc:           "Unmatched paths are routed to the default target",
+			pathMap:        fmt.Sprintf(`/api=%v, /static=%v`, targetURLs[1], targetURLs[2]),
+			path:           "/index.html",
+			expectedTarget: 0,
+			expectedPath:   "/index.html",
+		},
+		{
+			desc:           "The path map can be a comma-separated string",
+			pathMap:        fmt.Sprintf(`/api=%v, /static=%v`, targetURLs[1], targetURLs[2]),
+			path:           "/api/users",
+			expectedTarget: 1,
+			expectedPath:   "/api/users",
+		},
+		{
+			desc: "Prefixes can be stripped",
+			pathMap: fmt.Sprintf(`
+                                      - path: /api
+                                        target: %v
+                                        strip-prefix: true
+            `, targetURLs[1]),
+			path:           "/api/users",
+			expectedTarget: 1,
+			expectedPath:   "/users",
+		},
+		{
+			desc: "Stripping a prefix which equals the path leaves the root",
+			pathMap: fmt.Sprintf(`
+                                      - path: /api
+                                        target: %v
+                                        strip-prefix: true
+            `, targetURLs[1]),
+			path:           "/api",
+			expectedTarget: 1,
+			expectedPath:   "/",
+		},
+		{
+			desc: "The target's path is prepended after the prefix is stripped",
+			pathMap: fmt.Sprintf(`
+                                      - path: /api
+                                        target: %v/v1
+                                        strip-prefix: true
+            `, targetURLs[1]),
+			path:           "/api/users",
+			expectedTarget: 1,
+			expectedPath:   "/v1/users",
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      path-map: %v
+        `, targetURLs[0], testCase.pathMap)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			response, err := http.Get(relayService.HttpUrl() + testCase.path)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			select {
+			case request := <-received:
+				if request.target != testCase.expectedTarget {
+					t.Errorf("Test '%v': Expected target %v to receive the request but target %v did", testCase.desc, testCase.expectedTarget, request.target)
+				}
+				if request.path != testCase.expectedPath {
+					t.Errorf("Test '%v': Expected path '%v' but got '%v'", testCase.desc, testCase.expectedPath, request.path)
+				}
+			default:
+				t.Errorf("Test '%v': Expected a target to receive the request", testCase.desc)
+			}
+		})
+	}
+}
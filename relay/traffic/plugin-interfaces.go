@@ -53,12 +53,24 @@ type RequestInfo struct {
 	// request before plugins get an opportunity to handle it.
 	OriginalCookieHeaders []string
 
+	// The original Host header sent by the client, before the relay rewrote it
+	// to refer to the relay target.
+	OriginalHost string
+
+	// The original Origin header sent by the client, before any plugin or host
+	// route changed it. Empty if the client didn't send one.
+	OriginalOrigin string
+
 	// The original URL requested by the client, before any redirection by the
 	// relay.
 	OriginalURL *url.URL
 
 	// If true, a response has already been sent to the client.
 	Serviced bool
+
+	// If set, the sticky session cookie naming this target is set on the
+	// response once the request has been authorized.
+	stickyTarget *Target
 }
 
 /*
@@ -2,14 +2,13 @@ package plugin_loader
 
 import (
 	"fmt"
-	"log"
-	"os"
 
 	"github.com/fullstorydev/relay-core/relay/config"
+	"github.com/fullstorydev/relay-core/relay/logging"
 	"github.com/fullstorydev/relay-core/relay/traffic"
 )
 
-var logger = log.New(os.Stdout, "[traffic-plugin-loader] ", 0)
+var logger = logging.New("traffic-plugin-loader")
 
 // Load creates and configures a set of traffic plugins.
 func Load(
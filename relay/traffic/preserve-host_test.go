@@ -0,0 +1,146 @@
+package traffic_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"golang.org/x/net/websocket"
+)
+
+func TestPreserveHost(t *testing.T) {
+	// The targets record the Host header of each request, including websocket
+	// handshakes, and the https target records the server name sent via SNI.
+	hosts := make(chan string, 10)
+	serverNames := make(chan string, 10)
+	mux := http.NewServeMux()
+	echo := websocket.Handler(catcher.EchoServer)
+	mux.HandleFunc("/echo", func(response http.ResponseWriter, request *http.Request) {
+		hosts <- request.Host
+		echo.ServeHTTP(response, request)
+	})
+	mux.HandleFunc("/", func(response http.ResponseWriter, request *http.Request) {
+		hosts <- request.Host
+		response.WriteHeader(http.StatusOK)
+	})
+	httpTarget := httptest.NewServer(mux)
+	defer httpTarget.Close()
+	httpsTarget := httptest.NewUnstartedServer(mux)
+	httpsTarget.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	}
+	httpsTarget.StartTLS()
+	defer httpsTarget.Close()
+
+	// The test server's certificate is valid for "example.com", so that name
+	// can be used for SNI and verification.
+	caFile := writeCertificateFile(t, httpsTarget)
+	const clientHost = "app.example.com"
+
+	httpsTargetURL, err := url.Parse(httpsTarget.URL)
+	if err != nil {
+		t.Fatalf("Error parsing target URL: %v", err)
+	}
+
+	testCases := []struct {
+		desc               string
+		target             string
+		connectAddress     string
+		preserveHost       bool
+		tlsServerName      string
+		expectedHost       string
+		expectedServerName string
+	}{
+		{
+			desc:         "The target's host is sent by default",
+			target:       httpTarget.URL,
+			expectedHost: httpTarget.Listener.Addr().String(),
+		},
+		{
+			desc:         "The client's host is sent if it's preserved",
+			target:       httpTarget.URL,
+			preserveHost: true,
+			expectedHost: clientHost,
+		},
+		{
+			desc:               "The target's host is still sent via SNI if the client's host is preserved",
+			target:             fmt.Sprintf("https://example.com:%v", httpsTargetURL.Port()),
+			connectAddress:     httpsTargetURL.Host,
+			preserveHost:       true,
+			expectedHost:       clientHost,
+			expectedServerName: "example.com",
+		},
+		{
+			desc:               "The TLS server name is sent via SNI and used to verify the certificate",
+			target:             httpsTarget.URL,
+			preserveHost:       true,
+			tlsServerName:      "example.com",
+			expectedHost:       clientHost,
+			expectedServerName: "example.com",
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      connect-addr: '%v'
+                                      preserve-host: %v
+                                      tls-server-name: '%v'
+                                      tls-ca-file: %v
+        `, testCase.target, testCase.connectAddress, testCase.preserveHost, testCase.tlsServerName, caFile)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			for _, path := range []string{"/", "/echo"} {
+				// Discard server names from earlier requests.
+				for len(serverNames) > 0 {
+					<-serverNames
+				}
+
+				request, err := http.NewRequest("GET", relayService.HttpUrl()+path, nil)
+				if err != nil {
+					t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+					return
+				}
+				request.Host = clientHost
+				expectedStatus := http.StatusOK
+				if path == "/echo" {
+					request.Header.Set("Connection", "Upgrade")
+					request.Header.Set("Upgrade", "websocket")
+					request.Header.Set("Origin", relayService.HttpUrl())
+					request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+					request.Header.Set("Sec-WebSocket-Version", "13")
+					expectedStatus = http.StatusSwitchingProtocols
+				}
+
+				response, err := http.DefaultClient.Do(request)
+				if err != nil {
+					t.Errorf("Test '%v': Error requesting %v: %v", testCase.desc, path, err)
+					return
+				}
+				response.Body.Close()
+				if response.StatusCode != expectedStatus {
+					t.Errorf("Test '%v': Expected status %v for %v but got %v", testCase.desc, expectedStatus, path, response.StatusCode)
+					return
+				}
+
+				if host := <-hosts; host != testCase.expectedHost {
+					t.Errorf("Test '%v': Expected Host header '%v' for %v but got '%v'", testCase.desc, testCase.expectedHost, path, host)
+				}
+				if testCase.expectedServerName != "" {
+					if serverName := <-serverNames; serverName != testCase.expectedServerName {
+						t.Errorf("Test '%v': Expected server name '%v' for %v but got '%v'", testCase.desc, testCase.expectedServerName, path, serverName)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package traffic_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestUpstreamProxy(t *testing.T) {
+	// The proxy answers every request itself, recording the host it was asked
+	// to reach. The target's host doesn't exist, so requests which bypass the
+	// proxy fail.
+	proxiedHosts := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		proxiedHosts <- request.URL.Host
+		response.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+
+	const targetHost = "relay-target.invalid"
+
+	testCases := []struct {
+		desc          string
+		noProxy       string
+		expectProxied bool
+	}{
+		{
+			desc:          "Requests are sent through the upstream proxy",
+			noProxy:       "",
+			expectProxied: true,
+		},
+		{
+			desc:          "Hosts which aren't excluded are sent through the upstream proxy",
+			noProxy:       "other.example,.internal.example",
+			expectProxied: true,
+		},
+		{
+			desc:          "Excluded hosts bypass the upstream proxy",
+			noProxy:       "other.example," + targetHost,
+			expectProxied: false,
+		},
+		{
+			desc:          "Excluded domains bypass the upstream proxy",
+			noProxy:       ".invalid",
+			expectProxied: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: http://%v
+                                      upstream-proxy: %v
+                                      no-proxy: '%v'
+        `, targetHost, proxy.URL, testCase.noProxy)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			response, err := http.Get(relayService.HttpUrl() + "/path")
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			body, _ := io.ReadAll(response.Body)
+			response.Body.Close()
+
+			if !testCase.expectProxied {
+				if response.StatusCode != http.StatusBadGateway {
+					t.Errorf("Test '%v': Expected a direct request to fail with status 502 but got %v", testCase.desc, response.StatusCode)
+				}
+				select {
+				case host := <-proxiedHosts:
+					t.Errorf("Test '%v': Expected the proxy not to be used but it received a request for %v", testCase.desc, host)
+				default:
+				}
+				return
+			}
+
+			if response.StatusCode != http.StatusOK || string(body) != "proxied" {
+				t.Errorf("Test '%v': Expected the proxy's response but got status %v with body '%v'", testCase.desc, response.StatusCode, string(body))
+				return
+			}
+			if host := <-proxiedHosts; host != targetHost {
+				t.Errorf("Test '%v': Expected the proxy to be asked for %v but got %v", testCase.desc, targetHost, host)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package traffic
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitCleanupInterval is how often the rate limiter discards the buckets
+// of clients which have been idle long enough for their buckets to refill.
+var rateLimitCleanupInterval = time.Minute
+
+// rateLimiter limits the rate of requests from each client using a token
+// bucket per client. Each bucket holds up to burst tokens and refills at rate
+// tokens per second; each request consumes a token, and requests which find
+// their bucket empty are rejected. A rate of zero disables the limiter.
+type rateLimiter struct {
+	buckets     map[string]*tokenBucket
+	burst       float64
+	lastCleanup time.Time
+	mutex       sync.Mutex
+	rate        float64
+}
+
+type tokenBucket struct {
+	tokens  float64   // The number of tokens in the bucket as of updated.
+	updated time.Time // When tokens was last updated.
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		buckets:     map[string]*tokenBucket{},
+		burst:       float64(burst),
+		lastCleanup: time.Now(),
+		rate:        rate,
+	}
+}
+
+// allow reports whether a request from the provided client may proceed. If it
+// may not, it also returns how long the client should wait before retrying.
+func (limiter *rateLimiter) allow(client string) (bool, time.Duration) {
+	if limiter.rate <= 0 {
+		return true, 0
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(limiter.lastCleanup) >= rateLimitCleanupInterval {
+		limiter.cleanup(now)
+	}
+
+	bucket := limiter.buckets[client]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: limiter.burst, updated: now}
+		limiter.buckets[client] = bucket
+	} else {
+		refilled := bucket.tokens + now.Sub(bucket.updated).Seconds()*limiter.rate
+		bucket.tokens = math.Min(refilled, limiter.burst)
+		bucket.updated = now
+	}
+
+	if bucket.tokens < 1 {
+		wait := (1 - bucket.tokens) / limiter.rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// cleanup discards buckets which would have refilled completely by now. Such
+// buckets are indistinguishable from new ones, so discarding them doesn't
+// change the limiter's behavior, and it keeps the number of buckets from
+// growing without bound as new clients arrive.
+func (limiter *rateLimiter) cleanup(now time.Time) {
+	for client, bucket := range limiter.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*limiter.rate >= limiter.burst {
+			delete(limiter.buckets, client)
+		}
+	}
+	limiter.lastCleanup = now
+}
+
+// clientAddress returns the address of the client which sent the provided
+// request, for use in rate limiting and IP filtering. If trustForwarded is true
+// and the request has an X-Forwarded-For header, the first address in that
+// header is used, since the request was presumably forwarded by a trusted proxy.
+// Otherwise, the address of the connection is used, without its port.
+func clientAddress(request *http.Request, trustForwarded bool) string {
+	if trustForwarded {
+		if forwardedFor := request.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+			first, _, _ := strings.Cut(forwardedFor, ",")
+			if first = strings.TrimSpace(first); first != "" {
+				return first
+			}
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		return host
+	}
+	return request.RemoteAddr
+}
@@ -0,0 +1,97 @@
+package traffic_test
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestRateLimit(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		config           string
+		forwardedFor     []string
+		expectedStatuses []int
+	}{
+		{
+			desc:             "Requests are not limited by default",
+			config:           "",
+			forwardedFor:     []string{"", "", "", "", ""},
+			expectedStatuses: []int{200, 200, 200, 200, 200},
+		},
+		{
+			desc: "Requests beyond the burst are rejected",
+			config: `relay:
+                        rate-limit: 1
+                        rate-burst: 3
+            `,
+			forwardedFor:     []string{"", "", "", "", ""},
+			expectedStatuses: []int{200, 200, 200, 429, 429},
+		},
+		{
+			desc: "The burst defaults to the rate limit",
+			config: `relay:
+                        rate-limit: 2
+            `,
+			forwardedFor:     []string{"", "", ""},
+			expectedStatuses: []int{200, 200, 429},
+		},
+		{
+			desc: "X-Forwarded-For is ignored by default",
+			config: `relay:
+                        rate-limit: 1
+            `,
+			forwardedFor:     []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			expectedStatuses: []int{200, 429, 429},
+		},
+		{
+			desc: "Clients are identified by X-Forwarded-For if it's trusted",
+			config: `relay:
+                        rate-limit: 1
+                        trust-forwarded: true
+            `,
+			forwardedFor:     []string{"10.0.0.1", "10.0.0.2, 10.0.0.9", "10.0.0.1", "10.0.0.2"},
+			expectedStatuses: []int{200, 200, 429, 429},
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, testCase.config, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+			var statuses []int
+			for _, forwardedFor := range testCase.forwardedFor {
+				request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+				if err != nil {
+					t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+					return
+				}
+				if forwardedFor != "" {
+					request.Header.Set("X-Forwarded-For", forwardedFor)
+				}
+
+				response, err := http.DefaultClient.Do(request)
+				if err != nil {
+					t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+					return
+				}
+				response.Body.Close()
+				statuses = append(statuses, response.StatusCode)
+
+				if response.StatusCode == 429 && response.Header.Get("Retry-After") != "1" {
+					t.Errorf(
+						"Test '%v': Expected Retry-After '1' but got '%v'",
+						testCase.desc,
+						response.Header.Get("Retry-After"),
+					)
+				}
+			}
+
+			if !reflect.DeepEqual(statuses, testCase.expectedStatuses) {
+				t.Errorf("Test '%v': Expected statuses %v but got %v", testCase.desc, testCase.expectedStatuses, statuses)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package traffic
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// rewriteRedirectLocation rewrites the Location header of a redirect response
+// if it points at the target the request was relayed to, so that the client
+// continues to communicate through the relay rather than contacting the target
+// directly. The location is rewritten to refer to the relay's public host,
+// which is either configured explicitly or taken from the client's original
+// Host header. The target's host matches with or without its default port.
+// Relative locations and locations which refer to other hosts are left alone.
+func (handler *Handler) rewriteRedirectLocation(
+	targetResponse *http.Response,
+	clientRequest *http.Request,
+	originalHost string,
+) {
+	if targetResponse.StatusCode < 300 || targetResponse.StatusCode > 399 {
+		return
+	}
+
+	location := targetResponse.Header.Get("Location")
+	if location == "" {
+		return
+	}
+
+	locationURL, err := url.Parse(location)
+	if err != nil || locationURL.Host == "" {
+		return
+	}
+	// A scheme-relative location uses the scheme of the request.
+	locationScheme := locationURL.Scheme
+	if locationScheme == "" {
+		locationScheme = clientRequest.URL.Scheme
+	}
+	if !sameHost(locationScheme, locationURL.Host, clientRequest.URL.Scheme, clientRequest.URL.Host) {
+		return
+	}
+
+	publicHost := handler.publicHost(originalHost)
+	if publicHost == "" {
+		return
+	}
+
+	locationURL.Host = publicHost
+	if publicScheme := handler.publicScheme(); publicScheme != "" {
+		locationURL.Scheme = publicScheme
+	}
+	targetResponse.Header.Set("Location", locationURL.String())
+}
+
+// publicHost returns the host clients use to reach the relay: the configured
+// PublicHost if there is one, or otherwise the client's original Host header.
+func (handler *Handler) publicHost(originalHost string) string {
+	if handler.config.PublicHost != "" {
+		return handler.config.PublicHost
+	}
+	return originalHost
+}
+
+// publicScheme returns the scheme clients use to reach the relay: the scheme of
+// the configured PublicHost if it has one, or otherwise ForceClientScheme. If
+// neither is set, it returns "".
+func (handler *Handler) publicScheme() string {
+	if handler.config.PublicScheme != "" {
+		return handler.config.PublicScheme
+	}
+	return handler.config.ForceClientScheme
+}
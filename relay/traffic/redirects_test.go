@@ -0,0 +1,145 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestRedirectLocation(t *testing.T) {
+	var targetURL string
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/self":
+			http.Redirect(response, request, targetURL+"/next?x=1", http.StatusFound)
+		case "/external":
+			http.Redirect(response, request, "https://example.com/next", http.StatusFound)
+		case "/relative":
+			http.Redirect(response, request, "/next", http.StatusMovedPermanently)
+		case "/not-redirect":
+			response.Header().Set("Location", targetURL+"/next")
+			response.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer target.Close()
+	targetURL = target.URL
+
+	// Don't follow redirects; the test needs to see them.
+	client := &http.Client{
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	testCases := []struct {
+		desc             string
+		publicHost       string
+		path             string
+		expectedLocation string
+	}{
+		{
+			desc:             "Redirects to the target are rewritten to the relay",
+			path:             "/self",
+			expectedLocation: "http://${RELAY_HOST}/next?x=1",
+		},
+		{
+			desc:             "Redirects to the target are rewritten to the public host",
+			publicHost:       "relay.example",
+			path:             "/self",
+			expectedLocation: "http://relay.example/next?x=1",
+		},
+		{
+			desc:             "The public host may include a scheme",
+			publicHost:       "https://relay.example",
+			path:             "/self",
+			expectedLocation: "https://relay.example/next?x=1",
+		},
+		{
+			desc:             "Redirects to other hosts are unchanged",
+			publicHost:       "relay.example",
+			path:             "/external",
+			expectedLocation: "https://example.com/next",
+		},
+		{
+			desc:             "Relative redirects are unchanged",
+			publicHost:       "relay.example",
+			path:             "/relative",
+			expectedLocation: "/next",
+		},
+		{
+			desc:             "Location headers on other responses are unchanged",
+			publicHost:       "relay.example",
+			path:             "/not-redirect",
+			expectedLocation: "${TARGET_URL}/next",
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      public-host: '%v'
+        `, target.URL, testCase.publicHost)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			response, err := client.Get(relayService.HttpUrl() + testCase.path)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+
+			expectedLocation := strings.NewReplacer(
+				"${RELAY_HOST}", relayService.Address(),
+				"${TARGET_URL}", target.URL,
+			).Replace(testCase.expectedLocation)
+			if location := response.Header.Get("Location"); location != expectedLocation {
+				t.Errorf(
+					"Test '%v': Expected Location '%v' but got '%v'",
+					testCase.desc,
+					expectedLocation,
+					location,
+				)
+			}
+		})
+	}
+}
+
+func TestRedirectLocationDefaultPort(t *testing.T) {
+	// The target is configured with its scheme's default port, which is
+	// omitted from the Host header, so its redirects omit it too. The target's
+	// host doesn't exist, so the relay reaches it via the connect address.
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		http.Redirect(response, request, "http://"+request.Host+"/next", http.StatusFound)
+	}))
+	defer target.Close()
+
+	client := &http.Client{
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: http://relay-target.invalid:80
+                                  connect-addr: %v
+                                  public-host: relay.example
+    `, strings.TrimPrefix(target.URL, "http://"))
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		response, err := client.Get(relayService.HttpUrl())
+		if err != nil {
+			t.Fatalf("Error GETing: %v", err)
+		}
+		defer response.Body.Close()
+
+		expectedLocation := "http://relay.example/next"
+		if location := response.Header.Get("Location"); location != expectedLocation {
+			t.Errorf("Expected Location '%v' but got '%v'", expectedLocation, location)
+		}
+	})
+}
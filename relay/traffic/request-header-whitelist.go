@@ -0,0 +1,43 @@
+package traffic
+
+import (
+	"net/http"
+)
+
+// applyRequestHeaderWhitelist replaces the request's headers with a fresh set
+// containing only the headers listed in RequestHeaderWhitelist, if it's set.
+// The headers the relay itself depends on, like the one used to detect loops,
+// are always kept. The Host header isn't part of the header map, so it's
+// unaffected.
+func (handler *Handler) applyRequestHeaderWhitelist(request *http.Request) {
+	whitelist := handler.config.RequestHeaderWhitelist
+	if len(whitelist) == 0 {
+		return
+	}
+
+	header := http.Header{}
+	keep := func(name string) {
+		name = http.CanonicalHeaderKey(name)
+		if values, ok := request.Header[name]; ok {
+			header[name] = values
+		}
+	}
+	for _, name := range whitelist {
+		keep(name)
+	}
+	keep(RelayViaHeaderName)
+	keep(handler.config.RequestIDHeader)
+	keep("Expect")
+
+	// A User-Agent configured for the relay is kept. Otherwise, if the client's
+	// isn't whitelisted, the header is left present but empty, as in
+	// overrideUserAgent, so that the transport doesn't add Go's default.
+	if handler.config.UserAgent != "" {
+		keep("User-Agent")
+	}
+	if _, ok := header["User-Agent"]; !ok {
+		header["User-Agent"] = []string{""}
+	}
+
+	request.Header = header
+}
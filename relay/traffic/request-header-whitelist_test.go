@@ -0,0 +1,95 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"github.com/fullstorydev/relay-core/relay/traffic"
+)
+
+func TestRequestHeaderWhitelist(t *testing.T) {
+	receivedHeaders := make(chan http.Header, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		header := request.Header.Clone()
+		header.Set("Host", request.Host)
+		receivedHeaders <- header
+		response.Write([]byte("OK"))
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc             string
+		whitelist        string
+		expectedHeaders  []string
+		forbiddenHeaders []string
+	}{
+		{
+			desc:      "All headers are relayed by default",
+			whitelist: "",
+			expectedHeaders: []string{
+				"Accept",
+				"X-Allowed",
+				"X-Secret",
+				"X-Forwarded-For",
+			},
+		},
+		{
+			desc:      "Only whitelisted headers are relayed",
+			whitelist: "x-allowed, accept",
+			expectedHeaders: []string{
+				"Accept",
+				"Host",
+				"X-Allowed",
+				traffic.RelayViaHeaderName,
+				traffic.DefaultRequestIDHeader,
+			},
+			forbiddenHeaders: []string{
+				"User-Agent",
+				"X-Secret",
+				"X-Forwarded-For",
+				traffic.RelayVersionHeaderName,
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      request-header-whitelist: '%v'
+        `, target.URL, testCase.whitelist)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			request.Header.Set("Accept", "text/plain")
+			request.Header.Set("X-Allowed", "yes")
+			request.Header.Set("X-Secret", "hunter2")
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			header := <-receivedHeaders
+			for _, name := range testCase.expectedHeaders {
+				if header.Get(name) == "" {
+					t.Errorf("Test '%v': Expected header %v to be relayed, but got headers %v", testCase.desc, name, header)
+				}
+			}
+			for _, name := range testCase.forbiddenHeaders {
+				if value := header.Get(name); value != "" {
+					t.Errorf("Test '%v': Expected header %v to be dropped, but it was relayed with value '%v'", testCase.desc, name, value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package traffic
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// requestIDKey is the context key under which the correlation ID of a request
+// is stored, so that it can be included in the request's log lines.
+type requestIDKey struct{}
+
+// assignRequestID ensures that the provided request carries a correlation ID in
+// the configured header, generating one if the client didn't provide it. The
+// ID is echoed back to the client on the response. The returned request
+// carries the ID in its context.
+func (handler *Handler) assignRequestID(response http.ResponseWriter, request *http.Request) *http.Request {
+	headerName := handler.config.RequestIDHeader
+	requestID := request.Header.Get(headerName)
+	if requestID == "" {
+		requestID = newRequestID()
+		request.Header.Set(headerName, requestID)
+	}
+	response.Header().Set(headerName, requestID)
+	return request.WithContext(context.WithValue(request.Context(), requestIDKey{}, requestID))
+}
+
+// requestIDFromContext returns the correlation ID stored in the provided
+// context, or the empty string if there isn't one.
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// newRequestID returns a random (version 4) UUID.
+func newRequestID() string {
+	var uuid [16]byte
+	if _, err := rand.Read(uuid[:]); err != nil {
+		// crypto/rand only fails if the system's entropy source is broken.
+		panic(fmt.Sprintf("Could not generate a request ID: %v", err))
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40 // Version 4.
+	uuid[8] = (uuid[8] & 0x3f) | 0x80 // RFC 4122 variant.
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
@@ -0,0 +1,153 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/logging"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"golang.org/x/net/websocket"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRequestID(t *testing.T) {
+	// The target records the request ID it receives, and echoes it back like a
+	// service participating in tracing would.
+	var headerName string
+	receivedIDs := make(chan string, 1)
+	mux := http.NewServeMux()
+	mux.Handle("/echo", websocket.Server{
+		Handshake: func(config *websocket.Config, request *http.Request) error {
+			receivedIDs <- request.Header.Get(headerName)
+			return nil
+		},
+		Handler: catcher.EchoServer,
+	})
+	mux.HandleFunc("/", func(response http.ResponseWriter, request *http.Request) {
+		requestID := request.Header.Get(headerName)
+		receivedIDs <- requestID
+		response.Header().Set(headerName, requestID)
+		response.Write([]byte("OK"))
+	})
+	target := httptest.NewServer(mux)
+	defer target.Close()
+
+	testCases := []struct {
+		desc            string
+		requestIDHeader string
+		headerName      string
+		inboundID       string
+	}{
+		{
+			desc:       "An inbound request ID is relayed",
+			headerName: "X-Request-ID",
+			inboundID:  "inbound-id-123",
+		},
+		{
+			desc:       "A request ID is generated if there isn't one",
+			headerName: "X-Request-ID",
+		},
+		{
+			desc:            "The request ID header can be configured",
+			requestIDHeader: "X-Correlation-ID",
+			headerName:      "X-Correlation-ID",
+			inboundID:       "inbound-id-456",
+		},
+		{
+			desc:            "A request ID is generated in a configured header",
+			requestIDHeader: "X-Correlation-ID",
+			headerName:      "X-Correlation-ID",
+		},
+	}
+
+	defer logging.SetOutput(os.Stdout)
+	defer logging.SetFormat(logging.TextFormat)
+	defer logging.SetLevel(logging.InfoLevel)
+
+	for _, testCase := range testCases {
+		headerName = testCase.headerName
+		output := &syncBuffer{}
+		logging.SetOutput(output)
+
+		configYaml := fmt.Sprintf(
+			"relay:\n  target: %v\n  log-format: json\n  log-level: debug\n  request-id-header: '%v'\n",
+			target.URL,
+			testCase.requestIDHeader,
+		)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			if testCase.inboundID != "" {
+				request.Header.Set(testCase.headerName, testCase.inboundID)
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			receivedID := <-receivedIDs
+			if testCase.inboundID != "" && receivedID != testCase.inboundID {
+				t.Errorf("Test '%v': Expected the target to receive ID '%v' but got '%v'", testCase.desc, testCase.inboundID, receivedID)
+			}
+			if testCase.inboundID == "" && !uuidPattern.MatchString(receivedID) {
+				t.Errorf("Test '%v': Expected the target to receive a generated UUID but got '%v'", testCase.desc, receivedID)
+			}
+
+			// The ID is echoed exactly once, even though the target also
+			// echoes it.
+			if echoedIDs := response.Header.Values(testCase.headerName); len(echoedIDs) != 1 || echoedIDs[0] != receivedID {
+				t.Errorf("Test '%v': Expected the response to carry ID '%v' but got %v", testCase.desc, receivedID, echoedIDs)
+			}
+
+			// The request is logged after the response is sent, so allow
+			// some time for the log line to appear.
+			expectedField := fmt.Sprintf(`"request_id":"%v"`, receivedID)
+			for attempt := 0; attempt < 20 && !strings.Contains(output.String(), expectedField); attempt++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if !strings.Contains(output.String(), expectedField) {
+				t.Errorf("Test '%v': Expected log output to include %v, but got:\n%v", testCase.desc, expectedField, output.String())
+			}
+
+			// Websocket handshakes carry the ID to the target as well.
+			wsConfig, err := websocket.NewConfig(fmt.Sprintf("%v/echo", relayService.WsUrl()), relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error creating websocket config: %v", testCase.desc, err)
+				return
+			}
+			if testCase.inboundID != "" {
+				wsConfig.Header.Set(testCase.headerName, testCase.inboundID)
+			}
+			ws, err := websocket.DialConfig(wsConfig)
+			if err != nil {
+				t.Errorf("Test '%v': Error dialing websocket: %v", testCase.desc, err)
+				return
+			}
+			defer ws.Close()
+
+			receivedID = <-receivedIDs
+			if testCase.inboundID != "" && receivedID != testCase.inboundID {
+				t.Errorf("Test '%v': Expected the websocket target to receive ID '%v' but got '%v'", testCase.desc, testCase.inboundID, receivedID)
+			}
+			if testCase.inboundID == "" && !uuidPattern.MatchString(receivedID) {
+				t.Errorf("Test '%v': Expected the websocket target to receive a generated UUID but got '%v'", testCase.desc, receivedID)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package traffic
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// signRequest adds a Date header and an HMAC-SHA256 signature to the request,
+// if HMACSecret is set, so that the target can verify that the request came
+// through the relay. The signature is sent as a hex string in the HMACHeader
+// header, and covers the string returned by signatureInput. The client's own
+// Date header, if any, is replaced, since it's part of what's signed.
+func (handler *Handler) signRequest(request *http.Request) {
+	if handler.config.HMACSecret == "" {
+		return
+	}
+
+	request.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+	mac := hmac.New(sha256.New, []byte(handler.config.HMACSecret))
+	mac.Write([]byte(signatureInput(request)))
+	request.Header.Set(handler.config.HMACHeader, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// signatureInput returns the canonical string which is signed for a request:
+// its method, its path as it's sent to the target (without the query), and
+// its Date header, separated by newlines.
+func signatureInput(request *http.Request) string {
+	return request.Method + "\n" + request.URL.EscapedPath() + "\n" + request.Header.Get("Date")
+}
@@ -0,0 +1,116 @@
+package traffic_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestRequestSigning(t *testing.T) {
+	type signedRequest struct {
+		method    string
+		path      string
+		date      string
+		signature string
+	}
+	signedRequests := make(chan signedRequest, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		signedRequests <- signedRequest{
+			method:    request.Method,
+			path:      request.URL.EscapedPath(),
+			date:      request.Header.Get("Date"),
+			signature: request.Header.Get("X-Relay-Signature"),
+		}
+		response.Write([]byte("OK"))
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc         string
+		secret       string
+		header       string
+		method       string
+		path         string
+		expectedPath string
+	}{
+		{
+			desc:         "Requests aren't signed by default",
+			method:       "GET",
+			path:         "/some/path",
+			expectedPath: "/some/path",
+		},
+		{
+			desc:         "GET requests are signed",
+			secret:       "s3cret",
+			header:       "X-Relay-Signature",
+			method:       "GET",
+			path:         "/some/path?query=ignored",
+			expectedPath: "/some/path",
+		},
+		{
+			desc:         "POST requests are signed",
+			secret:       "s3cret",
+			header:       "x-relay-signature",
+			method:       "POST",
+			path:         "/escaped%2Fpath",
+			expectedPath: "/escaped%2Fpath",
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      hmac-secret: '%v'
+                                      hmac-header: '%v'
+        `, target.URL, testCase.secret, testCase.header)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			request, err := http.NewRequest(testCase.method, relayService.HttpUrl()+testCase.path, strings.NewReader("body"))
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			request.Header.Set("Date", "Tue, 15 Nov 1994 08:12:31 GMT")
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			received := <-signedRequests
+			if received.path != testCase.expectedPath {
+				t.Errorf("Test '%v': Expected path '%v' but got '%v'", testCase.desc, testCase.expectedPath, received.path)
+			}
+
+			if testCase.secret == "" {
+				if received.signature != "" {
+					t.Errorf("Test '%v': Expected no signature but got '%v'", testCase.desc, received.signature)
+				}
+				return
+			}
+
+			// The relay replaces the client's Date with the current time.
+			date, err := http.ParseTime(received.date)
+			if err != nil || time.Since(date) > time.Minute {
+				t.Errorf("Test '%v': Expected a current Date header but got '%v'", testCase.desc, received.date)
+			}
+
+			mac := hmac.New(sha256.New, []byte(testCase.secret))
+			mac.Write([]byte(received.method + "\n" + received.path + "\n" + received.date))
+			if expected := hex.EncodeToString(mac.Sum(nil)); received.signature != expected {
+				t.Errorf("Test '%v': Expected signature '%v' but got '%v'", testCase.desc, expected, received.signature)
+			}
+		})
+	}
+}
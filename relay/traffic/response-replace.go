@@ -0,0 +1,147 @@
+package traffic
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// rewritableContentTypes lists the media types of responses whose bodies may
+// contain absolute URLs that should be rewritten.
+var rewritableContentTypes = map[string]bool{
+	"application/json": true,
+	"text/css":         true,
+	"text/html":        true,
+}
+
+// rewriteResponseURLs rewrites absolute URLs in the response body which refer
+// to the target the request was relayed to, so that they refer to the relay's
+// public host instead, just like redirect locations. Only uncompressed text
+// responses are rewritten, and only if they can be buffered: their length must
+// be known and at most MaxBodySize bytes, or BufferStreamedResponses must be
+// set. The response's body and Content-Length are replaced if the body changes.
+func (handler *Handler) rewriteResponseURLs(
+	targetResponse *http.Response,
+	clientRequest *http.Request,
+	originalHost string,
+) error {
+	if !handler.config.ResponseReplace || !isRewritableResponse(targetResponse) {
+		return nil
+	}
+	// These responses have no body, even if they have a Content-Length.
+	if clientRequest.Method == http.MethodHead ||
+		targetResponse.StatusCode == http.StatusNoContent ||
+		targetResponse.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if targetResponse.ContentLength > handler.config.MaxBodySize {
+		return nil
+	}
+	if targetResponse.ContentLength < 0 && !handler.config.BufferStreamedResponses {
+		return nil
+	}
+
+	publicHost := handler.publicHost(originalHost)
+	if publicHost == "" {
+		return nil
+	}
+	publicScheme := clientRequest.URL.Scheme
+	if scheme := handler.publicScheme(); scheme != "" {
+		publicScheme = scheme
+	}
+	publicOrigin := []byte(publicScheme + "://" + publicHost)
+	targetOrigins := targetOrigins(clientRequest.URL)
+	for _, targetOrigin := range targetOrigins {
+		if bytes.Equal(targetOrigin, publicOrigin) {
+			return nil
+		}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(targetResponse.Body, handler.config.MaxBodySize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > handler.config.MaxBodySize {
+		// This can only happen to responses of unknown length; they're left
+		// for bufferResponseBody to reject.
+		targetResponse.Body = struct {
+			io.Reader
+			io.Closer
+		}{
+			Reader: io.MultiReader(bytes.NewReader(body), targetResponse.Body),
+			Closer: targetResponse.Body,
+		}
+		return nil
+	}
+
+	for _, targetOrigin := range targetOrigins {
+		body = replaceOrigin(body, targetOrigin, publicOrigin)
+	}
+	targetResponse.Body = io.NopCloser(bytes.NewReader(body))
+	targetResponse.ContentLength = int64(len(body))
+	targetResponse.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// targetOrigins returns the forms of the provided target URL's origin which may
+// appear in its responses: the origin as configured, and, if it differs, the
+// origin without the scheme's default port.
+func targetOrigins(targetURL *url.URL) [][]byte {
+	origins := [][]byte{[]byte(targetURL.Scheme + "://" + targetURL.Host)}
+	if headerHost, _ := normalizeHost(targetURL.Scheme, targetURL.Host); headerHost != targetURL.Host {
+		origins = append(origins, []byte(targetURL.Scheme+"://"+headerHost))
+	}
+	return origins
+}
+
+// replaceOrigin replaces each occurrence of origin in body with replacement.
+// An occurrence only counts if it's followed by a delimiter which ends the
+// origin, or by the end of the body, so that the origins of other hosts and
+// ports which merely begin with it, like "http://backend2" or
+// "http://backend:40001" for "http://backend:4000", are left alone.
+func replaceOrigin(body []byte, origin []byte, replacement []byte) []byte {
+	var result []byte
+	rest := body
+	for {
+		index := bytes.Index(rest, origin)
+		if index < 0 {
+			break
+		}
+		end := index + len(origin)
+		if end < len(rest) && !isOriginDelimiter(rest[end]) {
+			result = append(result, rest[:end]...)
+			rest = rest[end:]
+			continue
+		}
+		result = append(result, rest[:index]...)
+		result = append(result, replacement...)
+		rest = rest[end:]
+	}
+	if result == nil {
+		return body
+	}
+	return append(result, rest...)
+}
+
+// isOriginDelimiter reports whether the provided byte can follow an origin in
+// a URL or in the text around one.
+func isOriginDelimiter(b byte) bool {
+	switch b {
+	case '/', '?', '#', '"', '\'', '`', ' ', '\t', '\n', '\r', '\f':
+		return true
+	}
+	return false
+}
+
+// isRewritableResponse reports whether the provided response is an
+// uncompressed text response whose body may be rewritten.
+func isRewritableResponse(response *http.Response) bool {
+	if encoding := response.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	return err == nil && rewritableContentTypes[mediaType]
+}
@@ -0,0 +1,240 @@
+package traffic_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestResponseReplace(t *testing.T) {
+	page := func(origin string) string {
+		return fmt.Sprintf(`<html><body><a href="%v/page">Page</a><img src="%v/logo.png"></body></html>`, origin, origin)
+	}
+
+	// The target responds with its own absolute URLs, using the content type
+	// and encoding named by the path.
+	var targetURL string
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body := page(targetURL)
+		switch request.URL.Path {
+		case "/html":
+			response.Header().Set("Content-Type", "text/html; charset=utf-8")
+		case "/binary":
+			response.Header().Set("Content-Type", "application/octet-stream")
+		case "/compressed":
+			response.Header().Set("Content-Type", "text/html")
+			response.Header().Set("Content-Encoding", "br")
+		}
+		response.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		response.Write([]byte(body))
+	}))
+	defer target.Close()
+	targetURL = target.URL
+
+	testCases := []struct {
+		desc            string
+		publicHost      string
+		responseReplace bool
+		path            string
+		expectedOrigin  string
+	}{
+		{
+			desc:            "Links to the target are rewritten to the public host",
+			publicHost:      "https://relay.example",
+			responseReplace: true,
+			path:            "/html",
+			expectedOrigin:  "https://relay.example",
+		},
+		{
+			desc:            "Links to the target are rewritten to the client's host by default",
+			responseReplace: true,
+			path:            "/html",
+			expectedOrigin:  "", // The relay's own URL.
+		},
+		{
+			desc:            "Binary responses are relayed unchanged",
+			publicHost:      "https://relay.example",
+			responseReplace: true,
+			path:            "/binary",
+			expectedOrigin:  target.URL,
+		},
+		{
+			desc:            "Compressed responses are relayed unchanged",
+			publicHost:      "https://relay.example",
+			responseReplace: true,
+			path:            "/compressed",
+			expectedOrigin:  target.URL,
+		},
+		{
+			desc:            "Responses are relayed unchanged by default",
+			publicHost:      "https://relay.example",
+			responseReplace: false,
+			path:            "/html",
+			expectedOrigin:  target.URL,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      public-host: '%v'
+                                      response-replace: %v
+        `, target.URL, testCase.publicHost, testCase.responseReplace)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			response, err := http.Get(relayService.HttpUrl() + testCase.path)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Errorf("Test '%v': Error reading response body: %v", testCase.desc, err)
+				return
+			}
+
+			expectedOrigin := testCase.expectedOrigin
+			if expectedOrigin == "" {
+				expectedOrigin = relayService.HttpUrl()
+			}
+			expectedBody := page(expectedOrigin)
+			if string(body) != expectedBody {
+				t.Errorf("Test '%v': Expected body '%v' but got '%v'", testCase.desc, expectedBody, string(body))
+			}
+			if response.ContentLength != int64(len(expectedBody)) {
+				t.Errorf("Test '%v': Expected Content-Length %v but got %v", testCase.desc, len(expectedBody), response.ContentLength)
+			}
+		})
+	}
+}
+
+func TestResponseReplaceDefaultPort(t *testing.T) {
+	// The target is configured with its scheme's default port, but links to
+	// itself both with and without it. The target's host doesn't exist, so the
+	// relay reaches it via the connect address.
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(response, `<a href="http://%v/a">A</a><a href="http://%v:80/b">B</a>`, request.Host, request.Host)
+	}))
+	defer target.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: http://relay-target.invalid:80
+                                  connect-addr: %v
+                                  public-host: https://relay.example
+                                  response-replace: true
+    `, strings.TrimPrefix(target.URL, "http://"))
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		response, err := http.Get(relayService.HttpUrl())
+		if err != nil {
+			t.Fatalf("Error GETing: %v", err)
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatalf("Error reading response body: %v", err)
+		}
+
+		expectedBody := `<a href="https://relay.example/a">A</a><a href="https://relay.example/b">B</a>`
+		if string(body) != expectedBody {
+			t.Errorf("Expected body '%v' but got '%v'", expectedBody, string(body))
+		}
+	})
+}
+
+func TestResponseReplaceLookalikeHosts(t *testing.T) {
+	// The target responds with the body given in the query. The target's host
+	// doesn't exist, so the relay reaches it via the connect address.
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "text/html")
+		response.Write([]byte(request.URL.Query().Get("body")))
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc         string
+		target       string
+		body         string
+		expectedBody string
+	}{
+		{
+			desc:         "Origins followed by a path are rewritten",
+			target:       "http://backend.invalid",
+			body:         `<a href="http://backend.invalid/a">`,
+			expectedBody: `<a href="https://relay.example/a">`,
+		},
+		{
+			desc:         "Origins followed by a quote are rewritten",
+			target:       "http://backend.invalid",
+			body:         `<a href='http://backend.invalid'>`,
+			expectedBody: `<a href='https://relay.example'>`,
+		},
+		{
+			desc:         "Origins followed by a query or fragment are rewritten",
+			target:       "http://backend.invalid",
+			body:         `http://backend.invalid?q=1 http://backend.invalid#top`,
+			expectedBody: `https://relay.example?q=1 https://relay.example#top`,
+		},
+		{
+			desc:         "Origins at the end of the body are rewritten",
+			target:       "http://backend.invalid",
+			body:         `Visit http://backend.invalid`,
+			expectedBody: `Visit https://relay.example`,
+		},
+		{
+			desc:         "Hosts which begin with the target's host are unchanged",
+			target:       "http://backend.invalid",
+			body:         `<a href="http://backend.invalid2/a"><a href="http://backend.invalid.example.com/b">`,
+			expectedBody: `<a href="http://backend.invalid2/a"><a href="http://backend.invalid.example.com/b">`,
+		},
+		{
+			desc:         "Other ports on the target's host are unchanged",
+			target:       "http://backend.invalid",
+			body:         `<a href="http://backend.invalid:8080/a">`,
+			expectedBody: `<a href="http://backend.invalid:8080/a">`,
+		},
+		{
+			desc:         "Ports which begin with the target's port are unchanged",
+			target:       "http://backend.invalid:4000",
+			body:         `<a href="http://backend.invalid:40001/a"><a href="http://backend.invalid:4000/b">`,
+			expectedBody: `<a href="http://backend.invalid:40001/a"><a href="https://relay.example/b">`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      connect-addr: %v
+                                      public-host: https://relay.example
+                                      response-replace: true
+        `, testCase.target, strings.TrimPrefix(target.URL, "http://"))
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			response, err := http.Get(relayService.HttpUrl() + "?body=" + url.QueryEscape(testCase.body))
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Errorf("Test '%v': Error reading response body: %v", testCase.desc, err)
+				return
+			}
+
+			if string(body) != testCase.expectedBody {
+				t.Errorf("Test '%v': Expected body '%v' but got '%v'", testCase.desc, testCase.expectedBody, string(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package traffic
+
+import (
+	"io"
+
+	"github.com/fullstorydev/relay-core/relay/logging"
+)
+
+// countingReadCloser counts the bytes read from a response body, so that the
+// size of the body relayed to the client can be reported however it was
+// relayed.
+type countingReadCloser struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (reader *countingReadCloser) Read(data []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(data)
+	reader.bytes += int64(n)
+	return n, err
+}
+
+// observeResponseSize records the size of a response body read from the
+// target, and logs a warning if it exceeds LargeResponseThreshold.
+func (handler *Handler) observeResponseSize(size int64, status int, requestLogger *logging.Logger) {
+	handler.metrics.ObserveResponseSize(size)
+
+	if threshold := handler.config.LargeResponseThreshold; threshold > 0 && size > threshold {
+		requestLogger.With(logging.Fields{"status": status, "bytes": size}).Warnf(
+			"Response body of %v bytes exceeds the large response threshold of %v bytes",
+			size,
+			threshold,
+		)
+	}
+}
@@ -0,0 +1,115 @@
+package traffic_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/logging"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestLargeResponseLogging(t *testing.T) {
+	// The target responds with a body of the requested size. Streamed
+	// responses are flushed before the body is written, so they have no
+	// content length.
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		size, _ := strconv.Atoi(request.URL.Query().Get("size"))
+		if request.URL.Path == "/stream" {
+			response.WriteHeader(200)
+			response.(http.Flusher).Flush()
+		} else {
+			response.Header().Set("Content-Length", strconv.Itoa(size))
+		}
+		response.Write([]byte(strings.Repeat("x", size)))
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc                    string
+		path                    string
+		size                    int
+		bufferStreamedResponses bool
+		expectWarning           bool
+	}{
+		{
+			desc:          "Small responses with a content length aren't logged",
+			path:          "/length",
+			size:          100,
+			expectWarning: false,
+		},
+		{
+			desc:          "Large responses with a content length are logged",
+			path:          "/length",
+			size:          2000,
+			expectWarning: true,
+		},
+		{
+			desc:          "Small streamed responses aren't logged",
+			path:          "/stream",
+			size:          100,
+			expectWarning: false,
+		},
+		{
+			desc:          "Large streamed responses are logged",
+			path:          "/stream",
+			size:          2000,
+			expectWarning: true,
+		},
+		{
+			desc:                    "Large buffered responses are logged",
+			path:                    "/stream",
+			size:                    2000,
+			bufferStreamedResponses: true,
+			expectWarning:           true,
+		},
+	}
+
+	defer logging.SetOutput(os.Stdout)
+
+	for _, testCase := range testCases {
+		output := &syncBuffer{}
+		logging.SetOutput(output)
+
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      large-response-threshold: 1000
+                                      buffer-streamed-responses: %v
+        `, target.URL, testCase.bufferStreamedResponses)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			response, err := http.Get(fmt.Sprintf("%v%v?size=%v", relayService.HttpUrl(), testCase.path, testCase.size))
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			body, err := io.ReadAll(response.Body)
+			response.Body.Close()
+			if err != nil || len(body) != testCase.size {
+				t.Errorf("Test '%v': Expected a %v byte body but got %v bytes: %v", testCase.desc, testCase.size, len(body), err)
+			}
+
+			// The response is logged after its body is sent, so allow some
+			// time for the log line to appear.
+			expectedLine := fmt.Sprintf("Response body of %v bytes exceeds the large response threshold", testCase.size)
+			for attempt := 0; attempt < 20 && testCase.expectWarning && !strings.Contains(output.String(), expectedLine); attempt++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if warned := strings.Contains(output.String(), expectedLine); warned != testCase.expectWarning {
+				t.Errorf(
+					"Test '%v': Expected large response warning: %v, but got log output:\n%v",
+					testCase.desc,
+					testCase.expectWarning,
+					output.String(),
+				)
+			}
+		})
+	}
+}
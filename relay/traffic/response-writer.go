@@ -0,0 +1,57 @@
+package traffic
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// responseRecorder records the status and body length of the response sent to
+// the client, passing Hijack and Flush through to the wrapped ResponseWriter.
+type responseRecorder struct {
+	http.ResponseWriter
+	bytes  int64 // The number of body bytes written.
+	status int   // The final (non-informational) status sent, or 0 if none has been.
+}
+
+func (recorder *responseRecorder) WriteHeader(status int) {
+	if recorder.status == 0 && status >= 200 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *responseRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	n, err := recorder.ResponseWriter.Write(data)
+	recorder.bytes += int64(n)
+	return n, err
+}
+
+func (recorder *responseRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (recorder *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := recorder.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("The response writer does not support hijacking")
+	}
+	conn, buffer, err := hijacker.Hijack()
+	if err == nil && recorder.status == 0 {
+		// The connection is being taken over to relay a protocol upgrade.
+		recorder.status = http.StatusSwitchingProtocols
+	}
+	return conn, buffer, err
+}
+
+// Unwrap returns the underlying http.ResponseWriter. This allows
+// http.ResponseController to access its features.
+func (recorder *responseRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
@@ -0,0 +1,192 @@
+package traffic
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay/logging"
+)
+
+// AttemptsHeaderName is the response header which reports how many times the
+// relay tried to send a request to the target, if it tried more than once, or
+// if retries are enabled and every attempt failed.
+const AttemptsHeaderName = "X-Relay-Attempts"
+
+// roundTripWithRetries sends the request to the target, retrying up to
+// MaxRetries times if the request is idempotent and the connection to the
+// target fails or the target responds with one of the RetryOnStatus statuses.
+// If the final attempt receives such a status, that response is returned. The
+// delay between attempts starts at RetryBackoff and doubles after each retry.
+// The number of attempts made is returned alongside the response; if more than
+// one attempt failed, the error reports each failure.
+func (handler *Handler) roundTripWithRetries(
+	request *http.Request,
+	requestLogger *logging.Logger,
+) (*http.Response, int, error) {
+	maxRetries := handler.config.MaxRetries
+	if maxRetries == 0 || !isIdempotent(request.Method) {
+		response, err := handler.transportFor(request).RoundTrip(request)
+		return response, 1, err
+	}
+
+	// The transport consumes the request body, so it must be buffered to be
+	// resent. If it's larger than RetryBufferLimit, it's streamed to the
+	// target instead, and the request is sent once.
+	body, err := handler.bufferRequestBody(request, handler.config.RetryBufferLimit)
+	if err != nil {
+		return nil, 0, err
+	}
+	if body == nil && request.Body != nil && request.Body != http.NoBody {
+		requestLogger.Printf(
+			"Request body exceeds the retry buffer limit of %v bytes; retries are disabled for this request",
+			handler.config.RetryBufferLimit,
+		)
+		response, err := handler.transportFor(request).RoundTrip(request)
+		return response, 1, err
+	}
+
+	var failures []error
+	backoff := handler.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		if body != nil {
+			request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		response, err := handler.transportFor(request).RoundTrip(request)
+		if err == nil {
+			if attempt >= maxRetries || !handler.isRetryableStatus(response.StatusCode) {
+				return response, attempt + 1, nil
+			}
+			discardResponse(response)
+			requestLogger.With(logging.Fields{"status": response.StatusCode}).Warnf(
+				"Target responded with status %v; retrying in %v (retry %v of %v)",
+				response.StatusCode,
+				backoff,
+				attempt+1,
+				maxRetries,
+			)
+		} else {
+			failures = append(failures, err)
+			if attempt >= maxRetries || !isConnectionFailure(err) {
+				if len(failures) == 1 {
+					return nil, attempt + 1, err
+				}
+				return nil, attempt + 1, &attemptsError{errs: failures}
+			}
+
+			requestLogger.With(logging.Fields{"error": err}).Warnf(
+				"Connection to target failed; retrying in %v (retry %v of %v)",
+				backoff,
+				attempt+1,
+				maxRetries,
+			)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-request.Context().Done():
+			return nil, attempt + 1, request.Context().Err()
+		}
+		backoff *= 2
+	}
+}
+
+// attemptsError reports the failure of every attempt to send a request.
+type attemptsError struct {
+	errs []error
+}
+
+func (err *attemptsError) Error() string {
+	messages := make([]string, len(err.errs))
+	for i, attemptErr := range err.errs {
+		messages[i] = attemptErr.Error()
+	}
+	return fmt.Sprintf("all %v attempts failed: %v", len(err.errs), strings.Join(messages, "; "))
+}
+
+func (err *attemptsError) Unwrap() []error {
+	return err.errs
+}
+
+// bufferRequestBody reads the request body into memory so that it can be
+// resent. It returns nil if the request has no body, or if the body is larger
+// than the provided limit; in the latter case, the request body is left intact.
+func (handler *Handler) bufferRequestBody(request *http.Request, limit int64) ([]byte, error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(request.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) > limit {
+		request.Body = struct {
+			io.Reader
+			io.Closer
+		}{
+			Reader: io.MultiReader(bytes.NewReader(body), request.Body),
+			Closer: request.Body,
+		}
+		return nil, nil
+	}
+
+	request.Body.Close()
+	return body, nil
+}
+
+// isRetryableStatus reports whether a response with the provided status should
+// be retried, because it's one of the RetryOnStatus statuses.
+func (handler *Handler) isRetryableStatus(status int) bool {
+	for _, retryStatus := range handler.config.RetryOnStatus {
+		if status == retryStatus {
+			return true
+		}
+	}
+	return false
+}
+
+// maxDiscardedBodySize is the most that's read from the body of a response
+// which is discarded before a retry. Reading the rest of a small body lets the
+// connection be reused; larger bodies aren't worth reading, so the connection
+// is closed instead.
+const maxDiscardedBodySize = 64 * 1024
+
+// discardResponse drains and closes the body of a response which won't be
+// relayed to the client.
+func discardResponse(response *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(response.Body, maxDiscardedBodySize))
+	response.Body.Close()
+}
+
+// isIdempotent reports whether requests with the provided method can safely be
+// sent more than once.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// isConnectionFailure reports whether the provided error indicates that the
+// connection to the target was refused or dropped before a response was
+// received. Timeouts are not considered connection failures, since retrying
+// them would multiply the time the client spends waiting.
+func isConnectionFailure(err error) bool {
+	if isTimeout(err) {
+		return false
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,413 @@
+package traffic_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"github.com/fullstorydev/relay-core/relay/traffic"
+)
+
+func TestRetries(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		maxRetries       int
+		failures         int64
+		method           string
+		body             string
+		retryBufferLimit int64
+		expectedStatus   int
+		expectedAttempts int64
+		expectedHeader   string
+	}{
+		{
+			desc:             "Requests are not retried by default",
+			maxRetries:       0,
+			failures:         1,
+			method:           "GET",
+			expectedStatus:   502,
+			expectedAttempts: 1,
+		},
+		{
+			desc:             "GET requests are retried until they succeed",
+			maxRetries:       3,
+			failures:         2,
+			method:           "GET",
+			expectedStatus:   200,
+			expectedAttempts: 3,
+			expectedHeader:   "3",
+		},
+		{
+			desc:             "Retries stop after the maximum is reached",
+			maxRetries:       2,
+			failures:         5,
+			method:           "GET",
+			expectedStatus:   502,
+			expectedAttempts: 3,
+			expectedHeader:   "3",
+		},
+		{
+			desc:             "PUT request bodies are resent when retrying",
+			maxRetries:       2,
+			failures:         1,
+			method:           "PUT",
+			body:             "Hello, world",
+			expectedStatus:   200,
+			expectedAttempts: 2,
+			expectedHeader:   "2",
+		},
+		{
+			desc:             "Request bodies within the retry buffer limit are resent",
+			maxRetries:       2,
+			failures:         1,
+			method:           "PUT",
+			body:             "Hello, world",
+			retryBufferLimit: 16,
+			expectedStatus:   200,
+			expectedAttempts: 2,
+			expectedHeader:   "2",
+		},
+		{
+			desc:             "Request bodies over the retry buffer limit are streamed and not retried",
+			maxRetries:       2,
+			failures:         1,
+			method:           "PUT",
+			body:             strings.Repeat("Hello, world", 10),
+			retryBufferLimit: 16,
+			expectedStatus:   502,
+			expectedAttempts: 1,
+			expectedHeader:   "1",
+		},
+		{
+			desc:             "POST requests are never retried",
+			maxRetries:       3,
+			failures:         1,
+			method:           "POST",
+			body:             "Hello, world",
+			expectedStatus:   502,
+			expectedAttempts: 1,
+			expectedHeader:   "1",
+		},
+		{
+			desc:             "PATCH requests are never retried",
+			maxRetries:       3,
+			failures:         1,
+			method:           "PATCH",
+			body:             "Hello, world",
+			expectedStatus:   502,
+			expectedAttempts: 1,
+			expectedHeader:   "1",
+		},
+	}
+
+	for _, testCase := range testCases {
+		target, attempts := startFlakyTarget(t, testCase.failures, testCase.body)
+		defer target.Close()
+
+		retryBufferLimit := testCase.retryBufferLimit
+		if retryBufferLimit == 0 {
+			retryBufferLimit = traffic.DefaultRetryBufferLimit
+		}
+
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      max-retries: %v
+                                      retry-backoff: 1ms
+                                      retry-buffer-limit: %v
+        `, target.URL, testCase.maxRetries, retryBufferLimit)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			request, err := http.NewRequest(testCase.method, relayService.HttpUrl(), strings.NewReader(testCase.body))
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf(
+					"Test '%v': Expected status %v but got %v",
+					testCase.desc,
+					testCase.expectedStatus,
+					response.StatusCode,
+				)
+			}
+			if actualAttempts := attempts.Load(); actualAttempts != testCase.expectedAttempts {
+				t.Errorf(
+					"Test '%v': Expected %v attempts but got %v",
+					testCase.desc,
+					testCase.expectedAttempts,
+					actualAttempts,
+				)
+			}
+			if header := response.Header.Get(traffic.AttemptsHeaderName); header != testCase.expectedHeader {
+				t.Errorf(
+					"Test '%v': Expected %v header '%v' but got '%v'",
+					testCase.desc,
+					traffic.AttemptsHeaderName,
+					testCase.expectedHeader,
+					header,
+				)
+			}
+		})
+	}
+}
+
+func TestRetryOnStatus(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		retryOnStatus    string
+		maxRetries       int
+		failures         int64
+		failureStatus    int
+		method           string
+		expectedStatus   int
+		expectedAttempts int64
+		expectedHeader   string
+	}{
+		{
+			desc:             "Statuses are not retried by default",
+			retryOnStatus:    "",
+			maxRetries:       3,
+			failures:         1,
+			failureStatus:    503,
+			method:           "GET",
+			expectedStatus:   503,
+			expectedAttempts: 1,
+		},
+		{
+			desc:             "Configured statuses are retried until the request succeeds",
+			retryOnStatus:    "502,503",
+			maxRetries:       3,
+			failures:         1,
+			failureStatus:    503,
+			method:           "GET",
+			expectedStatus:   200,
+			expectedAttempts: 2,
+			expectedHeader:   "2",
+		},
+		{
+			desc:             "The last response is relayed after the maximum is reached",
+			retryOnStatus:    "503",
+			maxRetries:       2,
+			failures:         5,
+			failureStatus:    503,
+			method:           "GET",
+			expectedStatus:   503,
+			expectedAttempts: 3,
+			expectedHeader:   "3",
+		},
+		{
+			desc:             "Statuses which aren't configured are not retried",
+			retryOnStatus:    "503",
+			maxRetries:       3,
+			failures:         1,
+			failureStatus:    500,
+			method:           "GET",
+			expectedStatus:   500,
+			expectedAttempts: 1,
+		},
+		{
+			desc:             "POST requests are never retried",
+			retryOnStatus:    "503",
+			maxRetries:       3,
+			failures:         1,
+			failureStatus:    503,
+			method:           "POST",
+			expectedStatus:   503,
+			expectedAttempts: 1,
+		},
+	}
+
+	for _, testCase := range testCases {
+		attempts := &atomic.Int64{}
+		target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			if attempts.Add(1) <= testCase.failures {
+				response.WriteHeader(testCase.failureStatus)
+				response.Write([]byte("Unavailable"))
+				return
+			}
+			response.Write([]byte("OK"))
+		}))
+		defer target.Close()
+
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      max-retries: %v
+                                      retry-backoff: 1ms
+                                      retry-on-status: '%v'
+        `, target.URL, testCase.maxRetries, testCase.retryOnStatus)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			request, err := http.NewRequest(testCase.method, relayService.HttpUrl(), nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Errorf("Test '%v': Error reading body: %v", testCase.desc, err)
+				return
+			}
+
+			expectedBody := "OK"
+			if testCase.expectedStatus != 200 {
+				expectedBody = "Unavailable"
+			}
+			if response.StatusCode != testCase.expectedStatus || string(body) != expectedBody {
+				t.Errorf(
+					"Test '%v': Expected status %v with body '%v' but got %v with body '%v'",
+					testCase.desc,
+					testCase.expectedStatus,
+					expectedBody,
+					response.StatusCode,
+					string(body),
+				)
+			}
+			if actualAttempts := attempts.Load(); actualAttempts != testCase.expectedAttempts {
+				t.Errorf(
+					"Test '%v': Expected %v attempts but got %v",
+					testCase.desc,
+					testCase.expectedAttempts,
+					actualAttempts,
+				)
+			}
+			if header := response.Header.Get(traffic.AttemptsHeaderName); header != testCase.expectedHeader {
+				t.Errorf(
+					"Test '%v': Expected %v header '%v' but got '%v'",
+					testCase.desc,
+					traffic.AttemptsHeaderName,
+					testCase.expectedHeader,
+					header,
+				)
+			}
+		})
+	}
+}
+
+func TestRetryOnStatusExhausted(t *testing.T) {
+	// This target always responds with a retry status. Once the retries are
+	// exhausted, its last response is relayed, but it counts as a failure, so
+	// the circuit opens and the next request doesn't reach the target.
+	attempts := &atomic.Int64{}
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		attempts.Add(1)
+		response.WriteHeader(http.StatusServiceUnavailable)
+		response.Write([]byte("Unavailable"))
+	}))
+	defer target.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+                                  max-retries: 2
+                                  retry-backoff: 1ms
+                                  retry-on-status: '503'
+                                  circuit-breaker-threshold: 1
+                                  circuit-breaker-cooldown: 1m
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		testCases := []struct {
+			desc             string
+			expectedBody     string
+			expectedAttempts int64
+			expectedHeader   string
+		}{
+			{
+				desc:             "The last response is relayed with the number of attempts",
+				expectedBody:     "Unavailable",
+				expectedAttempts: 3,
+				expectedHeader:   "3",
+			},
+			{
+				desc:             "The failed attempts open the circuit",
+				expectedAttempts: 0,
+			},
+		}
+
+		for _, testCase := range testCases {
+			attempts.Store(0)
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			body, err := io.ReadAll(response.Body)
+			response.Body.Close()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading body: %v", testCase.desc, err)
+				return
+			}
+
+			if response.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("Test '%v': Expected status 503 but got %v", testCase.desc, response.StatusCode)
+			}
+			if testCase.expectedBody != "" && string(body) != testCase.expectedBody {
+				t.Errorf("Test '%v': Expected body '%v' but got '%v'", testCase.desc, testCase.expectedBody, string(body))
+			}
+			if actualAttempts := attempts.Load(); actualAttempts != testCase.expectedAttempts {
+				t.Errorf("Test '%v': Expected %v attempts but got %v", testCase.desc, testCase.expectedAttempts, actualAttempts)
+			}
+			if header := response.Header.Get(traffic.AttemptsHeaderName); header != testCase.expectedHeader {
+				t.Errorf(
+					"Test '%v': Expected %v header '%v' but got '%v'",
+					testCase.desc,
+					traffic.AttemptsHeaderName,
+					testCase.expectedHeader,
+					header,
+				)
+			}
+		}
+	})
+}
+
+// startFlakyTarget starts a target server which drops the connection for the
+// first 'failures' requests it receives, and then responds normally. Successful
+// requests must have the expected body. The number of requests received is
+// returned alongside the server.
+func startFlakyTarget(t *testing.T, failures int64, expectedBody string) (*httptest.Server, *atomic.Int64) {
+	attempts := &atomic.Int64{}
+
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if attempts.Add(1) <= failures {
+			conn, _, err := response.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Error hijacking connection: %v", err)
+				return
+			}
+			conn.Close()
+			return
+		}
+
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			t.Errorf("Error reading request body: %v", err)
+		}
+		if string(body) != expectedBody {
+			t.Errorf("Expected request body '%v' but got '%v'", expectedBody, string(body))
+		}
+		response.Write([]byte("OK"))
+	}))
+
+	return target, attempts
+}
@@ -0,0 +1,82 @@
+package traffic
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// hostRouteKey is the context key under which the host route matched by a
+// request is stored, so that the route's timeouts can be applied to it.
+type hostRouteKey struct{}
+
+// withHostRoute returns a copy of the provided request which carries the host
+// route it matched in its context.
+func withHostRoute(request *http.Request, route *HostRoute) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), hostRouteKey{}, route))
+}
+
+// hostRouteFromContext returns the host route stored in the provided context,
+// or nil if there isn't one.
+func hostRouteFromContext(ctx context.Context) *HostRoute {
+	route, _ := ctx.Value(hostRouteKey{}).(*HostRoute)
+	return route
+}
+
+// dialTimeout returns the dial timeout for connections made on behalf of the
+// request whose context is provided.
+func (handler *Handler) dialTimeout(ctx context.Context) time.Duration {
+	if route := hostRouteFromContext(ctx); route != nil && route.DialTimeout > 0 {
+		return route.DialTimeout
+	}
+	return handler.config.DialTimeout
+}
+
+// requestTimeout returns the timeout for the exchange with the target of the
+// request whose context is provided.
+func (handler *Handler) requestTimeout(ctx context.Context) time.Duration {
+	if route := hostRouteFromContext(ctx); route != nil && route.RequestTimeout > 0 {
+		return route.RequestTimeout
+	}
+	return handler.config.RequestTimeout
+}
+
+// newRouteTransports creates a transport for each host route which overrides
+// the dial or response header timeout, since the transport enforces those.
+// Other routes share the default transport.
+func (handler *Handler) newRouteTransports() map[*HostRoute]*http.Transport {
+	transports := map[*HostRoute]*http.Transport{}
+	for _, route := range handler.config.HostRoutes {
+		if route.DialTimeout == 0 && route.ResponseHeaderTimeout == 0 {
+			continue
+		}
+		transports[route] = handler.newTransport(handler.routeTimeouts(route))
+	}
+	return transports
+}
+
+// routeTimeouts returns the dial and response header timeouts for requests
+// which match the provided host route, which may be nil.
+func (handler *Handler) routeTimeouts(route *HostRoute) (dialTimeout time.Duration, responseHeaderTimeout time.Duration) {
+	dialTimeout = handler.config.DialTimeout
+	responseHeaderTimeout = handler.config.ResponseHeaderTimeout
+	if route != nil && route.DialTimeout > 0 {
+		dialTimeout = route.DialTimeout
+	}
+	if route != nil && route.ResponseHeaderTimeout > 0 {
+		responseHeaderTimeout = route.ResponseHeaderTimeout
+	}
+	return dialTimeout, responseHeaderTimeout
+}
+
+// transportFor returns the transport to use for the provided request. Requests
+// to Unix socket targets use their targets' transports.
+func (handler *Handler) transportFor(request *http.Request) *http.Transport {
+	if transport, ok := handler.socketTransports[socketTarget(request.Context(), dialAddress(request.URL))]; ok {
+		return transport
+	}
+	if transport, ok := handler.routeTransports[hostRouteFromContext(request.Context())]; ok {
+		return transport
+	}
+	return handler.transport
+}
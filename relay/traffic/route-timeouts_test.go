@@ -0,0 +1,119 @@
+package traffic_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestHostRouteTimeouts(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/slow-headers":
+			time.Sleep(300 * time.Millisecond)
+			response.Write([]byte("Slow headers"))
+		case "/slow-body":
+			// Send the headers and part of the body promptly, then stall.
+			response.WriteHeader(200)
+			response.Write([]byte("Slow"))
+			response.(http.Flusher).Flush()
+			time.Sleep(300 * time.Millisecond)
+			response.Write([]byte(" body"))
+		}
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc           string
+		host           string
+		path           string
+		expectedStatus int
+		expectedBody   string
+		expectCutOff   bool
+	}{
+		{
+			desc:           "Unrouted requests use the global response header timeout",
+			host:           "other.example.com",
+			path:           "/slow-headers",
+			expectedStatus: 504,
+		},
+		{
+			desc:           "A route's response header timeout overrides the global one",
+			host:           "patient.example.com",
+			path:           "/slow-headers",
+			expectedStatus: 200,
+			expectedBody:   "Slow headers",
+		},
+		{
+			desc:           "A route without a request timeout uses the global one",
+			host:           "patient.example.com",
+			path:           "/slow-body",
+			expectedStatus: 200,
+			expectedBody:   "Slow body",
+		},
+		{
+			desc:           "A route's request timeout applies to its response headers",
+			host:           "strict.example.com",
+			path:           "/slow-headers",
+			expectedStatus: 504,
+		},
+		{
+			desc:         "A route's request timeout applies to its response body",
+			host:         "strict.example.com",
+			path:         "/slow-body",
+			expectCutOff: true,
+		},
+	}
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+                                  response-header-timeout: 100ms
+                                  host-map:
+                                    - host: patient.example.com
+                                      target: %v
+                                      response-header-timeout: 2s
+                                    - host: strict.example.com
+                                      target: %v
+                                      response-header-timeout: 2s
+                                      request-timeout: 100ms
+    `, target.URL, target.URL, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		for _, testCase := range testCases {
+			request, err := http.NewRequest("GET", relayService.HttpUrl()+testCase.path, nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				continue
+			}
+			request.Host = testCase.host
+
+			response, err := http.DefaultClient.Do(request)
+			var body []byte
+			if err == nil {
+				body, err = io.ReadAll(response.Body)
+				response.Body.Close()
+			}
+
+			// A response which is cut off fails on the client, either while
+			// reading the headers or the body, depending on how much the relay
+			// had already sent.
+			if testCase.expectCutOff {
+				if err == nil {
+					t.Errorf("Test '%v': Expected the response to be cut off, but got '%v'", testCase.desc, string(body))
+				}
+			} else if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+			} else if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			} else if testCase.expectedBody != "" && string(body) != testCase.expectedBody {
+				t.Errorf("Test '%v': Expected body '%v' but got '%v'", testCase.desc, testCase.expectedBody, string(body))
+			}
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package traffic
+
+import (
+	"net/http"
+	"strings"
+)
+
+// rewriteSetCookieHeaders rewrites the Set-Cookie headers of a response so
+// that cookies which the target scoped to its own host apply to the relay
+// instead. If CookieDomain is configured, Domain attributes which name the
+// target's host are replaced with it. If CookiePath is configured, all Path
+// attributes are replaced with it.
+//
+// Only those attributes are changed. Everything else in each header, including
+// the cookie's value and attributes like Secure, HttpOnly, SameSite, and
+// Max-Age, is relayed exactly as the target sent it.
+func (handler *Handler) rewriteSetCookieHeaders(targetResponse *http.Response, clientRequest *http.Request) {
+	cookieDomain := handler.config.CookieDomain
+	cookiePath := handler.config.CookiePath
+	if cookieDomain == "" && cookiePath == "" {
+		return
+	}
+
+	setCookieHeaders := targetResponse.Header.Values("Set-Cookie")
+	if len(setCookieHeaders) == 0 {
+		return
+	}
+
+	targetHost := clientRequest.URL.Hostname()
+	rewrittenHeaders := make([]string, 0, len(setCookieHeaders))
+	for _, setCookie := range setCookieHeaders {
+		rewrittenHeaders = append(rewrittenHeaders, rewriteSetCookie(setCookie, targetHost, cookieDomain, cookiePath))
+	}
+	targetResponse.Header["Set-Cookie"] = rewrittenHeaders
+}
+
+// rewriteSetCookie rewrites the Domain and Path attributes of a single
+// Set-Cookie header value. The first item is the cookie's name and value, so
+// it's never treated as an attribute. Empty cookieDomain or cookiePath values
+// leave the corresponding attribute unchanged.
+func rewriteSetCookie(setCookie string, targetHost string, cookieDomain string, cookiePath string) string {
+	items := strings.Split(setCookie, ";")
+	for i := 1; i < len(items); i++ {
+		name, value, _ := strings.Cut(items[i], "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "domain":
+			// A leading dot is ignored; see RFC 6265, section 5.2.3.
+			domain := strings.TrimPrefix(strings.TrimSpace(value), ".")
+			if cookieDomain != "" && strings.EqualFold(domain, targetHost) {
+				items[i] = " Domain=" + cookieDomain
+			}
+		case "path":
+			if cookiePath != "" {
+				items[i] = " Path=" + cookiePath
+			}
+		}
+	}
+	return strings.Join(items, ";")
+}
@@ -0,0 +1,102 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestSetCookieRewriting(t *testing.T) {
+	var targetHost string
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		for _, setCookie := range setCookieHeaders(targetHost) {
+			response.Header().Add("Set-Cookie", setCookie)
+		}
+		response.Write([]byte("OK"))
+	}))
+	defer target.Close()
+
+	targetURL, err := url.Parse(target.URL)
+	if err != nil {
+		t.Fatalf("Error parsing target URL: %v", err)
+	}
+	targetHost = targetURL.Hostname()
+
+	testCases := []struct {
+		desc            string
+		cookieDomain    string
+		cookiePath      string
+		expectedCookies []string
+	}{
+		{
+			desc:            "Cookies are unchanged by default",
+			expectedCookies: setCookieHeaders(targetHost),
+		},
+		{
+			desc:         "Cookies scoped to the target are rescoped to the cookie domain",
+			cookieDomain: "relay.example",
+			expectedCookies: []string{
+				"session=abc; Domain=relay.example; Path=/api; Secure; HttpOnly; SameSite=Strict; Max-Age=3600",
+				"theme=dark; Domain=relay.example; path=/",
+				"tracker=xyz; Domain=example.com; Path=/api",
+				"plain=1",
+			},
+		},
+		{
+			desc:         "Cookie paths are replaced with the cookie path",
+			cookieDomain: "relay.example",
+			cookiePath:   "/app",
+			expectedCookies: []string{
+				"session=abc; Domain=relay.example; Path=/app; Secure; HttpOnly; SameSite=Strict; Max-Age=3600",
+				"theme=dark; Domain=relay.example; Path=/app",
+				"tracker=xyz; Domain=example.com; Path=/app",
+				"plain=1",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      cookie-domain: '%v'
+                                      cookie-path: '%v'
+        `, target.URL, testCase.cookieDomain, testCase.cookiePath)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			cookies := response.Header.Values("Set-Cookie")
+			if !reflect.DeepEqual(cookies, testCase.expectedCookies) {
+				t.Errorf(
+					"Test '%v': Expected cookies:\n%v\nbut got:\n%v",
+					testCase.desc,
+					strings.Join(testCase.expectedCookies, "\n"),
+					strings.Join(cookies, "\n"),
+				)
+			}
+		})
+	}
+}
+
+// setCookieHeaders returns the Set-Cookie headers sent by the target in
+// TestSetCookieRewriting.
+func setCookieHeaders(targetHost string) []string {
+	return []string{
+		fmt.Sprintf("session=abc; Domain=%v; Path=/api; Secure; HttpOnly; SameSite=Strict; Max-Age=3600", targetHost),
+		fmt.Sprintf("theme=dark; domain=.%v; path=/", targetHost),
+		"tracker=xyz; Domain=example.com; Path=/api",
+		"plain=1",
+	}
+}
@@ -0,0 +1,77 @@
+package traffic
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/fullstorydev/relay-core/relay/logging"
+)
+
+// startShadowRequest sends a copy of the request to the shadow target, if one
+// is configured, without waiting for the result. The shadow response is
+// discarded; its status is only compared with the status of the primary
+// response, which should be reported by invoking the returned function, and
+// any mismatch is logged. Shadow requests never affect the response sent to
+// the client.
+//
+// The request body is buffered so that both requests can read it. If the body
+// is larger than MaxBodySize, the request isn't shadowed.
+func (handler *Handler) startShadowRequest(
+	clientRequest *http.Request,
+	requestLogger *logging.Logger,
+) (reportPrimaryStatus func(status int)) {
+	shadowTarget := handler.config.ShadowTarget
+	if shadowTarget == nil {
+		return func(int) {}
+	}
+
+	body, err := handler.bufferRequestBody(clientRequest, handler.config.MaxBodySize)
+	if err != nil {
+		requestLogger.With(logging.Fields{"error": err}).Warnf("Not shadowing request: could not read body: %v", err)
+		return func(int) {}
+	}
+	if body == nil && clientRequest.Body != nil && clientRequest.Body != http.NoBody {
+		requestLogger.Debugf("Not shadowing request: body is too large to buffer")
+		return func(int) {}
+	}
+	if body != nil {
+		clientRequest.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	// The shadow request must outlive the client request, so it doesn't use
+	// the client request's context.
+	shadowRequest := withTarget(clientRequest.Clone(context.Background()), shadowTarget)
+	shadowRequest.URL.Scheme = shadowTarget.Scheme
+	shadowRequest.URL.Host = shadowTarget.Host
+	shadowRequest.Host = shadowTarget.Host
+	if body != nil {
+		shadowRequest.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	shadowLogger := requestLogger.With(logging.Fields{"shadow": shadowTarget.String()})
+	primaryStatus := make(chan int, 1)
+
+	go func() {
+		shadowStatus := 0
+		if shadowResponse, err := handler.transportFor(shadowRequest).RoundTrip(shadowRequest); err != nil {
+			shadowLogger.With(logging.Fields{"error": err}).Warnf("Shadow request failed: %v", err)
+		} else {
+			io.Copy(io.Discard, io.LimitReader(shadowResponse.Body, handler.config.MaxBodySize))
+			shadowResponse.Body.Close()
+			shadowStatus = shadowResponse.StatusCode
+		}
+
+		if status := <-primaryStatus; status != shadowStatus {
+			shadowLogger.With(logging.Fields{
+				"primaryStatus": status,
+				"shadowStatus":  shadowStatus,
+			}).Printf("Shadow response status %v differs from primary response status %v", shadowStatus, status)
+		}
+	}()
+
+	return func(status int) {
+		primaryStatus <- status
+	}
+}
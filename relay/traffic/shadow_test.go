@@ -0,0 +1,103 @@
+package traffic_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestShadowTarget(t *testing.T) {
+	type shadowedRequest struct {
+		method string
+		path   string
+		body   string
+	}
+	shadowedRequests := make(chan shadowedRequest, 1)
+	shadowTarget := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		shadowedRequests <- shadowedRequest{
+			method: request.Method,
+			path:   request.URL.Path,
+			body:   string(body),
+		}
+		response.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadowTarget.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  shadow-target: %v
+    `, shadowTarget.URL)
+
+	test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		response, err := http.Post(relayService.HttpUrl()+"/shadowed", "text/plain", strings.NewReader("Hello, shadow"))
+		if err != nil {
+			t.Errorf("Error POSTing: %v", err)
+			return
+		}
+		response.Body.Close()
+
+		if response.StatusCode != 200 {
+			t.Errorf("Expected the primary target's 200 response but got: %v", response)
+		}
+
+		lastRequest, err := catcherService.LastRequest()
+		if err != nil {
+			t.Errorf("Error reading last request from catcher: %v", err)
+			return
+		}
+		if lastRequest.URL.Path != "/shadowed" {
+			t.Errorf("Expected the primary target to receive the request, but got: %v", lastRequest.URL)
+		}
+
+		select {
+		case shadowed := <-shadowedRequests:
+			expected := shadowedRequest{method: "POST", path: "/shadowed", body: "Hello, shadow"}
+			if shadowed != expected {
+				t.Errorf("Expected shadow target to receive '%v' but got '%v'", expected, shadowed)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Shadow target didn't receive the request")
+		}
+	})
+}
+
+func TestUnreachableShadowTarget(t *testing.T) {
+	// Reserve a port and then release it, so that nothing is listening there.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error reserving port: %v", err)
+	}
+	shadowTargetURL := fmt.Sprintf("http://%v", listener.Addr())
+	listener.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  shadow-target: %v
+    `, shadowTargetURL)
+
+	test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		response, err := http.Post(relayService.HttpUrl(), "text/plain", strings.NewReader("Hello"))
+		if err != nil {
+			t.Errorf("Error POSTing: %v", err)
+			return
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != 200 {
+			t.Errorf("Expected shadow failures not to affect the response, but got: %v", response)
+		}
+
+		body, err := io.ReadAll(response.Body)
+		if err != nil || len(body) == 0 {
+			t.Errorf("Expected the primary target's response body, but got '%v': %v", string(body), err)
+		}
+	})
+}
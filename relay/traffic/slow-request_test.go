@@ -0,0 +1,85 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/logging"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestSlowRequestLogging(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		response.Write([]byte("OK"))
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc          string
+		threshold     string
+		path          string
+		expectLogLine bool
+	}{
+		{
+			desc:          "Slow requests are logged",
+			threshold:     "100ms",
+			path:          "/slow",
+			expectLogLine: true,
+		},
+		{
+			desc:          "Fast requests aren't logged",
+			threshold:     "100ms",
+			path:          "/fast",
+			expectLogLine: false,
+		},
+		{
+			desc:          "Slow requests aren't logged by default",
+			threshold:     "0s",
+			path:          "/slow",
+			expectLogLine: false,
+		},
+	}
+
+	defer logging.SetOutput(os.Stdout)
+
+	for _, testCase := range testCases {
+		output := &syncBuffer{}
+		logging.SetOutput(output)
+
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      log-level: info
+                                      slow-request-threshold: %v
+        `, target.URL, testCase.threshold)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			getBody(relayService.HttpUrl()+testCase.path, t)
+
+			// The request is logged after the response is sent, so allow
+			// some time for the log line to appear.
+			expectedLine := testCase.path + ": slow request serviced with status 200"
+			for attempt := 0; attempt < 20 && !strings.Contains(output.String(), expectedLine); attempt++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			logged := strings.Contains(output.String(), expectedLine)
+			if logged != testCase.expectLogLine {
+				t.Errorf(
+					"Test '%v': Expected slow request log line: %v, but got log output:\n%v",
+					testCase.desc,
+					testCase.expectLogLine,
+					output.String(),
+				)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package traffic
+
+import (
+	"hash/fnv"
+	"net/http"
+)
+
+// SplitBucketCount is the number of buckets that values of the split header are
+// hashed into. Each bucket receives about 1% of traffic.
+const SplitBucketCount = 100
+
+// SplitBucket directs requests whose split header value hashes into a range of
+// buckets to a specific target. See RelayOptions.SplitHeader.
+type SplitBucket struct {
+	First  int     // The first bucket in the range, from 0 to SplitBucketCount-1.
+	Last   int     // The last bucket in the range, inclusive.
+	Target *Target // The target to relay requests in the range to.
+}
+
+// Contains reports whether the provided bucket falls within this range.
+func (bucket *SplitBucket) Contains(index int) bool {
+	return index >= bucket.First && index <= bucket.Last
+}
+
+// splitBucketIndex returns the bucket that the provided split header value
+// hashes into. The same value always hashes into the same bucket, even across
+// restarts and between relays.
+func splitBucketIndex(value string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(value))
+	return int(hash.Sum32() % SplitBucketCount)
+}
+
+// splitTarget returns the target that the request should be relayed to
+// according to the split header, or nil if the request doesn't carry the header
+// or its bucket isn't mapped to a target.
+func (handler *Handler) splitTarget(request *http.Request) *Target {
+	if handler.config.SplitHeader == "" {
+		return nil
+	}
+	value := request.Header.Get(handler.config.SplitHeader)
+	if value == "" {
+		return nil
+	}
+
+	index := splitBucketIndex(value)
+	for _, bucket := range handler.config.SplitBuckets {
+		if bucket.Contains(index) {
+			return bucket.Target
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package traffic_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestSplitHeader(t *testing.T) {
+	// Each target responds with its name, so the test can tell which target a
+	// request reached.
+	newNamedTarget := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			io.WriteString(response, name)
+		}))
+	}
+	targetA := newNamedTarget("A")
+	defer targetA.Close()
+	targetB := newNamedTarget("B")
+	defer targetB.Close()
+	defaultTarget := newNamedTarget("default")
+	defer defaultTarget.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+                                  split-header: X-User-ID
+                                  split-buckets: 0-29=%v,30-59=%v
+    `, defaultTarget.URL, targetA.URL, targetB.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		getTarget := func(userID string) string {
+			request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+			if err != nil {
+				t.Fatalf("Error creating request: %v", err)
+			}
+			if userID != "" {
+				request.Header.Set("X-User-ID", userID)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatalf("Error GETing: %v", err)
+			}
+			defer response.Body.Close()
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Fatalf("Error reading response body: %v", err)
+			}
+			return string(body)
+		}
+
+		// Requests without the header go to the default target.
+		for i := 0; i < 5; i++ {
+			if target := getTarget(""); target != "default" {
+				t.Errorf("Expected a request without the split header to reach the default target but it reached %v", target)
+			}
+		}
+
+		// Requests with the same header value always reach the same target,
+		// and users are distributed among the targets by bucket.
+		const users = 2000
+		counts := map[string]int{}
+		for i := 0; i < users; i++ {
+			userID := fmt.Sprintf("user-%v", i)
+			target := getTarget(userID)
+			counts[target]++
+			if i%100 == 0 {
+				for j := 0; j < 3; j++ {
+					if repeated := getTarget(userID); repeated != target {
+						t.Errorf("Expected user %v to consistently reach target %v but it reached %v", userID, target, repeated)
+					}
+				}
+			}
+		}
+
+		const tolerance = 0.05
+		expectedShares := map[string]float64{"A": 0.3, "B": 0.3, "default": 0.4}
+		for target, expectedShare := range expectedShares {
+			share := float64(counts[target]) / users
+			if share < expectedShare-tolerance || share > expectedShare+tolerance {
+				t.Errorf("Expected target %v to receive %.1f%% of users but it received %.1f%%", target, expectedShare*100, share*100)
+			}
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package traffic
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/fullstorydev/relay-core/relay/logging"
+)
+
+// streamResponseBody relays a response body of unknown length to the client as
+// it arrives, using chunked transfer encoding. Each chunk is flushed to the
+// client immediately, so that streamed responses like server-sent events
+// aren't delayed by buffering. At most MaxBodySize bytes are relayed, except
+// for event streams, which may stay open indefinitely.
+func (handler *Handler) streamResponseBody(
+	clientResponse http.ResponseWriter,
+	targetResponse *http.Response,
+	requestLogger *logging.Logger,
+) {
+	clientResponse.WriteHeader(targetResponse.StatusCode)
+
+	// Without flushing, the response is still relayed, but the writer may
+	// buffer it, so streamed responses can be delayed.
+	writer := io.Writer(clientResponse)
+	if flusher, ok := clientResponse.(http.Flusher); ok && canFlush(clientResponse) {
+		flusher.Flush()
+		writer = &flushWriter{writer: clientResponse, flusher: flusher}
+	} else {
+		requestLogger.Debugf("The response writer does not support flushing; relaying the response body without flushing")
+	}
+	writer, clearDeadline := handler.withClientWriteTimeout(clientResponse, writer)
+	defer clearDeadline()
+
+	body := io.Reader(targetResponse.Body)
+	if !isEventStream(targetResponse) {
+		body = io.LimitReader(body, handler.config.MaxBodySize)
+	}
+
+	if _, err := io.Copy(writer, body); err != nil {
+		// The status and headers have already been sent, so aborting the
+		// response is the only way to let the client know that it's
+		// incomplete.
+		requestLogger.With(logging.Fields{"error": err, "status": targetResponse.StatusCode}).Errorf("Error relaying response body with unknown content-length: %s", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// bufferResponseBody reads a response body of unknown length into memory and
+// relays it to the client with a Content-Length header, for clients which
+// can't handle chunked responses. If the body is larger than MaxBodySize, the
+// client receives a 503 instead.
+func (handler *Handler) bufferResponseBody(
+	clientResponse http.ResponseWriter,
+	targetResponse *http.Response,
+	requestLogger *logging.Logger,
+) {
+	body, err := io.ReadAll(io.LimitReader(targetResponse.Body, handler.config.MaxBodySize+1))
+	if err != nil {
+		requestLogger.With(logging.Fields{"error": err, "status": targetResponse.StatusCode}).Errorf("Error buffering response body with unknown content-length: %s", err)
+		handler.writeError(clientResponse, "Could not read response body", http.StatusBadGateway)
+		return
+	}
+	if int64(len(body)) > handler.config.MaxBodySize {
+		handler.writeError(clientResponse, "Response body was too large", http.StatusServiceUnavailable)
+		return
+	}
+
+	// These statuses never have a body, so they mustn't have a Content-Length.
+	if targetResponse.StatusCode != http.StatusNoContent && targetResponse.StatusCode != http.StatusNotModified {
+		clientResponse.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	clientResponse.WriteHeader(targetResponse.StatusCode)
+	io.Copy(clientResponse, bytes.NewReader(body))
+}
+
+// isEventStream reports whether the provided response is a stream of
+// server-sent events. Event streams are long-lived, so they're always relayed
+// as they arrive.
+func isEventStream(response *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// canFlush reports whether the provided writer can flush to the client. The
+// relay's own wrappers, like responseRecorder, always implement http.Flusher,
+// so the writers they wrap are checked instead.
+func canFlush(writer http.ResponseWriter) bool {
+	for {
+		unwrapper, ok := writer.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			_, ok := writer.(http.Flusher)
+			return ok
+		}
+		writer = unwrapper.Unwrap()
+	}
+}
+
+// flushWriter flushes each write to the client immediately.
+type flushWriter struct {
+	writer  io.Writer
+	flusher http.Flusher
+}
+
+func (writer *flushWriter) Write(data []byte) (int, error) {
+	written, err := writer.writer.Write(data)
+	writer.flusher.Flush()
+	return written, err
+}
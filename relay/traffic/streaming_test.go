@@ -0,0 +1,223 @@
+package traffic_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/logging"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"github.com/fullstorydev/relay-core/relay/traffic"
+)
+
+func TestStreamedResponses(t *testing.T) {
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 4096) // 64KiB
+	chunkCount := 16
+
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		// Flushing makes the response chunked, so it has no content length.
+		for i := 0; i < chunkCount; i++ {
+			response.Write(chunk)
+			response.(http.Flusher).Flush()
+		}
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc                  string
+		config                string
+		maxBodySize           int
+		expectedStatus        int
+		expectedContentLength int64
+		expectedBody          []byte
+	}{
+		{
+			desc:                  "Responses of unknown length are streamed by default",
+			maxBodySize:           2 * 1024 * 1024,
+			expectedStatus:        200,
+			expectedContentLength: -1,
+			expectedBody:          bytes.Repeat(chunk, chunkCount),
+		},
+		{
+			desc:                  "Responses of unknown length can be buffered",
+			config:                "buffer-streamed-responses: true",
+			maxBodySize:           2 * 1024 * 1024,
+			expectedStatus:        200,
+			expectedContentLength: int64(len(chunk) * chunkCount),
+			expectedBody:          bytes.Repeat(chunk, chunkCount),
+		},
+		{
+			desc:                  "Buffered responses must not exceed the maximum body size",
+			config:                "buffer-streamed-responses: true",
+			maxBodySize:           len(chunk),
+			expectedStatus:        503,
+			expectedContentLength: int64(len("Response body was too large\n")),
+			expectedBody:          []byte("Response body was too large\n"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      max-body-size: %v
+                                      %v
+        `, target.URL, testCase.maxBodySize, testCase.config)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Errorf("Test '%v': Error reading body: %v", testCase.desc, err)
+				return
+			}
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+			if response.ContentLength != testCase.expectedContentLength {
+				t.Errorf(
+					"Test '%v': Expected content length %v but got %v",
+					testCase.desc,
+					testCase.expectedContentLength,
+					response.ContentLength,
+				)
+			}
+			if !bytes.Equal(body, testCase.expectedBody) {
+				t.Errorf("Test '%v': Expected %v byte body but got %v bytes", testCase.desc, len(testCase.expectedBody), len(body))
+			}
+		})
+	}
+}
+
+func TestNonFlushingResponseWriter(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		// Flush before writing the body, so the response is streamed with no
+		// content length.
+		response.WriteHeader(200)
+		response.(http.Flusher).Flush()
+		response.Write([]byte("Streamed response"))
+	}))
+	defer target.Close()
+
+	targetURL, err := url.Parse(target.URL)
+	if err != nil {
+		t.Fatalf("Error parsing target URL: %v", err)
+	}
+
+	output := &syncBuffer{}
+	logging.SetOutput(output)
+	logging.SetLevel(logging.DebugLevel)
+	defer logging.SetOutput(os.Stdout)
+	defer logging.SetLevel(logging.InfoLevel)
+
+	options := traffic.NewDefaultRelayOptions()
+	options.Targets = []*traffic.Target{{Host: targetURL.Host, Scheme: targetURL.Scheme}}
+	handler := traffic.NewHandler(options, nil, nil)
+
+	// Only the ResponseWriter methods of the recorder are exposed, so the
+	// writer doesn't implement http.Flusher.
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "http://relay.example/", nil)
+	handler.ServeHTTP(struct{ http.ResponseWriter }{recorder}, request)
+
+	if recorder.Code != 200 {
+		t.Errorf("Expected status 200 but got %v", recorder.Code)
+	}
+	if body := recorder.Body.String(); body != "Streamed response" {
+		t.Errorf("Expected body 'Streamed response' but got '%v'", body)
+	}
+	if !strings.Contains(output.String(), "does not support flushing") {
+		t.Errorf("Expected a log line about flushing but got log output:\n%v", output.String())
+	}
+}
+
+func TestServerSentEvents(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		options string
+	}{
+		{
+			desc:    "Event streams are relayed as they arrive",
+			options: "",
+		},
+		{
+			desc:    "Event streams aren't buffered even if streamed responses are",
+			options: "buffer-streamed-responses: true",
+		},
+		{
+			desc:    "Event streams aren't limited by max-body-size",
+			options: "max-body-size: 10",
+		},
+	}
+
+	for _, testCase := range testCases {
+		// The target sends each event only after the client has received the
+		// previous one, so the test only completes promptly if the relay
+		// delivers each event as soon as it arrives.
+		received := make(chan struct{}, 3)
+		target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			response.Header().Set("Content-Type", "text/event-stream")
+			for i := 1; i <= 3; i++ {
+				fmt.Fprintf(response, "data: event %v\n\n", i)
+				response.(http.Flusher).Flush()
+
+				select {
+				case <-received:
+				case <-time.After(2 * time.Second):
+					return
+				}
+			}
+		}))
+
+		configYaml := fmt.Sprintf("relay:\n  target: %v\n  %v\n", target.URL, testCase.options)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			start := time.Now()
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+
+			if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+				t.Errorf("Test '%v': Expected Content-Type 'text/event-stream' but got '%v'", testCase.desc, contentType)
+			}
+
+			reader := bufio.NewReader(response.Body)
+			for i := 1; i <= 3; i++ {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					t.Errorf("Test '%v': Error reading event %v: %v", testCase.desc, i, err)
+					return
+				}
+				if expected := fmt.Sprintf("data: event %v", i); strings.TrimSpace(line) != expected {
+					t.Errorf("Test '%v': Expected '%v' but got '%v'", testCase.desc, expected, line)
+				}
+				reader.ReadString('\n') // The blank line which ends the event.
+				received <- struct{}{}
+			}
+
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Test '%v': Expected events to be relayed immediately, but receiving them took %v", testCase.desc, elapsed)
+			}
+		})
+
+		target.Close()
+	}
+}
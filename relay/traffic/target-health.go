@@ -0,0 +1,153 @@
+package traffic
+
+import (
+	"sync"
+	"time"
+)
+
+// targetHealth passively tracks the health of the default targets, based on
+// the outcomes of the requests relayed to them. After threshold consecutive
+// requests to a target fail, it's considered unhealthy, and it's skipped when
+// targets are selected. Once recovery has passed since its last failure, it's
+// selected again as a probe; a success makes it healthy, while another failure
+// makes it unhealthy for another recovery period.
+//
+// Targets may also be marked down by active health checks; see healthChecker.
+// A target which is down is skipped until a later check marks it up again.
+//
+// Unlike the circuit breaker, which rejects requests for a failing target,
+// this only steers new requests towards the other targets. A threshold of zero
+// disables passive checking.
+type targetHealth struct {
+	down      map[string]bool // Hosts which failed their latest active health check. Nil if active checks are disabled.
+	failures  map[string]*targetFailures
+	mutex     sync.Mutex
+	recovery  time.Duration
+	threshold int
+}
+
+type targetFailures struct {
+	count       int       // The number of consecutive failures.
+	lastFailure time.Time // When the most recent failure occurred.
+}
+
+func newTargetHealth(threshold int, recovery time.Duration, activeChecks bool) *targetHealth {
+	health := &targetHealth{
+		failures:  map[string]*targetFailures{},
+		recovery:  recovery,
+		threshold: threshold,
+	}
+	if activeChecks {
+		health.down = map[string]bool{}
+	}
+	return health
+}
+
+// enabled reports whether either passive or active health checking is enabled.
+func (health *targetHealth) enabled() bool {
+	return health.threshold > 0 || health.down != nil
+}
+
+// healthy reports whether requests may be sent to the target with the
+// provided host.
+func (health *targetHealth) healthy(host string) bool {
+	if !health.enabled() {
+		return true
+	}
+
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	return health.healthyLocked(host, time.Now())
+}
+
+func (health *targetHealth) healthyLocked(host string, now time.Time) bool {
+	if health.down[host] {
+		return false
+	}
+	failures := health.failures[host]
+	return health.threshold <= 0 ||
+		failures == nil ||
+		failures.count < health.threshold ||
+		now.Sub(failures.lastFailure) >= health.recovery
+}
+
+// lastFailureLocked returns when the most recent relayed request to the
+// provided host failed, or the zero time if it hasn't failed.
+func (health *targetHealth) lastFailureLocked(host string) time.Time {
+	if failures := health.failures[host]; failures != nil {
+		return failures.lastFailure
+	}
+	return time.Time{}
+}
+
+// available returns the healthy targets among those provided. If none of them
+// are healthy, the one which failed least recently is returned alone, since
+// it's the most likely to have recovered.
+func (health *targetHealth) available(targets []*Target) []*Target {
+	if !health.enabled() {
+		return targets
+	}
+
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	now := time.Now()
+	var healthy []*Target
+	var leastRecentlyFailed *Target
+	for _, target := range targets {
+		if health.healthyLocked(target.Host, now) {
+			healthy = append(healthy, target)
+		} else if leastRecentlyFailed == nil ||
+			health.lastFailureLocked(target.Host).Before(health.lastFailureLocked(leastRecentlyFailed.Host)) {
+			leastRecentlyFailed = target
+		}
+	}
+	if len(healthy) == 0 {
+		return []*Target{leastRecentlyFailed}
+	}
+	return healthy
+}
+
+// recordSuccess marks the target with the provided host as healthy.
+func (health *targetHealth) recordSuccess(host string) {
+	if health.threshold <= 0 {
+		return
+	}
+
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	if failures := health.failures[host]; failures != nil && failures.count >= health.threshold {
+		logger.Printf("Target %v has recovered", host)
+	}
+	delete(health.failures, host)
+}
+
+// recordFailure counts a failed request to the target with the provided host,
+// marking it unhealthy if the threshold has been reached.
+func (health *targetHealth) recordFailure(host string) {
+	if health.threshold <= 0 {
+		return
+	}
+
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	failures := health.failures[host]
+	if failures == nil {
+		failures = &targetFailures{}
+		health.failures[host] = failures
+	}
+	failures.count++
+	failures.lastFailure = time.Now()
+	if failures.count == health.threshold {
+		logger.Warnf("Target %v is unhealthy after %v consecutive failures", host, failures.count)
+	}
+}
+
+// setDown records the outcome of an active health check of the target with the
+// provided host.
+func (health *targetHealth) setDown(host string, down bool) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	health.down[host] = down
+}
@@ -0,0 +1,79 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestTargetHealth(t *testing.T) {
+	targets, targetURLs, requestCounts := startCountingTargets(2)
+	for _, target := range targets {
+		defer target.Close()
+	}
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+                                  target-fail-threshold: 2
+                                  target-recovery: 200ms
+    `, strings.Join(targetURLs, ","))
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		get := func() int {
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Error GETing: %v", err)
+				return 0
+			}
+			response.Body.Close()
+			return response.StatusCode
+		}
+		countFailures := func(requests int) int {
+			failures := 0
+			for i := 0; i < requests; i++ {
+				if get() != http.StatusOK {
+					failures++
+				}
+			}
+			return failures
+		}
+
+		// Kill the second target. Targets are chosen round-robin, so it
+		// receives every other request until it reaches the threshold.
+		targets[1].Close()
+		if failures := countFailures(4); failures != 2 {
+			t.Errorf("Expected 2 requests to the dead target to fail but %v did", failures)
+		}
+
+		requestCounts[0].Store(0)
+		if failures := countFailures(10); failures != 0 {
+			t.Errorf("Expected requests to avoid the unhealthy target but %v failed", failures)
+		}
+		if count := requestCounts[0].Load(); count != 10 {
+			t.Errorf("Expected the healthy target to receive 10 requests but it received %v", count)
+		}
+
+		// Once the recovery period has passed, the unhealthy target is probed
+		// again; its failure takes it out of rotation for another period.
+		time.Sleep(250 * time.Millisecond)
+		if failures := countFailures(2); failures != 1 {
+			t.Errorf("Expected 1 probe of the unhealthy target to fail but %v did", failures)
+		}
+		if failures := countFailures(10); failures != 0 {
+			t.Errorf("Expected requests to avoid the unhealthy target after a failed probe but %v failed", failures)
+		}
+
+		// If every target is unhealthy, requests are still attempted rather
+		// than being rejected by the relay.
+		targets[0].Close()
+		countFailures(4)
+		if status := get(); status != http.StatusBadGateway {
+			t.Errorf("Expected a request to be attempted when all targets are unhealthy, with status 502, but got %v", status)
+		}
+	})
+}
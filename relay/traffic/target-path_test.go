@@ -0,0 +1,123 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"golang.org/x/net/websocket"
+)
+
+func TestTargetPath(t *testing.T) {
+	// The target records the request URI of each request it receives.
+	requestURIs := make(chan string, 10)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requestURIs <- request.RequestURI
+		response.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc        string
+		targetPath  string
+		requestURI  string
+		expectedURI string
+	}{
+		{
+			desc:        "A target without a path relays the path unchanged",
+			targetPath:  "",
+			requestURI:  "/a/b",
+			expectedURI: "/a/b",
+		},
+		{
+			desc:        "A target with a path prefixes the request path",
+			targetPath:  "/service",
+			requestURI:  "/a/b",
+			expectedURI: "/service/a/b",
+		},
+		{
+			desc:        "A trailing slash on the target path doesn't double the slash",
+			targetPath:  "/service/",
+			requestURI:  "/a/b",
+			expectedURI: "/service/a/b",
+		},
+		{
+			desc:        "The root path is relayed to the target path",
+			targetPath:  "/service/",
+			requestURI:  "/",
+			expectedURI: "/service/",
+		},
+		{
+			desc:        "Nested target paths are supported",
+			targetPath:  "/api/v1",
+			requestURI:  "/users",
+			expectedURI: "/api/v1/users",
+		},
+		{
+			desc:        "The query string is preserved",
+			targetPath:  "/service",
+			requestURI:  "/a?b=c&d=e",
+			expectedURI: "/service/a?b=c&d=e",
+		},
+		{
+			desc:        "The request path's encoding is preserved",
+			targetPath:  "/service",
+			requestURI:  "/a%2Fb",
+			expectedURI: "/service/a%2Fb",
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v%v
+        `, target.URL, testCase.targetPath)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			response, err := http.Get(relayService.HttpUrl() + testCase.requestURI)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+			if response.StatusCode != http.StatusOK {
+				t.Errorf("Test '%v': Expected status 200 but got %v", testCase.desc, response.StatusCode)
+				return
+			}
+			if requestURI := <-requestURIs; requestURI != testCase.expectedURI {
+				t.Errorf("Test '%v': Expected request URI '%v' but got '%v'", testCase.desc, testCase.expectedURI, requestURI)
+			}
+		})
+	}
+}
+
+func TestTargetPathWebSocket(t *testing.T) {
+	requestPaths := make(chan string, 10)
+	echo := websocket.Handler(catcher.EchoServer)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requestPaths <- request.URL.Path
+		echo.ServeHTTP(response, request)
+	}))
+	defer target.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v/service/
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		ws, err := websocket.Dial(fmt.Sprintf("%v/echo", relayService.WsUrl()), "", relayService.HttpUrl())
+		if err != nil {
+			t.Fatalf("Error dialing websocket: %v", err)
+		}
+		defer ws.Close()
+		if err := testEcho(ws, "Ten-four"); err != nil {
+			t.Errorf("Error in websocket echo: %v", err)
+		}
+		if requestPath := <-requestPaths; requestPath != "/service/echo" {
+			t.Errorf("Expected websocket request path '/service/echo' but got '%v'", requestPath)
+		}
+	})
+}
@@ -0,0 +1,221 @@
+package traffic
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Target describes a host to which the relay sends traffic.
+type Target struct {
+	Host       string // The host to relay traffic to. (e.g. 192.168.0.1:1234)
+	Path       string // If set, a prefix prepended to the path of each request relayed to the host. (e.g. /service)
+	Scheme     string // The scheme ('http' or 'https') to use to communicate with the host.
+	SocketPath string // If set, connections are made to this Unix socket, and Host is only used for the Host header.
+	Weight     int    // The target's share of traffic relative to the other default targets. Zero is treated as 1.
+}
+
+func (target *Target) String() string {
+	if target.SocketPath != "" {
+		return fmt.Sprintf("unix://%v", target.SocketPath)
+	}
+	return fmt.Sprintf("%v://%v%v", target.Scheme, target.Host, target.Path)
+}
+
+// DialAddress returns the network and address which are dialed to reach the
+// target: its Unix socket, if it has one, or otherwise its host and port,
+// using the default port for its scheme if it doesn't specify one.
+func (target *Target) DialAddress() (network string, address string) {
+	if target.SocketPath != "" {
+		return "unix", target.SocketPath
+	}
+	return "tcp", dialAddress(&url.URL{Scheme: target.Scheme, Host: target.Host})
+}
+
+// prefixPath prepends the target's path, if it has one, to the path of the
+// provided request URL. The two are joined with a single slash, and the
+// request path's original encoding is preserved.
+func (target *Target) prefixPath(requestURL *url.URL) {
+	if target.Path == "" {
+		return
+	}
+	requestURL.Path = joinPath(target.Path, requestURL.Path)
+	if requestURL.RawPath != "" {
+		prefixURL := url.URL{Path: target.Path}
+		requestURL.RawPath = joinPath(prefixURL.EscapedPath(), requestURL.RawPath)
+	}
+}
+
+// joinPath joins a path prefix and a path with exactly one slash between them.
+func joinPath(prefix string, path string) string {
+	return strings.TrimSuffix(prefix, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// weight returns the target's effective weight, which is always positive.
+func (target *Target) weight() int {
+	if target.Weight <= 0 {
+		return 1
+	}
+	return target.Weight
+}
+
+// stickyID returns the value of the sticky session cookie which identifies this
+// target. It's derived from the target's URL, so it remains valid if other
+// targets are added or removed, but it doesn't reveal the URL to clients.
+func (target *Target) stickyID() string {
+	hash := sha256.Sum256([]byte(target.String()))
+	return hex.EncodeToString(hash[:8])
+}
+
+// HostRoute directs requests for a particular host to a specific target,
+// rather than to the default targets.
+type HostRoute struct {
+	// The host to match. This is either an exact host name, like
+	// "a.example.com", or a wildcard like "*.example.com", which matches any
+	// subdomain of "example.com" (but not "example.com" itself).
+	Pattern string
+
+	// The target to relay matching requests to.
+	Target *Target
+
+	// If set, the Origin header of matching requests is handled according to
+	// this mode, overriding any mode set by the headers plugin.
+	OriginMode OriginMode
+
+	// If nonzero, these override the corresponding RelayOptions timeouts for
+	// matching requests.
+	DialTimeout           time.Duration
+	RequestTimeout        time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+// Matches reports whether the provided host, which may include a port, matches
+// this route's pattern. Host names are matched case-insensitively.
+func (route *HostRoute) Matches(host string) bool {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(host)
+	pattern := strings.ToLower(route.Pattern)
+
+	if suffix := strings.TrimPrefix(pattern, "*"); suffix != pattern {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == pattern
+}
+
+func (route *HostRoute) isWildcard() bool {
+	return strings.HasPrefix(route.Pattern, "*")
+}
+
+// matchHostRoute returns the host route which matches the provided host, or
+// nil if none does. Exact routes take precedence over wildcard routes, and
+// otherwise routes are considered in order.
+func (handler *Handler) matchHostRoute(host string) *HostRoute {
+	for _, wildcard := range []bool{false, true} {
+		for _, route := range handler.config.HostRoutes {
+			if route.isWildcard() == wildcard && route.Matches(host) {
+				return route
+			}
+		}
+	}
+	return nil
+}
+
+// selectTarget chooses the target that the provided request should be relayed
+// to. If the request matched a host route, that route's target is used; failing
+// that, if it matched a path route, that route's target is used. If the
+// request's split header hashes into a mapped bucket, that bucket's target is
+// used. Otherwise, requests are distributed among the default targets by
+// nextTarget. If no targets are configured, nil is returned.
+//
+// If a sticky session cookie is configured, a request which carries that cookie
+// is relayed to the target it names, if that target is still configured and
+// healthy. Otherwise, a target is chosen by nextTarget, and setCookie is true,
+// so that setStickyCookie sets the cookie on the response and the client's
+// later requests go to the same target. The cookie must be read before cookies
+// are removed from the request.
+func (handler *Handler) selectTarget(request *http.Request, route *HostRoute, pathRoute *PathRoute) (target *Target, setCookie bool) {
+	if route != nil {
+		return route.Target, false
+	}
+	if pathRoute != nil {
+		return pathRoute.Target, false
+	}
+	if target := handler.splitTarget(request); target != nil {
+		return target, false
+	}
+
+	targets := handler.config.Targets
+	if len(targets) == 0 {
+		return nil, false
+	}
+
+	cookieName := handler.config.StickyCookie
+	if cookieName != "" {
+		if cookie, err := request.Cookie(cookieName); err == nil {
+			for _, target := range targets {
+				if target.stickyID() == cookie.Value && handler.health.healthy(target.Host) {
+					return target, false
+				}
+			}
+		}
+	}
+	return handler.nextTarget(targets), cookieName != ""
+}
+
+// setStickyCookie sets the sticky session cookie naming the target chosen for
+// the request, if selectTarget decided that it should be set. It's only called
+// once the request has been authorized, and the cookie is marked Secure if
+// clients reach the relay via https.
+func (handler *Handler) setStickyCookie(clientResponse http.ResponseWriter, clientRequest *http.Request, requestInfo RequestInfo) {
+	if requestInfo.stickyTarget == nil {
+		return
+	}
+	scheme := handler.publicScheme()
+	if scheme == "" && clientRequest.TLS != nil {
+		scheme = "https"
+	}
+	http.SetCookie(clientResponse, &http.Cookie{
+		Name:     handler.config.StickyCookie,
+		Value:    requestInfo.stickyTarget.stickyID(),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   scheme == "https",
+	})
+}
+
+// nextTarget chooses one of the provided targets, which must not be empty.
+// Unhealthy targets are skipped unless none are healthy. If the remaining
+// targets all have the same weight, they're chosen round-robin; otherwise,
+// each is chosen at random with a probability proportional to its weight.
+func (handler *Handler) nextTarget(targets []*Target) *Target {
+	targets = handler.health.available(targets)
+
+	totalWeight := 0
+	weighted := false
+	for _, target := range targets {
+		totalWeight += target.weight()
+		weighted = weighted || target.weight() != targets[0].weight()
+	}
+
+	if !weighted {
+		index := handler.targetCounter.Add(1) - 1
+		return targets[index%uint64(len(targets))]
+	}
+
+	choice := rand.Intn(totalWeight)
+	for _, target := range targets {
+		if choice < target.weight() {
+			return target
+		}
+		choice -= target.weight()
+	}
+	return targets[len(targets)-1]
+}
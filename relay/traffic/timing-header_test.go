@@ -0,0 +1,73 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"github.com/fullstorydev/relay-core/relay/traffic"
+)
+
+func TestTimingHeader(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		time.Sleep(delay)
+		response.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc         string
+		timingHeader bool
+	}{
+		{
+			desc:         "The upstream time is reported if the timing header is enabled",
+			timingHeader: true,
+		},
+		{
+			desc:         "The upstream time isn't reported by default",
+			timingHeader: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      timing-header: %v
+        `, target.URL, testCase.timingHeader)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			start := time.Now()
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+			elapsed := time.Since(start)
+
+			value := response.Header.Get(traffic.UpstreamTimeHeaderName)
+			if !testCase.timingHeader {
+				if value != "" {
+					t.Errorf("Test '%v': Expected no %v header but got '%v'", testCase.desc, traffic.UpstreamTimeHeaderName, value)
+				}
+				return
+			}
+
+			milliseconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				t.Errorf("Test '%v': Expected %v to be a number of milliseconds but got '%v'", testCase.desc, traffic.UpstreamTimeHeaderName, value)
+				return
+			}
+			upstreamTime := time.Duration(milliseconds) * time.Millisecond
+			if upstreamTime < delay || upstreamTime > elapsed {
+				t.Errorf("Test '%v': Expected an upstream time between %v and %v but got %v", testCase.desc, delay, elapsed, upstreamTime)
+			}
+		})
+	}
+}
@@ -0,0 +1,377 @@
+package traffic_test
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"golang.org/x/net/websocket"
+)
+
+func TestTLSVerification(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("OK"))
+	}))
+	defer target.Close()
+
+	caFile := writeCertificateFile(t, target)
+
+	testCases := []struct {
+		desc          string
+		config        string
+		expectSuccess bool
+	}{
+		{
+			desc: "Untrusted certificates are rejected by default",
+			config: fmt.Sprintf(`relay:
+                                    target: %v
+            `, target.URL),
+			expectSuccess: false,
+		},
+		{
+			desc: "Certificates signed by a configured CA are trusted",
+			config: fmt.Sprintf(`relay:
+                                    target: %v
+                                    tls-ca-file: %v
+            `, target.URL, caFile),
+			expectSuccess: true,
+		},
+		{
+			desc: "Any certificate is trusted if verification is disabled",
+			config: fmt.Sprintf(`relay:
+                                    target: %v
+                                    tls-verify: false
+            `, target.URL),
+			expectSuccess: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithRelay(t, testCase.config, nil, func(relayService *relay.Service) {
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+
+			expectedStatus := 200
+			if !testCase.expectSuccess {
+				expectedStatus = 502
+			}
+			if response.StatusCode != expectedStatus {
+				t.Errorf(
+					"Test '%v': Expected response status %v but got %v",
+					testCase.desc,
+					expectedStatus,
+					response.StatusCode,
+				)
+			}
+		})
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	serverNames := make(chan string, 10)
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("OK"))
+	}))
+	target.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	}
+	target.StartTLS()
+	defer target.Close()
+
+	// The target is addressed by IP. Its certificate is valid for both
+	// 127.0.0.1 and example.com.
+	caFile := writeCertificateFile(t, target)
+
+	testCases := []struct {
+		desc               string
+		tlsServerName      string
+		expectSuccess      bool
+		expectedServerName string
+	}{
+		{
+			desc:               "No server name is sent via SNI for targets addressed by IP",
+			tlsServerName:      "",
+			expectSuccess:      true,
+			expectedServerName: "",
+		},
+		{
+			desc:               "The configured server name is sent via SNI",
+			tlsServerName:      "example.com",
+			expectSuccess:      true,
+			expectedServerName: "example.com",
+		},
+		{
+			desc:               "The certificate must be valid for the configured server name",
+			tlsServerName:      "backend.example",
+			expectSuccess:      false,
+			expectedServerName: "backend.example",
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      tls-ca-file: %v
+                                      tls-server-name: '%v'
+        `, target.URL, caFile, testCase.tlsServerName)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			// Discard server names from earlier test cases.
+			for len(serverNames) > 0 {
+				<-serverNames
+			}
+
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+
+			expectedStatus := 200
+			if !testCase.expectSuccess {
+				expectedStatus = 502
+			}
+			if response.StatusCode != expectedStatus {
+				t.Errorf(
+					"Test '%v': Expected response status %v but got %v",
+					testCase.desc,
+					expectedStatus,
+					response.StatusCode,
+				)
+			}
+
+			if serverName := <-serverNames; serverName != testCase.expectedServerName {
+				t.Errorf(
+					"Test '%v': Expected server name '%v' but got '%v'",
+					testCase.desc,
+					testCase.expectedServerName,
+					serverName,
+				)
+			}
+		})
+	}
+}
+
+func TestWebSocketTLSVerification(t *testing.T) {
+	serverNames := make(chan string, 10)
+	target := httptest.NewUnstartedServer(websocket.Handler(catcher.EchoServer))
+	target.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	}
+	target.StartTLS()
+	defer target.Close()
+
+	caFile := writeCertificateFile(t, target)
+	targetURL, err := url.Parse(target.URL)
+	if err != nil {
+		t.Fatalf("Error parsing target URL: %v", err)
+	}
+
+	testCases := []struct {
+		desc               string
+		config             string
+		expectSuccess      bool
+		expectedServerName string
+	}{
+		{
+			desc: "Untrusted certificates are rejected by default",
+			config: fmt.Sprintf(`relay:
+                                    target: %v
+            `, target.URL),
+			expectSuccess: false,
+		},
+		{
+			desc: "Certificates signed by a configured CA are trusted",
+			config: fmt.Sprintf(`relay:
+                                    target: %v
+                                    tls-ca-file: %v
+            `, target.URL, caFile),
+			expectSuccess: true,
+		},
+		{
+			desc: "The target's host name is sent via SNI",
+			config: fmt.Sprintf(`relay:
+                                    target: https://localhost:%v
+                                    tls-verify: false
+            `, targetURL.Port()),
+			expectSuccess:      true,
+			expectedServerName: "localhost",
+		},
+		{
+			desc: "The configured server name is sent via SNI to targets addressed by IP",
+			config: fmt.Sprintf(`relay:
+                                    target: %v
+                                    tls-ca-file: %v
+                                    tls-server-name: example.com
+            `, target.URL, caFile),
+			expectSuccess:      true,
+			expectedServerName: "example.com",
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithRelay(t, testCase.config, nil, func(relayService *relay.Service) {
+			// Discard server names from earlier test cases.
+			for len(serverNames) > 0 {
+				<-serverNames
+			}
+
+			if !testCase.expectSuccess {
+				status := webSocketUpgradeStatus(t, relayService)
+				if status != 502 {
+					t.Errorf("Test '%v': Expected status 502 but got %v", testCase.desc, status)
+				}
+				return
+			}
+
+			echoURL := fmt.Sprintf("%v/echo", relayService.WsUrl())
+			ws, err := websocket.Dial(echoURL, "", relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error dialing websocket: %v", testCase.desc, err)
+				return
+			}
+			defer ws.Close()
+
+			if err := testEcho(ws, "Come in, good buddy"); err != nil {
+				t.Errorf("Test '%v': Error in echo: %v", testCase.desc, err)
+			}
+
+			if testCase.expectedServerName != "" {
+				if serverName := <-serverNames; serverName != testCase.expectedServerName {
+					t.Errorf(
+						"Test '%v': Expected server name '%v' but got '%v'",
+						testCase.desc,
+						testCase.expectedServerName,
+						serverName,
+					)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	protocols := make(chan string, 1)
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		protocols <- request.Proto
+		// Flush before writing the body, so the response is streamed with no
+		// content length.
+		response.WriteHeader(200)
+		response.(http.Flusher).Flush()
+		response.Write([]byte("Streamed response"))
+	}))
+	target.EnableHTTP2 = true
+	target.StartTLS()
+	defer target.Close()
+
+	caFile := writeCertificateFile(t, target)
+
+	testCases := []struct {
+		desc             string
+		enableHTTP2      bool
+		expectedProtocol string
+	}{
+		{
+			desc:             "HTTP/1.1 is used by default",
+			enableHTTP2:      false,
+			expectedProtocol: "HTTP/1.1",
+		},
+		{
+			desc:             "HTTP/2 is used if enabled",
+			enableHTTP2:      true,
+			expectedProtocol: "HTTP/2.0",
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      tls-ca-file: %v
+                                      enable-http2: %v
+        `, target.URL, caFile, testCase.enableHTTP2)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Errorf("Test '%v': Error reading body: %v", testCase.desc, err)
+				return
+			}
+			if response.StatusCode != 200 || string(body) != "Streamed response" {
+				t.Errorf("Test '%v': Unexpected response %v with body '%v'", testCase.desc, response, string(body))
+			}
+
+			if protocol := <-protocols; protocol != testCase.expectedProtocol {
+				t.Errorf(
+					"Test '%v': Expected protocol '%v' but got '%v'",
+					testCase.desc,
+					testCase.expectedProtocol,
+					protocol,
+				)
+			}
+		})
+	}
+}
+
+// webSocketUpgradeStatus sends a websocket upgrade request to the relay and
+// returns the status of the response.
+func webSocketUpgradeStatus(t *testing.T, relayService *relay.Service) int {
+	request, err := http.NewRequest("GET", relayService.HttpUrl()+"/echo", nil)
+	if err != nil {
+		t.Errorf("Error creating request: %v", err)
+		return 0
+	}
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Errorf("Error sending upgrade request: %v", err)
+		return 0
+	}
+	defer response.Body.Close()
+	return response.StatusCode
+}
+
+// writeCertificateFile writes the certificate used by a TLS test server to a
+// PEM file, which can be used to configure the relay to trust that server.
+func writeCertificateFile(t *testing.T, server *httptest.Server) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	})
+	if err := os.WriteFile(path, pemBytes, 0600); err != nil {
+		t.Fatalf("Error writing certificate file: %v", err)
+	}
+	return path
+}
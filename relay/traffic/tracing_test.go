@@ -0,0 +1,206 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/config"
+	"github.com/fullstorydev/relay-core/relay/tracing"
+)
+
+func TestTracing(t *testing.T) {
+	type receivedHeaders struct {
+		traceparent string
+		tracestate  string
+	}
+	received := make(chan receivedHeaders, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		received <- receivedHeaders{
+			traceparent: request.Header.Get("Traceparent"),
+			tracestate:  request.Header.Get("Tracestate"),
+		}
+		if request.URL.Path == "/fail" {
+			response.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer target.Close()
+
+	// Reserve a port and then release it, so that requests to it fail.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error reserving port: %v", err)
+	}
+	unreachableURL := fmt.Sprintf("http://%v", listener.Addr())
+	listener.Close()
+
+	const inboundTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const inboundSpanID = "00f067aa0ba902b7"
+
+	testCases := []struct {
+		desc           string
+		target         string
+		path           string
+		traceparent    string
+		tracestate     string
+		expectExported bool
+		expectNewTrace bool
+		expectedStatus tracing.StatusCode
+	}{
+		{
+			desc:           "Inbound traces are continued",
+			target:         target.URL,
+			path:           "/",
+			traceparent:    fmt.Sprintf("00-%v-%v-01", inboundTraceID, inboundSpanID),
+			tracestate:     "vendor=value",
+			expectExported: true,
+			expectedStatus: tracing.StatusUnset,
+		},
+		{
+			desc:           "A new trace is started if there's no traceparent",
+			target:         target.URL,
+			path:           "/",
+			expectExported: true,
+			expectNewTrace: true,
+			expectedStatus: tracing.StatusUnset,
+		},
+		{
+			desc:           "A new trace is started if the traceparent is invalid",
+			target:         target.URL,
+			path:           "/",
+			traceparent:    "invalid",
+			tracestate:     "vendor=value",
+			expectExported: true,
+			expectNewTrace: true,
+			expectedStatus: tracing.StatusUnset,
+		},
+		{
+			desc:           "Unsampled traces are propagated but not exported",
+			target:         target.URL,
+			path:           "/",
+			traceparent:    fmt.Sprintf("00-%v-%v-00", inboundTraceID, inboundSpanID),
+			expectExported: false,
+		},
+		{
+			desc:           "Error responses are recorded",
+			target:         target.URL,
+			path:           "/fail",
+			traceparent:    fmt.Sprintf("00-%v-%v-01", inboundTraceID, inboundSpanID),
+			expectExported: true,
+			expectedStatus: tracing.StatusError,
+		},
+		{
+			desc:           "Failures to reach the target are recorded",
+			target:         unreachableURL,
+			path:           "/",
+			traceparent:    fmt.Sprintf("00-%v-%v-01", inboundTraceID, inboundSpanID),
+			expectExported: true,
+			expectedStatus: tracing.StatusError,
+		},
+	}
+
+	for _, testCase := range testCases {
+		exporter := &tracing.InMemoryExporter{}
+		withTracingRelay(t, testCase.target, tracing.NewTracer(exporter), func(relayService *relay.Service) {
+			request, err := http.NewRequest("GET", relayService.HttpUrl()+testCase.path, nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			if testCase.traceparent != "" {
+				request.Header.Set("Traceparent", testCase.traceparent)
+			}
+			if testCase.tracestate != "" {
+				request.Header.Set("Tracestate", testCase.tracestate)
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			var headers receivedHeaders
+			if testCase.target == target.URL {
+				headers = <-received
+			}
+
+			spans := exporter.Spans()
+			if !testCase.expectExported {
+				if len(spans) != 0 {
+					t.Errorf("Test '%v': Expected no spans but got %v", testCase.desc, len(spans))
+				}
+				if !strings.Contains(headers.traceparent, inboundTraceID) {
+					t.Errorf("Test '%v': Expected the trace to be propagated but got traceparent '%v'", testCase.desc, headers.traceparent)
+				}
+				return
+			}
+			if len(spans) != 1 {
+				t.Errorf("Test '%v': Expected 1 span but got %v", testCase.desc, len(spans))
+				return
+			}
+			span := spans[0]
+
+			traceID := fmt.Sprintf("%x", span.SpanContext.TraceID)
+			parentID := fmt.Sprintf("%x", span.Parent)
+			if testCase.expectNewTrace {
+				if traceID == inboundTraceID || parentID != "0000000000000000" {
+					t.Errorf("Test '%v': Expected a new trace but got trace %v with parent %v", testCase.desc, traceID, parentID)
+				}
+			} else if traceID != inboundTraceID || parentID != inboundSpanID {
+				t.Errorf("Test '%v': Expected trace %v with parent %v but got trace %v with parent %v", testCase.desc, inboundTraceID, inboundSpanID, traceID, parentID)
+			}
+
+			if span.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected span status %v but got %v", testCase.desc, testCase.expectedStatus, span.StatusCode)
+			}
+
+			if testCase.target != target.URL {
+				return
+			}
+
+			// The target sees the relay's span as the parent of its own work.
+			if expected := span.SpanContext.Traceparent(); headers.traceparent != expected {
+				t.Errorf("Test '%v': Expected the target to receive traceparent '%v' but got '%v'", testCase.desc, expected, headers.traceparent)
+			}
+			expectedTracestate := testCase.tracestate
+			if testCase.expectNewTrace {
+				expectedTracestate = ""
+			}
+			if headers.tracestate != expectedTracestate {
+				t.Errorf("Test '%v': Expected the target to receive tracestate '%v' but got '%v'", testCase.desc, expectedTracestate, headers.tracestate)
+			}
+		})
+	}
+}
+
+// withTracingRelay runs a relay with the provided tracer. The test helpers
+// configure the relay entirely from YAML, which can't provide a tracer with a
+// custom exporter, so the relay is set up directly here.
+func withTracingRelay(t *testing.T, target string, tracer *tracing.Tracer, action func(relayService *relay.Service)) {
+	configFile, err := config.NewFileFromYamlString(fmt.Sprintf("relay:\n  port: 0\n  target: %v\n", target))
+	if err != nil {
+		t.Errorf("Error parsing configuration YAML: %v", err)
+		return
+	}
+	options, err := relay.ReadOptions(configFile)
+	if err != nil {
+		t.Errorf("Error reading options: %v", err)
+		return
+	}
+	options.Relay.Tracer = tracer
+
+	relayService := relay.NewService(options, nil)
+	if err := relayService.Start("localhost", 0); err != nil {
+		t.Errorf("Error starting relay: %v", err)
+		return
+	}
+	defer relayService.Close()
+
+	action(relayService)
+}
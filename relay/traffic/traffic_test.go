@@ -2,16 +2,25 @@ package traffic_test
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/fullstorydev/relay-core/catcher"
 	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/logging"
 	"github.com/fullstorydev/relay-core/relay/plugins/traffic/test-interceptor-plugin"
 	"github.com/fullstorydev/relay-core/relay/test"
 	"github.com/fullstorydev/relay-core/relay/traffic"
@@ -132,6 +141,306 @@ func TestRelayedHeaders(t *testing.T) {
 	}
 }
 
+func TestHopByHopHeaders(t *testing.T) {
+	var targetRequestHeaders http.Header
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		targetRequestHeaders = request.Header.Clone()
+		response.Header().Set("Connection", "X-Target-Hop")
+		response.Header().Set("Keep-Alive", "timeout=5")
+		response.Header().Set("Proxy-Authenticate", "Basic")
+		response.Header().Set("X-Target-Hop", "1")
+		response.Header().Set("X-Target-End-To-End", "1")
+		response.Write([]byte("OK"))
+	}))
+	defer target.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+		if err != nil {
+			t.Errorf("Error creating request: %v", err)
+			return
+		}
+		request.Header.Set("Connection", "X-Client-Hop")
+		request.Header.Set("Keep-Alive", "timeout=5")
+		request.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+		request.Header.Set("X-Client-Hop", "1")
+		request.Header.Set("X-Client-End-To-End", "1")
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Errorf("Error GETing: %v", err)
+			return
+		}
+		defer response.Body.Close()
+
+		for _, headerName := range []string{"Keep-Alive", "Proxy-Authorization", "X-Client-Hop"} {
+			if value := targetRequestHeaders.Get(headerName); value != "" {
+				t.Errorf("Expected '%v' request header to be removed but got '%v'", headerName, value)
+			}
+		}
+		if value := targetRequestHeaders.Get("X-Client-End-To-End"); value != "1" {
+			t.Errorf("Expected 'X-Client-End-To-End' request header to be relayed but got '%v'", value)
+		}
+
+		for _, headerName := range []string{"Keep-Alive", "Proxy-Authenticate", "X-Target-Hop"} {
+			if value := response.Header.Get(headerName); value != "" {
+				t.Errorf("Expected '%v' response header to be removed but got '%v'", headerName, value)
+			}
+		}
+		if value := response.Header.Get("X-Target-End-To-End"); value != "1" {
+			t.Errorf("Expected 'X-Target-End-To-End' response header to be relayed but got '%v'", value)
+		}
+	})
+}
+
+func TestStripResponseHeaders(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Server", "target/1.0")
+		response.Header().Set("X-Backend-Server", "10.0.0.1")
+		response.Header().Set("X-Other", "unchanged")
+		response.Write([]byte("OK"))
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc            string
+		config          string
+		expectedHeaders map[string]string
+	}{
+		{
+			desc: "Response headers are relayed by default",
+			config: fmt.Sprintf(`relay:
+                                    target: %v
+            `, target.URL),
+			expectedHeaders: map[string]string{
+				"Server":           "target/1.0",
+				"X-Backend-Server": "10.0.0.1",
+				"X-Other":          "unchanged",
+			},
+		},
+		{
+			desc: "Listed response headers are stripped case-insensitively",
+			config: fmt.Sprintf(`relay:
+                                    target: %v
+                                    strip-response-headers:
+                                      - server
+                                      - X-BACKEND-SERVER
+            `, target.URL),
+			expectedHeaders: map[string]string{
+				"Server":           "",
+				"X-Backend-Server": "",
+				"X-Other":          "unchanged",
+			},
+		},
+		{
+			desc: "Stripped response headers can be a comma-separated string",
+			config: fmt.Sprintf(`relay:
+                                    target: %v
+                                    strip-response-headers: Server, x-backend-server
+            `, target.URL),
+			expectedHeaders: map[string]string{
+				"Server":           "",
+				"X-Backend-Server": "",
+				"X-Other":          "unchanged",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithRelay(t, testCase.config, nil, func(relayService *relay.Service) {
+			response, err := http.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+
+			for headerName, expectedValue := range testCase.expectedHeaders {
+				if actualValue := response.Header.Get(headerName); actualValue != expectedValue {
+					t.Errorf(
+						"Test '%v': Expected '%v' header value '%v' but got '%v'",
+						testCase.desc,
+						headerName,
+						expectedValue,
+						actualValue,
+					)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxRequestBodySize(t *testing.T) {
+	var targetBody []byte
+	requestCount := &atomic.Int64{}
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requestCount.Add(1)
+		targetBody, _ = io.ReadAll(request.Body)
+	}))
+	defer target.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+                                  max-request-body-size: 10
+    `, target.URL)
+
+	testCases := []struct {
+		desc           string
+		body           string
+		chunked        bool
+		expectedStatus int
+	}{
+		{
+			desc:           "Bodies under the limit are relayed",
+			body:           "123456789",
+			expectedStatus: 200,
+		},
+		{
+			desc:           "Bodies at the limit are relayed",
+			body:           "1234567890",
+			expectedStatus: 200,
+		},
+		{
+			desc:           "Bodies over the limit are rejected",
+			body:           "12345678901",
+			expectedStatus: 413,
+		},
+		{
+			desc:           "Chunked bodies at the limit are relayed",
+			body:           "1234567890",
+			chunked:        true,
+			expectedStatus: 200,
+		},
+		{
+			desc:           "Chunked bodies over the limit are rejected",
+			body:           "12345678901",
+			chunked:        true,
+			expectedStatus: 413,
+		},
+	}
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		for _, testCase := range testCases {
+			requestCount.Store(0)
+			targetBody = nil
+
+			var body io.Reader = strings.NewReader(testCase.body)
+			if testCase.chunked {
+				// Hide the length of the body, so that it's sent chunked.
+				body = io.MultiReader(body)
+			}
+
+			request, err := http.NewRequest("POST", relayService.HttpUrl(), body)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				continue
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error POSTing: %v", testCase.desc, err)
+				continue
+			}
+			response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf(
+					"Test '%v': Expected status %v but got %v",
+					testCase.desc,
+					testCase.expectedStatus,
+					response.StatusCode,
+				)
+			}
+
+			if testCase.expectedStatus == 200 && string(targetBody) != testCase.body {
+				t.Errorf("Test '%v': Expected target to receive body '%v' but got '%v'", testCase.desc, testCase.body, string(targetBody))
+			}
+			if testCase.expectedStatus != 200 && requestCount.Load() != 0 {
+				t.Errorf("Test '%v': Expected rejected request not to reach the target", testCase.desc)
+			}
+		}
+	})
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	requestCount := &atomic.Int64{}
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requestCount.Add(1)
+	}))
+	defer target.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+                                  max-header-bytes: 1024
+    `, target.URL)
+
+	testCases := []struct {
+		desc           string
+		headerSize     int
+		webSocket      bool
+		expectedStatus int
+	}{
+		{
+			desc:           "Requests with small headers are relayed",
+			headerSize:     100,
+			expectedStatus: 200,
+		},
+		{
+			desc:           "Requests with oversized headers are rejected",
+			headerSize:     2048,
+			expectedStatus: 431,
+		},
+		{
+			desc:           "Websocket upgrades with oversized headers are rejected",
+			headerSize:     2048,
+			webSocket:      true,
+			expectedStatus: 431,
+		},
+	}
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		for _, testCase := range testCases {
+			requestCount.Store(0)
+
+			request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				continue
+			}
+			request.Header.Set("X-Large", strings.Repeat("x", testCase.headerSize))
+			if testCase.webSocket {
+				request.Header.Set("Connection", "Upgrade")
+				request.Header.Set("Upgrade", "websocket")
+				request.Header.Set("Sec-WebSocket-Version", "13")
+				request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending request: %v", testCase.desc, err)
+				continue
+			}
+			response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf(
+					"Test '%v': Expected status %v but got %v",
+					testCase.desc,
+					testCase.expectedStatus,
+					response.StatusCode,
+				)
+			}
+			if testCase.expectedStatus != 200 && requestCount.Load() != 0 {
+				t.Errorf("Test '%v': Expected the request not to reach the target", testCase.desc)
+			}
+		}
+	})
+}
+
 func TestMaxBodySize(t *testing.T) {
 	configYaml := `relay:
                       max-body-size: 5
@@ -151,6 +460,660 @@ func TestMaxBodySize(t *testing.T) {
 	})
 }
 
+func TestUnconfiguredTarget(t *testing.T) {
+	handler := traffic.NewHandler(traffic.NewDefaultRelayOptions(), nil, nil)
+
+	request := httptest.NewRequest("GET", "http://relay.example/", nil)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+
+	if response.Code != 503 {
+		t.Errorf("Expected 503 response for a relay with no target: %v", response)
+	}
+}
+
+func TestMultipleTargets(t *testing.T) {
+	targets, targetURLs, requestCounts := startCountingTargets(3)
+	for _, target := range targets {
+		defer target.Close()
+	}
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+    `, strings.Join(targetURLs, ", "))
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		for i := 0; i < 30; i++ {
+			if body := getBody(relayService.HttpUrl(), t); body == nil {
+				return
+			}
+		}
+
+		for i, requestCount := range requestCounts {
+			if count := requestCount.Load(); count != 10 {
+				t.Errorf("Expected target %v to receive 10 requests but it received %v", i, count)
+			}
+		}
+	})
+}
+
+func TestMultipleTargetsConcurrently(t *testing.T) {
+	targets, targetURLs, requestCounts := startCountingTargets(3)
+	for _, target := range targets {
+		defer target.Close()
+	}
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+    `, strings.Join(targetURLs, ","))
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		var wg sync.WaitGroup
+		for i := 0; i < 60; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				getBody(relayService.HttpUrl(), t)
+			}()
+		}
+		wg.Wait()
+
+		for i, requestCount := range requestCounts {
+			if count := requestCount.Load(); count != 20 {
+				t.Errorf("Expected target %v to receive 20 requests but it received %v", i, count)
+			}
+		}
+	})
+}
+
+func TestWeightedTargets(t *testing.T) {
+	targets, targetURLs, requestCounts := startCountingTargets(3)
+	for _, target := range targets {
+		defer target.Close()
+	}
+
+	// The last target has no weight, so its weight is 1.
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v|70,%v|20,%v
+    `, targetURLs[0], targetURLs[1], targetURLs[2])
+	weights := []float64{70, 20, 1}
+	const requests = 1000
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		for i := 0; i < requests; i++ {
+			if body := getBody(relayService.HttpUrl(), t); body == nil {
+				return
+			}
+		}
+
+		// Targets are chosen at random, so allow for some variation.
+		const tolerance = 0.05
+		for i, requestCount := range requestCounts {
+			expectedShare := weights[i] / 91
+			share := float64(requestCount.Load()) / requests
+			if share < expectedShare-tolerance || share > expectedShare+tolerance {
+				t.Errorf("Expected target %v to receive %.1f%% of requests but it received %.1f%%", i, expectedShare*100, share*100)
+			}
+		}
+	})
+}
+
+func TestStickySessions(t *testing.T) {
+	targets, targetURLs, requestCounts := startCountingTargets(3)
+	for _, target := range targets {
+		defer target.Close()
+	}
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+                                  sticky-cookie: relay-target
+    `, strings.Join(targetURLs, ","))
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		// Each new client is assigned a target round-robin.
+		var sessionCookies []*http.Cookie
+		for i := 0; i < 3; i++ {
+			cookie := getStickyCookie(t, relayService.HttpUrl(), nil)
+			if cookie == nil {
+				return
+			}
+			sessionCookies = append(sessionCookies, cookie)
+		}
+		for i, requestCount := range requestCounts {
+			if count := requestCount.Swap(0); count != 1 {
+				t.Errorf("Expected target %v to receive 1 request from new clients but it received %v", i, count)
+			}
+		}
+
+		// Clients with a session cookie keep going to the same target.
+		for i := 0; i < 10; i++ {
+			if cookie := getStickyCookie(t, relayService.HttpUrl(), sessionCookies[1]); cookie != nil {
+				t.Errorf("Expected no new session cookie for an existing session but got '%v'", cookie)
+			}
+		}
+		for i, requestCount := range requestCounts {
+			expectedCount := int64(0)
+			if i == 1 {
+				expectedCount = 10
+			}
+			if count := requestCount.Swap(0); count != expectedCount {
+				t.Errorf("Expected target %v to receive %v requests from an existing session but it received %v", i, expectedCount, count)
+			}
+		}
+
+		// A cookie which doesn't name a configured target is replaced.
+		staleCookie := &http.Cookie{Name: "relay-target", Value: "removed-target"}
+		if cookie := getStickyCookie(t, relayService.HttpUrl(), staleCookie); cookie == nil {
+			t.Errorf("Expected a new session cookie to replace a stale one")
+		} else if cookie.Value == staleCookie.Value {
+			t.Errorf("Expected the stale session cookie to be replaced, but it was set again")
+		}
+	})
+}
+
+func TestStickySessionCookieAttributes(t *testing.T) {
+	targets, targetURLs, _ := startCountingTargets(2)
+	for _, target := range targets {
+		defer target.Close()
+	}
+
+	testCases := []struct {
+		desc           string
+		config         string
+		authorized     bool
+		expectedStatus int
+		expectCookie   bool
+		expectSecure   bool
+	}{
+		{
+			desc: "The cookie isn't set on unauthorized requests",
+			config: `relay:
+                                target: %v
+                                sticky-cookie: relay-target
+                                basic-auth-user: relay-user
+                                basic-auth-pass: relay-pass
+            `,
+			authorized:     false,
+			expectedStatus: http.StatusUnauthorized,
+			expectCookie:   false,
+		},
+		{
+			desc: "The cookie is set on authorized requests",
+			config: `relay:
+                                target: %v
+                                sticky-cookie: relay-target
+                                basic-auth-user: relay-user
+                                basic-auth-pass: relay-pass
+            `,
+			authorized:     true,
+			expectedStatus: http.StatusOK,
+			expectCookie:   true,
+			expectSecure:   false,
+		},
+		{
+			desc: "The cookie is Secure if clients use https",
+			config: `relay:
+                                target: %v
+                                sticky-cookie: relay-target
+                                force-client-scheme: https
+            `,
+			expectedStatus: http.StatusOK,
+			expectCookie:   true,
+			expectSecure:   true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(testCase.config, strings.Join(targetURLs, ","))
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			if testCase.authorized {
+				request.SetBasicAuth("relay-user", "relay-pass")
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+
+			var cookie *http.Cookie
+			for _, responseCookie := range response.Cookies() {
+				if responseCookie.Name == "relay-target" {
+					cookie = responseCookie
+				}
+			}
+			if (cookie != nil) != testCase.expectCookie {
+				t.Errorf("Test '%v': Expected a session cookie: %v, but got '%v'", testCase.desc, testCase.expectCookie, cookie)
+			} else if cookie != nil && cookie.Secure != testCase.expectSecure {
+				t.Errorf("Test '%v': Expected Secure to be %v but got %v", testCase.desc, testCase.expectSecure, cookie.Secure)
+			}
+		})
+	}
+}
+
+// getStickyCookie makes a request with the provided cookie, if it's not nil,
+// and returns the sticky session cookie set by the response, if any.
+func getStickyCookie(t *testing.T, url string, cookie *http.Cookie) *http.Cookie {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Errorf("Error creating request: %v", err)
+		return nil
+	}
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Errorf("Error GETing: %v", err)
+		return nil
+	}
+	response.Body.Close()
+
+	for _, responseCookie := range response.Cookies() {
+		if responseCookie.Name == "relay-target" {
+			return responseCookie
+		}
+	}
+	if cookie == nil {
+		t.Errorf("Expected a session cookie in response: %v", response)
+	}
+	return nil
+}
+
+func TestHostRouting(t *testing.T) {
+	targets, targetURLs, requestCounts := startCountingTargets(3)
+	for _, target := range targets {
+		defer target.Close()
+	}
+
+	testCases := []struct {
+		desc           string
+		hostMap        string
+		host           string
+		expectedTarget int
+	}{
+		{
+			desc: "Exact host matches are routed to their target",
+			hostMap: fmt.Sprintf(`
+                                      - host: a.example.com
+                                        target: %v
+                                      - host: '*.example.com'
+                                        target: %v
+            `, targetURLs[1], targetURLs[2]),
+			host:           "a.example.com",
+			expectedTarget: 1,
+		},
+		{
+			desc: "Exact host matches take precedence over earlier wildcards",
+			hostMap: fmt.Sprintf(`
+                                      - host: '*.example.com'
+                                        target: %v
+                                      - host: a.example.com
+                                        target: %v
+            `, targetURLs[2], targetURLs[1]),
+			host:           "a.example.com",
+			expectedTarget: 1,
+		},
+		{
+			desc: "Wildcard host matches are routed to their target",
+			hostMap: fmt.Sprintf(`
+                                      - host: a.example.com
+                                        target: %v
+                                      - host: '*.example.com'
+                                        target: %v
+            `, targetURLs[1], targetURLs[2]),
+			host:           "b.c.example.com",
+			expectedTarget: 2,
+		},
+		{
+			desc: "Hosts are matched case-insensitively and without ports",
+			hostMap: fmt.Sprintf(`
+                                      - host: a.example.com
+                                        target: %v
+            `, targetURLs[1]),
+			host:           "A.Example.com:8080",
+			expectedTarget: 1,
+		},
+		{
+			desc: "Wildcards don't match the bare domain",
+			hostMap: fmt.Sprintf(`
+                                      - host: '*.example.com'
+                                        target: %v
+            `, targetURLs[2]),
+			host:           "example.com",
+			expectedTarget: 0,
+		},
+		{
+			desc:           "Unmatched hosts are routed to the default target",
+			hostMap:        fmt.Sprintf(`a.example.com=%v, *.example.com=%v`, targetURLs[1], targetURLs[2]),
+			host:           "other.test",
+			expectedTarget: 0,
+		},
+		{
+			desc:           "The host map can be a comma-separated string",
+			hostMap:        fmt.Sprintf(`a.example.com=%v, *.example.com=%v`, targetURLs[1], targetURLs[2]),
+			host:           "b.example.com",
+			expectedTarget: 2,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+                                      host-map: %v
+        `, targetURLs[0], testCase.hostMap)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			for _, requestCount := range requestCounts {
+				requestCount.Store(0)
+			}
+
+			request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			request.Host = testCase.host
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			for i, requestCount := range requestCounts {
+				expectedCount := int64(0)
+				if i == testCase.expectedTarget {
+					expectedCount = 1
+				}
+				if actualCount := requestCount.Load(); actualCount != expectedCount {
+					t.Errorf("Test '%v': Expected target %v to receive %v requests but got %v", testCase.desc, i, expectedCount, actualCount)
+				}
+			}
+		})
+	}
+}
+
+func TestTruncatedResponseBody(t *testing.T) {
+	// This target advertises a longer Content-Length than the body it sends.
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		conn, _, err := response.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Error hijacking target connection: %v", err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nOnly 19 bytes here.")
+	}))
+	defer target.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		// Depending on buffering, the failure may be visible either when the
+		// response is received or when its body is read.
+		response, err := http.Get(relayService.HttpUrl())
+		if err == nil {
+			defer response.Body.Close()
+			_, err = ioutil.ReadAll(response.Body)
+		}
+		if err == nil {
+			t.Errorf("Expected an error when relaying a truncated response body")
+		}
+	})
+}
+
+func TestOverlongResponseBody(t *testing.T) {
+	// The first response from this target has a longer body than its
+	// Content-Length advertises. The extra bytes aren't part of the HTTP
+	// response, so they must not be relayed, either as part of that response
+	// or in place of the next response on the same client connection.
+	var requests int32
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if atomic.AddInt32(&requests, 1) > 1 {
+			io.WriteString(response, "World")
+			return
+		}
+		conn, _, err := response.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Error hijacking target connection: %v", err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nHello, and some extra bytes")
+	}))
+	defer target.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		client := &http.Client{Transport: &http.Transport{MaxConnsPerHost: 1}}
+		defer client.CloseIdleConnections()
+
+		for _, expected := range []string{"Hello", "World"} {
+			response, err := client.Get(relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Error GETing: %v", err)
+				return
+			}
+
+			body, err := ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			if err != nil {
+				t.Errorf("Error reading response body: %v", err)
+				return
+			}
+			if string(body) != expected || response.ContentLength != int64(len(expected)) {
+				t.Errorf("Expected a %v byte body '%v' but got %v bytes '%v'",
+					len(expected), expected, response.ContentLength, string(body))
+			}
+		}
+	})
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		response.Write([]byte("Too late"))
+	}))
+	defer target.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+                                  response-header-timeout: 50ms
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		response, err := http.Get(relayService.HttpUrl())
+		if err != nil {
+			t.Errorf("Error GETing: %v", err)
+			return
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != 504 {
+			t.Errorf("Expected 504 response for a slow target: %v", response)
+		}
+	})
+}
+
+func TestRequestTimeout(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/slow-headers":
+			time.Sleep(500 * time.Millisecond)
+			response.Write([]byte("Too late"))
+		case "/slow-body":
+			// Send the headers and part of the body promptly, then stall.
+			response.WriteHeader(200)
+			response.Write([]byte("Partial"))
+			response.(http.Flusher).Flush()
+			time.Sleep(500 * time.Millisecond)
+			response.Write([]byte(" response"))
+		default:
+			response.Write([]byte("Fast"))
+		}
+	}))
+	defer target.Close()
+
+	testCases := []struct {
+		desc           string
+		path           string
+		expectedStatus int
+		expectedBody   string
+		expectCutOff   bool
+	}{
+		{
+			desc:           "Requests which finish in time are relayed",
+			path:           "/fast",
+			expectedStatus: 200,
+			expectedBody:   "Fast",
+		},
+		{
+			desc:           "Requests whose response headers are too slow time out",
+			path:           "/slow-headers",
+			expectedStatus: 504,
+		},
+		{
+			desc:         "Responses whose body is too slow are cut off",
+			path:         "/slow-body",
+			expectCutOff: true,
+		},
+	}
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+                                  request-timeout: 100ms
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		for _, testCase := range testCases {
+			start := time.Now()
+			status, body, err := getStatusAndBody(relayService.HttpUrl() + testCase.path)
+
+			// A response which is cut off fails on the client, either while
+			// reading the headers or the body, depending on how much the relay
+			// had already sent.
+			if testCase.expectCutOff {
+				if err == nil {
+					t.Errorf("Test '%v': Expected the response to be cut off, but got '%v'", testCase.desc, body)
+				}
+			} else if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+			} else if status != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, status)
+			} else if testCase.expectedBody != "" && body != testCase.expectedBody {
+				t.Errorf("Test '%v': Expected body '%v' but got '%v'", testCase.desc, testCase.expectedBody, body)
+			}
+			if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+				t.Errorf("Test '%v': Expected the request to be cut off, but it took %v", testCase.desc, elapsed)
+			}
+		}
+	})
+}
+
+// getStatusAndBody GETs the provided URL and returns the response's status and
+// body, or an error if either couldn't be read.
+func getStatusAndBody(url string) (int, string, error) {
+	response, err := http.Get(url)
+	if err != nil {
+		return 0, "", err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return 0, "", err
+	}
+	return response.StatusCode, string(body), nil
+}
+
+func TestMaxConnsPerHost(t *testing.T) {
+	var activeRequests, maxActiveRequests atomic.Int64
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		active := activeRequests.Add(1)
+		defer activeRequests.Add(-1)
+		for {
+			currentMax := maxActiveRequests.Load()
+			if active <= currentMax || maxActiveRequests.CompareAndSwap(currentMax, active) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		response.Write([]byte("OK"))
+	}))
+	defer target.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+                                  max-conns-per-host: 1
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				response, err := http.Get(relayService.HttpUrl())
+				if err != nil {
+					t.Errorf("Error GETing: %v", err)
+					return
+				}
+				response.Body.Close()
+			}()
+		}
+		wg.Wait()
+
+		if maxActive := maxActiveRequests.Load(); maxActive != 1 {
+			t.Errorf("Expected the target to handle one request at a time, but it handled %v", maxActive)
+		}
+	})
+}
+
+func TestUnreachableTarget(t *testing.T) {
+	// Reserve a port and then release it, so that nothing is listening there.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error reserving port: %v", err)
+	}
+	targetURL := fmt.Sprintf("http://%v", listener.Addr())
+	listener.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+    `, targetURL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		response, err := http.Get(relayService.HttpUrl())
+		if err != nil {
+			t.Errorf("Error GETing: %v", err)
+			return
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != 502 {
+			t.Errorf("Expected 502 response for an unreachable target: %v", response)
+		}
+	})
+}
+
 func TestRelayNotFound(t *testing.T) {
 	test.WithCatcherAndRelay(t, "", nil, func(catcherService *catcher.Service, relayService *relay.Service) {
 		faviconURL := fmt.Sprintf("%v/favicon.ico", relayService.HttpUrl())
@@ -187,6 +1150,294 @@ func TestWebSocketEcho(t *testing.T) {
 	})
 }
 
+func TestWebSocketUnreachableTarget(t *testing.T) {
+	// Reserve a port and then release it, so that nothing is listening there.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error reserving port: %v", err)
+	}
+	targetHost := listener.Addr().String()
+	listener.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: http://%v
+    `, targetHost)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		request, err := http.NewRequest("GET", relayService.HttpUrl()+"/echo", nil)
+		if err != nil {
+			t.Errorf("Error creating request: %v", err)
+			return
+		}
+		request.Header.Set("Connection", "Upgrade")
+		request.Header.Set("Upgrade", "websocket")
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Errorf("Error sending upgrade request: %v", err)
+			return
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != 502 {
+			t.Errorf("Expected 502 response for an unreachable target: %v", response)
+		}
+
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Errorf("Error reading response body: %v", err)
+			return
+		}
+		expectedPrefix := fmt.Sprintf("Could not connect to %v: ", targetHost)
+		if !strings.HasPrefix(string(body), expectedPrefix) || strings.Contains(string(body), "%!") {
+			t.Errorf("Expected a message starting with '%v' but got '%v'", expectedPrefix, string(body))
+		}
+	})
+}
+
+func TestMaxWebSocketConnections(t *testing.T) {
+	configYaml := `relay:
+                      max-ws-connections: 2
+    `
+
+	test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		echoURL := fmt.Sprintf("%v/echo", relayService.WsUrl())
+
+		var connections []*websocket.Conn
+		defer func() {
+			for _, ws := range connections {
+				ws.Close()
+			}
+		}()
+
+		for i := 0; i < 2; i++ {
+			ws, err := websocket.Dial(echoURL, "", relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Error dialing websocket %v: %v", i, err)
+				return
+			}
+			connections = append(connections, ws)
+			if err := testEcho(ws, "Come in, good buddy"); err != nil {
+				t.Errorf("Error in echo for websocket %v: %v", i, err)
+				return
+			}
+		}
+
+		if ws, err := websocket.Dial(echoURL, "", relayService.HttpUrl()); err == nil {
+			ws.Close()
+			t.Errorf("Expected websocket beyond the limit to be refused")
+			return
+		} else if !strings.Contains(err.Error(), "bad status") {
+			t.Errorf("Expected websocket beyond the limit to be refused with a bad status: %v", err)
+			return
+		}
+
+		// Once a connection closes, a new one should be accepted. The relay
+		// notices the close asynchronously, so this may take a few attempts.
+		connections[0].Close()
+		connections = connections[1:]
+		for attempt := 0; ; attempt++ {
+			ws, err := websocket.Dial(echoURL, "", relayService.HttpUrl())
+			if err == nil {
+				connections = append(connections, ws)
+				break
+			}
+			if attempt >= 50 {
+				t.Errorf("Expected websocket to be accepted after a connection closed: %v", err)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestWebSocketIdleTimeout(t *testing.T) {
+	configYaml := `relay:
+                      ws-idle-timeout: 200ms
+    `
+
+	test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+		echoURL := fmt.Sprintf("%v/echo", relayService.WsUrl())
+		ws, err := websocket.Dial(echoURL, "", relayService.HttpUrl())
+		if err != nil {
+			t.Errorf("Error dialing websocket: %v", err)
+			return
+		}
+		defer ws.Close()
+
+		// Regular activity should keep the websocket open past the timeout.
+		for i := 0; i < 5; i++ {
+			if err := testEcho(ws, "Come in, good buddy"); err != nil {
+				t.Errorf("Error in echo %v: %v", i, err)
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		// Once the websocket is idle, the relay should close it. The client's
+		// own deadline ensures that the test fails rather than hanging if the
+		// relay doesn't.
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = ws.Read(make([]byte, 64))
+		if err == nil {
+			t.Errorf("Expected idle websocket to be closed")
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Errorf("Expected idle websocket to be closed by the relay, but it was still open")
+		}
+	})
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		timeout          time.Duration
+		closeClient      bool
+		expectedErr      error
+		expectClosedConn bool
+	}{
+		{
+			desc:        "Shutdown waits for websockets to finish",
+			timeout:     5 * time.Second,
+			closeClient: true,
+			expectedErr: nil,
+		},
+		{
+			desc:             "Shutdown closes websockets at the deadline",
+			timeout:          200 * time.Millisecond,
+			closeClient:      false,
+			expectedErr:      context.DeadlineExceeded,
+			expectClosedConn: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, "", nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+			echoURL := fmt.Sprintf("%v/echo", relayService.WsUrl())
+			ws, err := websocket.Dial(echoURL, "", relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error dialing websocket: %v", testCase.desc, err)
+				return
+			}
+			defer ws.Close()
+
+			if err := testEcho(ws, "Before shutdown"); err != nil {
+				t.Errorf("Test '%v': Error in echo: %v", testCase.desc, err)
+				return
+			}
+
+			shutdownResult := make(chan error, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), testCase.timeout)
+				defer cancel()
+				shutdownResult <- relayService.Shutdown(ctx)
+			}()
+
+			// The in-flight websocket should keep working while the relay
+			// shuts down.
+			time.Sleep(50 * time.Millisecond)
+			if err := testEcho(ws, "During shutdown"); err != nil {
+				t.Errorf("Test '%v': Error in echo during shutdown: %v", testCase.desc, err)
+				return
+			}
+
+			if testCase.closeClient {
+				ws.Close()
+			}
+
+			select {
+			case err := <-shutdownResult:
+				if err != testCase.expectedErr {
+					t.Errorf("Test '%v': Expected shutdown error '%v' but got '%v'", testCase.desc, testCase.expectedErr, err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Errorf("Test '%v': Shutdown did not finish", testCase.desc)
+				return
+			}
+
+			if testCase.expectClosedConn {
+				ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+				_, err = ws.Read(make([]byte, 64))
+				if err == nil {
+					t.Errorf("Test '%v': Expected websocket to be closed", testCase.desc)
+				} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					t.Errorf("Test '%v': Expected websocket to be closed by the relay, but it was still open", testCase.desc)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		logLevel      string
+		expectLogLine bool
+	}{
+		{
+			desc:          "Requests aren't logged at info level",
+			logLevel:      "info",
+			expectLogLine: false,
+		},
+		{
+			desc:          "Requests are logged at debug level",
+			logLevel:      "debug",
+			expectLogLine: true,
+		},
+	}
+
+	defer logging.SetOutput(os.Stdout)
+	defer logging.SetLevel(logging.InfoLevel)
+
+	for _, testCase := range testCases {
+		output := &syncBuffer{}
+		logging.SetOutput(output)
+
+		configYaml := fmt.Sprintf(`relay:
+                                      log-level: %v
+        `, testCase.logLevel)
+
+		test.WithCatcherAndRelay(t, configYaml, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+			getBody(fmt.Sprintf("%v/logged", relayService.HttpUrl()), t)
+
+			// The request is logged after the response is sent, so allow
+			// some time for the log line to appear.
+			expectedLine := "/logged: serviced"
+			for attempt := 0; attempt < 20 && !strings.Contains(output.String(), expectedLine); attempt++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			logged := strings.Contains(output.String(), expectedLine)
+			if logged != testCase.expectLogLine {
+				t.Errorf(
+					"Test '%v': Expected request log line: %v, but got log output:\n%v",
+					testCase.desc,
+					testCase.expectLogLine,
+					output.String(),
+				)
+			}
+		})
+	}
+}
+
+// syncBuffer is a bytes.Buffer which may be written to and read from
+// concurrently.
+type syncBuffer struct {
+	buffer bytes.Buffer
+	mutex  sync.Mutex
+}
+
+func (buffer *syncBuffer) Write(data []byte) (int, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	return buffer.buffer.Write(data)
+}
+
+func (buffer *syncBuffer) String() string {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	return buffer.buffer.String()
+}
+
 func testEcho(conn *websocket.Conn, message string) error {
 	_, err := conn.Write([]byte(message))
 	if err != nil {
@@ -203,6 +1454,25 @@ func testEcho(conn *websocket.Conn, message string) error {
 	return nil
 }
 
+// startCountingTargets starts the requested number of target services, each of
+// which counts the requests it receives.
+func startCountingTargets(count int) ([]*httptest.Server, []string, []*atomic.Int64) {
+	var targets []*httptest.Server
+	var targetURLs []string
+	var requestCounts []*atomic.Int64
+	for i := 0; i < count; i++ {
+		requestCount := &atomic.Int64{}
+		target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			requestCount.Add(1)
+			response.Write([]byte("OK"))
+		}))
+		targets = append(targets, target)
+		targetURLs = append(targetURLs, target.URL)
+		requestCounts = append(requestCounts, requestCount)
+	}
+	return targets, targetURLs, requestCounts
+}
+
 func getBody(url string, t *testing.T) []byte {
 	response, err := http.Get(url)
 	if err != nil {
@@ -0,0 +1,34 @@
+package traffic
+
+import (
+	"net/http"
+)
+
+// announceTrailers declares the target's trailers in the client response's
+// Trailer header, so that clients like gRPC know to expect them. It must be
+// called before the client response's status is written.
+func announceTrailers(clientResponse http.ResponseWriter, targetResponse *http.Response) {
+	if len(targetResponse.Trailer) == 0 {
+		return
+	}
+	for name := range targetResponse.Trailer {
+		clientResponse.Header().Add("Trailer", name)
+	}
+	// Trailers can only follow a chunked body, so the response can't have a
+	// Content-Length. The body is still relayed in full either way.
+	clientResponse.Header().Del("Content-Length")
+}
+
+// relayTrailers copies the target's trailers to the client response. The
+// trailers are only available once the target's response body has been read
+// to the end, so this must be called after the body has been relayed.
+func relayTrailers(clientResponse http.ResponseWriter, targetResponse *http.Response) {
+	for name, values := range targetResponse.Trailer {
+		if len(values) == 0 {
+			continue
+		}
+		// The prefix allows trailers which weren't announced up front to be
+		// relayed too.
+		clientResponse.Header()[http.TrailerPrefix+name] = values
+	}
+}
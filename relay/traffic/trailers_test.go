@@ -0,0 +1,93 @@
+package traffic_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestTrailers(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/announced", func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		io.WriteString(response, "Hello, world!")
+		response.Header().Set("Grpc-Status", "0")
+		response.Header().Set("Grpc-Message", "OK")
+	})
+	mux.HandleFunc("/unannounced", func(response http.ResponseWriter, request *http.Request) {
+		io.WriteString(response, "Hello, world!")
+		response.(http.Flusher).Flush()
+		response.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	})
+	mux.HandleFunc("/none", func(response http.ResponseWriter, request *http.Request) {
+		io.WriteString(response, "Hello, world!")
+	})
+	target := httptest.NewServer(mux)
+	defer target.Close()
+
+	testCases := []struct {
+		desc             string
+		path             string
+		expectedTrailers map[string]string
+	}{
+		{
+			desc: "Announced trailers are relayed",
+			path: "/announced",
+			expectedTrailers: map[string]string{
+				"Grpc-Status":  "0",
+				"Grpc-Message": "OK",
+			},
+		},
+		{
+			desc: "Unannounced trailers are relayed",
+			path: "/unannounced",
+			expectedTrailers: map[string]string{
+				"Grpc-Status": "0",
+			},
+		},
+		{
+			desc:             "Responses without trailers have none",
+			path:             "/none",
+			expectedTrailers: map[string]string{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: %v
+        `, target.URL)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			response, err := http.Get(relayService.HttpUrl() + testCase.path)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			defer response.Body.Close()
+
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Errorf("Test '%v': Error reading body: %v", testCase.desc, err)
+				return
+			}
+			if string(body) != "Hello, world!" {
+				t.Errorf("Test '%v': Expected body 'Hello, world!' but got '%v'", testCase.desc, string(body))
+			}
+
+			// Trailers are only available once the body has been read.
+			if len(response.Trailer) != len(testCase.expectedTrailers) {
+				t.Errorf("Test '%v': Expected %v trailers but got %v", testCase.desc, len(testCase.expectedTrailers), response.Trailer)
+			}
+			for name, expected := range testCase.expectedTrailers {
+				if actual := response.Trailer.Get(name); actual != expected {
+					t.Errorf("Test '%v': Expected trailer %v to be '%v' but got '%v'", testCase.desc, name, expected, actual)
+				}
+			}
+		})
+	}
+}
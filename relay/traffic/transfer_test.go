@@ -0,0 +1,88 @@
+package traffic
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestTransferBufferSize(t *testing.T) {
+	testCases := []struct {
+		desc               string
+		bufferSize         int
+		expectedBufferSize int
+	}{
+		{
+			desc:               "The configured buffer size is used",
+			bufferSize:         4096,
+			expectedBufferSize: 4096,
+		},
+		{
+			desc:               "The default is used if no size is configured",
+			bufferSize:         0,
+			expectedBufferSize: DefaultWebSocketBufferSize,
+		},
+	}
+
+	for _, testCase := range testCases {
+		source := &recordingReader{reader: bytes.NewReader(make([]byte, 100000))}
+		destination := &closingBuffer{}
+		transfer(destination, source, testCase.bufferSize, func() {})
+
+		if source.maxReadSize != testCase.expectedBufferSize {
+			t.Errorf("Test '%v': Expected reads of %v bytes but got %v", testCase.desc, testCase.expectedBufferSize, source.maxReadSize)
+		}
+		if destination.Len() != 100000 {
+			t.Errorf("Test '%v': Expected 100000 bytes to be transferred but got %v", testCase.desc, destination.Len())
+		}
+	}
+}
+
+func BenchmarkTransfer(b *testing.B) {
+	data := make([]byte, 16*1024*1024)
+	for _, bufferSize := range []int{MinWebSocketBufferSize, DefaultWebSocketBufferSize, MaxWebSocketBufferSize} {
+		b.Run(fmt.Sprintf("%vB", bufferSize), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				source := io.NopCloser(bytes.NewReader(data))
+				transfer(discardCloser{}, source, bufferSize, func() {})
+			}
+		})
+	}
+}
+
+// recordingReader records the largest buffer it's asked to read into.
+type recordingReader struct {
+	reader      io.Reader
+	maxReadSize int
+}
+
+func (reader *recordingReader) Read(data []byte) (int, error) {
+	if len(data) > reader.maxReadSize {
+		reader.maxReadSize = len(data)
+	}
+	return reader.reader.Read(data)
+}
+
+func (reader *recordingReader) Close() error {
+	return nil
+}
+
+type closingBuffer struct {
+	bytes.Buffer
+}
+
+func (buffer *closingBuffer) Close() error {
+	return nil
+}
+
+type discardCloser struct{}
+
+func (discardCloser) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (discardCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,63 @@
+package traffic
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// targetKey is the context key under which the target chosen for a request is
+// stored, so that requests to Unix socket targets can be sent via their
+// sockets.
+type targetKey struct{}
+
+// withTarget returns a copy of the provided request which carries the target
+// chosen for it in its context.
+func withTarget(request *http.Request, target *Target) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), targetKey{}, target))
+}
+
+// socketTarget returns the Unix socket target stored in the provided context,
+// or nil if there isn't one or if address isn't that target's dial address,
+// as when a plugin has directed the request elsewhere. A socket target's host
+// is only used for the Host header, so it may be shared with other targets,
+// which must still be dialed normally.
+func socketTarget(ctx context.Context, address string) *Target {
+	target, _ := ctx.Value(targetKey{}).(*Target)
+	if target == nil || target.SocketPath == "" {
+		return nil
+	}
+	if address != dialAddress(&url.URL{Scheme: target.Scheme, Host: target.Host}) {
+		return nil
+	}
+	return target
+}
+
+// newSocketTransports creates a transport for each Unix socket target, so that
+// connections to a socket are never pooled with connections to other targets
+// which have the same host. Targets of host routes use the routes' timeouts.
+func (handler *Handler) newSocketTransports() map[*Target]*http.Transport {
+	config := handler.config
+	transports := map[*Target]*http.Transport{}
+	addTransport := func(target *Target, route *HostRoute) {
+		if target != nil && target.SocketPath != "" {
+			dialTimeout, responseHeaderTimeout := handler.routeTimeouts(route)
+			transports[target] = handler.newTransport(dialTimeout, responseHeaderTimeout)
+		}
+	}
+
+	addTransport(config.ShadowTarget, nil)
+	for _, target := range config.Targets {
+		addTransport(target, nil)
+	}
+	for _, route := range config.HostRoutes {
+		addTransport(route.Target, route)
+	}
+	for _, route := range config.PathRoutes {
+		addTransport(route.Target, nil)
+	}
+	for _, bucket := range config.SplitBuckets {
+		addTransport(bucket.Target, nil)
+	}
+	return transports
+}
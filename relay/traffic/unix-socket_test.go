@@ -0,0 +1,143 @@
+package traffic_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"golang.org/x/net/websocket"
+)
+
+func TestUnixSocketTarget(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "target.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Error listening on Unix socket: %v", err)
+	}
+
+	hosts := make(chan string, 1)
+	mux := http.NewServeMux()
+	mux.Handle("/echo", websocket.Handler(catcher.EchoServer))
+	mux.HandleFunc("/", func(response http.ResponseWriter, request *http.Request) {
+		hosts <- request.Host
+		response.Write([]byte("OK"))
+	})
+	target := &httptest.Server{
+		Listener: listener,
+		Config:   &http.Server{Handler: mux},
+	}
+	target.Start()
+	defer target.Close()
+
+	testCases := []struct {
+		desc         string
+		target       string
+		expectedHost string
+	}{
+		{
+			desc:         "The Host header defaults to localhost",
+			target:       fmt.Sprintf("unix://%v", socketPath),
+			expectedHost: "localhost",
+		},
+		{
+			desc:         "The Host header can be configured",
+			target:       fmt.Sprintf("unix://%v?host=backend.example", socketPath),
+			expectedHost: "backend.example",
+		},
+	}
+
+	for _, testCase := range testCases {
+		configYaml := fmt.Sprintf(`relay:
+                                      target: '%v'
+        `, testCase.target)
+
+		test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+			if body := getBody(relayService.HttpUrl(), t); string(body) != "OK" {
+				t.Errorf("Test '%v': Expected body 'OK' but got '%v'", testCase.desc, string(body))
+				return
+			}
+			if host := <-hosts; host != testCase.expectedHost {
+				t.Errorf("Test '%v': Expected Host '%v' but got '%v'", testCase.desc, testCase.expectedHost, host)
+			}
+
+			echoURL := fmt.Sprintf("%v/echo", relayService.WsUrl())
+			ws, err := websocket.Dial(echoURL, "", relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error dialing websocket: %v", testCase.desc, err)
+				return
+			}
+			defer ws.Close()
+
+			if err := testEcho(ws, "Hello over a Unix socket"); err != nil {
+				t.Errorf("Test '%v': Error in echo: %v", testCase.desc, err)
+			}
+		})
+	}
+}
+
+func TestUnixSocketTargetSharingHost(t *testing.T) {
+	// A Unix socket target's host is only used for the Host header, so a TCP
+	// target may have the same host; each must still receive its own traffic.
+	socketPath := filepath.Join(t.TempDir(), "target.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Error listening on Unix socket: %v", err)
+	}
+	socketTarget := &httptest.Server{
+		Listener: listener,
+		Config: &http.Server{Handler: http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			response.Write([]byte("socket"))
+		})},
+	}
+	socketTarget.Start()
+	defer socketTarget.Close()
+
+	tcpTarget := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("tcp"))
+	}))
+	defer tcpTarget.Close()
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: http://relay-target.invalid
+                                  connect-addr: %v
+                                  path-map:
+                                    - path: /socket
+                                      target: 'unix://%v?host=relay-target.invalid'
+    `, tcpTarget.Listener.Addr(), socketPath)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		testCases := []struct {
+			desc         string
+			path         string
+			expectedBody string
+		}{
+			{
+				desc:         "The TCP target is dialed normally",
+				path:         "/",
+				expectedBody: "tcp",
+			},
+			{
+				desc:         "The Unix socket target is dialed via its socket",
+				path:         "/socket",
+				expectedBody: "socket",
+			},
+			{
+				desc:         "Connections to the Unix socket aren't reused for the TCP target",
+				path:         "/",
+				expectedBody: "tcp",
+			},
+		}
+
+		for _, testCase := range testCases {
+			if body := getBody(relayService.HttpUrl()+testCase.path, t); string(body) != testCase.expectedBody {
+				t.Errorf("Test '%v': Expected body '%v' but got '%v'", testCase.desc, testCase.expectedBody, string(body))
+			}
+		}
+	})
+}
@@ -0,0 +1,23 @@
+package traffic
+
+import (
+	"net/http"
+)
+
+// UserAgentNone is the value of RelayOptions.UserAgent which causes requests to
+// be relayed without a User-Agent header.
+const UserAgentNone = "none"
+
+// overrideUserAgent replaces the request's User-Agent header with the one
+// configured for the relay, if any.
+func (handler *Handler) overrideUserAgent(request *http.Request) {
+	switch userAgent := handler.config.UserAgent; userAgent {
+	case "":
+	case UserAgentNone:
+		// The header is left present but empty; if it were removed entirely,
+		// the transport would add Go's default User-Agent.
+		request.Header["User-Agent"] = []string{""}
+	default:
+		request.Header.Set("User-Agent", userAgent)
+	}
+}
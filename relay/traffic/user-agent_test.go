@@ -0,0 +1,73 @@
+package traffic_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/test"
+)
+
+func TestUserAgent(t *testing.T) {
+	testCases := []struct {
+		desc              string
+		config            string
+		expectedUserAgent []string
+	}{
+		{
+			desc: "The client's User-Agent is relayed by default",
+			config: `relay:
+            `,
+			expectedUserAgent: []string{"test-agent/1.0"},
+		},
+		{
+			desc: "The User-Agent can be overridden",
+			config: `relay:
+                         user-agent: relay-agent/2.0
+            `,
+			expectedUserAgent: []string{"relay-agent/2.0"},
+		},
+		{
+			desc: "The User-Agent can be removed",
+			config: `relay:
+                         user-agent: none
+            `,
+			expectedUserAgent: nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		test.WithCatcherAndRelay(t, testCase.config, nil, func(catcherService *catcher.Service, relayService *relay.Service) {
+			request, err := http.NewRequest("GET", relayService.HttpUrl(), nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				return
+			}
+			request.Header.Set("User-Agent", "test-agent/1.0")
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error GETing: %v", testCase.desc, err)
+				return
+			}
+			response.Body.Close()
+
+			lastRequest, err := catcherService.LastRequest()
+			if err != nil {
+				t.Errorf("Test '%v': Error reading last request from catcher: %v", testCase.desc, err)
+				return
+			}
+			userAgent := lastRequest.Header.Values("User-Agent")
+			if len(userAgent) != len(testCase.expectedUserAgent) {
+				t.Errorf("Test '%v': Expected User-Agent %v but got %v", testCase.desc, testCase.expectedUserAgent, userAgent)
+				return
+			}
+			for i := range userAgent {
+				if userAgent[i] != testCase.expectedUserAgent[i] {
+					t.Errorf("Test '%v': Expected User-Agent %v but got %v", testCase.desc, testCase.expectedUserAgent, userAgent)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,368 @@
+package traffic_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fullstorydev/relay-core/catcher"
+	"github.com/fullstorydev/relay-core/relay"
+	"github.com/fullstorydev/relay-core/relay/logging"
+	"github.com/fullstorydev/relay-core/relay/test"
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocketSubprotocol(t *testing.T) {
+	// The target chooses the last subprotocol the client offers that it
+	// supports, so that the choice isn't simply the client's first preference.
+	target := httptest.NewServer(websocket.Server{
+		Handshake: func(config *websocket.Config, request *http.Request) error {
+			var chosen []string
+			for _, protocol := range config.Protocol {
+				if protocol == "chat.v1" || protocol == "chat.v2" {
+					chosen = []string{protocol}
+				}
+			}
+			config.Protocol = chosen
+			return nil
+		},
+		Handler: catcher.EchoServer,
+	})
+	defer target.Close()
+
+	testCases := []struct {
+		desc             string
+		offered          []string
+		expectedProtocol string
+	}{
+		{
+			desc:             "The target's chosen subprotocol is relayed to the client",
+			offered:          []string{"chat.v1", "chat.v2", "other"},
+			expectedProtocol: "chat.v2",
+		},
+		{
+			desc:             "Unsupported subprotocols aren't chosen",
+			offered:          []string{"other", "chat.v1"},
+			expectedProtocol: "chat.v1",
+		},
+	}
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		for _, testCase := range testCases {
+			wsConfig, err := websocket.NewConfig(fmt.Sprintf("%v/echo", relayService.WsUrl()), relayService.HttpUrl())
+			if err != nil {
+				t.Errorf("Test '%v': Error creating websocket config: %v", testCase.desc, err)
+				continue
+			}
+			wsConfig.Protocol = testCase.offered
+
+			ws, err := websocket.DialConfig(wsConfig)
+			if err != nil {
+				t.Errorf("Test '%v': Error dialing websocket: %v", testCase.desc, err)
+				continue
+			}
+
+			protocol := ""
+			if len(ws.Config().Protocol) > 0 {
+				protocol = ws.Config().Protocol[0]
+			}
+			if protocol != testCase.expectedProtocol {
+				t.Errorf("Test '%v': Expected subprotocol '%v' but got '%v'", testCase.desc, testCase.expectedProtocol, protocol)
+			}
+
+			if err := testEcho(ws, "Breaker breaker"); err != nil {
+				t.Errorf("Test '%v': Error in echo: %v", testCase.desc, err)
+			}
+			ws.Close()
+		}
+	})
+}
+
+func TestWebSocketHandshakeRejected(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/echo", websocket.Handler(catcher.EchoServer))
+	mux.HandleFunc("/forbidden", func(response http.ResponseWriter, request *http.Request) {
+		http.Error(response, "Origin not allowed", http.StatusForbidden)
+	})
+	target := httptest.NewServer(mux)
+	defer target.Close()
+
+	testCases := []struct {
+		desc           string
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			desc:           "Accepted upgrades switch protocols",
+			path:           "/echo",
+			expectedStatus: http.StatusSwitchingProtocols,
+		},
+		{
+			desc:           "Rejected upgrades relay the target's response",
+			path:           "/forbidden",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "Origin not allowed\n",
+		},
+	}
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		for _, testCase := range testCases {
+			request, err := http.NewRequest("GET", relayService.HttpUrl()+testCase.path, nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				continue
+			}
+			request.Header.Set("Connection", "Upgrade")
+			request.Header.Set("Upgrade", "websocket")
+			request.Header.Set("Origin", relayService.HttpUrl())
+			request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			request.Header.Set("Sec-WebSocket-Version", "13")
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending upgrade request: %v", testCase.desc, err)
+				continue
+			}
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("Test '%v': Expected status %v but got %v", testCase.desc, testCase.expectedStatus, response.StatusCode)
+			}
+			if testCase.expectedBody != "" {
+				body, err := io.ReadAll(response.Body)
+				if err != nil {
+					t.Errorf("Test '%v': Error reading response body: %v", testCase.desc, err)
+				} else if string(body) != testCase.expectedBody {
+					t.Errorf("Test '%v': Expected body '%v' but got '%v'", testCase.desc, testCase.expectedBody, string(body))
+				}
+			}
+			response.Body.Close()
+		}
+	})
+}
+
+func TestWebSocketBytesLogged(t *testing.T) {
+	// The target accepts the upgrade and then echoes raw bytes, so that the
+	// number of bytes relayed isn't affected by websocket framing.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error starting target: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(reader); err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(conn, reader)
+	}()
+
+	defer logging.SetOutput(os.Stdout)
+	defer logging.SetFormat(logging.TextFormat)
+	output := &syncBuffer{}
+	logging.SetOutput(output)
+
+	configYaml := fmt.Sprintf("relay:\n  target: http://%v\n  log-format: json\n", listener.Addr())
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(relayService.HttpUrl(), "http://"))
+		if err != nil {
+			t.Errorf("Error connecting to relay: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		io.WriteString(conn, "GET /stream HTTP/1.1\r\nHost: relay\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		reader := bufio.NewReader(conn)
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Errorf("Error reading handshake response: %v", err)
+			return
+		}
+		if response.StatusCode != http.StatusSwitchingProtocols {
+			t.Errorf("Expected status 101 but got %v", response.StatusCode)
+			return
+		}
+
+		const messageSize = 10000
+		message := bytes.Repeat([]byte("x"), messageSize)
+		if _, err := conn.Write(message); err != nil {
+			t.Errorf("Error writing to websocket: %v", err)
+			return
+		}
+		if _, err := io.ReadFull(reader, make([]byte, messageSize)); err != nil {
+			t.Errorf("Error reading echo: %v", err)
+			return
+		}
+		conn.Close()
+
+		// The session is logged once the relay notices that it's closed. Other
+		// tests' websockets may still be closing, so only this session's line
+		// is checked.
+		targetField := fmt.Sprintf(`"target":"http://%v/stream"`, listener.Addr())
+		sessionLine := func() string {
+			for _, line := range strings.Split(output.String(), "\n") {
+				if strings.Contains(line, targetField) {
+					return line
+				}
+			}
+			return ""
+		}
+		for attempt := 0; attempt < 50 && sessionLine() == ""; attempt++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		line := sessionLine()
+		for _, field := range []string{
+			fmt.Sprintf(`"bytes_to_client":%v`, messageSize),
+			fmt.Sprintf(`"bytes_to_target":%v`, messageSize),
+			`"duration":`,
+		} {
+			if !strings.Contains(line, field) {
+				t.Errorf("Expected the session's log line to include %v, but got log output:\n%v", field, output.String())
+			}
+		}
+	})
+}
+
+func TestWebSocketCompression(t *testing.T) {
+	// The target negotiates permessage-deflate itself, accepting it only if the
+	// client offers it and the target supports it, and then echoes raw bytes.
+	// It records the extensions it was offered, so that the test can check
+	// that the client's offer was relayed intact.
+	var offered []string
+	target := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		offered = request.Header.Values("Sec-WebSocket-Extensions")
+		accepted := ""
+		if request.URL.Path == "/deflate" {
+			for _, value := range offered {
+				if strings.HasPrefix(value, "permessage-deflate") {
+					accepted = "permessage-deflate; server_no_context_takeover"
+				}
+			}
+		}
+
+		conn, buffer, err := response.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buffer.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		buffer.WriteString("Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+		if accepted != "" {
+			buffer.WriteString("Sec-WebSocket-Extensions: " + accepted + "\r\n")
+		}
+		buffer.WriteString("\r\n")
+		buffer.Flush()
+		io.Copy(conn, buffer)
+	}))
+	defer target.Close()
+
+	// A text frame containing "Hello", compressed with permessage-deflate, as
+	// in RFC 7692 section 7.2.3.1. RSV1 is set to mark it as compressed.
+	compressedFrame := []byte{0xc1, 0x07, 0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00}
+
+	testCases := []struct {
+		desc               string
+		path               string
+		offered            []string
+		expectedExtensions []string
+	}{
+		{
+			desc:               "Compression is negotiated if both sides support it",
+			path:               "/deflate",
+			offered:            []string{"permessage-deflate; client_max_window_bits"},
+			expectedExtensions: []string{"permessage-deflate; server_no_context_takeover"},
+		},
+		{
+			desc:               "Every extension offer is relayed to the target",
+			path:               "/deflate",
+			offered:            []string{"x-webkit-deflate-frame", "permessage-deflate; client_max_window_bits=10"},
+			expectedExtensions: []string{"permessage-deflate; server_no_context_takeover"},
+		},
+		{
+			desc:    "Compression is disabled if the target doesn't support it",
+			path:    "/plain",
+			offered: []string{"permessage-deflate"},
+		},
+		{
+			desc: "Compression is disabled if the client doesn't offer it",
+			path: "/deflate",
+		},
+	}
+
+	configYaml := fmt.Sprintf(`relay:
+                                  target: %v
+    `, target.URL)
+
+	test.WithRelay(t, configYaml, nil, func(relayService *relay.Service) {
+		for _, testCase := range testCases {
+			request, err := http.NewRequest("GET", relayService.HttpUrl()+testCase.path, nil)
+			if err != nil {
+				t.Errorf("Test '%v': Error creating request: %v", testCase.desc, err)
+				continue
+			}
+			request.Header.Set("Connection", "Upgrade")
+			request.Header.Set("Upgrade", "websocket")
+			request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			request.Header.Set("Sec-WebSocket-Version", "13")
+			for _, extension := range testCase.offered {
+				request.Header.Add("Sec-WebSocket-Extensions", extension)
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Errorf("Test '%v': Error sending upgrade request: %v", testCase.desc, err)
+				continue
+			}
+			if response.StatusCode != http.StatusSwitchingProtocols {
+				t.Errorf("Test '%v': Expected status 101 but got %v", testCase.desc, response.StatusCode)
+				response.Body.Close()
+				continue
+			}
+
+			if fmt.Sprint(offered) != fmt.Sprint(testCase.offered) {
+				t.Errorf("Test '%v': Expected the target to be offered %v but got %v", testCase.desc, testCase.offered, offered)
+			}
+			extensions := response.Header.Values("Sec-WebSocket-Extensions")
+			if fmt.Sprint(extensions) != fmt.Sprint(testCase.expectedExtensions) {
+				t.Errorf("Test '%v': Expected extensions %v but got %v", testCase.desc, testCase.expectedExtensions, extensions)
+			}
+
+			// Compressed frames are relayed untouched in both directions.
+			conn := response.Body.(io.ReadWriteCloser)
+			if _, err := conn.Write(compressedFrame); err != nil {
+				t.Errorf("Test '%v': Error writing frame: %v", testCase.desc, err)
+			} else {
+				echoed := make([]byte, len(compressedFrame))
+				if _, err := io.ReadFull(conn, echoed); err != nil {
+					t.Errorf("Test '%v': Error reading echoed frame: %v", testCase.desc, err)
+				} else if !bytes.Equal(echoed, compressedFrame) {
+					t.Errorf("Test '%v': Expected frame %x but got %x", testCase.desc, compressedFrame, echoed)
+				}
+			}
+			conn.Close()
+		}
+	})
+}